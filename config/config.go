@@ -0,0 +1,434 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config holds every tunable of the forwarder. A missing file or field keeps
+// the built-in defaults, which match the behaviour of a bare `go run .`.
+type Config struct {
+	// Addresses the plain DNS listeners bind, UDP and TCP (":53" is dual-stack)
+	Listen []string `json:"listen"`
+	// UDP sockets per listen address, each read by a goroutine of its own and
+	// sharing the port through SO_REUSEPORT; 0 is one per CPU
+	Workers int `json:"workers"`
+	// UDP queries waited on aside at once (iterative resolution, encrypted
+	// upstreams); more than that are answered SERVFAIL right away
+	Inflight int `json:"inflight"`
+	// Default upstream resolver: host:port or udp://, tls:// and https:// URLs
+	Upstream string `json:"upstream"`
+	// Plain DNS servers (host:port) that resolve the host names of encrypted
+	// upstreams, the system resolver when empty
+	Bootstrap []string `json:"bootstrap"`
+	// PEM file with extra CA certificates trusted for encrypted upstreams
+	UpstreamCA string `json:"upstream_ca"`
+	// Anonymized DNSCrypt relays (sdns:// stamps or ip:port), sdns:// upstreams
+	// are sent through a random one so the resolver never sees our address
+	Relays []string `json:"relays"`
+	// Domains answered by their own upstreams, the longest matching suffix wins
+	Forwarders []ForwardConfig `json:"forwarders"`
+	// Resolve from the root instead of forwarding to Upstream
+	Resolver ResolverConfig `json:"resolver"`
+	// Validate upstream and recursive answers
+	DNSSEC DNSSECConfig `json:"dnssec"`
+
+	Rebind RebindConfig `json:"rebind"`
+
+	// DNS-over-TLS listener (RFC 7858)
+	DoT DoTConfig `json:"dot"`
+	// DNS-over-HTTPS endpoint (RFC 8484)
+	DoH DoHConfig `json:"doh"`
+	// DNS-over-QUIC listener (RFC 9250)
+	DoQ DoQConfig `json:"doq"`
+
+	Overrides OverridesConfig `json:"overrides"`
+	// Zones served authoritatively from master files
+	Zones []ZoneConfig `json:"zones"`
+	// Zones pulled from a primary via AXFR/IXFR
+	Secondaries []SecondaryConfig `json:"secondaries"`
+	// Shared secrets for signed transfers, updates and NOTIFY
+	TSIGKeys []TSIGKeyConfig `json:"tsig_keys"`
+
+	// Named domain lists that groups can reference
+	Blocklists map[string]BlocklistConfig `json:"blocklists"`
+	// Named time windows that rules can reference
+	Schedules map[string]ScheduleConfig `json:"schedules"`
+	// Client groups, the most specific matching CIDR wins
+	Groups []GroupConfig `json:"groups"`
+}
+
+// RebindConfig controls DNS rebinding protection on upstream answers.
+type RebindConfig struct {
+	Enabled bool `json:"enabled"`
+	// Mode is "strip" (drop private A/AAAA records) or "refuse" (answer REFUSED)
+	Mode string `json:"mode"`
+	// Names under these domains may resolve to private addresses
+	AllowDomains []string `json:"allow_domains"`
+}
+
+// ForwardConfig sends queries for Domains (and their subdomains) to Upstreams
+type ForwardConfig struct {
+	Domains   []string `json:"domains"`
+	Upstreams []string `json:"upstreams"`
+	// How long to wait for an answer ("2s"), the default upstream timeout when empty.
+	// It holds for TCP, TLS and HTTPS upstreams as well, connecting included.
+	Timeout string `json:"timeout"`
+	// Let these upstreams answer with private addresses despite rebind protection
+	AllowPrivate bool `json:"allow_private"`
+}
+
+// ResolverConfig controls iterative resolution. Forwarders still apply to their domains.
+type ResolverConfig struct {
+	Recursive bool `json:"recursive"`
+	// Root server addresses, the built-in root hints when empty
+	RootHints []string `json:"root_hints"`
+	// Port nameservers are asked on
+	Port int `json:"port"`
+	// Most queries sent to resolve one client question
+	MaxQueries int `json:"max_queries"`
+	// Wait per query to an authoritative server ("800ms")
+	Timeout string `json:"timeout"`
+}
+
+// DNSSECConfig controls validation (RFC 4035). Hosted zones, overrides and
+// conditionally forwarded domains are trusted as they are.
+type DNSSECConfig struct {
+	Validate bool `json:"validate"`
+	// Root trust anchors as DS RDATA ("20326 8 2 E06D44..."), the IANA root KSKs when empty
+	TrustAnchors []string `json:"trust_anchors"`
+	// Answer names inside validated NSEC/NSEC3 gaps from the cache (RFC 8198), on by default
+	AggressiveNSEC bool `json:"aggressive_nsec"`
+}
+
+// DoTConfig turns on DNS-over-TLS when a certificate is set. The files are
+// re-read when they change, renewals need no restart.
+type DoTConfig struct {
+	// Address to listen on, ":853" by default
+	Listen   string `json:"listen"`
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+// DoQConfig enables the QUIC listener when a certificate is set
+type DoQConfig struct {
+	// UDP address to listen on (":853")
+	Listen   string `json:"listen"`
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+// DoHConfig serves /dns-query when Listen is set. Without a certificate it
+// speaks plain HTTP, for running behind a TLS terminating proxy.
+type DoHConfig struct {
+	// Address to listen on (":443")
+	Listen   string `json:"listen"`
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// Proxies (CIDRs) whose X-Forwarded-For names the real client
+	TrustedProxies []string `json:"trusted_proxies"`
+}
+
+// OverridesConfig lists the static record files answered locally
+type OverridesConfig struct {
+	// hosts.json style: {"name": "ip" | ["ip", ...] | {"a": [...], "aaaa": [...], "cname": "...", "txt": [...]}}
+	JSONFiles []string `json:"json_files"`
+	// /etc/hosts style: "ip name [aliases...]"
+	HostsFiles []string `json:"hosts_files"`
+	TTL        uint32   `json:"ttl"`
+}
+
+// ZoneConfig is one hosted zone
+type ZoneConfig struct {
+	Origin string `json:"origin"`
+	File   string `json:"file"`
+	// Clients (CIDRs) allowed to AXFR/IXFR the zone, nobody by default
+	AllowTransfer []string `json:"allow_transfer"`
+	// Clients (CIDRs) allowed to send dynamic updates, nobody by default.
+	// Accepted changes are written back to File.
+	AllowUpdate []string `json:"allow_update"`
+	// TSIG keys that may transfer or update the zone from anywhere
+	TransferKeys []string `json:"transfer_keys"`
+	UpdateKeys   []string `json:"update_keys"`
+	// Online DNSSEC signing, off unless a key file is set
+	Signing SigningConfig `json:"signing"`
+}
+
+// SigningConfig signs a hosted zone's answers as they go out (RFC 4470)
+type SigningConfig struct {
+	// PEM (PKCS #8) private key, generated on first start when the file is missing
+	KeyFile string `json:"key_file"`
+	// Algorithm of a generated key: "ecdsap256sha256" (default) or "ed25519"
+	Algorithm string `json:"algorithm"`
+	// Negative answers: "black_lies" (default, RFC 9824) or "minimal" (RFC 4470 white lies)
+	Denial string `json:"denial"`
+}
+
+// SecondaryConfig is one zone we keep a copy of
+type SecondaryConfig struct {
+	Origin string `json:"origin"`
+	// Primary server to transfer from (host:port)
+	Primary string `json:"primary"`
+	// Senders (CIDRs) whose NOTIFY triggers a refresh, the primary by default
+	AllowNotify []string `json:"allow_notify"`
+	// Clients (CIDRs) allowed to transfer the zone from us
+	AllowTransfer []string `json:"allow_transfer"`
+	// TSIG key signing our requests to the primary, also accepted on NOTIFY
+	Key string `json:"key"`
+}
+
+// TSIGKeyConfig is a shared secret (RFC 8945)
+type TSIGKeyConfig struct {
+	Name string `json:"name"`
+	// "hmac-sha256" or "hmac-sha512"
+	Algorithm string `json:"algorithm"`
+	// base64 encoded
+	Secret string `json:"secret"`
+}
+
+// BlocklistConfig is a set of blocked domains, inline or read from files.
+// A listed domain also blocks all of its subdomains.
+type BlocklistConfig struct {
+	Files   []string `json:"files"`
+	Domains []string `json:"domains"`
+}
+
+// GroupConfig selects the rules applied to clients whose address falls in CIDRs
+type GroupConfig struct {
+	Name       string   `json:"name"`
+	CIDRs      []string `json:"cidrs"`
+	Blocklists []string `json:"blocklists"`
+	// Blocklists that only apply while their schedule is active
+	Rules []RuleConfig `json:"rules"`
+	// Overrides the default upstream when set
+	Upstream   string `json:"upstream"`
+	SafeSearch bool   `json:"safe_search"`
+}
+
+// RuleConfig applies a blocklist only during a schedule
+type RuleConfig struct {
+	Blocklist string `json:"blocklist"`
+	Schedule  string `json:"schedule"`
+}
+
+// ScheduleConfig is a set of weekly windows in one timezone (IANA name, default local)
+type ScheduleConfig struct {
+	Timezone string         `json:"timezone"`
+	Windows  []WindowConfig `json:"windows"`
+}
+
+// WindowConfig is "start"-"end" (HH:MM) on the listed days ("mon".."sun" or "monday".."sunday", empty = every day).
+// An end before the start runs past midnight into the next day.
+type WindowConfig struct {
+	Days  []string `json:"days"`
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+}
+
+// ParseWeekday reads a day of a window, the English name or its three letter
+// abbreviation in any case ("Monday", "mon")
+func ParseWeekday(s string) (time.Weekday, bool) {
+	s = strings.ToLower(s)
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		name := strings.ToLower(d.String())
+		if s == name || s == name[:3] {
+			return d, true
+		}
+	}
+	return 0, false
+}
+
+func Default() *Config {
+	return &Config{
+		Listen:    []string{":53"},
+		Inflight:  1024,
+		Upstream:  "9.9.9.9:53",
+		Rebind:    RebindConfig{Mode: "strip"},
+		Overrides: OverridesConfig{TTL: 300},
+		Resolver:  ResolverConfig{Port: 53, MaxQueries: 50, Timeout: "800ms"},
+		DNSSEC:    DNSSECConfig{AggressiveNSEC: true},
+		DoT:       DoTConfig{Listen: ":853"},
+		DoQ:       DoQConfig{Listen: ":853"},
+	}
+}
+
+// Load reads a JSON config file on top of the defaults
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	if path == "" {
+		return cfg, nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config: %v", err)
+	}
+
+	if err := json.Unmarshal(raw, cfg); err != nil {
+		return nil, fmt.Errorf("parsing config %s: %v", path, err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (c *Config) Validate() error {
+	if len(c.Listen) == 0 {
+		return fmt.Errorf("listen: no addresses")
+	}
+	for _, l := range c.Listen {
+		if _, _, err := net.SplitHostPort(l); err != nil {
+			return fmt.Errorf("listen: bad address %q", l)
+		}
+	}
+	if c.Workers < 0 {
+		return fmt.Errorf("workers: %d is negative", c.Workers)
+	}
+	if c.Inflight < 1 {
+		return fmt.Errorf("inflight: %d is not positive", c.Inflight)
+	}
+
+	switch c.Rebind.Mode {
+	case "strip", "refuse":
+	default:
+		return fmt.Errorf("rebind: unknown mode %q", c.Rebind.Mode)
+	}
+
+	if c.Resolver.Port <= 0 || c.Resolver.Port > 65535 {
+		return fmt.Errorf("resolver: bad port %d", c.Resolver.Port)
+	}
+	if c.Resolver.MaxQueries <= 0 {
+		return fmt.Errorf("resolver: max_queries must be positive")
+	}
+	if d, err := time.ParseDuration(c.Resolver.Timeout); err != nil || d <= 0 {
+		return fmt.Errorf("resolver: bad timeout %q", c.Resolver.Timeout)
+	}
+	for _, ta := range c.DNSSEC.TrustAnchors {
+		if len(strings.Fields(ta)) < 4 {
+			return fmt.Errorf("dnssec: trust anchor %q is not \"keytag algorithm digesttype digest\"", ta)
+		}
+	}
+	if (c.DoT.CertFile == "") != (c.DoT.KeyFile == "") {
+		return fmt.Errorf("dot: cert_file and key_file go together")
+	}
+	if (c.DoQ.CertFile == "") != (c.DoQ.KeyFile == "") {
+		return fmt.Errorf("doq: cert_file and key_file go together")
+	}
+	if (c.DoH.CertFile == "") != (c.DoH.KeyFile == "") {
+		return fmt.Errorf("doh: cert_file and key_file go together")
+	}
+
+	routed := make(map[string]bool)
+	for _, f := range c.Forwarders {
+		if len(f.Domains) == 0 || len(f.Upstreams) == 0 {
+			return fmt.Errorf("forwarders: every entry needs domains and upstreams")
+		}
+		if f.Timeout != "" {
+			if d, err := time.ParseDuration(f.Timeout); err != nil || d <= 0 {
+				return fmt.Errorf("forwarders: bad timeout %q", f.Timeout)
+			}
+		}
+		for _, d := range f.Domains {
+			d = strings.ToLower(strings.TrimSuffix(d, "."))
+			if routed[d] {
+				return fmt.Errorf("forwarders: %s is routed twice", d)
+			}
+			routed[d] = true
+		}
+	}
+
+	keys := make(map[string]bool)
+	for _, k := range c.TSIGKeys {
+		if k.Name == "" {
+			return fmt.Errorf("tsig_keys: every key needs a name")
+		}
+		keys[strings.ToLower(strings.TrimSuffix(k.Name, "."))] = true
+	}
+	knownKey := func(name string) bool {
+		return keys[strings.ToLower(strings.TrimSuffix(name, "."))]
+	}
+
+	origins := make(map[string]bool)
+	for _, z := range c.Zones {
+		origins[strings.ToLower(strings.TrimSuffix(z.Origin, "."))] = true
+		for _, k := range append(append([]string(nil), z.TransferKeys...), z.UpdateKeys...) {
+			if !knownKey(k) {
+				return fmt.Errorf("zone %s: unknown tsig key %q", z.Origin, k)
+			}
+		}
+		switch z.Signing.Algorithm {
+		case "", "ecdsap256sha256", "ed25519":
+		default:
+			return fmt.Errorf("zone %s: signing algorithm must be ecdsap256sha256 or ed25519", z.Origin)
+		}
+		switch z.Signing.Denial {
+		case "", "black_lies", "minimal":
+		default:
+			return fmt.Errorf("zone %s: signing denial must be black_lies or minimal", z.Origin)
+		}
+	}
+	for _, sc := range c.Secondaries {
+		if sc.Origin == "" || sc.Primary == "" {
+			return fmt.Errorf("secondaries: origin and primary are required")
+		}
+		if sc.Key != "" && !knownKey(sc.Key) {
+			return fmt.Errorf("secondary %s: unknown tsig key %q", sc.Origin, sc.Key)
+		}
+		o := strings.ToLower(strings.TrimSuffix(sc.Origin, "."))
+		if origins[o] {
+			return fmt.Errorf("secondaries: %s is configured twice", sc.Origin)
+		}
+		origins[o] = true
+	}
+
+	for name, sc := range c.Schedules {
+		for _, w := range sc.Windows {
+			for _, d := range w.Days {
+				if _, ok := ParseWeekday(d); !ok {
+					return fmt.Errorf("schedule %s: unknown day %q", name, d)
+				}
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	def := ""
+	for _, g := range c.Groups {
+		if g.Name == "" {
+			return fmt.Errorf("groups: every group needs a name")
+		}
+		if seen[g.Name] {
+			return fmt.Errorf("groups: duplicate group %q", g.Name)
+		}
+		seen[g.Name] = true
+		if len(g.CIDRs) == 0 {
+			if def != "" {
+				return fmt.Errorf("groups: %s and %s both have no cidrs, only one may be the default", def, g.Name)
+			}
+			def = g.Name
+		}
+
+		for _, bl := range g.Blocklists {
+			if _, ok := c.Blocklists[bl]; !ok {
+				return fmt.Errorf("group %s: unknown blocklist %q", g.Name, bl)
+			}
+		}
+
+		for _, r := range g.Rules {
+			if _, ok := c.Blocklists[r.Blocklist]; !ok {
+				return fmt.Errorf("group %s: unknown blocklist %q", g.Name, r.Blocklist)
+			}
+			if _, ok := c.Schedules[r.Schedule]; r.Schedule != "" && !ok {
+				return fmt.Errorf("group %s: unknown schedule %q", g.Name, r.Schedule)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package dns
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxDenialRanges caps the NSEC/NSEC3 records kept per zone
+const maxDenialRanges = 4096
+
+// denialCache keeps the NSEC and NSEC3 records of validated answers per zone,
+// so names inside a proven gap are answered without asking again (RFC 8198)
+type denialCache struct {
+	mu    sync.Mutex
+	zones map[string]*zoneDenials
+}
+
+// zoneDenials is one zone's cached proofs, each list sorted by the order the
+// records chain in: canonical owner for NSEC, hash for NSEC3
+type zoneDenials struct {
+	soa   denialRange
+	nsec  []denialRange
+	nsec3 []denialRange
+}
+
+type denialRange struct {
+	key     string // owner name or hash label
+	set     *rrset
+	expires time.Time
+}
+
+func newDenialCache() *denialCache {
+	return &denialCache{zones: make(map[string]*zoneDenials)}
+}
+
+// add remembers the proofs of a validated answer from zone. The SOA has to
+// come along, synthesized answers need it.
+func (dc *denialCache) add(zone string, soa *rrset, proofs []*rrset) {
+	if soa == nil || len(proofs) == 0 {
+		return
+	}
+	ttl := soa.ttl()
+	if m := time.Duration(soa.rrs[0].RData.SOA.Minimum) * time.Second; m < ttl {
+		ttl = m
+	}
+
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	zd := dc.zones[zone]
+	if zd == nil {
+		zd = &zoneDenials{}
+		dc.zones[zone] = zd
+	}
+	now := time.Now()
+	zd.soa = denialRange{key: zone, set: soa, expires: now.Add(ttl)}
+	for _, p := range proofs {
+		r := denialRange{key: p.owner, set: p, expires: now.Add(min(ttl, p.ttl()))}
+		if p.rtype == TypeNSEC3 {
+			// opt-out spans may hide unsigned delegations (RFC 8198 section 5.2)
+			if p.rrs[0].RData.NSEC3.Flags&NSEC3OptOut != 0 {
+				continue
+			}
+			r.key, _, _ = strings.Cut(p.owner, ".")
+			zd.nsec3 = insertRange(zd.nsec3, r, strings.Compare, now)
+		} else {
+			zd.nsec = insertRange(zd.nsec, r, CanonicalCompare, now)
+		}
+	}
+}
+
+// insertRange adds r to the sorted ranges, replacing the one with the same key
+// and dropping expired ones once the list is full
+func insertRange(ranges []denialRange, r denialRange, cmp func(a, b string) int, now time.Time) []denialRange {
+	if len(ranges) >= maxDenialRanges {
+		kept := ranges[:0]
+		for _, have := range ranges {
+			if have.expires.After(now) {
+				kept = append(kept, have)
+			}
+		}
+		ranges = kept
+		if len(ranges) >= maxDenialRanges {
+			return ranges
+		}
+	}
+
+	i := sort.Search(len(ranges), func(i int) bool { return cmp(ranges[i].key, r.key) >= 0 })
+	if i < len(ranges) && ranges[i].key == r.key {
+		ranges[i] = r
+		return ranges
+	}
+	ranges = append(ranges, denialRange{})
+	copy(ranges[i+1:], ranges[i:])
+	ranges[i] = r
+	return ranges
+}
+
+// at returns the unexpired range starting at or right before key, which is
+// the only one that can match or cover it. Keys before the first one fall in
+// the last range, which wraps around to the apex.
+func at(ranges []denialRange, key string, cmp func(a, b string) int, now time.Time) (denialRange, bool) {
+	if len(ranges) == 0 {
+		return denialRange{}, false
+	}
+	i := sort.Search(len(ranges), func(i int) bool { return cmp(ranges[i].key, key) > 0 }) - 1
+	if i < 0 {
+		i = len(ranges) - 1
+	}
+	return ranges[i], ranges[i].expires.After(now)
+}
+
+// synthesize answers a question from the cached proofs, the answer carries
+// what proved it
+func (dc *denialCache) synthesize(q DNSQuestionPacket) (DNSAnswerPacket, bool) {
+	name, qtype := normName(q.Question.Name), q.Question.Type
+	now := time.Now()
+
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	// the closest zone we hold proofs for
+	var zone string
+	var zd *zoneDenials
+	for cur := name; ; {
+		if zd = dc.zones[cur]; zd != nil {
+			zone = cur
+			break
+		}
+		if cur == "" {
+			return DNSAnswerPacket{}, false
+		}
+		_, cur, _ = strings.Cut(cur, ".")
+	}
+
+	// the proofs for name, its ancestors in the zone and their wildcards
+	var targets []string
+	for cur := name; ; {
+		targets = append(targets, cur, wildcardOf(cur))
+		if cur == zone {
+			break
+		}
+		_, cur, _ = strings.Cut(cur, ".")
+	}
+	var proofs []*rrset
+	expires := zd.soa.expires
+	seen := make(map[*rrset]bool)
+	use := func(r denialRange, ok bool) {
+		if !ok || seen[r.set] || !r.set.signedAt(now) {
+			return
+		}
+		seen[r.set] = true
+		proofs = append(proofs, r.set)
+		if r.expires.Before(expires) {
+			expires = r.expires
+		}
+	}
+	for _, t := range targets {
+		use(at(zd.nsec, t, CanonicalCompare, now))
+	}
+	if len(zd.nsec3) > 0 {
+		n := zd.nsec3[0].set.rrs[0].RData.NSEC3
+		for _, t := range targets {
+			use(at(zd.nsec3, NSEC3Hash(t, n.Salt, n.Iterations), strings.Compare, now))
+		}
+	}
+
+	if delegated(proofs, name, qtype, zone) {
+		return DNSAnswerPacket{}, false
+	}
+
+	rcode := uint8(RCodeSuccess)
+	switch {
+	case provesNoData(proofs, name, qtype, zone):
+	case provesNXDomain(proofs, name, zone):
+		rcode = RCodeNXDomain
+	default:
+		return DNSAnswerPacket{}, false
+	}
+
+	ttl := uint32(expires.Sub(now) / time.Second)
+	if ttl == 0 {
+		return DNSAnswerPacket{}, false
+	}
+
+	resp := NewResponse(q, rcode, nil)
+	resp.Header.AD = true
+	for _, set := range append([]*rrset{zd.soa.set}, proofs...) {
+		resp.Authority = append(resp.Authority, set.withSigs(ttl)...)
+	}
+	return resp, true
+}
+
+// delegated reports whether a proof shows name at or below a zone cut, where
+// the parent's records say nothing about the child's data
+func delegated(proofs []*rrset, name string, qtype uint16, zone string) bool {
+	cut := func(types []uint16) bool {
+		return HasType(types, TypeNS) && !HasType(types, TypeSOA)
+	}
+	for cur := name; cur != zone; {
+		// the DS at a cut is the parent's to deny
+		if cur != name || qtype != TypeDS {
+			if n, ok := nsecFind(proofs, cur, zone, false); ok && cut(n.Types) {
+				return true
+			}
+			if n, ok := nsec3Find(proofs, cur, zone, false); ok && cut(n.Types) {
+				return true
+			}
+		}
+		_, cur, _ = strings.Cut(cur, ".")
+	}
+	return false
+}
+
+// signedAt reports whether one of the set's signatures is valid at now
+func (set *rrset) signedAt(now time.Time) bool {
+	for _, sig := range set.sigs {
+		if sigTimeOK(sig, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// withSigs turns the set back into records with their RRSIGs, all with ttl
+func (set *rrset) withSigs(ttl uint32) []DNSAnswer {
+	out := make([]DNSAnswer, 0, len(set.rrs)+len(set.sigs))
+	for _, rr := range set.rrs {
+		rr.TTL = ttl
+		out = append(out, rr)
+	}
+	for _, sig := range set.sigs {
+		out = append(out, DNSAnswer{Name: set.owner, Type: TypeRRSIG, Class: set.rrs[0].Class, TTL: ttl, RData: RData{RRSIG: sig}})
+	}
+	return out
+}
@@ -0,0 +1,74 @@
+package dns
+
+import (
+	"net"
+	"slices"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// udpBatchSize is how many datagrams one recvmmsg or sendmmsg moves
+const udpBatchSize = 32
+
+// batchConn reads and writes several datagrams per syscall. On Linux that is
+// recvmmsg/sendmmsg, elsewhere x/net falls back to one datagram per call.
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+func newBatchConn(c *net.UDPConn) batchConn {
+	// dual-stack and IPv6 sockets take the IPv6 socket options
+	if a, ok := c.LocalAddr().(*net.UDPAddr); ok && a.IP.To4() == nil {
+		return ipv6.NewPacketConn(c)
+	}
+	return ipv4.NewPacketConn(c)
+}
+
+// batchBuffers gives every message a read buffer of its own, all cut from
+// one allocation the worker keeps for as long as it runs
+func batchBuffers(ms []ipv4.Message) {
+	buf := make([]byte, len(ms)*udpBufSize)
+	for i := range ms {
+		ms[i].Buffers = [][]byte{buf[i*udpBufSize : (i+1)*udpBufSize : (i+1)*udpBufSize]}
+	}
+}
+
+// writeBatch sends every message, WriteBatch may take only part of them per call
+func writeBatch(c batchConn, ms []ipv4.Message) {
+	for len(ms) > 0 {
+		n, err := c.WriteBatch(ms, 0)
+		if err != nil {
+			// skip the datagram that failed, the rest may still go out
+			n = max(n, 1)
+		}
+		ms = ms[n:]
+	}
+}
+
+// udpReplies collects the answers of one batch by the listener they leave on
+type udpReplies struct {
+	conns []*net.UDPConn
+	bcs   []batchConn
+	msgs  [][]ipv4.Message
+}
+
+func (r *udpReplies) add(conn *net.UDPConn, msg []byte, addr *net.UDPAddr) {
+	i := slices.Index(r.conns, conn)
+	if i < 0 {
+		r.conns = append(r.conns, conn)
+		r.bcs = append(r.bcs, newBatchConn(conn))
+		r.msgs = append(r.msgs, nil)
+		i = len(r.conns) - 1
+	}
+	r.msgs[i] = append(r.msgs[i], ipv4.Message{Buffers: [][]byte{msg}, Addr: addr})
+}
+
+func (r *udpReplies) flush() {
+	for i := range r.conns {
+		writeBatch(r.bcs[i], r.msgs[i])
+		clear(r.msgs[i])
+		r.msgs[i] = r.msgs[i][:0]
+	}
+}
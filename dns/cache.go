@@ -1,8 +1,6 @@
 package dns
 
 import (
-	"fmt"
-	"strings"
 	"time"
 
 	"github.com/dgraph-io/ristretto/v2"
@@ -12,20 +10,30 @@ import (
 type CacheEntry struct {
 	RawPkt []byte
 	Expiry  time.Time
+	// DNSSEC status of the answer, bogus ones are only served to CD clients
+	Validation ValidationState
 }
 
 func CacheRetrieve(q DNSQuestionPacket, cache *ristretto.Cache[string, CacheEntry]) (answers []byte) {
-	key := fmt.Sprintf("%s|%d|%d", strings.ToLower(q.Question.Name), q.Question.Type, q.Question.Class)
-	if v, found := cache.Get(key); found {
-		entry := v
-		if time.Now().Before(entry.Expiry) {
-			return entry.RawPkt
-		}
+	return CacheRetrieveKey(CacheKeyFromQuestion(q), cache)
+}
+
+func CacheRetrieveKey(key string, cache *ristretto.Cache[string, CacheEntry]) (answers []byte) {
+	if entry, found := CacheLookup(key, cache); found {
+		return entry.RawPkt
 	}
 
 	return nil
 }
 
+// CacheLookup returns the whole unexpired entry under key
+func CacheLookup(key string, cache *ristretto.Cache[string, CacheEntry]) (CacheEntry, bool) {
+	if entry, found := cache.Get(key); found && time.Now().Before(entry.Expiry) {
+		return entry, true
+	}
+	return CacheEntry{}, false
+}
+
 /* func CachePut(q DNSQuestionPacket, a DNSAnswerPacket, cache *ristretto.Cache[string, CacheEntry]) {
 	if len(a.Answers) < 1 {
 		log.Error().Msg("Tried to add empty answers to cache")
@@ -40,12 +48,41 @@ func CacheRetrieve(q DNSQuestionPacket, cache *ristretto.Cache[string, CacheEntr
 } */
 
 func CachePutKey(key string, a DNSAnswerPacket, cache *ristretto.Cache[string, CacheEntry]) {
+	CachePutKeyUntil(key, a, time.Time{}, cache)
+}
+
+// CachePutKeyUntil caches like CachePutKey but never past until (zero means no cap)
+func CachePutKeyUntil(key string, a DNSAnswerPacket, until time.Time, cache *ristretto.Cache[string, CacheEntry]) {
+	CachePutValidated(key, a, until, Indeterminate, cache)
+}
+
+// CachePutValidated caches like CachePutKeyUntil and remembers the DNSSEC status,
+// bogus answers only for a short while
+func CachePutValidated(key string, a DNSAnswerPacket, until time.Time, state ValidationState, cache *ristretto.Cache[string, CacheEntry]) {
 	if len(a.Answers) == 0 {
 		log.Error().Msg("Tried to add empty answers to cache")
 		return
 	}
 	rawPkt, _ := BuildAnswerPacket(a)
 	ttl := time.Duration(a.Answers[0].TTL) * time.Second
-	entry := CacheEntry{RawPkt: rawPkt, Expiry: time.Now().Add(ttl)}
+	if !until.IsZero() {
+		ttl = min(ttl, time.Until(until))
+	}
+	if state == Bogus {
+		ttl = min(ttl, bogusTTL)
+	}
+	cachePutEntry(key, CacheEntry{RawPkt: rawPkt, Validation: state}, ttl, cache)
+}
+
+// CachePutRaw stores an already built response, e.g. a synthesized block answer
+func CachePutRaw(key string, rawPkt []byte, ttl time.Duration, cache *ristretto.Cache[string, CacheEntry]) {
+	cachePutEntry(key, CacheEntry{RawPkt: rawPkt}, ttl, cache)
+}
+
+func cachePutEntry(key string, entry CacheEntry, ttl time.Duration, cache *ristretto.Cache[string, CacheEntry]) {
+	if ttl <= 0 {
+		return
+	}
+	entry.Expiry = time.Now().Add(ttl)
 	cache.SetWithTTL(key, entry, 1, ttl)
 }
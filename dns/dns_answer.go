@@ -3,13 +3,17 @@ package dns
 import (
 	"encoding/binary"
 	"fmt"
+
+	"github.com/rs/zerolog/log"
 )
 
 type DNSAnswerPacket struct {
-	Header    DNSHeader
-	Questions []DNSQuestion
-	Answers   []DNSAnswer
-	Raw       []byte
+	Header     DNSHeader
+	Questions  []DNSQuestion
+	Answers    []DNSAnswer
+	Authority  []DNSAnswer
+	Additional []DNSAnswer
+	Raw        []byte
 }
 
 type DNSAnswer struct {
@@ -57,14 +61,44 @@ func ParseAnswerPacket(b []byte, n int) (DNSAnswerPacket, error) {
 		return a_pkt, fmt.Errorf("answer lengths dont match")
 	}
 
+	authority, off, err := parseSection(msg, off, header.NSCount)
+	if err != nil {
+		return a_pkt, fmt.Errorf("enountered error while parsing authority: %v", err)
+	}
+
+	additional, _, err := parseSection(msg, off, header.ARCount)
+	if err != nil {
+		return a_pkt, fmt.Errorf("enountered error while parsing additional: %v", err)
+	}
+
 	a_pkt.Header = header
 	a_pkt.Questions = questions
 	a_pkt.Answers = answers
+	a_pkt.Authority = authority
+	a_pkt.Additional = additional
 	a_pkt.Raw = msg
 
 	return a_pkt, nil
 }
 
+// parseSection reads count resource records starting at off
+func parseSection(msg []byte, off int, count uint16) ([]DNSAnswer, int, error) {
+	if count == 0 {
+		return nil, off, nil
+	}
+
+	rrs := make([]DNSAnswer, 0, count)
+	for i := 0; i < int(count); i++ {
+		rr, next, err := ParseAnswer(msg, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		rrs = append(rrs, rr)
+		off = next
+	}
+	return rrs, off, nil
+}
+
 func ParseAnswer(b []byte, start int) (DNSAnswer, int, error) {
 	answer := DNSAnswer{}
 
@@ -92,6 +126,13 @@ func ParseAnswer(b []byte, start int) (DNSAnswer, int, error) {
 	}
 
 	answer.RDLength = a_rdlength
+
+	// empty RDATA only shows up in UPDATE prerequisites and deletions (RFC 2136)
+	if a_rdlength == 0 && (answer.Class == ClassANY || answer.Class == ClassNONE) {
+		answer.RData = RData{Kind: answer.Type}
+		return answer, rdataEnd, nil
+	}
+
 	answer.RData, err = ParseRdata(b, rdataStart, answer.RDLength, answer.Type)
 	if err != nil {
 		return answer, 0, fmt.Errorf("error parsing rdata %v", err)
@@ -111,7 +152,14 @@ func BuildAnswer(pkt []byte, raw []byte, a DNSAnswer, names map[string]int) ([]b
 
 	pkt = append(pkt, byte(a.TTL>>24), byte(a.TTL>>16), byte(a.TTL>>8), byte(a.TTL))
 
-	pkt = append(pkt, byte(a.RDLength>>8), byte(a.RDLength)) //Might need to calculate this myself at some point
+	// RDLENGTH depends on how well the rdata names compress here, patched below
+	lenOff := len(pkt)
+	pkt = append(pkt, 0, 0)
+
+	// class ANY carries no RDATA (RFC 2136 section 2.4 and 2.5), TSIG aside
+	if a.Class == ClassANY && a.Type != TypeTSIG {
+		return pkt, nil
+	}
 
 	pkt, err := BuildRdata(pkt, a.RData, a.Type, names)
 	if err != nil{
@@ -120,6 +168,12 @@ func BuildAnswer(pkt []byte, raw []byte, a DNSAnswer, names map[string]int) ([]b
 
 		return pkt, fmt.Errorf("error building rdata %v", err)
 	}
+	rdlen := len(pkt) - lenOff - 2
+	if rdlen > 0xFFFF {
+		pkt = pkt[:ansStart]
+		return pkt, fmt.Errorf("rdata of %d bytes does not fit RDLENGTH", rdlen)
+	}
+	binary.BigEndian.PutUint16(pkt[lenOff:], uint16(rdlen))
 
 	// Check if it can be decoded
 	_, _, err = ParseAnswer(pkt, ansStart)
@@ -144,7 +198,7 @@ func BuildAnswerPacket(a_pkt DNSAnswerPacket) ([]byte, error) {
 	for i := 0; i < len(a_pkt.Questions); i++ {
 		pkt, err = BuildQuestion(pkt, a_pkt.Questions[i], compression_values)
 		if err != nil {
-			fmt.Println("error while building answer packet, could not build question: ", err)
+			log.Warn().Str("name", a_pkt.Questions[i].Name).Msg("could not build question: " + err.Error())
 		}
 	}
 
@@ -152,21 +206,64 @@ func BuildAnswerPacket(a_pkt DNSAnswerPacket) ([]byte, error) {
 	for i := 0; i < len(a_pkt.Answers); i++ {
 		pkt, err = BuildAnswer(pkt, a_pkt.Raw, a_pkt.Answers[i], compression_values)
 		if err != nil {
-			fmt.Println("error while building answer packet, could not build answer: ", err)
+			log.Warn().Str("name", a_pkt.Answers[i].Name).Msg("could not build answer record, dropped: " + err.Error())
 		} else {
 			anCount++
 		}
 	}
 
-	_, err2 := ParseAnswerPacket(pkt, len(pkt))
-	if err2 != nil {
-		return pkt, fmt.Errorf("packet check failed: %v", err)
+	nsCount := 0
+	for i := 0; i < len(a_pkt.Authority); i++ {
+		pkt, err = BuildAnswer(pkt, a_pkt.Raw, a_pkt.Authority[i], compression_values)
+		if err != nil {
+			log.Warn().Str("name", a_pkt.Authority[i].Name).Msg("could not build authority record, dropped: " + err.Error())
+		} else {
+			nsCount++
+		}
+	}
+
+	arCount := 0
+	for i := 0; i < len(a_pkt.Additional); i++ {
+		pkt, err = BuildAnswer(pkt, a_pkt.Raw, a_pkt.Additional[i], compression_values)
+		if err != nil {
+			log.Warn().Str("name", a_pkt.Additional[i].Name).Msg("could not build additional record, dropped: " + err.Error())
+		} else {
+			arCount++
+		}
 	}
 
 	h := a_pkt.Header
+	h.QDCount = uint16(len(a_pkt.Questions))
 	h.ANCount = uint16(anCount)
+	h.NSCount = uint16(nsCount)
+	h.ARCount = uint16(arCount)
 	header := BuildHeader(h)
 	copy(pkt[:12], header)
 
+	_, err2 := ParseAnswerPacket(pkt, len(pkt))
+	if err2 != nil {
+		return pkt, fmt.Errorf("packet check failed: %v", err2)
+	}
+
 	return pkt, nil
 }
+
+// NewResponse starts a reply to q, mirroring the client's ID and RD bit
+func NewResponse(q DNSQuestionPacket, rcode uint8, answers []DNSAnswer) DNSAnswerPacket {
+	hdr := DNSHeader{
+		ID:      q.Header.ID,
+		QR:      true,
+		Opcode:  q.Header.Opcode,
+		RD:      q.Header.RD,
+		RA:      true,
+		RCode:   rcode,
+		QDCount: 1,
+	}
+
+	return DNSAnswerPacket{Header: hdr, Questions: []DNSQuestion{q.Question}, Answers: answers}
+}
+
+// BuildResponse answers q with the given rcode and records
+func BuildResponse(q DNSQuestionPacket, rcode uint8, answers []DNSAnswer) ([]byte, error) {
+	return BuildAnswerPacket(NewResponse(q, rcode, answers))
+}
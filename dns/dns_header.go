@@ -11,7 +11,8 @@ type DNSHeader struct {
 	QR                                 bool  // query(0)/response(1)
 	Opcode                             uint8 // 4 bits
 	AA, TC, RD, RA                     bool
-	Z                                  uint8 // 3 bits (must be 0 in classic DNS)
+	Z                                  uint8 // 1 bit, must be 0
+	AD, CD                             bool  // DNSSEC authenticated data, checking disabled (RFC 4035)
 	RCode                              uint8 // 4 bits
 	QDCount, ANCount, NSCount, ARCount uint16
 }
@@ -34,7 +35,9 @@ func ParseHeader(b []byte) (DNSHeader, error) {
 	header.TC = ((flags >> 9) & 1) == 1
 	header.RD = ((flags >> 8) & 1) == 1
 	header.RA = ((flags >> 7) & 1) == 1
-	header.Z = uint8((flags >> 4) & 7)
+	header.Z = uint8((flags >> 6) & 1)
+	header.AD = ((flags >> 5) & 1) == 1
+	header.CD = ((flags >> 4) & 1) == 1
 	header.RCode = uint8(flags & 15)
 
 	header.QDCount = binary.BigEndian.Uint16(b[4:6])
@@ -66,7 +69,13 @@ func BuildHeader(header DNSHeader) []byte {
 		flags |= 1 << 7
 	}
 
-	flags |= (uint16(header.Z) & 7) << 4
+	flags |= (uint16(header.Z) & 1) << 6
+	if header.AD {
+		flags |= 1 << 5
+	}
+	if header.CD {
+		flags |= 1 << 4
+	}
 	flags |= uint16(header.RCode) & 15
 
 	out := make([]byte, DNSHeaderSize)
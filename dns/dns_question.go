@@ -70,3 +70,10 @@ func BuildQuestion(pkt []byte, q DNSQuestion, names map[string]int) ([]byte, err
 
 	return pkt, nil
 }
+
+// BuildQuery builds a recursive query for q, the caller sets the ID
+func BuildQuery(q DNSQuestion) []byte {
+	pkt := BuildHeader(DNSHeader{RD: true, QDCount: 1})
+	pkt, _ = BuildQuestion(pkt, q, make(map[string]int))
+	return pkt
+}
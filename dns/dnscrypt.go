@@ -0,0 +1,387 @@
+package dns
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	mrand "math/rand/v2"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Stamp protocols (https://dnscrypt.info/stamps-specifications)
+const (
+	StampPlain    = 0x00
+	StampDNSCrypt = 0x01
+	StampRelay    = 0x81
+)
+
+const (
+	dnscryptCertSize = 124
+	// es-version of X25519-XSalsa20Poly1305, the only construction we speak
+	dnscryptXSalsa20 = 1
+	// UDP queries are padded to at least this, TCP ones to a multiple of 64
+	dnscryptMinQuery = 256
+	// certificates are fetched again this often, so rotated keys get picked up
+	dnscryptCertRefresh = time.Hour
+)
+
+var (
+	dnscryptCertMagic     = []byte("DNSC")
+	dnscryptResolverMagic = []byte{0x72, 0x36, 0x66, 0x6e, 0x76, 0x57, 0x6a, 0x38}
+	// prefix of a query an anonymizing relay passes on
+	anonMagic = []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00}
+)
+
+// Stamp is a decoded sdns:// server stamp
+type Stamp struct {
+	Proto        byte
+	Props        uint64 // DNSSEC, no logs, no filter bits
+	Addr         string // ip:port
+	PublicKey    []byte // provider key that signs the DNSCrypt certificates
+	ProviderName string // "2.dnscrypt-cert.example.com"
+}
+
+// ParseStamp decodes plain DNS, DNSCrypt and relay stamps
+func ParseStamp(s string) (Stamp, error) {
+	var st Stamp
+	enc, ok := strings.CutPrefix(s, "sdns://")
+	if !ok {
+		return st, fmt.Errorf("stamp %q: no sdns:// prefix", s)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(enc, "="))
+	if err != nil || len(b) < 1 {
+		return st, fmt.Errorf("stamp %q: bad encoding", s)
+	}
+	st.Proto, b = b[0], b[1:]
+
+	lp := func() ([]byte, error) {
+		if len(b) < 1 || len(b) < 1+int(b[0]) {
+			return nil, errors.New("truncated")
+		}
+		v := b[1 : 1+int(b[0])]
+		b = b[1+int(b[0]):]
+		return v, nil
+	}
+	port := "443"
+	if st.Proto != StampRelay {
+		if len(b) < 8 {
+			return st, fmt.Errorf("stamp %q: truncated", s)
+		}
+		st.Props, b = binary.LittleEndian.Uint64(b), b[8:]
+	}
+	if st.Proto == StampPlain {
+		port = "53"
+	}
+
+	addr, err := lp()
+	if err != nil {
+		return st, fmt.Errorf("stamp %q: %v", s, err)
+	}
+	st.Addr = withPort(string(addr), port)
+
+	switch st.Proto {
+	case StampPlain, StampRelay:
+	case StampDNSCrypt:
+		if st.PublicKey, err = lp(); err == nil && len(st.PublicKey) != ed25519.PublicKeySize {
+			err = errors.New("bad provider key")
+		}
+		var name []byte
+		if err == nil {
+			name, err = lp()
+		}
+		if err != nil {
+			return st, fmt.Errorf("stamp %q: %v", s, err)
+		}
+		st.ProviderName = normName(string(name))
+	default:
+		return st, fmt.Errorf("stamp %q: unsupported protocol %#x", s, st.Proto)
+	}
+	return st, nil
+}
+
+// String encodes the stamp again
+func (st Stamp) String() string {
+	b := []byte{st.Proto}
+	if st.Proto != StampRelay {
+		b = binary.LittleEndian.AppendUint64(b, st.Props)
+	}
+	lp := func(v []byte) {
+		b = append(append(b, byte(len(v))), v...)
+	}
+	lp([]byte(st.Addr))
+	if st.Proto == StampDNSCrypt {
+		lp(st.PublicKey)
+		lp([]byte(st.ProviderName))
+	}
+	return "sdns://" + base64.RawURLEncoding.EncodeToString(b)
+}
+
+// dnscryptUpstream encrypts every query to a DNSCrypt v2 resolver under a
+// fresh key pair, optionally through an anonymizing relay, so neither the
+// resolver nor the relay sees both who asks and what
+type dnscryptUpstream struct {
+	stamp  Stamp
+	server netip.AddrPort
+	relays []string
+
+	mu         sync.Mutex
+	cert       *dnscryptCert
+	fetched    time.Time
+	refreshing bool // a query is fetching the certificates, the others keep the current one
+}
+
+type dnscryptCert struct {
+	resolverPK  [32]byte
+	clientMagic [8]byte
+	serial      uint32
+	notAfter    time.Time
+}
+
+func newDNSCryptUpstream(st Stamp, relays []string) (*dnscryptUpstream, error) {
+	if st.Proto != StampDNSCrypt {
+		return nil, fmt.Errorf("stamp %s: not a DNSCrypt server", st)
+	}
+	server, err := netip.ParseAddrPort(st.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("stamp %s: server address must be an IP", st)
+	}
+	u := &dnscryptUpstream{stamp: st, server: server}
+
+	for _, r := range relays {
+		addr := r
+		if strings.HasPrefix(r, "sdns://") {
+			rs, err := ParseStamp(r)
+			if err != nil {
+				return nil, err
+			}
+			if rs.Proto != StampRelay {
+				return nil, fmt.Errorf("stamp %q: not a relay", r)
+			}
+			addr = rs.Addr
+		}
+		u.relays = append(u.relays, withPort(addr, "443"))
+	}
+	return u, nil
+}
+
+func (u *dnscryptUpstream) String() string { return "dnscrypt://" + u.stamp.ProviderName + "@" + u.stamp.Addr }
+
+func (u *dnscryptUpstream) Exchange(msg []byte, timeout time.Duration) ([]byte, error) {
+	if len(msg) < DNSHeaderSize {
+		return nil, errors.New("short query")
+	}
+	deadline := time.Now().Add(timeout)
+	cert, err := u.certificate(deadline)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", u, err)
+	}
+
+	reply, err := u.exchange(cert, msg, false, deadline)
+	if err == nil && len(reply) >= DNSHeaderSize {
+		if hdr, _ := ParseHeader(reply); hdr.TC {
+			reply, err = u.exchange(cert, msg, true, deadline)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", u, err)
+	}
+	return reply, nil
+}
+
+// exchange seals msg for the resolver and opens its answer
+func (u *dnscryptUpstream) exchange(cert *dnscryptCert, msg []byte, tcp bool, deadline time.Time) ([]byte, error) {
+	pk, sk, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	var shared [32]byte
+	box.Precompute(&shared, &cert.resolverPK, sk)
+
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:12]); err != nil {
+		return nil, err
+	}
+
+	minLen := dnscryptMinQuery
+	if tcp {
+		minLen = 0
+	}
+	query := append(append(append([]byte(nil), cert.clientMagic[:]...), pk[:]...), nonce[:12]...)
+	query = box.SealAfterPrecomputation(query, dnscryptPad(msg, minLen), &nonce, &shared)
+
+	reply, err := u.send(query, tcp, deadline)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) < len(dnscryptResolverMagic)+24+box.Overhead || !bytes.Equal(reply[:8], dnscryptResolverMagic) || !bytes.Equal(reply[8:20], nonce[:12]) {
+		return nil, errors.New("reply is not for our query")
+	}
+	copy(nonce[:], reply[8:32])
+	plain, ok := box.OpenAfterPrecomputation(nil, reply[32:], &nonce, &shared)
+	if !ok {
+		return nil, errors.New("reply does not decrypt")
+	}
+	return dnscryptUnpad(plain)
+}
+
+// send delivers packet to the resolver, through a random relay when there are
+// any, and returns the first packet that comes back
+func (u *dnscryptUpstream) send(packet []byte, tcp bool, deadline time.Time) ([]byte, error) {
+	target := u.stamp.Addr
+	if len(u.relays) > 0 {
+		target = u.relays[mrand.IntN(len(u.relays))]
+		ip := u.server.Addr().As16()
+		hdr := append(append([]byte(nil), anonMagic...), ip[:]...)
+		hdr = binary.BigEndian.AppendUint16(hdr, u.server.Port())
+		packet = append(hdr, packet...)
+	}
+
+	network := "udp"
+	if tcp {
+		network = "tcp"
+	}
+	c, err := net.DialTimeout(network, target, time.Until(deadline))
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	_ = c.SetDeadline(deadline)
+
+	if tcp {
+		if err := WriteTCPMessage(c, packet); err != nil {
+			return nil, err
+		}
+		return ReadTCPMessage(c)
+	}
+	if _, err := c.Write(packet); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4096)
+	n, err := c.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// certificate returns the newest valid certificate the provider signed,
+// fetching them again once an hour or when the current one ran out. The
+// fetch happens outside the lock, other queries go on with the current
+// certificate meanwhile.
+func (u *dnscryptUpstream) certificate(deadline time.Time) (*dnscryptCert, error) {
+	u.mu.Lock()
+	now := time.Now()
+	cur := u.cert
+	if cur != nil && !now.Before(cur.notAfter) {
+		cur = nil
+	}
+	if cur != nil && (now.Sub(u.fetched) < dnscryptCertRefresh || u.refreshing) {
+		u.mu.Unlock()
+		return cur, nil
+	}
+	u.refreshing = true
+	u.mu.Unlock()
+
+	fresh, err := u.fetchCertificate(deadline)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.refreshing = false
+	if err != nil {
+		// an hourly refresh that failed leaves the current one in service
+		if cur != nil {
+			log.Warn().Str("upstream", u.String()).Msg("dnscrypt certificate refresh failed: " + err.Error())
+			return cur, nil
+		}
+		return nil, err
+	}
+	u.cert, u.fetched = fresh, time.Now()
+	return fresh, nil
+}
+
+// fetchCertificate asks the provider for its certificates and picks the newest valid one
+func (u *dnscryptUpstream) fetchCertificate(deadline time.Time) (*dnscryptCert, error) {
+	query := BuildQuery(DNSQuestion{Name: u.stamp.ProviderName, Type: TypeTXT, Class: ClassIN})
+	binary.BigEndian.PutUint16(query[:2], uint16(mrand.Uint32()))
+	reply, err := u.send(query, false, deadline)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := ParseAnswerPacket(reply, len(reply))
+	if err != nil {
+		return nil, err
+	}
+	if resp.Header.ID != binary.BigEndian.Uint16(query[:2]) {
+		return nil, errors.New("certificate reply is not for our query")
+	}
+
+	now := time.Now()
+	var best *dnscryptCert
+	for _, rr := range resp.Answers {
+		if rr.Type != TypeTXT {
+			continue
+		}
+		c, err := parseDNSCryptCert(bytes.Join(rr.RData.TXT, nil), u.stamp.PublicKey, now)
+		if err == nil && (best == nil || c.serial > best.serial) {
+			best = c
+		}
+	}
+	if best == nil {
+		return nil, errors.New("no valid certificate")
+	}
+	return best, nil
+}
+
+func parseDNSCryptCert(b []byte, providerKey []byte, now time.Time) (*dnscryptCert, error) {
+	if len(b) < dnscryptCertSize || !bytes.Equal(b[:4], dnscryptCertMagic) {
+		return nil, errors.New("not a certificate")
+	}
+	if binary.BigEndian.Uint16(b[4:6]) != dnscryptXSalsa20 {
+		return nil, errors.New("unsupported construction")
+	}
+	// the signature covers everything after it, extensions included
+	if !ed25519.Verify(providerKey, b[72:], b[8:72]) {
+		return nil, errors.New("bad signature")
+	}
+
+	c := &dnscryptCert{serial: binary.BigEndian.Uint32(b[112:116])}
+	copy(c.resolverPK[:], b[72:104])
+	copy(c.clientMagic[:], b[104:112])
+	start := time.Unix(int64(binary.BigEndian.Uint32(b[116:120])), 0)
+	c.notAfter = time.Unix(int64(binary.BigEndian.Uint32(b[120:124])), 0)
+	if now.Before(start) || !now.Before(c.notAfter) {
+		return nil, errors.New("certificate not valid now")
+	}
+	return c, nil
+}
+
+// dnscryptPad appends 0x80 and zeros up to a multiple of 64, at least minLen
+func dnscryptPad(msg []byte, minLen int) []byte {
+	n := max(minLen, (len(msg)+1+63)/64*64)
+	out := make([]byte, n)
+	copy(out, msg)
+	out[len(msg)] = 0x80
+	return out
+}
+
+func dnscryptUnpad(b []byte) ([]byte, error) {
+	i := len(b) - 1
+	for i >= 0 && b[i] == 0 {
+		i--
+	}
+	if i < DNSHeaderSize || b[i] != 0x80 {
+		return nil, errors.New("bad padding")
+	}
+	return b[:i], nil
+}
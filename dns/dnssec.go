@@ -0,0 +1,318 @@
+package dns
+
+import (
+	"cmp"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	_ "crypto/sha256" // crypto.SHA256 for DS digests and signatures
+	_ "crypto/sha512" // crypto.SHA384 and SHA512
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DNSSEC algorithm numbers we can verify (RFC 8624 section 3.1)
+const (
+	AlgRSASHA256       = 8
+	AlgRSASHA512       = 10
+	AlgECDSAP256SHA256 = 13
+	AlgECDSAP384SHA384 = 14
+	AlgED25519         = 15
+)
+
+// DS digest types (RFC 8624 section 3.3)
+const (
+	DigestSHA1   = 1
+	DigestSHA256 = 2
+	DigestSHA384 = 4
+)
+
+// DNSKEY flags (RFC 4034 section 2.1.1, RFC 5011)
+const (
+	DNSKEYZone   = 0x0100
+	DNSKEYRevoke = 0x0080
+	DNSKEYSEP    = 0x0001
+)
+
+// NSEC3OptOut marks an NSEC3 span that may hide unsigned delegations (RFC 5155 section 3.1.2.1)
+const NSEC3OptOut = 0x01
+
+var errUnsupportedAlgorithm = errors.New("unsupported DNSSEC algorithm")
+
+// SupportedAlgorithm reports whether signatures of alg can be checked
+func SupportedAlgorithm(alg uint8) bool {
+	switch alg {
+	case AlgRSASHA256, AlgRSASHA512, AlgECDSAP256SHA256, AlgECDSAP384SHA384, AlgED25519:
+		return true
+	}
+	return false
+}
+
+func digestHash(digestType uint8) (crypto.Hash, bool) {
+	switch digestType {
+	case DigestSHA1:
+		return crypto.SHA1, true
+	case DigestSHA256:
+		return crypto.SHA256, true
+	case DigestSHA384:
+		return crypto.SHA384, true
+	}
+	return 0, false
+}
+
+// KeyTag computes the tag RRSIG and DS records use to point at a key (RFC 4034 appendix B)
+func KeyTag(k DNSKEYData) uint16 {
+	rd, _ := BuildRdata(nil, RData{DNSKEY: k}, TypeDNSKEY, nil)
+	var ac uint32
+	for i, b := range rd {
+		if i&1 == 0 {
+			ac += uint32(b) << 8
+		} else {
+			ac += uint32(b)
+		}
+	}
+	ac += ac >> 16 & 0xFFFF
+	return uint16(ac)
+}
+
+// DSDigest hashes the owner name and DNSKEY RDATA the way a DS record does (RFC 4034 section 5.1.4)
+func DSDigest(owner string, k DNSKEYData, digestType uint8) ([]byte, error) {
+	h, ok := digestHash(digestType)
+	if !ok {
+		return nil, fmt.Errorf("unsupported DS digest type %d", digestType)
+	}
+	data := BuildName(nil, normName(owner))
+	data, _ = BuildRdata(data, RData{DNSKEY: k}, TypeDNSKEY, nil)
+
+	hh := h.New()
+	hh.Write(data)
+	return hh.Sum(nil), nil
+}
+
+// NewDS returns the DS record vouching for k, owned by zone
+func NewDS(zone string, k DNSKEYData, digestType uint8) (DSData, error) {
+	digest, err := DSDigest(zone, k, digestType)
+	if err != nil {
+		return DSData{}, err
+	}
+	return DSData{KeyTag: KeyTag(k), Algorithm: k.Algorithm, DigestType: digestType, Digest: digest}, nil
+}
+
+// CanonicalCompare orders names the DNSSEC way (RFC 4034 section 6.1): label by
+// label from the root, each label as lower-cased octets
+func CanonicalCompare(a, b string) int {
+	la, lb := splitLabels(normName(a)), splitLabels(normName(b))
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(len(la), len(lb))
+}
+
+func splitLabels(name string) []string {
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, ".")
+}
+
+// labelCount is the RRSIG labels value for name: the wildcard label does not count
+func labelCount(name string) int {
+	labels := splitLabels(normName(name))
+	if len(labels) > 0 && labels[0] == "*" {
+		return len(labels) - 1
+	}
+	return len(labels)
+}
+
+// canonicalRdata is the RDATA without compression and with the embedded names
+// of the RFC 4034 section 6.2 types lower-cased
+func canonicalRdata(rr DNSAnswer) []byte {
+	rd := rr.RData
+	switch rr.Type {
+	case TypeNS, TypeCNAME, TypePTR:
+		rd.Name = normName(rd.Name)
+	case TypeMX:
+		rd.MX.Host = normName(rd.MX.Host)
+	case TypeSRV:
+		rd.SRV.Target = normName(rd.SRV.Target)
+	case TypeSOA:
+		rd.SOA.MName, rd.SOA.RName = normName(rd.SOA.MName), normName(rd.SOA.RName)
+	case TypeRRSIG:
+		rd.RRSIG.SignerName = normName(rd.RRSIG.SignerName)
+	}
+	out, _ := BuildRdata(nil, rd, rr.Type, nil)
+	return out
+}
+
+// SignedData is what an RRSIG's signature covers: its own RDATA up to the
+// signature followed by the RRset in canonical form and order (RFC 4034
+// section 3.1.8.1). Wildcard expansions are signed with the wildcard owner.
+func SignedData(sig RRSIGData, rrs []DNSAnswer) []byte {
+	sig.SignerName = normName(sig.SignerName)
+	out := appendRRSIGHeader(nil, sig)
+	if len(rrs) == 0 {
+		return out
+	}
+
+	owner := normName(rrs[0].Name)
+	if labels := splitLabels(owner); int(sig.Labels) < labelCount(owner) {
+		owner = strings.Join(append([]string{"*"}, labels[len(labels)-int(sig.Labels):]...), ".")
+	}
+	prefix := BuildName(nil, owner)
+	prefix = binary.BigEndian.AppendUint16(prefix, rrs[0].Type)
+	prefix = binary.BigEndian.AppendUint16(prefix, rrs[0].Class)
+	prefix = binary.BigEndian.AppendUint32(prefix, sig.OrigTTL)
+
+	rdatas := make([][]byte, 0, len(rrs))
+	for _, rr := range rrs {
+		rdatas = append(rdatas, canonicalRdata(rr))
+	}
+	sort.Slice(rdatas, func(i, j int) bool { return string(rdatas[i]) < string(rdatas[j]) })
+
+	for i, rd := range rdatas {
+		// duplicates are signed once (RFC 4034 section 6.3)
+		if i > 0 && string(rd) == string(rdatas[i-1]) {
+			continue
+		}
+		out = append(out, prefix...)
+		out = binary.BigEndian.AppendUint16(out, uint16(len(rd)))
+		out = append(out, rd...)
+	}
+	return out
+}
+
+// VerifyRRSIG checks sig over rrs with key. Validity period and owner checks are
+// left to the caller.
+func VerifyRRSIG(sig RRSIGData, key DNSKEYData, rrs []DNSAnswer) error {
+	if key.Algorithm != sig.Algorithm || KeyTag(key) != sig.KeyTag {
+		return fmt.Errorf("key %d does not match signature", KeyTag(key))
+	}
+	data := SignedData(sig, rrs)
+
+	switch sig.Algorithm {
+	case AlgRSASHA256, AlgRSASHA512:
+		pub, err := rsaPublicKey(key.PublicKey)
+		if err != nil {
+			return err
+		}
+		h := crypto.SHA256
+		if sig.Algorithm == AlgRSASHA512 {
+			h = crypto.SHA512
+		}
+		hh := h.New()
+		hh.Write(data)
+		return rsa.VerifyPKCS1v15(pub, h, hh.Sum(nil), sig.Signature)
+
+	case AlgECDSAP256SHA256, AlgECDSAP384SHA384:
+		curve, size, h := elliptic.P256(), 32, crypto.SHA256
+		if sig.Algorithm == AlgECDSAP384SHA384 {
+			curve, size, h = elliptic.P384(), 48, crypto.SHA384
+		}
+		if len(key.PublicKey) != 2*size || len(sig.Signature) != 2*size {
+			return fmt.Errorf("ECDSA key or signature has the wrong size")
+		}
+		pub := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(key.PublicKey[:size]),
+			Y:     new(big.Int).SetBytes(key.PublicKey[size:]),
+		}
+		hh := h.New()
+		hh.Write(data)
+		r := new(big.Int).SetBytes(sig.Signature[:size])
+		s := new(big.Int).SetBytes(sig.Signature[size:])
+		if !ecdsa.Verify(pub, hh.Sum(nil), r, s) {
+			return fmt.Errorf("ECDSA signature does not verify")
+		}
+		return nil
+
+	case AlgED25519:
+		if len(key.PublicKey) != ed25519.PublicKeySize {
+			return fmt.Errorf("Ed25519 key has the wrong size")
+		}
+		if !ed25519.Verify(ed25519.PublicKey(key.PublicKey), data, sig.Signature) {
+			return fmt.Errorf("Ed25519 signature does not verify")
+		}
+		return nil
+	}
+	return errUnsupportedAlgorithm
+}
+
+// rsaPublicKey decodes the RFC 3110 key format: exponent length, exponent, modulus
+func rsaPublicKey(b []byte) (*rsa.PublicKey, error) {
+	if len(b) < 3 {
+		return nil, fmt.Errorf("RSA key too short")
+	}
+	expLen, off := int(b[0]), 1
+	if expLen == 0 {
+		expLen, off = int(binary.BigEndian.Uint16(b[1:])), 3
+	}
+	if expLen == 0 || expLen > 4 || off+expLen >= len(b) {
+		return nil, fmt.Errorf("RSA key has a bad exponent")
+	}
+
+	var e int
+	for _, c := range b[off : off+expLen] {
+		e = e<<8 | int(c)
+	}
+	n := new(big.Int).SetBytes(b[off+expLen:])
+	if n.BitLen() < 1024 {
+		return nil, fmt.Errorf("RSA key too small")
+	}
+	return &rsa.PublicKey{N: n, E: e}, nil
+}
+
+// sigTimeOK checks the validity period with serial number arithmetic (RFC 4034 section 3.1.5)
+func sigTimeOK(sig RRSIGData, now time.Time) bool {
+	t := uint32(now.Unix())
+	return int32(t-sig.Inception) >= 0 && int32(sig.Expiration-t) >= 0
+}
+
+var nsec3Encoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// NSEC3Hash returns the owner label NSEC3 uses for name: iterated SHA-1 over
+// the canonical name and salt, in lower-case base32hex (RFC 5155 section 5)
+func NSEC3Hash(name string, salt []byte, iterations uint16) string {
+	h := sha1.New()
+	h.Write(BuildName(nil, normName(name)))
+	h.Write(salt)
+	digest := h.Sum(nil)
+	for i := 0; i < int(iterations); i++ {
+		h.Reset()
+		h.Write(digest)
+		h.Write(salt)
+		digest = h.Sum(digest[:0])
+	}
+	return strings.ToLower(nsec3Encoding.EncodeToString(digest))
+}
+
+// nsecCovers reports whether an NSEC from owner to next proves name absent from
+// zone: it sorts strictly between them, or after owner on the last NSEC
+func nsecCovers(owner, next, name, zone string) bool {
+	if !IsSubdomain(name, zone) {
+		return false
+	}
+	if CanonicalCompare(owner, next) < 0 {
+		return CanonicalCompare(owner, name) < 0 && CanonicalCompare(name, next) < 0
+	}
+	// the last NSEC points back to the apex
+	return CanonicalCompare(owner, name) < 0 || CanonicalCompare(name, next) < 0
+}
+
+// hashCovers is nsecCovers for NSEC3 hashes, base32hex keeps the byte order
+func hashCovers(owner, next, hash string) bool {
+	if owner < next {
+		return owner < hash && hash < next
+	}
+	return owner < hash || hash < next
+}
@@ -0,0 +1,186 @@
+package dns
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	dohPath        = "/dns-query"
+	dohContentType = "application/dns-message"
+	dohMaxMessage  = 65535
+)
+
+func parseProxies(cidrs []string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, c := range cidrs {
+		p, err := netip.ParsePrefix(c)
+		if err != nil {
+			return nil, fmt.Errorf("trusted_proxies: %v", err)
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
+
+// ListenDoH opens the DNS-over-HTTPS listener. With a certificate it speaks
+// TLS and offers HTTP/2, without one plain HTTP for a proxy in front.
+func (s *Server) ListenDoH(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if s.cfg.DoH.CertFile == "" {
+		return ln, nil
+	}
+	certs, err := NewCertReloader(s.cfg.DoH.CertFile, s.cfg.DoH.KeyFile)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return tls.NewListener(ln, ServerTLSConfig(certs, "h2", "http/1.1")), nil
+}
+
+// ServeDoH answers RFC 8484 requests on ln until the listener is closed
+func (s *Server) ServeDoH(ln net.Listener) error {
+	hs := &http.Server{
+		Handler:           s.DoHHandler(),
+		ReadHeaderTimeout: tcpIdleTimeout,
+		IdleTimeout:       2 * time.Minute,
+	}
+	return hs.Serve(ln)
+}
+
+// DoHHandler serves /dns-query, queries come as the base64url "dns"
+// parameter of a GET or as the body of a POST
+func (s *Server) DoHHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(dohPath, s.serveDoH)
+	return mux
+}
+
+func (s *Server) serveDoH(w http.ResponseWriter, r *http.Request) {
+	var msg []byte
+	switch r.Method {
+	case http.MethodGet:
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			http.Error(w, "missing dns parameter", http.StatusBadRequest)
+			return
+		}
+		// the RFC drops the padding, some clients send it anyway
+		var err error
+		if msg, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(param, "=")); err != nil {
+			http.Error(w, "dns parameter is not base64url", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct != dohContentType {
+			http.Error(w, "content type must be "+dohContentType, http.StatusUnsupportedMediaType)
+			return
+		}
+		var err error
+		if msg, err = io.ReadAll(io.LimitReader(r.Body, dohMaxMessage+1)); err != nil {
+			http.Error(w, "reading the query failed", http.StatusBadRequest)
+			return
+		}
+		if len(msg) > dohMaxMessage {
+			http.Error(w, "query too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q, err := ParseQuestionPacket(msg, len(msg))
+	if err != nil {
+		http.Error(w, "malformed dns query", http.StatusBadRequest)
+		return
+	}
+
+	resp := s.Resolve(q, msg, s.dohClient(r))
+	if resp == nil {
+		http.Error(w, "no answer", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", dohContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(resp)))
+	if ttl, ok := answerTTL(resp); ok {
+		w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(ttl), 10))
+	}
+	_, _ = w.Write(resp)
+}
+
+// dohClient is the address policies apply to. Behind a trusted proxy that is
+// the right-most X-Forwarded-For hop the proxies did not add themselves.
+func (s *Server) dohClient(r *http.Request) netip.Addr {
+	ap, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}
+	}
+	client := ap.Addr().Unmap()
+	if !s.trustedProxy(client) {
+		return client
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		a, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		client = a.Unmap()
+		if !s.trustedProxy(client) {
+			break
+		}
+	}
+	return client
+}
+
+func (s *Server) trustedProxy(a netip.Addr) bool {
+	for _, p := range s.proxies {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// answerTTL is how long HTTP caches may keep resp: the smallest TTL in it,
+// negative answers by their SOA (RFC 2308). Errors and empty answers get none.
+func answerTTL(resp []byte) (uint32, bool) {
+	pkt, err := ParseAnswerPacket(resp, len(resp))
+	if err != nil || pkt.Header.RCode != RCodeSuccess && pkt.Header.RCode != RCodeNXDomain {
+		return 0, false
+	}
+
+	var ttl uint32
+	found := false
+	for _, section := range [][]DNSAnswer{pkt.Answers, pkt.Authority, pkt.Additional} {
+		for _, rr := range section {
+			if rr.Type == TypeOPT || rr.Type == TypeTSIG {
+				continue
+			}
+			t := rr.TTL
+			if rr.Type == TypeSOA {
+				t = min(t, rr.RData.SOA.Minimum)
+			}
+			if !found || t < ttl {
+				ttl, found = t, true
+			}
+		}
+	}
+	return ttl, found
+}
@@ -0,0 +1,186 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/rs/zerolog/log"
+)
+
+// DoQ error codes (RFC 9250 section 4.3)
+const (
+	doqInternalError   = 0x1
+	doqProtocolError   = 0x2
+	doqRequestCanceled = 0x3
+)
+
+// doqMaxStreams is how many queries one client may have open at once
+const doqMaxStreams = 256
+
+// ListenDoQ opens the DNS-over-QUIC listener (RFC 9250)
+func (s *Server) ListenDoQ(addr string) (*quic.Listener, error) {
+	certs, err := NewCertReloader(s.cfg.DoQ.CertFile, s.cfg.DoQ.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return quic.ListenAddr(addr, ServerTLSConfig(certs, "doq"), &quic.Config{
+		MaxIdleTimeout:     upstreamIdleTimeout,
+		MaxIncomingStreams: doqMaxStreams,
+	})
+}
+
+// ServeDoQ accepts QUIC connections until the listener is closed
+func (s *Server) ServeDoQ(ln *quic.Listener) {
+	for {
+		conn, err := ln.Accept(context.Background())
+		if err != nil {
+			if errors.Is(err, quic.ErrServerClosed) {
+				return
+			}
+			continue
+		}
+		go s.serveDoQConn(conn)
+	}
+}
+
+// serveDoQConn answers every stream the client opens, one query each
+func (s *Server) serveDoQConn(conn *quic.Conn) {
+	client := AddrOf(conn.RemoteAddr())
+	for {
+		st, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go s.serveDoQStream(conn, st, client)
+	}
+}
+
+func (s *Server) serveDoQStream(conn *quic.Conn, st *quic.Stream, client netip.Addr) {
+	defer st.Close()
+	_ = st.SetDeadline(time.Now().Add(tcpIdleTimeout))
+
+	msg, err := ReadTCPMessage(st)
+	if err != nil {
+		st.CancelRead(doqRequestCanceled)
+		st.CancelWrite(doqRequestCanceled)
+		return
+	}
+	q, err := ParseQuestionPacket(msg, len(msg))
+	// the ID is 0 on DoQ, the stream tells the queries apart
+	if err != nil || q.Header.ID != 0 {
+		_ = conn.CloseWithError(doqProtocolError, "malformed query")
+		return
+	}
+
+	if q.Question.Type == TypeAXFR || q.Question.Type == TypeIXFR {
+		if err := s.Transfer(st, q, msg, client); err != nil {
+			log.Warn().Str("zone", q.Question.Name).Str("client", client.String()).Msg("transfer failed: " + err.Error())
+			st.CancelWrite(doqInternalError)
+		}
+		return
+	}
+
+	resp := s.Resolve(q, msg, client)
+	if resp == nil {
+		st.CancelWrite(doqInternalError)
+		return
+	}
+	_ = WriteTCPMessage(st, resp)
+}
+
+// quicUpstream sends each query on its own stream of one shared QUIC
+// connection, dialed again when it went away
+type quicUpstream struct {
+	addr      string
+	boot      *bootstrap
+	tlsConfig *tls.Config
+
+	mu   sync.Mutex
+	conn *quic.Conn
+}
+
+func (u *quicUpstream) String() string { return "quic://" + u.addr }
+
+func (u *quicUpstream) Exchange(msg []byte, timeout time.Duration) ([]byte, error) {
+	if len(msg) < DNSHeaderSize {
+		return nil, errors.New("short query")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// a connection the server closed while idle fails on the first stream,
+	// one retry on a fresh connection covers that
+	var err error
+	for try := 0; try < 2; try++ {
+		var conn *quic.Conn
+		if conn, err = u.connection(ctx); err != nil {
+			break
+		}
+		var reply []byte
+		if reply, err = u.exchange(ctx, conn, msg); err == nil {
+			return reply, nil
+		}
+		if conn.Context().Err() == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, fmt.Errorf("%s: %v", u, err)
+}
+
+func (u *quicUpstream) connection(ctx context.Context) (*quic.Conn, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.conn != nil && u.conn.Context().Err() == nil {
+		return u.conn, nil
+	}
+
+	addrs, err := u.boot.resolve(u.addr)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		var conn *quic.Conn
+		if conn, err = quic.DialAddr(ctx, a, u.tlsConfig, &quic.Config{MaxIdleTimeout: upstreamIdleTimeout}); err == nil {
+			u.conn = conn
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+func (u *quicUpstream) exchange(ctx context.Context, conn *quic.Conn, msg []byte) ([]byte, error) {
+	st, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = st.SetDeadline(deadline)
+	}
+
+	query := append([]byte(nil), msg...)
+	binary.BigEndian.PutUint16(query[:2], 0)
+	if err := WriteTCPMessage(st, query); err != nil {
+		st.CancelRead(doqRequestCanceled)
+		return nil, err
+	}
+	// closing our side tells the server the query is complete
+	_ = st.Close()
+
+	reply, err := ReadTCPMessage(st)
+	if err != nil {
+		st.CancelRead(doqRequestCanceled)
+		return nil, err
+	}
+	if len(reply) < DNSHeaderSize {
+		return nil, errors.New("short reply")
+	}
+	copy(reply[:2], msg[:2])
+	return reply, nil
+}
@@ -0,0 +1,143 @@
+package dns
+
+import (
+	"encoding/binary"
+)
+
+// EDNS(0) (RFC 6891) travels as an OPT pseudo record in the additional section:
+// CLASS carries the UDP payload size and TTL the extended RCODE, version and flags
+const (
+	ednsUDPSize = 1232
+	ednsDO      = 0x8000 // DNSSEC OK (RFC 3225)
+)
+
+// findOPT returns the offset of the OPT record's TTL field in msg, -1 when there is none
+func findOPT(msg []byte) int {
+	hdr, err := ParseHeader(msg)
+	if err != nil || hdr.ARCount == 0 {
+		return -1
+	}
+
+	off := DNSHeaderSize
+	for i := 0; i < int(hdr.QDCount); i++ {
+		if _, off, err = ParseQuestion(msg, off); err != nil {
+			return -1
+		}
+	}
+
+	// only the fixed fields matter, skip over the RDATA without parsing it
+	additional := int(hdr.ANCount) + int(hdr.NSCount)
+	records := additional + int(hdr.ARCount)
+	for i := 0; i < records; i++ {
+		if _, off, err = ParseName(msg, off); err != nil || off+10 > len(msg) {
+			return -1
+		}
+		if i >= additional && binary.BigEndian.Uint16(msg[off:]) == TypeOPT {
+			return off + 4
+		}
+		off += 10 + int(binary.BigEndian.Uint16(msg[off+8:]))
+	}
+	return -1
+}
+
+// EDNSFlags reports whether msg carries an OPT record and whether it sets DO
+func EDNSFlags(msg []byte) (edns, do bool) {
+	off := findOPT(msg)
+	if off < 0 {
+		return false, false
+	}
+	return true, binary.BigEndian.Uint32(msg[off:])&ednsDO != 0
+}
+
+// WithDO returns a copy of the query msg asking for DNSSEC records, adding an
+// OPT record when the client didn't send one
+func WithDO(msg []byte) []byte {
+	out := append([]byte(nil), msg...)
+	if off := findOPT(out); off >= 0 {
+		out[off+2] |= ednsDO >> 8
+		return out
+	}
+
+	out = append(out, 0) // root owner
+	out = binary.BigEndian.AppendUint16(out, TypeOPT)
+	out = binary.BigEndian.AppendUint16(out, ednsUDPSize)
+	out = binary.BigEndian.AppendUint32(out, ednsDO)
+	out = binary.BigEndian.AppendUint16(out, 0)
+	binary.BigEndian.PutUint16(out[10:12], binary.BigEndian.Uint16(out[10:12])+1)
+	return out
+}
+
+// UDPSize is the largest UDP reply the client of query takes: what its OPT
+// record advertises, 512 bytes without one or when it offers less (RFC 6891)
+func UDPSize(query []byte) int {
+	off := findOPT(query)
+	if off < 0 {
+		return 512
+	}
+	return max(int(binary.BigEndian.Uint16(query[off-2:])), 512)
+}
+
+// TruncateUDP cuts resp down to the header and question with TC set when it
+// doesn't fit the client of query, which then retries over TCP (RFC 7766).
+// An OPT record in resp is kept, without its options.
+func TruncateUDP(resp, query []byte) []byte {
+	return truncateUDP(resp, UDPSize(query))
+}
+
+// truncateUDP is TruncateUDP for a client that takes size bytes
+func truncateUDP(resp []byte, size int) []byte {
+	if len(resp) <= size {
+		return resp
+	}
+	m, err := ParseMsg(resp)
+	if err != nil {
+		return resp
+	}
+
+	opt := findOPT(resp)
+	out := append([]byte(nil), resp[:m.qEnd]...)
+	out[2] |= 0x02
+	binary.BigEndian.PutUint16(out[6:], 0)
+	binary.BigEndian.PutUint16(out[8:], 0)
+	binary.BigEndian.PutUint16(out[10:], 0)
+	if opt >= 0 {
+		// root owner, type, class and TTL as they were, no RDATA
+		out = append(out, 0)
+		out = append(out, resp[opt-4:opt+4]...)
+		out = binary.BigEndian.AppendUint16(out, 0)
+		binary.BigEndian.PutUint16(out[10:], 1)
+	}
+	return out
+}
+
+// StripDNSSEC removes the DNSSEC records a client that didn't set DO must not
+// get (RFC 4035 section 3.2.1), unless it asked for that type. noOPT also drops
+// the OPT record for clients that didn't use EDNS.
+func StripDNSSEC(ans *DNSAnswerPacket, noOPT bool) {
+	var qtype uint16
+	if len(ans.Questions) > 0 {
+		qtype = ans.Questions[0].Type
+	}
+
+	keep := func(rrs []DNSAnswer, answer bool) []DNSAnswer {
+		out := rrs[:0]
+		for _, rr := range rrs {
+			switch rr.Type {
+			case TypeRRSIG, TypeNSEC, TypeNSEC3:
+				if !answer || rr.Type != qtype {
+					continue
+				}
+			case TypeOPT:
+				if noOPT {
+					continue
+				}
+			}
+			out = append(out, rr)
+		}
+		return out
+	}
+
+	ans.Answers = keep(ans.Answers, true)
+	ans.Authority = keep(ans.Authority, false)
+	ans.Additional = keep(ans.Additional, false)
+}
@@ -0,0 +1,96 @@
+package dns
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"nyasaki/dns-server/config"
+)
+
+// Route sends the names below Suffix to its own upstreams, rotating between them
+type Route struct {
+	Suffix    string
+	Upstreams []string
+	Timeout   time.Duration
+	// AllowPrivate exempts the route's answers from rebinding protection
+	AllowPrivate bool
+
+	next atomic.Uint32
+}
+
+// Pick returns the upstream for the next query
+func (r *Route) Pick() string {
+	n := r.next.Add(1) - 1
+	return r.Upstreams[int(n)%len(r.Upstreams)]
+}
+
+// Next returns the upstream n places after spec in the rotation, the one to
+// try when spec didn't answer
+func (r *Route) Next(spec string, n int) string {
+	for i, u := range r.Upstreams {
+		if u == spec {
+			return r.Upstreams[(i+n)%len(r.Upstreams)]
+		}
+	}
+	return r.Upstreams[n%len(r.Upstreams)]
+}
+
+// Router is the conditional forwarding table, keyed by domain suffix
+type Router struct {
+	routes map[string]*Route
+}
+
+func NewRouter(cfgs []config.ForwardConfig) (*Router, error) {
+	r := &Router{routes: make(map[string]*Route)}
+	for _, fc := range cfgs {
+		timeout := upstreamTimeout
+		if fc.Timeout != "" {
+			d, err := time.ParseDuration(fc.Timeout)
+			if err != nil {
+				return nil, err
+			}
+			timeout = d
+		}
+
+		for _, d := range fc.Domains {
+			suffix := normName(d)
+			r.routes[suffix] = &Route{Suffix: suffix, Upstreams: fc.Upstreams, Timeout: timeout, AllowPrivate: fc.AllowPrivate}
+		}
+	}
+	return r, nil
+}
+
+// Match returns the route with the longest suffix covering name, nil when the
+// name goes to the default upstream
+func (r *Router) Match(name string) *Route {
+	if len(r.routes) == 0 {
+		return nil
+	}
+
+	name = normName(name)
+	for {
+		if rt, ok := r.routes[name]; ok {
+			return rt
+		}
+		if name == "" {
+			return nil
+		}
+		_, name, _ = strings.Cut(name, ".")
+	}
+}
+
+// Upstreams lists every distinct upstream the routes use
+func (r *Router) Upstreams() []string {
+	var out []string
+	seen := make(map[string]bool)
+	for _, rt := range r.routes {
+		for _, u := range rt.Upstreams {
+			if !seen[u] {
+				seen[u] = true
+				out = append(out, u)
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,698 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"nyasaki/dns-server/config"
+	"nyasaki/dns-server/metrics"
+
+	"github.com/dgraph-io/ristretto/v2"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/ipv4"
+)
+
+// BlockTTL is how long a block answer is cached when no schedule can lift it
+const BlockTTL = time.Hour
+
+// Server ties the listeners to the shared answering pipeline
+type Server struct {
+	cfg       *config.Config
+	stats     *metrics.Stats
+	cache     *ristretto.Cache[string, CacheEntry]
+	policy    *Policy
+	zones     *Zones
+	overrides *Overrides
+	rebind    *RebindGuard
+	keys      Keyring
+	router    *Router
+	resolver  *Resolver      // nil when forwarding
+	validator *Validator     // nil when DNSSEC validation is off
+	proxies   []netip.Prefix // DoH peers whose X-Forwarded-For is believed
+
+	secondaries map[string]*Secondary // by origin
+	updateMu    sync.Mutex
+
+	udpConns   []*net.UDPConn
+	inflight   chan struct{}           // a slot per UDP query answered aside
+	upstreams  map[string]*net.UDPConn // plain upstreams by spec, "" is the default
+	transports map[string]Upstream     // every upstream by spec, "" is the default
+}
+
+// Forward describes a query that has to go upstream and what to do with the reply
+type Forward struct {
+	Query    []byte // packet to send, ID is set by the transport
+	Upstream string // group upstream, "" for the default
+	Key      string // cache key, "" to skip caching
+	Name     string // question name the client asked
+	Until    time.Time
+	Alias    string      // original name when a rewritten one was forwarded
+	Chain    []DNSAnswer // CNAMEs leading from Alias to the forwarded name
+	Timeout  time.Duration
+	// conditional forwarding route the upstream came from, its other
+	// upstreams are tried when that one doesn't answer
+	Route *Route
+	// resolve from the root instead of asking Upstream
+	Iterative bool
+	// check the reply with DNSSEC; whether the client sent EDNS, set DO
+	// (wants DNSSEC records) or CD (wants the data even when it is bogus)
+	Validate     bool
+	EDNS, DO, CD bool
+}
+
+func NewServer(cfg *config.Config, stats *metrics.Stats) (*Server, error) {
+	cache, err := ristretto.NewCache(
+		&ristretto.Config[string, CacheEntry]{
+			NumCounters: 1e5,
+			MaxCost:     1 << 30,
+			BufferItems: 64,
+		},
+	)
+	if err != nil {
+		log.Error().Msg("failed to add to cache '" + err.Error() + "'")
+		return nil, err
+	}
+
+	overrides, err := LoadOverrides(cfg.Overrides)
+	if err != nil {
+		log.Error().Msg("failed to load local overrides " + err.Error())
+		return nil, err
+	}
+
+	zones, err := LoadZones(cfg.Zones)
+	if err != nil {
+		log.Error().Msg("failed to load zones " + err.Error())
+		return nil, err
+	}
+
+	policy, err := NewPolicy(cfg)
+	if err != nil {
+		log.Error().Msg("failed to load client policy " + err.Error())
+		return nil, err
+	}
+
+	router, err := NewRouter(cfg.Forwarders)
+	if err != nil {
+		log.Error().Msg("failed to load forwarders " + err.Error())
+		return nil, err
+	}
+
+	transports, err := newTransports(cfg, router, policy)
+	if err != nil {
+		log.Error().Msg("failed to set up upstreams " + err.Error())
+		return nil, err
+	}
+
+	var resolver *Resolver
+	if cfg.Resolver.Recursive {
+		if resolver, err = NewResolver(cfg.Resolver); err != nil {
+			log.Error().Msg("failed to set up the resolver " + err.Error())
+			return nil, err
+		}
+	}
+
+	var validator *Validator
+	if cfg.DNSSEC.Validate {
+		fetch := UpstreamFetcher(transports[""])
+		if resolver != nil {
+			resolver.dnssec = true
+			fetch = resolver.Fetch
+		}
+		if validator, err = NewValidator(cfg.DNSSEC, fetch); err != nil {
+			log.Error().Msg("failed to set up dnssec validation " + err.Error())
+			return nil, err
+		}
+	}
+
+	keys, err := NewKeyring(cfg.TSIGKeys)
+	if err != nil {
+		log.Error().Msg("failed to load tsig keys " + err.Error())
+		return nil, err
+	}
+
+	proxies, err := parseProxies(cfg.DoH.TrustedProxies)
+	if err != nil {
+		log.Error().Msg("failed to load doh trusted proxies " + err.Error())
+		return nil, err
+	}
+
+	secondaries := make(map[string]*Secondary)
+	for _, sc := range cfg.Secondaries {
+		sec, err := NewSecondary(sc, zones, keys)
+		if err != nil {
+			log.Error().Msg("failed to set up secondary zone " + err.Error())
+			return nil, err
+		}
+		secondaries[sec.Origin] = sec
+	}
+
+	return &Server{
+		cfg:         cfg,
+		stats:       stats,
+		cache:       cache,
+		policy:      policy,
+		zones:       zones,
+		overrides:   overrides,
+		rebind:      NewRebindGuard(cfg.Rebind),
+		keys:        keys,
+		router:      router,
+		resolver:    resolver,
+		validator:   validator,
+		proxies:     proxies,
+		transports:  transports,
+		secondaries: secondaries,
+		inflight:    make(chan struct{}, cfg.Inflight),
+	}, nil
+}
+
+// ReloadZones re-reads every zone file, changed serials are journaled for IXFR
+func (s *Server) ReloadZones() error {
+	for _, zc := range s.cfg.Zones {
+		z, err := LoadConfiguredZone(zc)
+		if err != nil {
+			return err
+		}
+		s.zones.Replace(z)
+		log.Info().Str("zone", z.Origin).Uint32("serial", z.SOA().RData.SOA.Serial).Msg("zone loaded")
+	}
+	return nil
+}
+
+// Run opens the sockets and serves until the UDP listener fails
+func (s *Server) Run() error {
+	workers := s.cfg.Workers
+	if workers == 0 {
+		workers = runtime.NumCPU()
+	}
+
+	// plain DNS on every bind, UDP and TCP alike, a UDP socket per worker
+	for _, addr := range s.cfg.Listen {
+		udpConns, err := ListenUDPWorkers(addr, workers)
+		if err != nil {
+			log.Error().Msg("error setting up the udp server " + err.Error())
+			return err
+		}
+		s.udpConns = append(s.udpConns, udpConns...)
+
+		tcpLn, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Error().Msg("failed to start listening (tcp) '" + err.Error() + "'")
+			return err
+		}
+		go s.ServeTCP(tcpLn)
+	}
+
+	// one socket per plain upstream, encrypted ones keep their own connections
+	s.upstreams = make(map[string]*net.UDPConn)
+	for spec, up := range s.transports {
+		p, ok := up.(*plainUpstream)
+		if !ok {
+			continue
+		}
+		c, err := DialUpstream(p.addr)
+		if err != nil {
+			log.Error().Msg("upstream " + spec + ": " + err.Error())
+			return err
+		}
+		s.upstreams[spec] = c
+	}
+
+	if s.cfg.DoT.CertFile != "" {
+		dotLn, err := s.ListenDoT(s.cfg.DoT.Listen)
+		if err != nil {
+			log.Error().Msg("failed to start listening (dot) '" + err.Error() + "'")
+			return err
+		}
+		go s.ServeTCP(dotLn)
+	}
+
+	if s.cfg.DoQ.CertFile != "" {
+		doqLn, err := s.ListenDoQ(s.cfg.DoQ.Listen)
+		if err != nil {
+			log.Error().Msg("failed to start listening (doq) '" + err.Error() + "'")
+			return err
+		}
+		go s.ServeDoQ(doqLn)
+	}
+
+	if s.cfg.DoH.Listen != "" {
+		dohLn, err := s.ListenDoH(s.cfg.DoH.Listen)
+		if err != nil {
+			log.Error().Msg("failed to start listening (doh) '" + err.Error() + "'")
+			return err
+		}
+		go func() {
+			if err := s.ServeDoH(dohLn); err != nil {
+				log.Error().Msg("doh server stopped " + err.Error())
+			}
+		}()
+	}
+
+	for _, c := range s.upstreams {
+		go UpstreamReader(s, c)
+	}
+	for _, sec := range s.secondaries {
+		go sec.Run()
+	}
+	go Sweeper()
+
+	errc := make(chan error, len(s.udpConns))
+	for _, c := range s.udpConns {
+		go func(c *net.UDPConn) { errc <- s.ServeUDP(c) }(c)
+	}
+	return <-errc
+}
+
+// ServeUDP answers the queries arriving on conn until it is closed, reading
+// and answering them a batch per syscall
+func (s *Server) ServeUDP(conn *net.UDPConn) error {
+	bc := newBatchConn(conn)
+	ms := make([]ipv4.Message, udpBatchSize)
+	batchBuffers(ms)
+	// cache hits are built in these, one per message of a batch
+	out := make([]ipv4.Message, udpBatchSize)
+	batchBuffers(out)
+	replies := make([][]byte, udpBatchSize)
+	for i := range out {
+		replies[i] = out[i].Buffers[0]
+	}
+
+	for {
+		n, err := bc.ReadBatch(ms, 0)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			continue
+		}
+
+		k := 0
+		for i := range ms[:n] {
+			cAddr, ok := ms[i].Addr.(*net.UDPAddr)
+			if !ok {
+				continue
+			}
+			query := ms[i].Buffers[0][:ms[i].N]
+			// cache hits carry whatever size the first client took, cut them down here
+			if resp := s.serveUDPQuery(conn, query, cAddr, replies[k]); resp != nil {
+				out[k].Buffers[0], out[k].Addr = TruncateUDP(resp, query), cAddr
+				k++
+			}
+		}
+		writeBatch(bc, out[:k])
+	}
+}
+
+// serveUDPQuery returns the answer to send right away, queries that wait on
+// an upstream are answered later by whoever gets the reply. Cache hits are
+// built in dst.
+func (s *Server) serveUDPQuery(conn *net.UDPConn, buffer []byte, cAddr *net.UDPAddr, dst []byte) []byte {
+	// dual-stack sockets see IPv4 clients as ::ffff:a.b.c.d
+	client := cAddr.AddrPort().Addr().Unmap()
+	if resp, ok := s.CachedResponse(dst, buffer, client); ok {
+		return resp
+	}
+
+	// clone the packet before any mutation, the buffer is read into again
+	pkt := make([]byte, len(buffer))
+	copy(pkt, buffer)
+
+	// parse question
+	q, err := ParseQuestionPacket(pkt, len(pkt))
+	if err != nil {
+		return nil
+	}
+
+	resp, fwd := s.HandleQuery(q, pkt, client)
+	if resp != nil || fwd == nil {
+		return resp
+	}
+
+	// iterative resolution takes several round trips, don't hold up the listener
+	if fwd.Iterative {
+		return s.answerAside(conn, q, pkt, cAddr, func() []byte { return s.ResolveIterative(q, fwd) })
+	}
+
+	// encrypted upstreams answer on their own connections, wait for them aside
+	if s.upstreams[fwd.Upstream] == nil {
+		return s.answerAside(conn, q, pkt, cAddr, func() []byte { return s.forward(q, fwd) })
+	}
+
+	// ID remap + pending bookkeeping
+	orig := binary.BigEndian.Uint16(pkt[:2])
+	now := time.Now().UnixNano()
+	upID, ok := allocUpID(now)
+	if !ok { /* optionally SERVFAIL */
+		return nil
+	}
+
+	slot := &pending[upID]
+	slot.srv = s
+	slot.conn = conn
+	slot.addr = cAddr
+	slot.orig = orig
+	slot.fwd = *fwd
+	slot.size = UDPSize(buffer)
+	atomic.StoreUint32(&slot.tries, 0)
+	atomic.StoreInt64(&slot.exp, now+int64(fwd.Timeout))
+
+	binary.BigEndian.PutUint16(fwd.Query[:2], upID)
+	_, _ = s.upstreams[fwd.Upstream].Write(fwd.Query)
+	return nil
+}
+
+// answerAside sends the answer to pkt from a goroutine of its own once it is
+// there, cut down to what the client takes over UDP. With every slot taken
+// the query is answered SERVFAIL right away instead.
+func (s *Server) answerAside(conn *net.UDPConn, q DNSQuestionPacket, pkt []byte, addr *net.UDPAddr, answer func() []byte) []byte {
+	select {
+	case s.inflight <- struct{}{}:
+	default:
+		s.stats.Overloaded.Add(1)
+		resp, _ := BuildResponse(q, RCodeServFail, nil)
+		return resp
+	}
+	go func() {
+		defer func() { <-s.inflight }()
+		_, _ = conn.WriteToUDP(TruncateUDP(answer(), pkt), addr)
+	}()
+	return nil
+}
+
+// CachedResponse answers a plain query straight from the cache, reading pkt
+// in place and building the key and the answer in dst, so a hit allocates
+// nothing. ok is false for anything else, which takes HandleQuery.
+func (s *Server) CachedResponse(dst, pkt []byte, client netip.Addr) (resp []byte, ok bool) {
+	m, err := ParseMsg(pkt)
+	if err != nil || m.Flags()&0x8000 != 0 || m.Opcode() != 0 || m.Count(-1) != 1 || !m.HasQuestion() {
+		return nil, false
+	}
+	if t := m.QType(); t == TypeAXFR || t == TypeIXFR {
+		return nil, false
+	}
+
+	// an OPT record is all the additional section may hold, TSIG wants the full path
+	do := false
+	additional := m.Records(SectionAdditional)
+	for rr, more := additional.Next(); more; rr, more = additional.Next() {
+		if rr.Type != TypeOPT {
+			return nil, false
+		}
+		do = rr.TTL&ednsDO != 0
+	}
+	if additional.Err() != nil {
+		return nil, false
+	}
+
+	// overrides and hosted zones come before the cache
+	name, err := m.AppendQName(dst[:0])
+	if err != nil || (s.overrides != nil && s.overrides.Has(name)) || s.zones.Contains(name) {
+		return nil, false
+	}
+
+	key, err := s.policy.GroupFor(client).AppendCacheKey(dst[:0], &m)
+	if err != nil {
+		return nil, false
+	}
+	if s.validator != nil && do {
+		key = append(key, "|do"...)
+	}
+	// the cache only hashes the key, it can look at dst for the moment
+	entry, found := CacheLookup(unsafe.String(unsafe.SliceData(key), len(key)), s.cache)
+	if !found || len(entry.RawPkt) < 2 || (entry.Validation == Bogus && m.Flags()&0x0010 == 0) {
+		return nil, false
+	}
+	s.stats.CacheHits.Add(1)
+
+	resp = append(dst[:0], entry.RawPkt...)
+	binary.BigEndian.PutUint16(resp[:2], m.ID())
+	return resp, true
+}
+
+// HandleQuery runs the local part of the pipeline: overrides, hosted zones, cache,
+// policy and safe search. It returns either a finished response or a Forward.
+// Signed requests get signed local answers, what would have to go upstream is
+// refused: we can't vouch for an upstream's answer and it mustn't see the TSIG.
+func (s *Server) HandleQuery(q DNSQuestionPacket, pkt []byte, client netip.Addr) ([]byte, *Forward) {
+	sig, err := s.keys.Verify(pkt, nil)
+	if err != nil {
+		resp, _ := BuildResponse(q, RCodeFormErr, nil)
+		return resp, nil
+	}
+	if sig != nil && sig.Error != 0 {
+		log.Warn().Str("key", sig.Name).Str("client", client.String()).Uint16("error", sig.Error).Msg("tsig check failed")
+		resp, _ := BuildResponse(q, RCodeNotAuth, nil)
+		return sig.Reply(resp), nil
+	}
+
+	resp, fwd := s.handleQuery(q, pkt, client, sig)
+	if fwd != nil && sig != nil {
+		resp, _ = BuildResponse(q, RCodeRefused, nil)
+		fwd = nil
+	}
+	if resp != nil {
+		resp = sig.Reply(resp)
+	}
+	return resp, fwd
+}
+
+func (s *Server) handleQuery(q DNSQuestionPacket, pkt []byte, client netip.Addr, sig *TSIGResult) ([]byte, *Forward) {
+	group := s.policy.GroupFor(client)
+	key := group.CacheKey(q)
+	fwd := &Forward{Query: pkt, Upstream: group.Upstream, Key: key, Name: q.Question.Name, Timeout: upstreamTimeout}
+	if s.validator != nil {
+		fwd.EDNS, fwd.DO = EDNSFlags(pkt)
+		fwd.CD = q.Header.CD
+		// DO clients get the signatures as well, keep them apart
+		if fwd.DO {
+			key += "|do"
+			fwd.Key = key
+		}
+	}
+
+	if q.Header.Opcode == OpcodeNotify {
+		return s.HandleNotify(q, client, sig), nil
+	}
+	if q.Header.Opcode == OpcodeUpdate {
+		return s.HandleUpdate(q, pkt, client, sig), nil
+	}
+
+	if q.Question.Type == TypeAXFR || q.Question.Type == TypeIXFR {
+		// transfers only make sense over TCP, which handles them before we get here
+		if resp := s.TransferOverUDP(q, client, sig); resp != nil {
+			return resp, nil
+		}
+		resp, _ := BuildResponse(q, RCodeRefused, nil)
+		return resp, nil
+	}
+
+	// local overrides are authoritative and never hit the cache
+	var target string
+	if s.overrides != nil {
+		if answers, forward, ok := s.overrides.Lookup(q.Question); ok {
+			s.stats.LocalAnswers.Add(1)
+			if forward == "" {
+				resp := NewResponse(q, 0, answers)
+				resp.Header.AA = true
+				resp.Authority = s.overrides.Authority(q.Question, answers)
+				wire, _ := BuildAnswerPacket(resp)
+				return wire, nil
+			}
+
+			// CNAME pointing outside our data, resolve the target upstream
+			target, fwd.Chain, fwd.Key = forward, answers, ""
+		}
+	}
+
+	// hosted zones are answered from memory as well
+	if z := s.zones.Find(q.Question.Name); z != nil && target == "" && q.Question.Class == ClassIN {
+		s.stats.AuthAnswers.Add(1)
+		resp := z.Answer(q)
+		if _, do := EDNSFlags(pkt); do && z.Signer != nil {
+			resp = z.Signer.Sign(z, q, resp)
+		}
+		wire, _ := BuildAnswerPacket(resp)
+		return wire, nil
+	}
+
+	// try cache, block answers are cached per group as well
+	if fwd.Key != "" {
+		if entry, ok := CacheLookup(fwd.Key, s.cache); ok && len(entry.RawPkt) >= 2 {
+			s.stats.CacheHits.Add(1)
+			if entry.Validation == Bogus && !q.Header.CD {
+				resp, _ := BuildResponse(q, RCodeServFail, nil)
+				return resp, nil
+			}
+
+			// copy cached packet so we don’t mutate shared memory and patch the ID
+			resp := append([]byte(nil), entry.RawPkt...)
+			binary.BigEndian.PutUint16(resp[:2], q.Header.ID)
+			return resp, nil
+		}
+	}
+	s.stats.CacheMisses.Add(1)
+
+	blocked, until := group.Decide(q.Question.Name, time.Now())
+	if blocked && target == "" {
+		s.stats.Blocked.Add(1)
+		resp, err := BuildResponse(q, RCodeNXDomain, nil)
+		if err == nil {
+			ttl := BlockTTL
+			if !until.IsZero() {
+				ttl = min(ttl, time.Until(until))
+			}
+			CachePutRaw(key, resp, ttl, s.cache)
+		}
+		return resp, nil
+	}
+	fwd.Until = until
+
+	// safe-search names are answered with a CNAME to the engine's restricted endpoint
+	if group.SafeSearch && target == "" {
+		if t, ok := SafeSearchTarget(q.Question.Name); ok {
+			s.stats.SafeSearchRewrites.Add(1)
+			target = t
+			fwd.Chain = []DNSAnswer{SafeSearchCNAME(q.Question, t)}
+
+			// nothing to look up when the client only wants the alias
+			if q.Question.Type == TypeCNAME {
+				resp, err := BuildResponse(q, 0, fwd.Chain)
+				if err == nil {
+					CachePutRaw(key, resp, SafeSearchTTL*time.Second, s.cache)
+				}
+				return resp, nil
+			}
+		}
+	}
+
+	lookup := q.Question.Name
+	if target != "" {
+		lookup = target
+		fwd.Alias = q.Question.Name
+		fwd.Query = BuildQuery(DNSQuestion{Name: target, Type: q.Question.Type, Class: q.Question.Class})
+	}
+
+	// conditional forwarding beats both the group's and the default upstream
+	rt := s.router.Match(lookup)
+	if rt != nil {
+		fwd.Upstream, fwd.Timeout, fwd.Route = rt.Pick(), rt.Timeout, rt
+	} else if s.resolver != nil {
+		fwd.Iterative = true
+	}
+
+	// forwarded domains are private namespaces, everything else gets checked
+	if s.validator != nil && rt == nil {
+		fwd.Validate = true
+		fwd.Query = WithDO(fwd.Query)
+
+		// a name inside a gap we hold a validated proof for needs no upstream
+		if target == "" && !fwd.CD {
+			if ans, ok := s.validator.Synthesize(q); ok {
+				s.stats.DNSSECSynthesized.Add(1)
+				if !fwd.DO {
+					StripDNSSEC(&ans, true)
+				}
+				wire, _ := BuildAnswerPacket(ans)
+				return wire, nil
+			}
+		}
+	}
+
+	return nil, fwd
+}
+
+// FinishUpstream applies rebinding protection and alias restoration to an upstream
+// reply (ID already restored), caches it and returns the bytes for the client
+func (s *Server) FinishUpstream(raw []byte, fwd *Forward) []byte {
+	out := raw
+	rebuild := false
+	// routes marked allow_private are internal namespaces, like the allowed domains
+	guarded := s.rebind != nil && (fwd.Route == nil || !fwd.Route.AllowPrivate) && !s.rebind.Allowed(fwd.Name)
+	ans, err := ParseAnswerPacket(raw, len(raw))
+	if err != nil {
+		// what we can't look into can't be validated or filtered either
+		if fwd.Validate || guarded {
+			log.Warn().Str("name", fwd.Name).Msg("can't check the upstream answer: " + err.Error())
+			return upstreamFailure(raw, fwd)
+		}
+		return out
+	}
+
+	state := Indeterminate
+	if fwd.Validate {
+		var verr error
+		state, verr = s.validator.Validate(ans)
+		switch state {
+		case Secure:
+			s.stats.DNSSECSecure.Add(1)
+		case Bogus:
+			s.stats.DNSSECBogus.Add(1)
+			log.Warn().Str("name", fwd.Name).Msg("dnssec validation failed: " + verr.Error())
+		}
+		ans.Header.AD = state == Secure
+		if !fwd.DO {
+			StripDNSSEC(&ans, !fwd.EDNS)
+		}
+		rebuild = true
+	}
+
+	if guarded {
+		if stripped := s.rebind.Filter(&ans); stripped > 0 {
+			s.stats.RebindStripped.Add(uint64(stripped))
+			log.Warn().Str("name", fwd.Name).Int("stripped", stripped).Msg("rebind protection dropped private answers")
+			rebuild = true
+		}
+	}
+
+	// we asked for an alias target, answer the name the client asked for
+	if fwd.Alias != "" {
+		ans = WithAlias(ans, fwd.Alias, fwd.Chain)
+		rebuild = true
+	}
+
+	// the raw reply is not what we mean to send any more, never fall back to it
+	if rebuild {
+		rebuilt, bErr := BuildAnswerPacket(ans)
+		if bErr != nil {
+			log.Warn().Str("name", fwd.Name).Msg("could not rebuild the upstream answer: " + bErr.Error())
+			return upstreamFailure(raw, fwd)
+		}
+		out = rebuilt
+	}
+
+	if len(ans.Answers) > 0 && fwd.Key != "" {
+		CachePutValidated(fwd.Key, ans, fwd.Until, state, s.cache)
+	}
+
+	// bogus data only goes to clients that disabled checking
+	if state == Bogus && !fwd.CD {
+		q := DNSQuestionPacket{Header: ans.Header}
+		if len(ans.Questions) > 0 {
+			q.Question = ans.Questions[0]
+		}
+		out, _ = BuildResponse(q, RCodeServFail, nil)
+	}
+
+	return out
+}
+
+// upstreamFailure answers SERVFAIL for a reply we couldn't vouch for, to the
+// question the client asked
+func upstreamFailure(raw []byte, fwd *Forward) []byte {
+	q, _ := ParseQuestionPacket(fwd.Query, len(fwd.Query))
+	if len(raw) >= 2 {
+		q.Header.ID = binary.BigEndian.Uint16(raw[:2])
+	}
+	if fwd.Alias != "" {
+		q.Question.Name = fwd.Alias
+	}
+	resp, _ := BuildResponse(q, RCodeServFail, nil)
+	return resp
+}
@@ -3,6 +3,8 @@ package dns
 import (
 	"encoding/binary"
 	"fmt"
+	"net/netip"
+	"strconv"
 	"strings"
 )
 
@@ -10,9 +12,13 @@ const DNSHeaderSize = 12
 
 func ParseName(msg []byte, off int) (domainName string, offset int, err error) {
 	
-	var labels []string
+	// labels are joined in place, the name is the only allocation
+	var buf [255]byte
+	name := buf[:0]
 	start := off
 	jumped := false
+	hops := 0
+	wire := 1 // the root label
 
 	for {
 		if off >= len(msg) {
@@ -26,6 +32,11 @@ func ParseName(msg []byte, off int) (domainName string, offset int, err error) {
 				return "", 0, fmt.Errorf("truncated pointer")
 			}
 
+			// pointers may point at each other, don't follow them forever
+			if hops++; hops > maxPointers {
+				return "", 0, fmt.Errorf("pointer loop")
+			}
+
 			pointer := int(binary.BigEndian.Uint16(msg[off:off+2]) & 0x3FFF)
 			if pointer >= len(msg) {
 				return "", 0, fmt.Errorf("bad ptr %d", pointer)
@@ -54,26 +65,33 @@ func ParseName(msg []byte, off int) (domainName string, offset int, err error) {
 		if off+int(length) > len(msg) {
 			return "", 0, fmt.Errorf("label length overflow")
 		}
+		if wire += 1 + int(length); wire > 255 {
+			return "", 0, fmt.Errorf("name longer than 255 octets")
+		}
 
-		// Append to labels array for later joining
-		labels = append(labels, string(msg[off:off+int(length)]))
+		if len(name) > 0 {
+			name = append(name, '.')
+		}
+		name = append(name, msg[off:off+int(length)]...)
 		off += int(length)
 	}
 
-	// Joins labels with .
-	name := strings.Join(labels, ".")
-
 	// No pointer, just continue reading normally
 	if !jumped {
-		return name, off, nil
+		return string(name), off, nil
 	}
 
 	// Continue reading after pointer
-	return name, start, nil
+	return string(name), start, nil
 }
 
 // Appends a compressed name to the end of the packet using names as compression map
 func BuildNameCompressed(pkt []byte, name string, names map[string]int) ([]byte, int) {
+	// a nil map means no compression, e.g. for canonical (RFC 4034 section 6.2) RDATA
+	if names == nil {
+		return BuildName(pkt, name), len(pkt)
+	}
+
 	//fmt.Println("Got map: ", names)
 
 	name = strings.TrimSuffix(name, ".")
@@ -124,3 +142,56 @@ func BuildNameCompressed(pkt []byte, name string, names map[string]int) ([]byte,
 
 	return pkt, start
 }
+
+// BuildName appends name without compression, for RDATA that must not be compressed
+func BuildName(pkt []byte, name string) []byte {
+	name = strings.TrimSuffix(name, ".")
+	if name != "" {
+		for _, lab := range strings.Split(name, ".") {
+			pkt = append(pkt, byte(len(lab)))
+			pkt = append(pkt, lab...)
+		}
+	}
+	return append(pkt, 0)
+}
+
+// IsSubdomain reports whether name equals zone or sits below it (label aware, case insensitive)
+func IsSubdomain(name, zone string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	zone = strings.ToLower(strings.TrimSuffix(zone, "."))
+
+	if zone == "" {
+		return true
+	}
+	if name == zone {
+		return true
+	}
+	return strings.HasSuffix(name, "."+zone)
+}
+
+// ReverseName returns the in-addr.arpa / ip6.arpa name for ip
+func ReverseName(ip netip.Addr) string {
+	ip = ip.Unmap()
+	var sb strings.Builder
+
+	if ip.Is4() {
+		a := ip.As4()
+		for i := 3; i >= 0; i-- {
+			sb.WriteString(strconv.Itoa(int(a[i])))
+			sb.WriteByte('.')
+		}
+		sb.WriteString("in-addr.arpa")
+		return sb.String()
+	}
+
+	const hex = "0123456789abcdef"
+	a := ip.As16()
+	for i := 15; i >= 0; i-- {
+		sb.WriteByte(hex[a[i]&0xF])
+		sb.WriteByte('.')
+		sb.WriteByte(hex[a[i]>>4])
+		sb.WriteByte('.')
+	}
+	sb.WriteString("ip6.arpa")
+	return sb.String()
+}
@@ -0,0 +1,54 @@
+package dns
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxJournal bounds how many versions back IXFR can reach
+const maxJournal = 100
+
+// ZoneDelta is the change from one serial to the next in IXFR terms
+type ZoneDelta struct {
+	OldSOA, NewSOA DNSAnswer
+	Removed, Added []DNSAnswer
+}
+
+// rrKey identifies a record including its TTL, a TTL change is a remove plus an add
+func rrKey(rr DNSAnswer) string {
+	return fmt.Sprintf("%s|%d|%d|%d|%v", strings.ToLower(rr.Name), rr.Type, rr.Class, rr.TTL, rr.RData)
+}
+
+// Diff computes the delta turning old into new, SOAs excluded from the sets
+func Diff(old, new *Zone) ZoneDelta {
+	d := ZoneDelta{OldSOA: old.SOA(), NewSOA: new.SOA()}
+
+	have := make(map[string]DNSAnswer)
+	for _, rr := range old.Records()[1:] {
+		have[rrKey(rr)] = rr
+	}
+
+	for _, rr := range new.Records()[1:] {
+		k := rrKey(rr)
+		if _, ok := have[k]; ok {
+			delete(have, k)
+			continue
+		}
+		d.Added = append(d.Added, rr)
+	}
+	for _, rr := range have {
+		d.Removed = append(d.Removed, rr)
+	}
+	return d
+}
+
+// DeltasSince returns the consecutive deltas leading from serial to the current
+// version, false when the journal does not start at serial
+func (z *Zone) DeltasSince(serial uint32) ([]ZoneDelta, bool) {
+	for i, d := range z.journal {
+		if d.OldSOA.RData.SOA.Serial == serial {
+			return z.journal[i:], true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,304 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Sections of a message, for Msg.Records
+const (
+	SectionAnswer = iota
+	SectionAuthority
+	SectionAdditional
+)
+
+// maxPointers bounds how many compression pointers one name may follow, a
+// loop of pointers must not keep us busy
+const maxPointers = 64
+
+// Msg is a read-only view of a DNS message. It only remembers where the
+// question and the record sections start; names and records are read in
+// place when asked for, so looking at a message allocates nothing.
+type Msg struct {
+	b     []byte
+	qname int    // offset of the first question's name, 0 without a question
+	qEnd  int    // offset after the question section
+	sec   [3]int // offsets of the record sections, 0 until walked to
+}
+
+// ParseMsg checks the header and the question section of b and returns the
+// view on it. The records are only looked at by Records.
+func ParseMsg(b []byte) (Msg, error) {
+	if len(b) < DNSHeaderSize {
+		return Msg{}, fmt.Errorf("packet too short: %d < 12", len(b))
+	}
+	m := Msg{b: b, qEnd: DNSHeaderSize}
+	for i := 0; i < int(m.Count(-1)); i++ {
+		end, err := skipName(b, m.qEnd)
+		if err != nil || end+4 > len(b) {
+			return Msg{}, fmt.Errorf("truncated question section")
+		}
+		if i == 0 {
+			m.qname = m.qEnd
+		}
+		m.qEnd = end + 4
+	}
+	return m, nil
+}
+
+// Bytes is the message the view looks at
+func (m *Msg) Bytes() []byte { return m.b }
+
+func (m *Msg) ID() uint16 { return binary.BigEndian.Uint16(m.b[0:2]) }
+
+// Flags is the second header word: QR, opcode, AA, TC, RD, RA, Z, AD, CD, rcode
+func (m *Msg) Flags() uint16 { return binary.BigEndian.Uint16(m.b[2:4]) }
+
+func (m *Msg) Opcode() uint8 { return uint8(m.Flags()>>11) & 15 }
+
+// Count is the number of records in a section, -1 counts the questions
+func (m *Msg) Count(section int) uint16 {
+	return binary.BigEndian.Uint16(m.b[6+2*section:])
+}
+
+// HasQuestion tells whether there is a question to look at
+func (m *Msg) HasQuestion() bool { return m.qname != 0 }
+
+// QNameOffset is where the first question's name starts, for NameEqual
+func (m *Msg) QNameOffset() int { return m.qname }
+
+func (m *Msg) QType() uint16 {
+	end, _ := skipName(m.b, m.qname)
+	return binary.BigEndian.Uint16(m.b[end:])
+}
+
+func (m *Msg) QClass() uint16 {
+	end, _ := skipName(m.b, m.qname)
+	return binary.BigEndian.Uint16(m.b[end+2:])
+}
+
+// AppendQName appends the first question's name the way ParseName and
+// normName spell it: dotted, lower-cased, without the trailing dot
+func (m *Msg) AppendQName(dst []byte) ([]byte, error) {
+	if m.qname == 0 {
+		return dst, fmt.Errorf("no question")
+	}
+	return appendName(dst, m.b, m.qname)
+}
+
+// AppendCacheKey appends the cache key of the first question, the same one
+// CacheKeyFromQuestion makes from the parsed question
+func (m *Msg) AppendCacheKey(dst []byte) ([]byte, error) {
+	dst, err := m.AppendQName(dst)
+	if err != nil {
+		return dst, err
+	}
+	return appendKeySuffix(dst, m.QType(), m.QClass()), nil
+}
+
+// Records walks the records of one section
+func (m *Msg) Records(section int) RRIter {
+	off, err := m.section(section)
+	return RRIter{msg: m.b, off: off, left: int(m.Count(section)), err: err}
+}
+
+// section finds where a record section starts, skipping the ones before it once
+func (m *Msg) section(section int) (int, error) {
+	if m.sec[section] != 0 {
+		return m.sec[section], nil
+	}
+	off := m.qEnd
+	if section > 0 {
+		prev := m.Records(section - 1)
+		for {
+			if _, ok := prev.Next(); !ok {
+				break
+			}
+		}
+		if prev.err != nil {
+			return 0, prev.err
+		}
+		off = prev.off
+	}
+	m.sec[section] = off
+	return off, nil
+}
+
+// RRView is one resource record read in place, RData points into the message
+type RRView struct {
+	msg   []byte
+	name  int
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	RData []byte
+}
+
+// NameOffset is where the owner name starts in the message, for NameEqual
+func (r RRView) NameOffset() int { return r.name }
+
+// Name decodes the owner name
+func (r RRView) Name() (string, error) {
+	name, _, err := ParseName(r.msg, r.name)
+	return name, err
+}
+
+// RRIter reads the records of a section one after the other
+type RRIter struct {
+	msg  []byte
+	off  int
+	left int
+	err  error
+}
+
+// Next returns the next record, false at the end of the section or on a
+// malformed record, which Err then reports
+func (it *RRIter) Next() (RRView, bool) {
+	if it.left <= 0 || it.err != nil {
+		return RRView{}, false
+	}
+	end, err := skipName(it.msg, it.off)
+	if err == nil && end+10 > len(it.msg) {
+		err = fmt.Errorf("truncated record")
+	}
+	var rdlen int
+	if err == nil {
+		rdlen = int(binary.BigEndian.Uint16(it.msg[end+8:]))
+		if end+10+rdlen > len(it.msg) {
+			err = fmt.Errorf("rdata overflow")
+		}
+	}
+	if err != nil {
+		it.err = err
+		return RRView{}, false
+	}
+
+	rr := RRView{
+		msg:   it.msg,
+		name:  it.off,
+		Type:  binary.BigEndian.Uint16(it.msg[end:]),
+		Class: binary.BigEndian.Uint16(it.msg[end+2:]),
+		TTL:   binary.BigEndian.Uint32(it.msg[end+4:]),
+		RData: it.msg[end+10 : end+10+rdlen],
+	}
+	it.off = end + 10 + rdlen
+	it.left--
+	return rr, true
+}
+
+func (it *RRIter) Err() error { return it.err }
+
+// skipName returns the offset after the name at off without decoding it, a
+// compression pointer ends the name where it stands
+func skipName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, fmt.Errorf("oob")
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			return off + 1, nil
+		case length&0xC0 == 0xC0:
+			if off+1 >= len(msg) {
+				return 0, fmt.Errorf("truncated pointer")
+			}
+			return off + 2, nil
+		case length > 63:
+			return 0, fmt.Errorf("bad label type %#x", length)
+		}
+		off += 1 + length
+	}
+}
+
+// nextLabel returns the label at off, following compression pointers, and
+// the offset of the label after it. An empty label ends the name.
+func nextLabel(msg []byte, off int, hops *int) ([]byte, int, error) {
+	for {
+		if off >= len(msg) {
+			return nil, 0, fmt.Errorf("oob")
+		}
+		length := int(msg[off])
+		if length&0xC0 != 0xC0 {
+			if length > 63 || off+1+length > len(msg) {
+				return nil, 0, fmt.Errorf("label length overflow")
+			}
+			return msg[off+1 : off+1+length], off + 1 + length, nil
+		}
+		if off+1 >= len(msg) {
+			return nil, 0, fmt.Errorf("truncated pointer")
+		}
+		if *hops++; *hops > maxPointers {
+			return nil, 0, fmt.Errorf("pointer loop")
+		}
+		off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+	}
+}
+
+// appendName appends the name at off dotted and lower-cased
+func appendName(dst, msg []byte, off int) ([]byte, error) {
+	hops := 0
+	for first := true; ; first = false {
+		label, next, err := nextLabel(msg, off, &hops)
+		if err != nil {
+			return dst, err
+		}
+		if len(label) == 0 {
+			return dst, nil
+		}
+		if !first {
+			dst = append(dst, '.')
+		}
+		for _, c := range label {
+			dst = append(dst, lowerASCII(c))
+		}
+		off = next
+	}
+}
+
+// NameEqual compares the wire-format names at aOff in a and bOff in b label
+// by label, ignoring ASCII case (RFC 4343) and following compression
+// pointers, without decoding either of them
+func NameEqual(a []byte, aOff int, b []byte, bOff int) bool {
+	aHops, bHops := 0, 0
+	for {
+		la, an, err := nextLabel(a, aOff, &aHops)
+		if err != nil {
+			return false
+		}
+		lb, bn, err := nextLabel(b, bOff, &bHops)
+		if err != nil || len(la) != len(lb) {
+			return false
+		}
+		if len(la) == 0 {
+			return true
+		}
+		for i := range la {
+			if lowerASCII(la[i]) != lowerASCII(lb[i]) {
+				return false
+			}
+		}
+		aOff, bOff = an, bn
+	}
+}
+
+// SameQuestion tells whether a reply answers the question of query: same
+// name, type and class
+func SameQuestion(reply, query []byte) bool {
+	r, err := ParseMsg(reply)
+	if err != nil || !r.HasQuestion() {
+		return false
+	}
+	q, err := ParseMsg(query)
+	if err != nil || !q.HasQuestion() {
+		return false
+	}
+	return r.QType() == q.QType() && r.QClass() == q.QClass() && NameEqual(reply, r.qname, query, q.qname)
+}
+
+func lowerASCII(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
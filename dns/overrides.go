@@ -0,0 +1,257 @@
+package dns
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+
+	"nyasaki/dns-server/config"
+)
+
+// Overrides holds static records that are answered authoritatively instead of forwarding
+type Overrides struct {
+	TTL     uint32
+	records map[string][]DNSAnswer // lower-cased owner name -> records
+}
+
+func NewOverrides(ttl uint32) *Overrides {
+	return &Overrides{TTL: ttl, records: make(map[string][]DNSAnswer)}
+}
+
+// LoadOverrides reads every configured file, nil when none are configured
+func LoadOverrides(cfg config.OverridesConfig) (*Overrides, error) {
+	if len(cfg.JSONFiles) == 0 && len(cfg.HostsFiles) == 0 {
+		return nil, nil
+	}
+
+	o := NewOverrides(cfg.TTL)
+	for _, path := range cfg.JSONFiles {
+		if err := o.LoadJSONFile(path); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range cfg.HostsFiles {
+		if err := o.LoadHostsFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	// files are merged, a CNAME in one and an address in another clash as well
+	for name, rrs := range o.records {
+		cnames := 0
+		for _, rr := range rrs {
+			if rr.Type == TypeCNAME {
+				cnames++
+			}
+		}
+		if cnames > 0 && len(rrs) > 1 {
+			return nil, fmt.Errorf("overrides: %s has a CNAME and other data", name)
+		}
+	}
+	return o, nil
+}
+
+func normName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+func (o *Overrides) add(name string, typ uint16, rd RData) {
+	key := normName(name)
+	rd.Kind = typ
+
+	// files commonly repeat the same mapping, keep one copy
+	for _, rr := range o.records[key] {
+		if rr.Type == typ && rr.RData.A == rd.A && rr.RData.AAAA == rd.AAAA && rr.RData.Name == rd.Name && len(rd.TXT) == 0 {
+			return
+		}
+	}
+
+	o.records[key] = append(o.records[key], DNSAnswer{Name: key, Type: typ, Class: ClassIN, TTL: o.TTL, RData: rd})
+}
+
+// AddAddr maps name to ip and adds the matching PTR record
+func (o *Overrides) AddAddr(name string, ip netip.Addr) {
+	ip = ip.Unmap()
+	if ip.Is4() {
+		o.add(name, TypeA, RData{A: ip.As4()})
+	} else {
+		o.add(name, TypeAAAA, RData{AAAA: ip.As16()})
+	}
+	o.add(ReverseName(ip), TypePTR, RData{Name: normName(name)})
+}
+
+func (o *Overrides) AddCNAME(name, target string) {
+	o.add(name, TypeCNAME, RData{Name: normName(target)})
+}
+
+// AddTXT stores text as one TXT record, split into 255 byte character-strings
+func (o *Overrides) AddTXT(name, text string) {
+	var parts [][]byte
+	for b := []byte(text); ; b = b[255:] {
+		if len(b) <= 255 {
+			parts = append(parts, b)
+			break
+		}
+		parts = append(parts, b[:255])
+	}
+	o.add(name, TypeTXT, RData{TXT: parts})
+}
+
+type jsonOverride struct {
+	A     []string `json:"a"`
+	AAAA  []string `json:"aaaa"`
+	CNAME string   `json:"cname"`
+	TXT   []string `json:"txt"`
+}
+
+// LoadJSONFile reads a hosts.json file
+func (o *Overrides) LoadJSONFile(path string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var entries map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	for name, v := range entries {
+		var e jsonOverride
+		var one string
+		var many []string
+
+		switch {
+		case json.Unmarshal(v, &one) == nil:
+			e.A = []string{one}
+		case json.Unmarshal(v, &many) == nil:
+			e.A = many
+		case json.Unmarshal(v, &e) == nil:
+		default:
+			return fmt.Errorf("%s: %s: unsupported value %s", path, name, v)
+		}
+
+		for _, s := range append(e.A, e.AAAA...) {
+			ip, err := netip.ParseAddr(s)
+			if err != nil {
+				return fmt.Errorf("%s: %s: %v", path, name, err)
+			}
+			o.AddAddr(name, ip)
+		}
+		if e.CNAME != "" {
+			if len(e.A)+len(e.AAAA)+len(e.TXT) > 0 {
+				return fmt.Errorf("%s: %s: CNAME cannot coexist with other records", path, name)
+			}
+			o.AddCNAME(name, e.CNAME)
+		}
+		for _, t := range e.TXT {
+			o.AddTXT(name, t)
+		}
+	}
+	return nil
+}
+
+// LoadHostsFile reads an /etc/hosts style file
+func (o *Overrides) LoadHostsFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		text := sc.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return fmt.Errorf("%s:%d: missing hostname", path, line)
+		}
+
+		// zone index (fe80::1%eth0) means nothing to remote clients
+		addr, _, _ := strings.Cut(fields[0], "%")
+		ip, err := netip.ParseAddr(addr)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		for _, name := range fields[1:] {
+			o.AddAddr(name, ip)
+		}
+	}
+	return sc.Err()
+}
+
+// Has tells whether there are records for name, given dotted and lower-cased
+func (o *Overrides) Has(name []byte) bool {
+	_, ok := o.records[string(name)]
+	return ok
+}
+
+// Lookup answers q from the overrides. found is false when the name is not overridden
+// or q is not of class IN. A CNAME is chased through the overrides; when the target
+// lives elsewhere it is returned as forward so the caller can resolve it upstream.
+func (o *Overrides) Lookup(q DNSQuestion) (answers []DNSAnswer, forward string, found bool) {
+	if q.Class != ClassIN {
+		return nil, "", false
+	}
+	name := normName(q.Name)
+
+	for hops := 0; hops < 8; hops++ {
+		rrs, ok := o.records[name]
+		if !ok {
+			if hops == 0 {
+				return nil, "", false
+			}
+			// alias out of our data
+			if q.Type != TypeCNAME {
+				forward = name
+			}
+			return answers, forward, true
+		}
+
+		var cname string
+		for _, rr := range rrs {
+			if rr.Type == q.Type {
+				answers = append(answers, rr)
+			} else if rr.Type == TypeCNAME {
+				cname = rr.RData.Name
+				answers = append(answers, rr)
+			}
+		}
+
+		if cname == "" || q.Type == TypeCNAME {
+			// no records of this type means NODATA
+			return answers, "", true
+		}
+		name = cname
+	}
+	return answers, "", true
+}
+
+// Authority is the authority section for answers Lookup gave to q: nothing when
+// they hold the data, an SOA for the last name of the chain when they are NODATA
+// (RFC 2308). Its minimum is the override TTL, resolvers cache the gap as long
+// as they would the records.
+func (o *Overrides) Authority(q DNSQuestion, answers []DNSAnswer) []DNSAnswer {
+	owner := normName(q.Name)
+	for _, rr := range answers {
+		if rr.Type == q.Type {
+			return nil
+		}
+		if rr.Type == TypeCNAME {
+			owner = normName(rr.RData.Name)
+		}
+	}
+
+	soa := SOAData{MName: owner, RName: "hostmaster." + owner, Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, Minimum: o.TTL}
+	return []DNSAnswer{{Name: owner, Type: TypeSOA, Class: ClassIN, TTL: o.TTL, RData: RData{Kind: TypeSOA, SOA: soa}}}
+}
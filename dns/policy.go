@@ -0,0 +1,239 @@
+package dns
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"nyasaki/dns-server/config"
+)
+
+// Blocklist is a set of domains, a hit on any parent domain counts as blocked
+type Blocklist struct {
+	domains map[string]struct{}
+}
+
+func NewBlocklist(domains []string) *Blocklist {
+	bl := &Blocklist{domains: make(map[string]struct{}, len(domains))}
+	for _, d := range domains {
+		bl.Add(d)
+	}
+	return bl
+}
+
+// Add accepts plain domains and the `*.domain` wildcard form
+func (bl *Blocklist) Add(domain string) {
+	domain = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+	domain = strings.TrimPrefix(domain, "*.")
+	if domain == "" {
+		return
+	}
+	bl.domains[domain] = struct{}{}
+}
+
+// LoadFile reads one domain per line, `#` comments and hosts style lines ("0.0.0.0 ads.example") are accepted
+func (bl *Blocklist) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		switch len(fields) {
+		case 0:
+			continue
+		case 1:
+			bl.Add(fields[0])
+		default:
+			for _, f := range fields[1:] {
+				bl.Add(f)
+			}
+		}
+	}
+	return sc.Err()
+}
+
+func (bl *Blocklist) Len() int { return len(bl.domains) }
+
+// Match walks the name from the full label chain up to the TLD
+func (bl *Blocklist) Match(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for name != "" {
+		if _, ok := bl.domains[name]; ok {
+			return true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+	}
+	return false
+}
+
+// Rule blocks a list, either always (nil Schedule) or while the schedule is active
+type Rule struct {
+	List     *Blocklist
+	Schedule *Schedule
+}
+
+// ClientGroup is the set of rules applied to one class of clients
+type ClientGroup struct {
+	Name       string
+	Prefixes   []netip.Prefix
+	Rules      []Rule
+	Upstream   string // empty means the default upstream
+	SafeSearch bool
+}
+
+// Decide evaluates the group's rules for name at now. until is the next schedule
+// transition that could flip the verdict (zero when it can't change), so answers
+// cached on the strength of this decision must not live past it.
+func (g *ClientGroup) Decide(name string, now time.Time) (blocked bool, until time.Time) {
+	for _, r := range g.Rules {
+		if !r.List.Match(name) {
+			continue
+		}
+
+		if r.Schedule == nil {
+			return true, time.Time{}
+		}
+
+		if r.Schedule.Active(now) {
+			blocked = true
+		}
+		if next := r.Schedule.NextTransition(now); !next.IsZero() && (until.IsZero() || next.Before(until)) {
+			until = next
+		}
+	}
+	return blocked, until
+}
+
+// Blocked reports whether any of the group's rules blocks name right now
+func (g *ClientGroup) Blocked(name string) bool {
+	blocked, _ := g.Decide(name, time.Now())
+	return blocked
+}
+
+// CacheKey keeps answers that depend on the group (own upstream, cached blocks, safe search) out of everyone else's cache
+func (g *ClientGroup) CacheKey(q DNSQuestionPacket) string {
+	key := CacheKeyFromQuestion(q)
+	if !g.ownCache() {
+		return key
+	}
+	return g.Name + "|" + key
+}
+
+// AppendCacheKey appends the same key as CacheKey, read from the message in place
+func (g *ClientGroup) AppendCacheKey(dst []byte, m *Msg) ([]byte, error) {
+	if g.ownCache() {
+		dst = append(append(dst, g.Name...), '|')
+	}
+	return m.AppendCacheKey(dst)
+}
+
+func (g *ClientGroup) ownCache() bool {
+	return g.Upstream != "" || len(g.Rules) > 0 || g.SafeSearch
+}
+
+// Policy maps client addresses to their group
+type Policy struct {
+	groups []*ClientGroup
+	def    *ClientGroup
+}
+
+func NewPolicy(cfg *config.Config) (*Policy, error) {
+	lists := make(map[string]*Blocklist, len(cfg.Blocklists))
+	for name, bc := range cfg.Blocklists {
+		bl := NewBlocklist(bc.Domains)
+		for _, path := range bc.Files {
+			if err := bl.LoadFile(path); err != nil {
+				return nil, fmt.Errorf("blocklist %s: %v", name, err)
+			}
+		}
+		lists[name] = bl
+	}
+
+	schedules := make(map[string]*Schedule, len(cfg.Schedules))
+	for name, sc := range cfg.Schedules {
+		sched, err := NewSchedule(name, sc)
+		if err != nil {
+			return nil, err
+		}
+		schedules[name] = sched
+	}
+
+	defaultGroup := &ClientGroup{Name: ""}
+	p := &Policy{def: defaultGroup}
+	for _, gc := range cfg.Groups {
+		g := &ClientGroup{Name: gc.Name, Upstream: gc.Upstream, SafeSearch: gc.SafeSearch}
+
+		for _, c := range gc.CIDRs {
+			pfx, err := netip.ParsePrefix(c)
+			if err != nil {
+				return nil, fmt.Errorf("group %s: %v", gc.Name, err)
+			}
+			g.Prefixes = append(g.Prefixes, pfx.Masked())
+		}
+		for _, name := range gc.Blocklists {
+			bl := lists[name]
+			if bl == nil {
+				return nil, fmt.Errorf("group %s: unknown blocklist %q", gc.Name, name)
+			}
+			g.Rules = append(g.Rules, Rule{List: bl})
+		}
+		for _, rc := range gc.Rules {
+			bl, sched := lists[rc.Blocklist], schedules[rc.Schedule]
+			if bl == nil {
+				return nil, fmt.Errorf("group %s: unknown blocklist %q", gc.Name, rc.Blocklist)
+			}
+			if sched == nil && rc.Schedule != "" {
+				return nil, fmt.Errorf("group %s: unknown schedule %q", gc.Name, rc.Schedule)
+			}
+			g.Rules = append(g.Rules, Rule{List: bl, Schedule: sched})
+		}
+
+		// a group without CIDRs replaces the catch-all default, there is only one
+		if len(g.Prefixes) == 0 {
+			if p.def != defaultGroup {
+				return nil, fmt.Errorf("groups %s and %s both have no cidrs, only one may be the default", p.def.Name, gc.Name)
+			}
+			p.def = g
+			continue
+		}
+		p.groups = append(p.groups, g)
+	}
+
+	return p, nil
+}
+
+// GroupFor picks the group with the longest prefix containing addr
+func (p *Policy) GroupFor(addr netip.Addr) *ClientGroup {
+	addr = addr.Unmap()
+	best, bestBits := p.def, -1
+
+	for _, g := range p.groups {
+		for _, pfx := range g.Prefixes {
+			if pfx.Bits() > bestBits && pfx.Contains(addr) {
+				best, bestBits = g, pfx.Bits()
+			}
+		}
+	}
+	return best
+}
+
+// Groups lists every group including the default one
+func (p *Policy) Groups() []*ClientGroup {
+	return append([]*ClientGroup{p.def}, p.groups...)
+}
@@ -3,6 +3,8 @@ package dns
 import (
 	"encoding/binary"
 	"fmt"
+	"sort"
+	"strings"
 )
 
 type MXData struct {
@@ -20,6 +22,62 @@ type SRVData struct {
 	Target        string
 }
 
+// TSIGData is the RDATA of a transaction signature (RFC 8945 section 4.2)
+type TSIGData struct {
+	Algorithm  string
+	TimeSigned uint64 // 48 bits, seconds since the epoch
+	Fudge      uint16
+	MAC        []byte
+	OrigID     uint16
+	Error      uint16
+	Other      []byte
+}
+
+// DSData is the digest of a child zone's key held by the parent (RFC 4034 section 5)
+type DSData struct {
+	KeyTag     uint16
+	Algorithm  uint8
+	DigestType uint8
+	Digest     []byte
+}
+
+// DNSKEYData is a zone's public key (RFC 4034 section 2)
+type DNSKEYData struct {
+	Flags     uint16
+	Protocol  uint8
+	Algorithm uint8
+	PublicKey []byte
+}
+
+// RRSIGData signs one RRset (RFC 4034 section 3), times are seconds since the epoch
+type RRSIGData struct {
+	TypeCovered uint16
+	Algorithm   uint8
+	Labels      uint8
+	OrigTTL     uint32
+	Expiration  uint32
+	Inception   uint32
+	KeyTag      uint16
+	SignerName  string
+	Signature   []byte
+}
+
+// NSECData links an owner to the next one in the zone and lists its types (RFC 4034 section 4)
+type NSECData struct {
+	NextName string
+	Types    []uint16
+}
+
+// NSEC3Data is the hashed variant of NSEC (RFC 5155 section 3)
+type NSEC3Data struct {
+	HashAlg    uint8
+	Flags      uint8
+	Iterations uint16
+	Salt       []byte
+	NextHashed []byte
+	Types      []uint16
+}
+
 type RData struct {
 	Kind   uint16 // same as Type
 	A      [4]byte
@@ -29,11 +87,17 @@ type RData struct {
 	SRV    SRVData
 	SOA    SOAData
 	TXT    [][]byte
+	DS     DSData
+	DNSKEY DNSKEYData
+	RRSIG  RRSIGData
+	NSEC   NSECData
+	NSEC3  NSEC3Data
+	TSIG   TSIGData
 	Opaque []byte // fallback
 }
 
 func ParseRdata(pkt []byte, start int, rdlen uint16, atype uint16) (RData, error) {
-	rdat := RData{}
+	rdat := RData{Kind: atype}
 	end := start + int(rdlen)
 	if end > len(pkt) {
 		return rdat, fmt.Errorf("short RDATA")
@@ -47,7 +111,7 @@ func ParseRdata(pkt []byte, start int, rdlen uint16, atype uint16) (RData, error
 		}
 
 		var a [4]byte
-		copy(a[:], data[:start+4])
+		copy(a[:], data)
 		rdat.A = a
 
 	case 2: //NS
@@ -201,17 +265,139 @@ func ParseRdata(pkt []byte, start int, rdlen uint16, atype uint16) (RData, error
 		srv := SRVData{Pri: priority, Wt: weight, Port: port, Target: target}
 		rdat.SRV = srv
 
-	case 64, 65, 257: //SVCB, HTTPS, CAA
-		return rdat, fmt.Errorf("type SVCB, HTTPS, CAA not supported yet")
+	case 43, 59: //DS, CDS
+		if len(data) < 4 {
+			return rdat, fmt.Errorf("'DS' short RDATA")
+		}
+		rdat.DS = DSData{
+			KeyTag:     binary.BigEndian.Uint16(data),
+			Algorithm:  data[2],
+			DigestType: data[3],
+			Digest:     append([]byte(nil), data[4:]...),
+		}
+
+	case 46: //RRSIG, the signer name is never compressed
+		if len(data) < 18 {
+			return rdat, fmt.Errorf("'RRSIG' short RDATA")
+		}
+		signer, roff, err := ParseName(pkt, start+18)
+		if err != nil {
+			return rdat, err
+		}
+		if roff > end {
+			return rdat, fmt.Errorf("%d name overruns RDATA", atype)
+		}
+		rdat.RRSIG = RRSIGData{
+			TypeCovered: binary.BigEndian.Uint16(data),
+			Algorithm:   data[2],
+			Labels:      data[3],
+			OrigTTL:     binary.BigEndian.Uint32(data[4:]),
+			Expiration:  binary.BigEndian.Uint32(data[8:]),
+			Inception:   binary.BigEndian.Uint32(data[12:]),
+			KeyTag:      binary.BigEndian.Uint16(data[16:]),
+			SignerName:  signer,
+			Signature:   append([]byte(nil), pkt[roff:end]...),
+		}
+
+	case 47: //NSEC
+		next, roff, err := ParseName(pkt, start)
+		if err != nil {
+			return rdat, err
+		}
+		if roff > end {
+			return rdat, fmt.Errorf("%d name overruns RDATA", atype)
+		}
+		types, err := parseTypeBitmap(pkt[roff:end])
+		if err != nil {
+			return rdat, err
+		}
+		rdat.NSEC = NSECData{NextName: next, Types: types}
+
+	case 48, 60: //DNSKEY, CDNSKEY
+		if len(data) < 4 {
+			return rdat, fmt.Errorf("'DNSKEY' short RDATA")
+		}
+		rdat.DNSKEY = DNSKEYData{
+			Flags:     binary.BigEndian.Uint16(data),
+			Protocol:  data[2],
+			Algorithm: data[3],
+			PublicKey: append([]byte(nil), data[4:]...),
+		}
+
+	case 50: //NSEC3
+		if len(data) < 5 {
+			return rdat, fmt.Errorf("'NSEC3' short RDATA")
+		}
+		n := NSEC3Data{HashAlg: data[0], Flags: data[1], Iterations: binary.BigEndian.Uint16(data[2:])}
+		i := 4
+		saltLen := int(data[i])
+		i++
+		if i+saltLen >= len(data) {
+			return rdat, fmt.Errorf("'NSEC3' salt overruns RDATA")
+		}
+		n.Salt = append([]byte(nil), data[i:i+saltLen]...)
+		i += saltLen
+		hashLen := int(data[i])
+		i++
+		if hashLen == 0 || i+hashLen > len(data) {
+			return rdat, fmt.Errorf("'NSEC3' hash overruns RDATA")
+		}
+		n.NextHashed = append([]byte(nil), data[i:i+hashLen]...)
+		i += hashLen
+		types, err := parseTypeBitmap(data[i:])
+		if err != nil {
+			return rdat, err
+		}
+		n.Types = types
+		rdat.NSEC3 = n
+
+	case 250: //TSIG
+		alg, roff, err := ParseName(pkt, start)
+		if err != nil {
+			return rdat, err
+		}
+		if roff+16 > end {
+			return rdat, fmt.Errorf("'TSIG' short RDATA")
+		}
 
-	default:
+		t := TSIGData{Algorithm: alg}
+		t.TimeSigned = uint64(binary.BigEndian.Uint16(pkt[roff:]))<<32 | uint64(binary.BigEndian.Uint32(pkt[roff+2:]))
+		t.Fudge = binary.BigEndian.Uint16(pkt[roff+6:])
+		macLen := int(binary.BigEndian.Uint16(pkt[roff+8:]))
+		roff += 10
+
+		if roff+macLen+6 > end {
+			return rdat, fmt.Errorf("'TSIG' MAC overruns RDATA")
+		}
+		t.MAC = append([]byte(nil), pkt[roff:roff+macLen]...)
+		roff += macLen
+
+		t.OrigID = binary.BigEndian.Uint16(pkt[roff:])
+		t.Error = binary.BigEndian.Uint16(pkt[roff+2:])
+		otherLen := int(binary.BigEndian.Uint16(pkt[roff+4:]))
+		roff += 6
+
+		if roff+otherLen != end {
+			return rdat, fmt.Errorf("'TSIG' other data does not match RDATA")
+		}
+		t.Other = append([]byte(nil), pkt[roff:end]...)
+
+		rdat.TSIG = t
+
+	default: // SVCB, HTTPS, CAA and whatever else we don't look into (RFC 3597)
 		rdat.Opaque = append([]byte(nil), data...)
 	}
 
 	return rdat, nil
 }
 
+// BuildRdata appends the RDATA of every type ParseRdata reads. Only the names
+// of the RFC 1035 types are compressed (RFC 3597 section 4), values that
+// don't fit their wire fields are an error rather than cut short.
 func BuildRdata(ans []byte, dat RData, type_code uint16, names map[string]int) ([]byte, error) {
+	if err := checkRdata(dat, type_code); err != nil {
+		return ans, err
+	}
 
 	switch type_code {
 	case 1: //A
@@ -227,13 +413,17 @@ func BuildRdata(ans []byte, dat RData, type_code uint16, names map[string]int) (
 	case 6: //SOA
 		ans, _ = BuildNameCompressed(ans, dat.SOA.MName, names)
 		ans, _ = BuildNameCompressed(ans, dat.SOA.RName, names)
-		ans = append(ans, byte(dat.SOA.Serial))
+		ans = binary.BigEndian.AppendUint32(ans, dat.SOA.Serial)
+		ans = binary.BigEndian.AppendUint32(ans, dat.SOA.Refresh)
+		ans = binary.BigEndian.AppendUint32(ans, dat.SOA.Retry)
+		ans = binary.BigEndian.AppendUint32(ans, dat.SOA.Expire)
+		ans = binary.BigEndian.AppendUint32(ans, dat.SOA.Minimum)
 
 	case 12: //PTR
 		ans, _ = BuildNameCompressed(ans, dat.Name, names)
 
 	case 15: //MX
-		ans = append(ans, byte(dat.MX.Pref))
+		ans = binary.BigEndian.AppendUint16(ans, dat.MX.Pref)
 		ans, _ = BuildNameCompressed(ans, dat.MX.Host, names)
 
 	case 16: //TXT
@@ -247,18 +437,176 @@ func BuildRdata(ans []byte, dat RData, type_code uint16, names map[string]int) (
 		a6 := dat.AAAA
 		ans = append(ans, a6[:]...)
 
-	case 33: // SRV
-		ans = append(ans, byte(dat.SRV.Pri))
-		ans = append(ans, byte(dat.SRV.Wt))
-		ans = append(ans, byte(dat.SRV.Port))
-		ans, _ = BuildNameCompressed(ans, dat.SRV.Target, names)
-
-	case 64, 65, 257: //SVCB, HTTPS, CAA
-		return ans, fmt.Errorf("type SVCB, HTTPS, CAA not supported yet")
-
-	default: //Opaque?
+	case 33: // SRV, the target is never compressed (RFC 2782)
+		ans = binary.BigEndian.AppendUint16(ans, dat.SRV.Pri)
+		ans = binary.BigEndian.AppendUint16(ans, dat.SRV.Wt)
+		ans = binary.BigEndian.AppendUint16(ans, dat.SRV.Port)
+		ans = BuildName(ans, dat.SRV.Target)
+
+	case 43, 59: //DS, CDS
+		ans = binary.BigEndian.AppendUint16(ans, dat.DS.KeyTag)
+		ans = append(ans, dat.DS.Algorithm, dat.DS.DigestType)
+		ans = append(ans, dat.DS.Digest...)
+
+	case 46: //RRSIG
+		ans = appendRRSIGHeader(ans, dat.RRSIG)
+		ans = append(ans, dat.RRSIG.Signature...)
+
+	case 47: //NSEC, the next name is never compressed
+		ans = BuildName(ans, dat.NSEC.NextName)
+		ans = appendTypeBitmap(ans, dat.NSEC.Types)
+
+	case 48, 60: //DNSKEY, CDNSKEY
+		ans = binary.BigEndian.AppendUint16(ans, dat.DNSKEY.Flags)
+		ans = append(ans, dat.DNSKEY.Protocol, dat.DNSKEY.Algorithm)
+		ans = append(ans, dat.DNSKEY.PublicKey...)
+
+	case 50: //NSEC3
+		n := dat.NSEC3
+		ans = append(ans, n.HashAlg, n.Flags)
+		ans = binary.BigEndian.AppendUint16(ans, n.Iterations)
+		ans = append(ans, byte(len(n.Salt)))
+		ans = append(ans, n.Salt...)
+		ans = append(ans, byte(len(n.NextHashed)))
+		ans = append(ans, n.NextHashed...)
+		ans = appendTypeBitmap(ans, n.Types)
+
+	case 250: //TSIG, the algorithm name is never compressed
+		t := dat.TSIG
+		ans = BuildName(ans, t.Algorithm)
+		ans = binary.BigEndian.AppendUint16(ans, uint16(t.TimeSigned>>32))
+		ans = binary.BigEndian.AppendUint32(ans, uint32(t.TimeSigned))
+		ans = binary.BigEndian.AppendUint16(ans, t.Fudge)
+		ans = binary.BigEndian.AppendUint16(ans, uint16(len(t.MAC)))
+		ans = append(ans, t.MAC...)
+		ans = binary.BigEndian.AppendUint16(ans, t.OrigID)
+		ans = binary.BigEndian.AppendUint16(ans, t.Error)
+		ans = binary.BigEndian.AppendUint16(ans, uint16(len(t.Other)))
+		ans = append(ans, t.Other...)
+
+	default: // written back as it was read
 		ans = append(ans, dat.Opaque...)
 	}
 
 	return ans, nil
 }
+
+// checkRdata rejects what BuildRdata can't encode faithfully
+func checkRdata(dat RData, type_code uint16) error {
+	var names []string
+	switch type_code {
+	case 2, 5, 12: //NS, CNAME, PTR
+		names = []string{dat.Name}
+	case 6: //SOA
+		names = []string{dat.SOA.MName, dat.SOA.RName}
+	case 15: //MX
+		names = []string{dat.MX.Host}
+	case 16: //TXT
+		for _, s := range dat.TXT {
+			if len(s) > 255 {
+				return fmt.Errorf("TXT character-string of %d bytes, at most 255", len(s))
+			}
+		}
+	case 33: //SRV
+		names = []string{dat.SRV.Target}
+	case 46: //RRSIG
+		names = []string{dat.RRSIG.SignerName}
+	case 47: //NSEC
+		names = []string{dat.NSEC.NextName}
+	case 50: //NSEC3
+		if len(dat.NSEC3.Salt) > 255 || len(dat.NSEC3.NextHashed) == 0 || len(dat.NSEC3.NextHashed) > 255 {
+			return fmt.Errorf("'NSEC3' salt or hash does not fit its length byte")
+		}
+	case 250: //TSIG
+		names = []string{dat.TSIG.Algorithm}
+	}
+	for _, name := range names {
+		if err := checkName(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkName rejects names that have no wire form: empty labels, labels over
+// 63 octets or more than 255 octets in all
+func checkName(name string) error {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return nil
+	}
+	if len(name)+2 > 255 {
+		return fmt.Errorf("name %q is longer than 255 octets", name)
+	}
+	for _, lab := range strings.Split(name, ".") {
+		if len(lab) == 0 || len(lab) > 63 {
+			return fmt.Errorf("name %q has a label of %d octets", name, len(lab))
+		}
+	}
+	return nil
+}
+
+// appendRRSIGHeader writes the RRSIG RDATA up to the signature, which is also
+// the start of the data a signature covers (RFC 4034 section 3.1.8.1)
+func appendRRSIGHeader(ans []byte, sig RRSIGData) []byte {
+	ans = binary.BigEndian.AppendUint16(ans, sig.TypeCovered)
+	ans = append(ans, sig.Algorithm, sig.Labels)
+	ans = binary.BigEndian.AppendUint32(ans, sig.OrigTTL)
+	ans = binary.BigEndian.AppendUint32(ans, sig.Expiration)
+	ans = binary.BigEndian.AppendUint32(ans, sig.Inception)
+	ans = binary.BigEndian.AppendUint16(ans, sig.KeyTag)
+	return BuildName(ans, sig.SignerName)
+}
+
+// parseTypeBitmap reads the window blocks of an NSEC/NSEC3 type bitmap (RFC 4034 section 4.1.2)
+func parseTypeBitmap(data []byte) ([]uint16, error) {
+	var types []uint16
+	for i := 0; i < len(data); {
+		if i+2 > len(data) {
+			return nil, fmt.Errorf("type bitmap truncated")
+		}
+		window, length := int(data[i]), int(data[i+1])
+		i += 2
+		if length == 0 || length > 32 || i+length > len(data) {
+			return nil, fmt.Errorf("type bitmap window %d has bad length %d", window, length)
+		}
+		for j, b := range data[i : i+length] {
+			for bit := 0; bit < 8; bit++ {
+				if b&(0x80>>bit) != 0 {
+					types = append(types, uint16(window<<8|j*8+bit))
+				}
+			}
+		}
+		i += length
+	}
+	return types, nil
+}
+
+func appendTypeBitmap(ans []byte, types []uint16) []byte {
+	sorted := append([]uint16(nil), types...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	for i := 0; i < len(sorted); {
+		window := sorted[i] >> 8
+		var bits [32]byte
+		length := 0
+		for ; i < len(sorted) && sorted[i]>>8 == window; i++ {
+			low := sorted[i] & 0xFF
+			bits[low/8] |= 0x80 >> (low % 8)
+			length = int(low/8) + 1
+		}
+		ans = append(ans, byte(window), byte(length))
+		ans = append(ans, bits[:length]...)
+	}
+	return ans
+}
+
+// HasType reports whether an NSEC/NSEC3 type list contains t
+func HasType(types []uint16, t uint16) bool {
+	for _, have := range types {
+		if have == t {
+			return true
+		}
+	}
+	return false
+}
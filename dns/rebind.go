@@ -0,0 +1,83 @@
+package dns
+
+import (
+	"net/netip"
+
+	"nyasaki/dns-server/config"
+)
+
+// RebindGuard drops upstream answers pointing public names at internal addresses
+type RebindGuard struct {
+	Refuse bool
+	allow  []string
+}
+
+// NewRebindGuard returns nil when protection is disabled so callers can skip it cheaply
+func NewRebindGuard(cfg config.RebindConfig) *RebindGuard {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &RebindGuard{Refuse: cfg.Mode == "refuse", allow: cfg.AllowDomains}
+}
+
+// IsPrivateAddr covers RFC1918/ULA, loopback, link-local and the unspecified address
+func IsPrivateAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()
+}
+
+// Allowed reports whether name is an internal domain that may resolve privately
+func (g *RebindGuard) Allowed(name string) bool {
+	for _, d := range g.allow {
+		if IsSubdomain(name, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter removes private A/AAAA records from the answer and additional sections and returns how many were dropped.
+// In refuse mode any hit empties the answer and turns the response into REFUSED.
+func (g *RebindGuard) Filter(a *DNSAnswerPacket) int {
+	answers, stripped := stripPrivate(a.Answers)
+	additional, n := stripPrivate(a.Additional)
+	stripped += n
+
+	if stripped == 0 {
+		return 0
+	}
+
+	if g.Refuse {
+		a.Header.RCode = RCodeRefused
+		answers = nil
+	}
+
+	a.Answers, a.Additional = answers, additional
+	return stripped
+}
+
+// stripPrivate returns rrs without the A/AAAA records for private addresses
+func stripPrivate(rrs []DNSAnswer) ([]DNSAnswer, int) {
+	kept := rrs[:0:0]
+	stripped := 0
+
+	for _, rr := range rrs {
+		var ip netip.Addr
+		switch rr.Type {
+		case TypeA:
+			ip = netip.AddrFrom4(rr.RData.A)
+		case TypeAAAA:
+			ip = netip.AddrFrom16(rr.RData.AAAA)
+		default:
+			kept = append(kept, rr)
+			continue
+		}
+
+		if IsPrivateAddr(ip) {
+			stripped++
+			continue
+		}
+		kept = append(kept, rr)
+	}
+	return kept, stripped
+}
@@ -0,0 +1,442 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"nyasaki/dns-server/config"
+
+	"github.com/rs/zerolog/log"
+)
+
+// rootHints are the IPv4 addresses of a.root-servers.net through m.root-servers.net
+var rootHints = []string{
+	"198.41.0.4", "170.247.170.2", "192.33.4.12", "199.7.91.13", "192.203.230.10",
+	"192.5.5.241", "192.112.36.4", "198.97.190.53", "192.36.148.17", "192.58.128.30",
+	"193.0.14.129", "199.7.83.42", "202.12.27.33",
+}
+
+const (
+	maxCNAMEHops = 8
+	// nested lookups of nameserver addresses that had no glue
+	maxResolveDepth = 4
+)
+
+var errQueryLimit = errors.New("query limit reached")
+
+// delegation is a cached zone cut: where to ask about names below zone
+type delegation struct {
+	servers []netip.Addr
+	expires time.Time
+}
+
+// Resolver answers questions iteratively, starting at the root and following
+// referrals (RFC 1034 section 5.3.3). Delegations it learns are cached until
+// their NS TTL runs out.
+type Resolver struct {
+	roots      []netip.Addr
+	port       uint16
+	maxQueries int
+	timeout    time.Duration
+	// ask for and keep DNSSEC records, for the validator
+	dnssec bool
+
+	mu          sync.Mutex
+	delegations map[string]delegation
+}
+
+func NewResolver(cfg config.ResolverConfig) (*Resolver, error) {
+	timeout, err := time.ParseDuration(cfg.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("resolver: %v", err)
+	}
+
+	hints := cfg.RootHints
+	if len(hints) == 0 {
+		hints = rootHints
+	}
+
+	r := &Resolver{
+		port:        uint16(cfg.Port),
+		maxQueries:  cfg.MaxQueries,
+		timeout:     timeout,
+		delegations: make(map[string]delegation),
+	}
+	for _, h := range hints {
+		ip, err := netip.ParseAddr(h)
+		if err != nil {
+			return nil, fmt.Errorf("resolver: root hint: %v", err)
+		}
+		r.roots = append(r.roots, ip)
+	}
+	return r, nil
+}
+
+// Result is what a resolution ended with
+type Result struct {
+	RCode     uint8
+	Answers   []DNSAnswer // CNAME chain first, then the data
+	Authority []DNSAnswer // SOA of negative answers, NSEC/NSEC3 proofs when validating
+}
+
+// Resolve looks q up from the closest cached delegation downwards
+func (r *Resolver) Resolve(q DNSQuestion) (Result, error) {
+	budget := r.maxQueries
+	return r.resolve(normName(q.Name), q.Type, &budget, 0)
+}
+
+func (r *Resolver) resolve(name string, qtype uint16, budget *int, depth int) (Result, error) {
+	var res Result
+
+	for hops := 0; hops <= maxCNAMEHops; hops++ {
+		zone, servers := r.closestDelegation(name)
+		// the DS records of a zone live on the parent side of the cut
+		if qtype == TypeDS && zone == name && name != "" {
+			_, parent, _ := strings.Cut(name, ".")
+			zone, servers = r.closestDelegation(parent)
+		}
+
+		for {
+			resp, err := r.ask(servers, zone, name, qtype, budget)
+			if err != nil {
+				return res, fmt.Errorf("%s %s: %v", name, TypeName(qtype), err)
+			}
+
+			// a referral takes us one zone further down
+			if cut, ns := referral(resp, zone, name); cut != "" && !(qtype == TypeDS && cut == name) {
+				next, err := r.follow(cut, ns, resp, zone, budget, depth)
+				if err != nil {
+					return res, fmt.Errorf("%s %s: %v", name, TypeName(qtype), err)
+				}
+				zone, servers = cut, next
+				continue
+			}
+
+			// only trust records the server is authoritative for
+			data, target, done := chase(resp.Answers, zone, name, qtype)
+			res.Answers = append(res.Answers, data...)
+
+			if done || resp.Header.RCode == RCodeNXDomain || target == "" {
+				res.RCode = resp.Header.RCode
+				res.Authority = append(res.Authority, proofOnly(resp.Authority, !done)...)
+				return res, nil
+			}
+			// wildcard expansions along the chain come with their proofs
+			res.Authority = append(res.Authority, proofOnly(resp.Authority, false)...)
+
+			// the chain leaves what this server knows about, start over for the target
+			name = target
+			break
+		}
+	}
+	return res, fmt.Errorf("CNAME chain longer than %d", maxCNAMEHops)
+}
+
+// closestDelegation returns the deepest cached zone cut above name, the root
+// hints when we know nothing closer
+func (r *Resolver) closestDelegation(name string) (string, []netip.Addr) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for {
+		if d, ok := r.delegations[name]; ok {
+			if now.Before(d.expires) {
+				return name, d.servers
+			}
+			delete(r.delegations, name)
+		}
+		if name == "" {
+			return "", r.roots
+		}
+		_, name, _ = strings.Cut(name, ".")
+	}
+}
+
+// ask sends the question to each server in turn until one gives a usable answer,
+// lame or unreachable servers are skipped
+func (r *Resolver) ask(servers []netip.Addr, zone, name string, qtype uint16, budget *int) (DNSAnswerPacket, error) {
+	err := fmt.Errorf("no nameservers for %q", zone)
+	for _, ip := range servers {
+		if *budget <= 0 {
+			return DNSAnswerPacket{}, errQueryLimit
+		}
+		*budget--
+
+		resp, xerr := r.exchange(ip, name, qtype)
+		if xerr != nil {
+			err = xerr
+			continue
+		}
+		if lame(resp, zone, name) {
+			err = fmt.Errorf("lame delegation: %s for %q", ip, zone)
+			continue
+		}
+		return resp, nil
+	}
+	return DNSAnswerPacket{}, err
+}
+
+// exchange sends one non-recursive query over UDP, retrying over TCP when truncated
+func (r *Resolver) exchange(ip netip.Addr, name string, qtype uint16) (DNSAnswerPacket, error) {
+	addr := netip.AddrPortFrom(ip, r.port).String()
+
+	query := BuildQuery(DNSQuestion{Name: name, Type: qtype, Class: ClassIN})
+	binary.BigEndian.PutUint16(query[0:2], uint16(rand.Uint32()))
+	query[2] &^= 0x01 // clear RD, we do the recursion
+	if r.dnssec {
+		query = WithDO(query)
+	}
+
+	reply, err := exchangeUDP(addr, query, r.timeout)
+	if err != nil {
+		return DNSAnswerPacket{}, err
+	}
+	resp, err := ParseAnswerPacket(reply, len(reply))
+	if err != nil {
+		return DNSAnswerPacket{}, err
+	}
+	if len(resp.Questions) != 1 || normName(resp.Questions[0].Name) != name || resp.Questions[0].Type != qtype {
+		return DNSAnswerPacket{}, fmt.Errorf("%s answered a different question", addr)
+	}
+	return resp, nil
+}
+
+// exchangeUDP sends query to addr and returns the reply with the same ID,
+// asking again over TCP when it comes back truncated
+func exchangeUDP(addr string, query []byte, timeout time.Duration) ([]byte, error) {
+	c, err := net.DialTimeout("udp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(timeout))
+
+	if _, err := c.Write(query); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// ignore anything that doesn't answer our question
+		if n < DNSHeaderSize || binary.BigEndian.Uint16(buf[:2]) != binary.BigEndian.Uint16(query[:2]) {
+			continue
+		}
+
+		reply := buf[:n]
+		if hdr, _ := ParseHeader(reply); hdr.TC {
+			return exchangeTCP(addr, query, timeout)
+		}
+		return reply, nil
+	}
+}
+
+// lame reports responses that don't move the resolution forward: errors, and
+// non-authoritative answers that neither carry data nor delegate further down
+func lame(resp DNSAnswerPacket, zone, name string) bool {
+	switch resp.Header.RCode {
+	case RCodeSuccess, RCodeNXDomain:
+	default:
+		return true
+	}
+	if resp.Header.AA || len(resp.Answers) > 0 {
+		return false
+	}
+	cut, _ := referral(resp, zone, name)
+	return cut == ""
+}
+
+// referral returns the zone cut and NS names when resp delegates to a zone
+// strictly below the one asked and above (or at) name
+func referral(resp DNSAnswerPacket, zone, name string) (string, []string) {
+	if len(resp.Answers) > 0 || resp.Header.RCode != RCodeSuccess {
+		return "", nil
+	}
+
+	var cut string
+	var ns []string
+	for _, rr := range resp.Authority {
+		if rr.Type != TypeNS {
+			continue
+		}
+		owner := normName(rr.Name)
+		if owner == zone || !IsSubdomain(owner, zone) || !IsSubdomain(name, owner) {
+			continue
+		}
+		if cut != "" && owner != cut {
+			continue
+		}
+		cut = owner
+		ns = append(ns, normName(rr.RData.Name))
+	}
+	return cut, ns
+}
+
+// follow turns a referral into server addresses, using in-bailiwick glue where
+// there is some and resolving the NS names where there is none, then caches it
+func (r *Resolver) follow(cut string, ns []string, resp DNSAnswerPacket, parent string, budget *int, depth int) ([]netip.Addr, error) {
+	var servers []netip.Addr
+	for _, host := range ns {
+		for _, rr := range resp.Additional {
+			// glue outside the parent zone could be a poisoning attempt
+			if normName(rr.Name) != host || rr.Type != TypeA || !IsSubdomain(host, parent) {
+				continue
+			}
+			servers = append(servers, netip.AddrFrom4(rr.RData.A))
+		}
+	}
+
+	if len(servers) == 0 && depth < maxResolveDepth {
+		for _, host := range ns {
+			// without glue a nameserver inside the cut can't be reached
+			if IsSubdomain(host, cut) {
+				continue
+			}
+			res, err := r.resolve(host, TypeA, budget, depth+1)
+			if errors.Is(err, errQueryLimit) {
+				return nil, err
+			}
+			for _, rr := range res.Answers {
+				if rr.Type == TypeA {
+					servers = append(servers, netip.AddrFrom4(rr.RData.A))
+				}
+			}
+			if len(servers) > 0 {
+				break
+			}
+		}
+	}
+
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no usable nameserver address for %q", cut)
+	}
+
+	ttl := referralTTL(resp, cut)
+	r.mu.Lock()
+	r.delegations[cut] = delegation{servers: servers, expires: time.Now().Add(ttl)}
+	r.mu.Unlock()
+	return servers, nil
+}
+
+// referralTTL is how long a delegation is kept: the NS TTL, a day at most
+func referralTTL(resp DNSAnswerPacket, cut string) time.Duration {
+	ttl := 24 * time.Hour
+	for _, rr := range resp.Authority {
+		if rr.Type == TypeNS && normName(rr.Name) == cut {
+			ttl = min(ttl, time.Duration(rr.TTL)*time.Second)
+		}
+	}
+	return ttl
+}
+
+// chase walks the answer section from name: data of qtype ends it, CNAMEs are
+// followed while their targets are in the answer too. target is where the
+// chain left off when the data is missing. Signatures come along with what they cover.
+func chase(answers []DNSAnswer, zone, name string, qtype uint16) (data []DNSAnswer, target string, done bool) {
+	cur := name
+	for hops := 0; hops <= maxCNAMEHops; hops++ {
+		var found, cname, sigs []DNSAnswer
+		for _, rr := range answers {
+			if normName(rr.Name) != cur || !IsSubdomain(cur, zone) {
+				continue
+			}
+			switch {
+			case rr.Type == qtype || qtype == TypeANY:
+				found = append(found, rr)
+			case rr.Type == TypeCNAME:
+				cname = append(cname, rr)
+			case rr.Type == TypeRRSIG:
+				sigs = append(sigs, rr)
+			}
+		}
+
+		if len(found) > 0 {
+			return append(append(data, found...), covering(sigs, qtype)...), "", true
+		}
+		if len(cname) == 0 {
+			if cur == name {
+				return data, "", false
+			}
+			return data, cur, false
+		}
+		data = append(append(data, cname[0]), covering(sigs, TypeCNAME)...)
+		cur = normName(cname[0].RData.Name)
+	}
+	return data, "", false
+}
+
+// covering picks the signatures over type t, all of them for ANY
+func covering(sigs []DNSAnswer, t uint16) []DNSAnswer {
+	var out []DNSAnswer
+	for _, rr := range sigs {
+		if t == TypeANY || rr.RData.RRSIG.TypeCovered == t {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+// proofOnly keeps the NSEC/NSEC3 records of an authority section with their
+// signatures, and the SOA as well for negative answers
+func proofOnly(rrs []DNSAnswer, negative bool) []DNSAnswer {
+	keep := func(t uint16) bool {
+		return t == TypeNSEC || t == TypeNSEC3 || negative && t == TypeSOA
+	}
+	var out []DNSAnswer
+	for _, rr := range rrs {
+		if keep(rr.Type) || rr.Type == TypeRRSIG && keep(rr.RData.RRSIG.TypeCovered) {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+// Fetch resolves q for the validator and returns the result as a response
+func (r *Resolver) Fetch(q DNSQuestion) (DNSAnswerPacket, error) {
+	res, err := r.Resolve(q)
+	if err != nil {
+		return DNSAnswerPacket{}, err
+	}
+	resp := NewResponse(DNSQuestionPacket{Question: q}, res.RCode, res.Answers)
+	resp.Authority = res.Authority
+	return resp, nil
+}
+
+// ResolveIterative answers q by resolving fwd's question from the root and runs
+// the result through the same post-processing as upstream replies
+func (s *Server) ResolveIterative(q DNSQuestionPacket, fwd *Forward) []byte {
+	question, _, err := ParseQuestion(fwd.Query, DNSHeaderSize)
+	if err != nil {
+		resp, _ := BuildResponse(q, RCodeFormErr, nil)
+		return resp
+	}
+
+	res, err := s.resolver.Resolve(question)
+	if err != nil {
+		s.stats.UpstreamErr.Add(1)
+		log.Warn().Str("name", question.Name).Msg("iterative resolution failed: " + err.Error())
+		resp, _ := BuildResponse(q, RCodeServFail, nil)
+		return resp
+	}
+	s.stats.UpstreamOK.Add(1)
+
+	ans := NewResponse(DNSQuestionPacket{Header: q.Header, Question: question}, res.RCode, res.Answers)
+	ans.Authority = res.Authority
+	raw, err := BuildAnswerPacket(ans)
+	if err != nil {
+		resp, _ := BuildResponse(q, RCodeServFail, nil)
+		return resp
+	}
+	return s.FinishUpstream(raw, fwd)
+}
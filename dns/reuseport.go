@@ -0,0 +1,26 @@
+//go:build linux
+
+package dns
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// reusePortSupported tells whether several sockets can share one UDP port
+const reusePortSupported = true
+
+// reusePort lets every worker bind its own socket to the same address, the
+// kernel spreads the incoming queries over them. Only Linux balances like
+// that, the BSDs and macOS hand everything to one socket.
+func reusePort(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package dns
+
+import "syscall"
+
+// reusePortSupported tells whether several sockets can share one UDP port
+const reusePortSupported = false
+
+func reusePort(network, address string, c syscall.RawConn) error { return nil }
@@ -0,0 +1,70 @@
+package dns
+
+import "strings"
+
+// SafeSearchTTL is the TTL of the synthesized CNAME
+const SafeSearchTTL = 300
+
+// Hostnames the engines publish for enforced safe search / restricted mode
+var safeSearchHosts = map[string]string{
+	"www.bing.com": "strict.bing.com",
+	"bing.com":     "strict.bing.com",
+
+	"duckduckgo.com":       "safe.duckduckgo.com",
+	"www.duckduckgo.com":   "safe.duckduckgo.com",
+	"start.duckduckgo.com": "safe.duckduckgo.com",
+
+	"www.youtube.com":          "restrict.youtube.com",
+	"m.youtube.com":            "restrict.youtube.com",
+	"youtubei.googleapis.com":  "restrict.youtube.com",
+	"youtube.googleapis.com":   "restrict.youtube.com",
+	"www.youtube-nocookie.com": "restrict.youtube.com",
+}
+
+const googleSafeSearch = "forcesafesearch.google.com"
+
+// SafeSearchTarget returns the safe endpoint name should be aliased to, if any
+func SafeSearchTarget(name string) (string, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if t, ok := safeSearchHosts[name]; ok {
+		return t, true
+	}
+
+	// google.<cctld> and www.google.<cctld>, e.g. www.google.co.uk
+	rest, ok := strings.CutPrefix(strings.TrimPrefix(name, "www."), "google.")
+	if !ok || rest == "" || strings.Count(rest, ".") > 1 {
+		return "", false
+	}
+	for _, l := range strings.Split(rest, ".") {
+		if len(l) < 2 || len(l) > 3 {
+			return "", false
+		}
+	}
+	return googleSafeSearch, true
+}
+
+// SafeSearchCNAME is the synthesized alias record for q
+func SafeSearchCNAME(q DNSQuestion, target string) DNSAnswer {
+	return DNSAnswer{
+		Name:  q.Name,
+		Type:  TypeCNAME,
+		Class: q.Class,
+		TTL:   SafeSearchTTL,
+		RData: RData{Kind: TypeCNAME, Name: target},
+	}
+}
+
+// WithAlias turns an answer for an alias target back into one for the name the
+// client asked: the question is restored and chain (the CNAMEs leading from alias
+// to the target) is put in front
+func WithAlias(a DNSAnswerPacket, alias string, chain []DNSAnswer) DNSAnswerPacket {
+	if len(a.Questions) == 0 {
+		return a
+	}
+
+	a.Questions = []DNSQuestion{{Name: alias, Type: a.Questions[0].Type, Class: a.Questions[0].Class}}
+	a.Answers = append(append([]DNSAnswer(nil), chain...), a.Answers...)
+	a.Header.QDCount = 1
+
+	return a
+}
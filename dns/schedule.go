@@ -0,0 +1,126 @@
+package dns
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"nyasaki/dns-server/config"
+)
+
+// Window is a weekly time range, minutes since midnight in the schedule's zone
+type Window struct {
+	Days       [7]bool // indexed by time.Weekday
+	Start, End int
+}
+
+// Schedule is a set of windows evaluated in one timezone
+type Schedule struct {
+	Name    string
+	Loc     *time.Location
+	Windows []Window
+}
+
+func parseClock(s string) (int, error) {
+	var h, m int
+	if _, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil {
+		return 0, fmt.Errorf("bad time %q", s)
+	}
+	if h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("time out of range %q", s)
+	}
+	return h*60 + m, nil
+}
+
+func NewSchedule(name string, cfg config.ScheduleConfig) (*Schedule, error) {
+	loc := time.Local
+	if cfg.Timezone != "" {
+		l, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %s: %v", name, err)
+		}
+		loc = l
+	}
+
+	s := &Schedule{Name: name, Loc: loc}
+	for _, wc := range cfg.Windows {
+		var w Window
+		var err error
+
+		if w.Start, err = parseClock(wc.Start); err != nil {
+			return nil, fmt.Errorf("schedule %s: %v", name, err)
+		}
+		if w.End, err = parseClock(wc.End); err != nil {
+			return nil, fmt.Errorf("schedule %s: %v", name, err)
+		}
+		if w.Start == w.End {
+			return nil, fmt.Errorf("schedule %s: empty window %s-%s", name, wc.Start, wc.End)
+		}
+
+		if len(wc.Days) == 0 {
+			w.Days = [7]bool{true, true, true, true, true, true, true}
+		}
+		for _, d := range wc.Days {
+			wd, ok := config.ParseWeekday(d)
+			if !ok {
+				return nil, fmt.Errorf("schedule %s: unknown day %q", name, d)
+			}
+			w.Days[wd] = true
+		}
+
+		s.Windows = append(s.Windows, w)
+	}
+
+	return s, nil
+}
+
+// Active reports whether t falls inside any window
+func (s *Schedule) Active(t time.Time) bool {
+	t = t.In(s.Loc)
+	m := t.Hour()*60 + t.Minute()
+	wd := t.Weekday()
+	prev := (wd + 6) % 7
+
+	for _, w := range s.Windows {
+		if w.Start < w.End {
+			if w.Days[wd] && m >= w.Start && m < w.End {
+				return true
+			}
+			continue
+		}
+
+		// runs past midnight: the tail belongs to the previous day's window
+		if (w.Days[wd] && m >= w.Start) || (w.Days[prev] && m < w.End) {
+			return true
+		}
+	}
+	return false
+}
+
+// NextTransition returns the first instant after t where Active changes, zero if it never does
+func (s *Schedule) NextTransition(t time.Time) time.Time {
+	t = t.In(s.Loc)
+	y, mo, d := t.Date()
+
+	// every window edge for the coming week, in order
+	var edges []time.Time
+	for day := 0; day <= 8; day++ {
+		for _, w := range s.Windows {
+			for _, m := range []int{w.Start, w.End} {
+				e := time.Date(y, mo, d+day, 0, m, 0, 0, s.Loc)
+				if e.After(t) {
+					edges = append(edges, e)
+				}
+			}
+		}
+	}
+	sort.Slice(edges, func(i, j int) bool { return edges[i].Before(edges[j]) })
+
+	now := s.Active(t)
+	for _, e := range edges {
+		if s.Active(e) != now {
+			return e
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,419 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"nyasaki/dns-server/config"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	xfrInTimeout = time.Minute
+	// used until the first SOA tells us the real timers
+	secondaryInitialRetry = 30 * time.Second
+	// a zone with refresh or retry 0 must not have us hammer its primary
+	secondaryMinRefresh = 5 * time.Second
+)
+
+// errIXFRBase is an IXFR whose deltas don't start at the serial we have
+var errIXFRBase = errors.New("IXFR does not start at our serial")
+
+// Secondary keeps a local copy of a zone in sync with its primary (RFC 1034
+// section 4.3.5): SOA checks every refresh interval, retries on failure, the zone
+// is dropped once expire passes without contact, NOTIFY short-cuts the wait.
+type Secondary struct {
+	Origin        string
+	Primary       string
+	AllowNotify   []netip.Prefix
+	AllowTransfer []netip.Prefix
+	Key           *TSIGKey // signs our requests, nil for none
+
+	zones  *Zones
+	notify chan struct{}
+
+	mu     sync.Mutex
+	lastOK time.Time
+}
+
+func NewSecondary(cfg config.SecondaryConfig, zones *Zones, keys Keyring) (*Secondary, error) {
+	sec := &Secondary{
+		Origin:  normName(cfg.Origin),
+		Primary: cfg.Primary,
+		zones:   zones,
+		notify:  make(chan struct{}, 1),
+	}
+
+	if cfg.Key != "" {
+		if sec.Key = keys.Get(cfg.Key); sec.Key == nil {
+			return nil, fmt.Errorf("secondary %s: unknown tsig key %q", cfg.Origin, cfg.Key)
+		}
+	}
+
+	parse := func(cidrs []string) ([]netip.Prefix, error) {
+		var out []netip.Prefix
+		for _, c := range cidrs {
+			p, err := netip.ParsePrefix(c)
+			if err != nil {
+				return nil, fmt.Errorf("secondary %s: %v", cfg.Origin, err)
+			}
+			out = append(out, p.Masked())
+		}
+		return out, nil
+	}
+
+	var err error
+	if sec.AllowTransfer, err = parse(cfg.AllowTransfer); err != nil {
+		return nil, err
+	}
+	if sec.AllowNotify, err = parse(cfg.AllowNotify); err != nil {
+		return nil, err
+	}
+
+	// by default only the primary itself may notify us
+	if len(sec.AllowNotify) == 0 {
+		host, _, err := net.SplitHostPort(cfg.Primary)
+		if err != nil {
+			return nil, fmt.Errorf("secondary %s: primary: %v", cfg.Origin, err)
+		}
+		if ip, err := netip.ParseAddr(host); err == nil {
+			sec.AllowNotify = []netip.Prefix{netip.PrefixFrom(ip, ip.BitLen())}
+		}
+	}
+
+	return sec, nil
+}
+
+// NotifyAllowed checks the NOTIFY ACL, a NOTIFY signed with our key is always accepted
+func (sec *Secondary) NotifyAllowed(client netip.Addr, sig *TSIGResult) bool {
+	if sec.Key != nil && sig.Allowed([]string{sec.Key.Name}) {
+		return true
+	}
+
+	client = client.Unmap()
+	for _, p := range sec.AllowNotify {
+		if p.Contains(client) {
+			return true
+		}
+	}
+	return false
+}
+
+// Notify wakes the refresh loop, repeated NOTIFYs collapse into one refresh
+func (sec *Secondary) Notify() {
+	select {
+	case sec.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Refresh compares serials with the primary and transfers the zone when it moved
+func (sec *Secondary) Refresh() error {
+	current := sec.zones.Get(sec.Origin)
+
+	if current != nil {
+		serial, err := QuerySOA(sec.Primary, sec.Origin, sec.Key)
+		if err != nil {
+			return err
+		}
+		if !SerialLess(current.SOA().RData.SOA.Serial, serial) {
+			sec.markOK()
+			return nil
+		}
+	}
+
+	z, err := TransferIn(sec.Primary, sec.Origin, current, sec.Key)
+	if err != nil {
+		return err
+	}
+	if z != current {
+		z.AllowTransfer = sec.AllowTransfer
+		sec.zones.Replace(z)
+		log.Info().Str("zone", sec.Origin).Uint32("serial", z.SOA().RData.SOA.Serial).Msg("secondary zone updated")
+	}
+	sec.markOK()
+	return nil
+}
+
+func (sec *Secondary) markOK() {
+	sec.mu.Lock()
+	sec.lastOK = time.Now()
+	sec.mu.Unlock()
+}
+
+// Run drives the SOA timers forever
+func (sec *Secondary) Run() {
+	for {
+		err := sec.Refresh()
+		wait := secondaryInitialRetry
+
+		if z := sec.zones.Get(sec.Origin); z != nil {
+			soa := z.SOA().RData.SOA
+			wait = time.Duration(soa.Refresh) * time.Second
+
+			if err != nil {
+				wait = time.Duration(soa.Retry) * time.Second
+
+				sec.mu.Lock()
+				expired := time.Since(sec.lastOK) > time.Duration(soa.Expire)*time.Second
+				sec.mu.Unlock()
+
+				if expired {
+					log.Error().Str("zone", sec.Origin).Msg("secondary zone expired, no longer serving it")
+					sec.zones.Remove(sec.Origin)
+				}
+			}
+		}
+
+		if err != nil {
+			log.Warn().Str("zone", sec.Origin).Str("primary", sec.Primary).Msg("refresh failed: " + err.Error())
+		}
+
+		select {
+		case <-time.After(max(wait, secondaryMinRefresh)):
+		case <-sec.notify:
+		}
+	}
+}
+
+// newXfrQuery builds an AXFR query, or an IXFR one carrying our SOA when we have a copy
+func newXfrQuery(origin string, current *Zone) []byte {
+	q := DNSQuestion{Name: origin, Type: TypeAXFR, Class: ClassIN}
+	pkt := DNSAnswerPacket{Header: DNSHeader{ID: uint16(rand.Uint32())}}
+
+	if current != nil {
+		q.Type = TypeIXFR
+		pkt.Authority = []DNSAnswer{current.SOA()}
+	}
+	pkt.Questions = []DNSQuestion{q}
+
+	wire, _ := BuildAnswerPacket(pkt)
+	return wire
+}
+
+// QuerySOA asks primary for the zone's current serial over TCP, signed when key is set
+func QuerySOA(primary, origin string, key *TSIGKey) (uint32, error) {
+	query := BuildQuery(DNSQuestion{Name: origin, Type: TypeSOA, Class: ClassIN})
+	binary.BigEndian.PutUint16(query[:2], uint16(rand.Uint32()))
+
+	var mac []byte
+	if key != nil {
+		query, mac = key.Sign(query, nil)
+	}
+
+	reply, err := ExchangeTCPRaw(primary, query)
+	if err != nil {
+		return 0, err
+	}
+	if key != nil {
+		if err := NewTSIGStream(key, mac).Verify(reply); err != nil {
+			return 0, fmt.Errorf("SOA query to %s: %v", primary, err)
+		}
+	}
+	pkt, err := ParseAnswerPacket(reply, len(reply))
+	if err != nil {
+		return 0, err
+	}
+	if pkt.Header.RCode != RCodeSuccess || !pkt.Header.AA {
+		return 0, fmt.Errorf("primary %s is not authoritative for %s (rcode %d)", primary, origin, pkt.Header.RCode)
+	}
+
+	for _, rr := range pkt.Answers {
+		if rr.Type == TypeSOA && IsSubdomain(rr.Name, origin) && IsSubdomain(origin, rr.Name) {
+			return rr.RData.SOA.Serial, nil
+		}
+	}
+	return 0, fmt.Errorf("primary %s returned no SOA for %s", primary, origin)
+}
+
+// TransferIn pulls origin from primary. With a current copy it asks for IXFR and
+// applies the deltas; it returns current itself when nothing changed. With a key
+// the request is signed and every signed message of the answer verified.
+// Deltas that don't start at our serial are thrown away for a full AXFR.
+func TransferIn(primary, origin string, current *Zone, key *TSIGKey) (*Zone, error) {
+	z, err := transferIn(primary, origin, current, key)
+	if errors.Is(err, errIXFRBase) {
+		log.Warn().Str("zone", origin).Str("primary", primary).Msg("falling back to AXFR: " + err.Error())
+		return transferIn(primary, origin, nil, key)
+	}
+	return z, err
+}
+
+func transferIn(primary, origin string, current *Zone, key *TSIGKey) (*Zone, error) {
+	query := newXfrQuery(origin, current)
+	id := binary.BigEndian.Uint16(query[:2])
+
+	var stream *TSIGStream
+	if key != nil {
+		var mac []byte
+		query, mac = key.Sign(query, nil)
+		stream = NewTSIGStream(key, mac)
+	}
+
+	c, err := net.DialTimeout("tcp", primary, tcpUpstreamTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(xfrInTimeout))
+
+	if err := WriteTCPMessage(c, query); err != nil {
+		return nil, err
+	}
+
+	var records []DNSAnswer
+	for msgs := 0; ; msgs++ {
+		msg, err := ReadTCPMessage(c)
+		if err != nil {
+			return nil, fmt.Errorf("transfer of %s from %s: %v", origin, primary, err)
+		}
+
+		if stream != nil {
+			if err := stream.Verify(msg); err != nil {
+				return nil, fmt.Errorf("transfer of %s from %s: %v", origin, primary, err)
+			}
+		}
+
+		pkt, err := ParseAnswerPacket(msg, len(msg))
+		if err != nil {
+			return nil, err
+		}
+		if pkt.Header.ID != id {
+			return nil, fmt.Errorf("transfer of %s: mismatched message ID", origin)
+		}
+		if pkt.Header.RCode != RCodeSuccess {
+			return nil, fmt.Errorf("transfer of %s refused by %s (rcode %d)", origin, primary, pkt.Header.RCode)
+		}
+		records = append(records, pkt.Answers...)
+
+		// the closing message has to be signed as well
+		finished := func(z *Zone) (*Zone, error) {
+			if stream != nil && !stream.Done() {
+				return nil, fmt.Errorf("transfer of %s from %s: last message unsigned", origin, primary)
+			}
+			return z, nil
+		}
+
+		// a lone SOA in the first message means we are current (RFC 1995 section 2)
+		if msgs == 0 && len(records) == 1 && current != nil && records[0].Type == TypeSOA &&
+			!SerialLess(current.SOA().RData.SOA.Serial, records[0].RData.SOA.Serial) {
+			return finished(current)
+		}
+
+		z, done, err := applyTransfer(origin, records, current)
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			return finished(z)
+		}
+	}
+}
+
+// applyTransfer interprets the records received so far. done is false while the
+// closing SOA has not arrived yet.
+func applyTransfer(origin string, records []DNSAnswer, current *Zone) (*Zone, bool, error) {
+	if len(records) == 0 {
+		return nil, false, nil
+	}
+	if records[0].Type != TypeSOA {
+		return nil, false, fmt.Errorf("transfer of %s does not start with its SOA", origin)
+	}
+	if len(records) < 2 {
+		return nil, false, nil
+	}
+	newSerial := records[0].RData.SOA.Serial
+
+	// AXFR, or an IXFR answered with the full zone
+	if records[1].Type != TypeSOA || current == nil {
+		last := records[len(records)-1]
+		if last.Type != TypeSOA || last.RData.SOA.Serial != newSerial {
+			return nil, false, nil
+		}
+		z, err := NewZone(origin, records[:len(records)-1])
+		return z, err == nil, err
+	}
+
+	// incremental: (old SOA, removed..., new SOA, added...)* final SOA
+	have := make(map[string]DNSAnswer)
+	for _, rr := range current.Records()[1:] {
+		have[rrKey(rr)] = rr
+	}
+
+	// each delta starts where the one before left off, the first at our copy
+	serial := current.SOA().RData.SOA.Serial
+	i := 1
+	for {
+		if i >= len(records) {
+			return nil, false, nil
+		}
+		if records[i].Type != TypeSOA {
+			return nil, false, fmt.Errorf("malformed IXFR for %s", origin)
+		}
+		if records[i].RData.SOA.Serial == newSerial {
+			if i != len(records)-1 {
+				return nil, false, fmt.Errorf("data after the closing SOA of %s", origin)
+			}
+			break
+		}
+		if records[i].RData.SOA.Serial != serial {
+			if i == 1 {
+				return nil, false, fmt.Errorf("%w: %d, we have %d", errIXFRBase, records[i].RData.SOA.Serial, serial)
+			}
+			return nil, false, fmt.Errorf("IXFR for %s skips from serial %d to %d", origin, serial, records[i].RData.SOA.Serial)
+		}
+
+		// removals up to the delta's new SOA
+		i++
+		for ; i < len(records) && records[i].Type != TypeSOA; i++ {
+			delete(have, rrKey(records[i]))
+		}
+		if i >= len(records) {
+			return nil, false, nil
+		}
+		serial = records[i].RData.SOA.Serial
+
+		// additions up to the next delta or the closing SOA
+		i++
+		for ; i < len(records) && records[i].Type != TypeSOA; i++ {
+			have[rrKey(records[i])] = records[i]
+		}
+	}
+
+	out := []DNSAnswer{records[0]}
+	for _, rr := range have {
+		out = append(out, rr)
+	}
+	z, err := NewZone(origin, out)
+	return z, err == nil, err
+}
+
+// HandleNotify answers a NOTIFY (RFC 1996) and kicks the matching secondary
+func (s *Server) HandleNotify(q DNSQuestionPacket, client netip.Addr, sig *TSIGResult) []byte {
+	rcode := uint8(RCodeSuccess)
+
+	sec := s.secondaries[normName(q.Question.Name)]
+	switch {
+	case sec == nil:
+		rcode = RCodeNotAuth
+	case !sec.NotifyAllowed(client, sig):
+		log.Warn().Str("zone", sec.Origin).Str("client", client.String()).Msg("NOTIFY refused by ACL")
+		rcode = RCodeRefused
+	default:
+		log.Info().Str("zone", sec.Origin).Str("client", client.String()).Msg("NOTIFY received")
+		sec.Notify()
+	}
+
+	resp := NewResponse(q, rcode, nil)
+	resp.Header.AA = rcode == RCodeSuccess
+	resp.Header.RA = false
+	wire, _ := BuildAnswerPacket(resp)
+	return wire
+}
@@ -1,26 +1,36 @@
 package dns
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"nyasaki/dns-server/config"
 	"nyasaki/dns-server/metrics"
-	"strings"
+	"strconv"
 	"sync/atomic"
 	"time"
 
-	"github.com/dgraph-io/ristretto/v2"
 	"github.com/rs/zerolog/log"
+	"golang.org/x/net/ipv4"
 )
 
 type PendEntry struct {
+	srv   *Server
+	conn  *net.UDPConn // listener the query came in on
 	addr  *net.UDPAddr
 	orig  uint16
-	key   string // cache key for this query
-	exp   int64  // mono nanos
+	size  int     // largest reply the client takes over UDP
+	fwd   Forward // how to post-process and cache the reply
+	exp   int64   // mono nanos, the sweeper reads it concurrently
+	tries uint32  // other upstreams of the route asked so far
 	inUse uint32
 }
 
+// upstreamTimeout is how long a UDP query may wait for its upstream by default
+const upstreamTimeout = 250 * time.Millisecond
+
 var pending [65536]PendEntry
 var idCursor uint32 // atomically incremented
 
@@ -31,126 +41,134 @@ func allocUpID(now int64) (uint16, bool) {
 		id := uint16(atomic.AddUint32(&idCursor, 1))
 		slot := &pending[id]
 		if atomic.CompareAndSwapUint32(&slot.inUse, 0, 1) {
-			slot.exp = now + int64(250*time.Millisecond) // your timeout
+			atomic.StoreInt64(&slot.exp, now+int64(upstreamTimeout))
 			return id, true
 		}
 	}
 	return 0, false
 }
 
-/*
-	hdr := DNSHeader{
-		ID:      q.Header.ID,
-		QR:      true,
-		Opcode:  q.Header.Opcode,
-		AA:      false,
-		TC:      false,
-		RD:      q.Header.RD, // reflect client
-		RA:      true,
-		RCode:   0,
-		QDCount: 1,
-		ANCount: uint16(len(answers)),
-		NSCount: 0,
-		ARCount: 0,
-	}
-
-resp := DNSAnswerPacket{Header: hdr, Questions: []DNSQuestion{q.Question}, Answers: answers}
-wire, err := BuildAnswerPacket(resp)
-
-	if err != nil {
-		return false
-	}
-*/
-func ServeFromCache(
-	q DNSQuestionPacket,
-	conn *net.UDPConn,
-	cAddr *net.UDPAddr,
-	cache *ristretto.Cache[string, CacheEntry],
-	stats *metrics.Stats,
-) bool {
-	rawPkt := CacheRetrieve(q, cache)
-	if len(rawPkt) < 2 {
-		return false
-	}
-
-	// copy cached packet so we don’t mutate shared memory
-	pkt := make([]byte, len(rawPkt))
-	copy(pkt, rawPkt)
+// UpstreamReader hands the replies of a plain upstream back to the clients
+// waiting in the pending table, a batch of them per syscall
+func UpstreamReader(srv *Server, upConn *net.UDPConn) {
+	bc := newBatchConn(upConn)
+	ms := make([]ipv4.Message, udpBatchSize)
+	batchBuffers(ms)
 
-	// patch ID for this client
-	binary.BigEndian.PutUint16(pkt[:2], q.Header.ID)
-
-	_, err := conn.WriteToUDP(pkt, cAddr)
-	if err != nil {
-		// optional: stats + log
-		return false
-	}
-
-	stats.CacheHits.Add(1)
-	return true
-}
-
-func UpstreamReader(udpConn, upConn *net.UDPConn, cache *ristretto.Cache[string, CacheEntry]) {
-	buf := make([]byte, 4096)
+	var out udpReplies
 	for {
-		n, _, err := upConn.ReadFromUDP(buf)
-		if err != nil || n < 2 {
+		n, err := bc.ReadBatch(ms, 0)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			continue
 		}
 
-		upID := binary.BigEndian.Uint16(buf[:2])
-		slot := &pending[upID]
-		if atomic.LoadUint32(&slot.inUse) == 0 {
-			continue
-		}
+		for i := range ms[:n] {
+			buf := ms[i].Buffers[0][:ms[i].N]
+			if len(buf) < 2 {
+				continue
+			}
+
+			upID := binary.BigEndian.Uint16(buf[:2])
+			slot := &pending[upID]
+			// a reply has to answer the question we asked, not just guess the ID
+			if atomic.LoadUint32(&slot.inUse) == 0 || !SameQuestion(buf, slot.fwd.Query) {
+				continue
+			}
 
-		// restore original client ID
-		binary.BigEndian.PutUint16(buf[:2], slot.orig)
+			// restore original client ID
+			binary.BigEndian.PutUint16(buf[:2], slot.orig)
+
+			// validation may have to fetch keys first, don't hold up the other replies
+			if slot.fwd.Validate {
+				reply, fwd, conn, addr, size := append([]byte(nil), buf...), slot.fwd, slot.conn, slot.addr, slot.size
+				atomic.StoreUint32(&slot.inUse, 0)
+				go func() {
+					_, _ = conn.WriteToUDP(truncateUDP(srv.FinishUpstream(reply, &fwd), size), addr)
+				}()
+				continue
+			}
 
-		// parse + cache
-		ans, err := ParseAnswerPacket(buf[:n], n)
-		if err == nil && len(ans.Answers) > 0 && slot.key != "" {
-			CachePutKey(slot.key, ans, cache) // implement: put by key directly
+			out.add(slot.conn, truncateUDP(srv.FinishUpstream(buf, &slot.fwd), slot.size), slot.addr)
+			atomic.StoreUint32(&slot.inUse, 0)
 		}
-
-		_, _ = udpConn.WriteToUDP(buf[:n], slot.addr)
-		atomic.StoreUint32(&slot.inUse, 0)
+		out.flush()
 	}
 }
 
-func SetupConnection() (*net.UDPConn, *net.UDPConn, error) {
-	server, err := net.ResolveUDPAddr("udp4", ":53")
-	if err != nil {
-		log.Error().Msg("failed to reserve port (udp) '" + err.Error() + "'")
-		return nil, nil, err
-	}
+// udpBufSize is the read buffer of every message in a UDP batch
+const udpBufSize = 4096
 
-	sConn, err := net.ListenUDP("udp4", server)
+// SetupConnection opens a UDP listener on addr, ":53" takes IPv4 and IPv6
+func SetupConnection(addr string) (*net.UDPConn, error) {
+	conns, err := ListenUDPWorkers(addr, 1)
 	if err != nil {
-		log.Error().Msg("failed to start listening (udp) '" + err.Error() + "'")
-		return nil, nil, err
+		return nil, err
 	}
+	return conns[0], nil
+}
 
-	sConn.SetReadBuffer(1 << 20)
-	sConn.SetWriteBuffer(1 << 20)
-
-	// Create upstream here so every routine gets it own reply
-	upstream, err := net.ResolveUDPAddr("udp4", "9.9.9.9:53")
-	if err != nil {
-		log.Error().Msg("failed to resolve upstream '" + err.Error() + "'")
+// ListenUDPWorkers opens n sockets on addr sharing the port through
+// SO_REUSEPORT, one per worker. Without SO_REUSEPORT it is one socket.
+func ListenUDPWorkers(addr string, n int) ([]*net.UDPConn, error) {
+	if !reusePortSupported {
+		n = 1
+	}
+	lc := net.ListenConfig{}
+	if n > 1 {
+		lc.Control = reusePort
 	}
 
-	upConn, err := net.DialUDP("udp4", nil, upstream)
-	if err != nil {
-		log.Error().Msg("failed to open connection to upstream '" + err.Error() + "'")
+	var conns []*net.UDPConn
+	for i := 0; i < n; i++ {
+		pc, err := lc.ListenPacket(context.Background(), "udp", addr)
+		if err != nil {
+			log.Error().Msg("failed to start listening (udp) '" + err.Error() + "'")
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+		sConn := pc.(*net.UDPConn)
+		sConn.SetReadBuffer(1 << 20)
+		sConn.SetWriteBuffer(1 << 20)
+		conns = append(conns, sConn)
+
+		// the others have to join the port the first one got
+		if i == 0 {
+			host, _, _ := net.SplitHostPort(addr)
+			addr = net.JoinHostPort(host, strconv.Itoa(sConn.LocalAddr().(*net.UDPAddr).Port))
+		}
 	}
 
 	log.Debug().Msg("Listening...")
 
-	return sConn, upConn, nil
+	return conns, nil
 }
+
+func DialUpstream(addr string) (*net.UDPConn, error) {
+	upstream, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve upstream %s: %v", addr, err)
+	}
+
+	return net.DialUDP("udp", nil, upstream)
+}
+
 func CacheKeyFromQuestion(q DNSQuestionPacket) string {
-	return fmt.Sprintf("%s|%d|%d", strings.ToLower(q.Question.Name), q.Question.Type, q.Question.Class)
+	key := make([]byte, 0, len(q.Question.Name)+12)
+	for i := 0; i < len(q.Question.Name); i++ {
+		key = append(key, lowerASCII(q.Question.Name[i]))
+	}
+	return string(appendKeySuffix(key, q.Question.Type, q.Question.Class))
+}
+
+// appendKeySuffix ends a cache key with "|type|class"
+func appendKeySuffix(key []byte, qtype, qclass uint16) []byte {
+	key = strconv.AppendUint(append(key, '|'), uint64(qtype), 10)
+	return strconv.AppendUint(append(key, '|'), uint64(qclass), 10)
 }
 
 func Sweeper() {
@@ -160,73 +178,42 @@ func Sweeper() {
 		nn := now.UnixNano()
 		for i := 0; i < len(pending); i++ {
 			s := &pending[i]
-			if atomic.LoadUint32(&s.inUse) == 1 && s.exp < nn {
+			exp := atomic.LoadInt64(&s.exp)
+			if atomic.LoadUint32(&s.inUse) == 1 && exp < nn && !s.retry(exp, nn) {
 				atomic.StoreUint32(&s.inUse, 0)
 			}
 		}
 	}
 }
 
-func StartServer(stats *metrics.Stats) error {
-	buffer := make([]byte, 4096)
-	cache, err := ristretto.NewCache(
-		&ristretto.Config[string, CacheEntry]{
-			NumCounters: 1e5,
-			MaxCost:     1 << 30,
-			BufferItems: 64,
-		},
-	)
-	if err != nil {
-		log.Error().Msg("failed to add to cache '" + err.Error() + "'")
+// retry sends a routed query that timed out to the route's next plain
+// upstream under the same ID, false when there is none left to ask
+func (p *PendEntry) retry(exp, now int64) bool {
+	rt := p.fwd.Route
+	if rt == nil || p.srv == nil {
+		return false
 	}
-
-	udpConn, upConn, err := SetupConnection()
-	if err != nil {
-		log.Error().Msg("error setting up the udp server " + err.Error())
+	// another sweeper may have got here first
+	if !atomic.CompareAndSwapInt64(&p.exp, exp, now+int64(rt.Timeout)) {
+		return true
 	}
 
-	go UpstreamReader(udpConn, upConn, cache /* & stats if needed */)
-	go Sweeper()
-
-	for {
-		n, cAddr, err := udpConn.ReadFromUDP(buffer)
-		if err != nil {
-			continue
-		}
-
-		// clone the packet before any mutation
-		pkt := make([]byte, n)
-		copy(pkt, buffer[:n])
-
-		// parse question
-		q, err := ParseQuestionPacket(pkt, n)
-		if err != nil {
-			continue
-		}
-
-		// try cache
-		if ServeFromCache(q, udpConn, cAddr, cache, stats) {
-			stats.CacheHits.Add(1)
-			continue
-		}
-		stats.CacheMisses.Add(1)
-
-		// ID remap + pending bookkeeping
-		orig := binary.BigEndian.Uint16(pkt[:2])
-		now := time.Now().UnixNano()
-		upID, ok := allocUpID(now)
-		if !ok { /* optionally SERVFAIL */
-			continue
-		}
-
-		key := CacheKeyFromQuestion(q) // implement once; same as you used for CacheRetrieve/Put
-		slot := &pending[upID]
-		slot.addr = cAddr
-		slot.orig = orig
-		slot.key = key
-		slot.exp = now + int64(250*time.Millisecond)
+	n := int(atomic.AddUint32(&p.tries, 1))
+	if n >= len(rt.Upstreams) {
+		return false
+	}
+	up := p.srv.upstreams[rt.Next(p.fwd.Upstream, n)]
+	if up == nil {
+		return false
+	}
+	_, _ = up.Write(p.fwd.Query)
+	return true
+}
 
-		binary.BigEndian.PutUint16(pkt[:2], upID)
-		_, _ = upConn.Write(pkt)
+func StartServer(cfg *config.Config, stats *metrics.Stats) error {
+	srv, err := NewServer(cfg, stats)
+	if err != nil {
+		return err
 	}
+	return srv.Run()
 }
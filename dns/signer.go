@@ -0,0 +1,348 @@
+package dns
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"nyasaki/dns-server/config"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Signatures are made valid from an hour ago to cover clock skew and renewed
+// once half of their validity has passed
+const (
+	sigValidity   = 7 * 24 * time.Hour
+	sigBackdate   = time.Hour
+	maxCachedSigs = 10000
+)
+
+// Signer signs a hosted zone's answers as they go out with one combined key
+// (KSK and ZSK in one, flags 257). Negative answers are proven with NSEC
+// records made up for the query, so the zone can't be walked.
+type Signer struct {
+	key     crypto.Signer
+	dnskey  DNSKEYData
+	minimal bool
+
+	mu   sync.Mutex
+	sigs map[string]RRSIGData
+}
+
+// LoadSigner reads the zone's key, generating and saving it when the file is missing
+func LoadSigner(cfg config.SigningConfig) (*Signer, error) {
+	key, err := loadSigningKey(cfg.KeyFile, cfg.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return NewSigner(key, cfg.Denial == "minimal")
+}
+
+// NewSigner signs with an ECDSA P-256 or Ed25519 key. minimal selects RFC 4470
+// white lies for NXDOMAIN instead of black lies (RFC 9824).
+func NewSigner(key crypto.Signer, minimal bool) (*Signer, error) {
+	k := DNSKEYData{Flags: DNSKEYZone | DNSKEYSEP, Protocol: 3}
+	switch pub := key.Public().(type) {
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("only P-256 ECDSA keys are supported")
+		}
+		k.Algorithm = AlgECDSAP256SHA256
+		k.PublicKey = append(pub.X.FillBytes(make([]byte, 32)), pub.Y.FillBytes(make([]byte, 32))...)
+	case ed25519.PublicKey:
+		k.Algorithm = AlgED25519
+		k.PublicKey = append([]byte(nil), pub...)
+	default:
+		return nil, fmt.Errorf("unsupported signing key %T", pub)
+	}
+	return &Signer{key: key, dnskey: k, minimal: minimal, sigs: make(map[string]RRSIGData)}, nil
+}
+
+func loadSigningKey(path, alg string) (crypto.Signer, error) {
+	if path == "" {
+		return nil, fmt.Errorf("signing needs a key file")
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return generateSigningKey(path, alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s: no PKCS #8 private key", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported key type %T", path, key)
+	}
+	return signer, nil
+}
+
+func generateSigningKey(path, alg string) (crypto.Signer, error) {
+	var key crypto.Signer
+	var err error
+	if alg == "ed25519" {
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	} else {
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		return nil, err
+	}
+	log.Info().Str("file", path).Msg("generated zone signing key")
+	return key, nil
+}
+
+// DNSKEY is the public half of the signing key
+func (s *Signer) DNSKEY() DNSKEYData {
+	return s.dnskey
+}
+
+// apexRecords are the DNSKEY, CDS and CDNSKEY records (RFC 7344) published at the apex
+func (s *Signer) apexRecords(origin string, ttl uint32, qtype uint16) []DNSAnswer {
+	ds, _ := NewDS(origin, s.dnskey, DigestSHA256)
+	all := []DNSAnswer{
+		{Name: origin, Type: TypeDNSKEY, Class: ClassIN, TTL: ttl, RData: RData{DNSKEY: s.dnskey}},
+		{Name: origin, Type: TypeCDS, Class: ClassIN, TTL: ttl, RData: RData{DS: ds}},
+		{Name: origin, Type: TypeCDNSKEY, Class: ClassIN, TTL: ttl, RData: RData{DNSKEY: s.dnskey}},
+	}
+
+	var out []DNSAnswer
+	for _, rr := range all {
+		if qtype == TypeANY || qtype == rr.Type {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+// sign returns the RRSIG over one RRset, reusing a fresh enough earlier signature
+func (s *Signer) sign(signer string, rrs []DNSAnswer) (DNSAnswer, error) {
+	ttl := rrs[0].TTL
+	for _, rr := range rrs {
+		ttl = min(ttl, rr.TTL)
+	}
+	key := string(SignedData(RRSIGData{OrigTTL: ttl}, rrs))
+	now := time.Now()
+
+	s.mu.Lock()
+	sig, ok := s.sigs[key]
+	s.mu.Unlock()
+
+	if !ok || now.Add(sigValidity/2).Unix() > int64(sig.Expiration) {
+		sig = RRSIGData{
+			TypeCovered: rrs[0].Type,
+			Algorithm:   s.dnskey.Algorithm,
+			Labels:      uint8(labelCount(rrs[0].Name)),
+			OrigTTL:     ttl,
+			Expiration:  uint32(now.Add(sigValidity).Unix()),
+			Inception:   uint32(now.Add(-sigBackdate).Unix()),
+			KeyTag:      KeyTag(s.dnskey),
+			SignerName:  signer,
+		}
+		data := SignedData(sig, rrs)
+
+		var err error
+		if k, ok := s.key.(*ecdsa.PrivateKey); ok {
+			// DNSSEC wants r and s side by side, not the ASN.1 crypto.Signer returns
+			digest := sha256.Sum256(data)
+			var r, rs *big.Int
+			if r, rs, err = ecdsa.Sign(rand.Reader, k, digest[:]); err == nil {
+				sig.Signature = append(r.FillBytes(make([]byte, 32)), rs.FillBytes(make([]byte, 32))...)
+			}
+		} else {
+			sig.Signature, err = s.key.Sign(rand.Reader, data, crypto.Hash(0))
+		}
+		if err != nil {
+			return DNSAnswer{}, err
+		}
+
+		s.mu.Lock()
+		if len(s.sigs) >= maxCachedSigs {
+			s.sigs = make(map[string]RRSIGData)
+		}
+		s.sigs[key] = sig
+		s.mu.Unlock()
+	}
+
+	return DNSAnswer{Name: rrs[0].Name, Type: TypeRRSIG, Class: rrs[0].Class, TTL: ttl, RData: RData{RRSIG: sig}}, nil
+}
+
+// signSection appends an RRSIG after every RRset of section the zone is
+// authoritative for, delegation NS records and glue stay unsigned
+func (s *Signer) signSection(z *Zone, section []DNSAnswer) []DNSAnswer {
+	var out []DNSAnswer
+	for _, set := range rrsets(section) {
+		out = append(out, set.rrs...)
+		// an NSEC at a cut belongs to the parent side just like the DS
+		rtype := set.rtype
+		if rtype == TypeNSEC {
+			rtype = TypeDS
+		}
+		if !IsSubdomain(set.owner, z.Origin) || z.findCut(set.owner, rtype) != nil {
+			continue
+		}
+
+		sig, err := s.sign(z.Origin, set.rrs)
+		if err != nil {
+			log.Error().Str("zone", z.Origin).Msg("signing failed: " + err.Error())
+			continue
+		}
+		out = append(out, sig)
+	}
+	return out
+}
+
+// typesAt lists the types an NSEC at name has to claim, those of the wildcard
+// for names synthesized from one
+func (s *Signer) typesAt(z *Zone, name string) []uint16 {
+	n, ok := z.nodes[name]
+	if !ok {
+		n, ok = z.nodes["*."+z.closestEncloser(name)]
+	}
+
+	types := []uint16{TypeRRSIG, TypeNSEC}
+	if ok {
+		for t := range n.rrsets {
+			types = append(types, t)
+		}
+	}
+	if name == z.Origin {
+		types = append(types, TypeDNSKEY, TypeCDS, TypeCDNSKEY)
+	}
+	return types
+}
+
+func (s *Signer) nsec(owner, next string, ttl uint32, types []uint16) DNSAnswer {
+	return DNSAnswer{Name: owner, Type: TypeNSEC, Class: ClassIN, TTL: ttl, RData: RData{NSEC: NSECData{NextName: next, Types: types}}}
+}
+
+// cover is a white lie NSEC spanning name and everything below it, from the
+// name just before it to the one just after its subtree (RFC 4470 section 3)
+func (s *Signer) cover(name string, ttl uint32) DNSAnswer {
+	label, rest, _ := strings.Cut(name, ".")
+	return s.nsec(predecessor(name), subdomain(label+"\x00", rest), ttl, []uint16{TypeRRSIG, TypeNSEC})
+}
+
+// predecessor returns a name sorting just before name: the last octet of the
+// first label decremented and the label filled up with the highest octet that
+// survives lower-casing
+func predecessor(name string) string {
+	label, rest, _ := strings.Cut(name, ".")
+	last := label[len(label)-1]
+	label = label[:len(label)-1]
+	if last == 0 {
+		if label == "" {
+			return rest
+		}
+	} else {
+		last--
+		if last >= 'A' && last <= 'Z' {
+			last = 'A' - 1
+		}
+		label += string(last)
+
+		// the whole name may not grow past 255 octets
+		room := 255 - len(BuildName(nil, name))
+		label += strings.Repeat("\x7f", max(0, min(63-len(label), room)))
+	}
+
+	return subdomain(label, rest)
+}
+
+// subdomain prepends label to name
+func subdomain(label, name string) string {
+	if name == "" {
+		return label
+	}
+	return label + "." + name
+}
+
+// Sign adds the DNSSEC records to z's answer for a client that set DO: RRSIGs
+// on the authoritative data, a DS or proof of its absence on referrals and NSEC
+// records made up for negative answers.
+func (s *Signer) Sign(z *Zone, q DNSQuestionPacket, resp DNSAnswerPacket) DNSAnswerPacket {
+	name, qtype := normName(q.Question.Name), q.Question.Type
+
+	// a negative answer is about the end of the CNAME chain
+	if qtype != TypeCNAME {
+		for _, rr := range resp.Answers {
+			if rr.Type == TypeCNAME && normName(rr.Name) == name {
+				name = normName(rr.RData.Name)
+			}
+		}
+	}
+
+	var cut string
+	for _, rr := range resp.Authority {
+		if rr.Type == TypeNS && normName(rr.Name) != z.Origin {
+			cut = normName(rr.Name)
+		}
+	}
+	negative := len(resp.Authority) > 0 && resp.Authority[0].Type == TypeSOA
+	ttl := z.negativeSOA().TTL
+
+	switch {
+	case cut != "":
+		if ds := z.nodes[cut].rrsets[TypeDS]; len(ds) > 0 {
+			resp.Authority = append(resp.Authority, ds...)
+		} else {
+			// an insecure delegation: NS but no DS at the cut
+			resp.Authority = append(resp.Authority, s.nsec(cut, subdomain("\x00", cut), ttl, s.typesAt(z, cut)))
+		}
+
+	case resp.Header.RCode == RCodeNXDomain && s.minimal:
+		ce := z.closestEncloser(name)
+		labels := splitLabels(name)
+		nextCloser := strings.Join(labels[len(labels)-len(splitLabels(ce))-1:], ".")
+		resp.Authority = append(resp.Authority, s.cover(nextCloser, ttl))
+		if wc := wildcardOf(ce); wc != nextCloser {
+			resp.Authority = append(resp.Authority, s.cover(wc, ttl))
+		}
+
+	case resp.Header.RCode == RCodeNXDomain:
+		// black lies: the name exists, just without any data
+		resp.Header.RCode = RCodeSuccess
+		resp.Authority = append(resp.Authority, s.nsec(name, subdomain("\x00", name), ttl, []uint16{TypeRRSIG, TypeNSEC, TypeNXNAME}))
+
+	case negative:
+		resp.Authority = append(resp.Authority, s.nsec(name, subdomain("\x00", name), ttl, s.typesAt(z, name)))
+	}
+
+	resp.Answers = s.signSection(z, resp.Answers)
+	resp.Authority = s.signSection(z, resp.Authority)
+	resp.Additional = s.signSection(z, resp.Additional)
+
+	// tell the client we did look at DO
+	resp.Additional = append(resp.Additional, DNSAnswer{Type: TypeOPT, Class: ednsUDPSize, TTL: ednsDO})
+	return resp
+}
@@ -0,0 +1,195 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	tcpIdleTimeout     = 10 * time.Second
+	tcpUpstreamTimeout = 5 * time.Second
+)
+
+// ReadTCPMessage reads one length-prefixed message (RFC 1035 section 4.2.2)
+func ReadTCPMessage(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// WriteTCPMessage writes msg with its length prefix in a single write
+func WriteTCPMessage(w io.Writer, msg []byte) error {
+	if len(msg) > 0xFFFF {
+		return fmt.Errorf("message too long for TCP: %d", len(msg))
+	}
+
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+// AddrOf extracts the client IP from a connection address
+func AddrOf(a net.Addr) netip.Addr {
+	if ap, err := netip.ParseAddrPort(a.String()); err == nil {
+		return ap.Addr().Unmap()
+	}
+	return netip.Addr{}
+}
+
+// ServeTCP accepts stream connections until the listener is closed
+func (s *Server) ServeTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go s.ServeStream(conn)
+	}
+}
+
+// ServeStream answers length-prefixed queries on conn until the client goes quiet
+func (s *Server) ServeStream(conn net.Conn) {
+	defer conn.Close()
+	client := AddrOf(conn.RemoteAddr())
+
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		msg, err := ReadTCPMessage(conn)
+		if err != nil {
+			return
+		}
+
+		q, err := ParseQuestionPacket(msg, len(msg))
+		if err != nil {
+			return
+		}
+
+		if q.Question.Type == TypeAXFR || q.Question.Type == TypeIXFR {
+			if err := s.Transfer(conn, q, msg, client); err != nil {
+				log.Warn().Str("zone", q.Question.Name).Str("client", client.String()).Msg("transfer failed: " + err.Error())
+				return
+			}
+			continue
+		}
+
+		resp := s.Resolve(q, msg, client)
+		if resp == nil {
+			return
+		}
+		if err := WriteTCPMessage(conn, resp); err != nil {
+			return
+		}
+	}
+}
+
+// Resolve runs the full pipeline synchronously, forwarding over TCP or the
+// upstream's encrypted transport when needed.
+// Stream transports use it, UDP keeps its asynchronous pending table.
+func (s *Server) Resolve(q DNSQuestionPacket, msg []byte, client netip.Addr) []byte {
+	resp, fwd := s.HandleQuery(q, msg, client)
+	if resp != nil || fwd == nil {
+		return resp
+	}
+	if fwd.Iterative {
+		return s.ResolveIterative(q, fwd)
+	}
+
+	return s.forward(q, fwd)
+}
+
+// forward asks fwd's upstream, answering SERVFAIL when that fails
+func (s *Server) forward(q DNSQuestionPacket, fwd *Forward) []byte {
+	reply, err := s.ExchangeUpstream(fwd, q.Header.ID)
+	if err != nil {
+		s.stats.UpstreamErr.Add(1)
+		resp, _ := BuildResponse(q, RCodeServFail, nil)
+		return resp
+	}
+	s.stats.UpstreamOK.Add(1)
+	return reply
+}
+
+// ExchangeUpstream sends fwd to its upstream over TCP or the upstream's
+// encrypted transport and post-processes the reply. A routed query that
+// fails moves on to the route's other upstreams.
+func (s *Server) ExchangeUpstream(fwd *Forward, id uint16) ([]byte, error) {
+	tries := 1
+	if fwd.Route != nil {
+		tries = len(fwd.Route.Upstreams)
+	}
+
+	// a route's timeout holds for every transport, handshakes included
+	timeout := tcpUpstreamTimeout
+	if fwd.Route != nil {
+		timeout = fwd.Route.Timeout
+	}
+
+	binary.BigEndian.PutUint16(fwd.Query[:2], id)
+	var err error
+	for n := 0; n < tries; n++ {
+		spec := fwd.Upstream
+		if n > 0 {
+			spec = fwd.Route.Next(fwd.Upstream, n)
+		}
+		up := s.transports[spec]
+		if up == nil {
+			err = fmt.Errorf("no upstream %q", spec)
+			continue
+		}
+
+		var reply []byte
+		if reply, err = up.Exchange(fwd.Query, timeout); err == nil {
+			return s.FinishUpstream(reply, fwd), nil
+		}
+		if n+1 < tries {
+			log.Warn().Str("upstream", spec).Msg("routed upstream failed, trying the next: " + err.Error())
+		}
+	}
+	return nil, err
+}
+
+// ExchangeTCPRaw sends one message to addr and returns the reply carrying the same ID
+func ExchangeTCPRaw(addr string, msg []byte) ([]byte, error) {
+	return exchangeTCP(addr, msg, tcpUpstreamTimeout)
+}
+
+func exchangeTCP(addr string, msg []byte, timeout time.Duration) ([]byte, error) {
+	c, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(timeout))
+
+	if err := WriteTCPMessage(c, msg); err != nil {
+		return nil, err
+	}
+
+	reply, err := ReadTCPMessage(c)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) < DNSHeaderSize || binary.BigEndian.Uint16(reply[:2]) != binary.BigEndian.Uint16(msg[:2]) {
+		return nil, fmt.Errorf("%s: mismatched reply", addr)
+	}
+	return reply, nil
+}
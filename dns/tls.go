@@ -0,0 +1,115 @@
+package dns
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// CertReloader hands out a certificate loaded from files and loads it again
+// when either file changed, so renewals need no restart. Handshakes look at
+// the files at most every certCheckInterval.
+type CertReloader struct {
+	certFile, keyFile string
+
+	cert    atomic.Pointer[tls.Certificate]
+	checked atomic.Int64 // unix nanos of the last look at the files
+
+	mu              sync.Mutex // one reload at a time
+	certMod, keyMod time.Time
+}
+
+// certCheckInterval is how stale a renewed certificate may get before it is picked up
+const certCheckInterval = 2 * time.Second
+
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	r.checked.Store(time.Now().UnixNano())
+	return r, nil
+}
+
+func (r *CertReloader) load() error {
+	certMod, keyMod, err := r.modTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert.Store(&cert)
+	r.certMod, r.keyMod = certMod, keyMod
+	return nil
+}
+
+func (r *CertReloader) modTimes() (time.Time, time.Time, error) {
+	ci, err := os.Stat(r.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	ki, err := os.Stat(r.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return ci.ModTime(), ki.ModTime(), nil
+}
+
+// GetCertificate is the tls.Config hook. A broken renewal keeps the old
+// certificate in service.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	now := time.Now().UnixNano()
+	last := r.checked.Load()
+	// one handshake per interval looks at the files, the others go on with what there is
+	if now-last >= int64(certCheckInterval) && r.checked.CompareAndSwap(last, now) {
+		r.reload()
+	}
+	return r.cert.Load(), nil
+}
+
+func (r *CertReloader) reload() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	certMod, keyMod, err := r.modTimes()
+	if err != nil || certMod.Equal(r.certMod) && keyMod.Equal(r.keyMod) {
+		return
+	}
+	if err := r.load(); err != nil {
+		log.Warn().Str("cert", r.certFile).Msg("certificate reload failed, keeping the old one: " + err.Error())
+	} else {
+		log.Info().Str("cert", r.certFile).Msg("certificate reloaded")
+	}
+}
+
+// ServerTLSConfig is the TLS setup of the encrypted listeners. Session tickets
+// are on, crypto/tls rotates their keys, so returning clients resume without
+// a full handshake.
+func ServerTLSConfig(r *CertReloader, protos ...string) *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+		NextProtos:     protos,
+	}
+}
+
+// ListenDoT opens the DNS-over-TLS listener (RFC 7858). Connections carry the
+// same length-prefixed messages as plain TCP, ServeTCP handles them.
+func (s *Server) ListenDoT(addr string) (net.Listener, error) {
+	certs, err := NewCertReloader(s.cfg.DoT.CertFile, s.cfg.DoT.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(ln, ServerTLSConfig(certs, "dot")), nil
+}
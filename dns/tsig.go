@@ -0,0 +1,315 @@
+package dns
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"time"
+
+	"nyasaki/dns-server/config"
+)
+
+// TSIG error codes carried in the TSIG RR (RFC 8945 section 3)
+const (
+	TSIGBadSig  = 16
+	TSIGBadKey  = 17
+	TSIGBadTime = 18
+)
+
+// tsigFudge is the clock skew we allow and ask peers to allow
+const tsigFudge = 300
+
+// maxUnsignedXfr is how many messages of a transfer may go unsigned in a row
+const maxUnsignedXfr = 99
+
+var tsigAlgorithms = map[string]func() hash.Hash{
+	"hmac-sha256": sha256.New,
+	"hmac-sha512": sha512.New,
+}
+
+// TSIGKey is a shared secret identified by its (domain style) name
+type TSIGKey struct {
+	Name      string
+	Algorithm string
+	Secret    []byte
+}
+
+func NewTSIGKey(cfg config.TSIGKeyConfig) (*TSIGKey, error) {
+	alg := normName(cfg.Algorithm)
+	if _, ok := tsigAlgorithms[alg]; !ok {
+		return nil, fmt.Errorf("tsig key %s: unsupported algorithm %q", cfg.Name, cfg.Algorithm)
+	}
+	secret, err := base64.StdEncoding.DecodeString(cfg.Secret)
+	if err != nil || len(secret) == 0 {
+		return nil, fmt.Errorf("tsig key %s: secret must be base64", cfg.Name)
+	}
+	return &TSIGKey{Name: normName(cfg.Name), Algorithm: alg, Secret: secret}, nil
+}
+
+// Keyring holds the configured keys by name
+type Keyring map[string]*TSIGKey
+
+func NewKeyring(cfgs []config.TSIGKeyConfig) (Keyring, error) {
+	kr := make(Keyring)
+	for _, kc := range cfgs {
+		k, err := NewTSIGKey(kc)
+		if err != nil {
+			return nil, err
+		}
+		kr[k.Name] = k
+	}
+	return kr, nil
+}
+
+// Get returns the key called name, nil when there is none
+func (kr Keyring) Get(name string) *TSIGKey {
+	return kr[normName(name)]
+}
+
+// TSIGResult is the outcome of checking a signed message
+type TSIGResult struct {
+	Key   *TSIGKey // nil when the key is unknown
+	Name  string   // key name and algorithm as sent by the peer
+	Alg   string
+	MAC   []byte
+	Error uint16 // TSIG error to report, 0 when the signature is good
+}
+
+// splitTSIG finds the TSIG record, which must be the last one in the additional
+// section. unsigned is the message as it was before signing: TSIG removed,
+// ARCOUNT decremented and the original ID restored.
+func splitTSIG(msg []byte) (unsigned []byte, tsig DNSAnswer, ok bool, err error) {
+	hdr, err := ParseHeader(msg)
+	if err != nil || hdr.ARCount == 0 {
+		// nothing we could have signed
+		return nil, tsig, false, nil
+	}
+
+	off := DNSHeaderSize
+	for i := 0; i < int(hdr.QDCount); i++ {
+		if _, off, err = ParseQuestion(msg, off); err != nil {
+			return nil, tsig, false, err
+		}
+	}
+	records := int(hdr.ANCount) + int(hdr.NSCount) + int(hdr.ARCount)
+	for i := 0; i < records-1; i++ {
+		if _, off, err = ParseAnswer(msg, off); err != nil {
+			return nil, tsig, false, err
+		}
+	}
+
+	start := off
+	tsig, _, err = ParseAnswer(msg, start)
+	if err != nil || tsig.Type != TypeTSIG {
+		return nil, tsig, false, err
+	}
+
+	unsigned = append([]byte(nil), msg[:start]...)
+	binary.BigEndian.PutUint16(unsigned[0:2], tsig.RData.TSIG.OrigID)
+	binary.BigEndian.PutUint16(unsigned[10:12], hdr.ARCount-1)
+	return unsigned, tsig, true, nil
+}
+
+// digest computes the MAC over prevMAC (request or previous message), the
+// unsigned message and the TSIG variables (RFC 8945 section 4.3.3), or only the
+// timers for later messages of a multi-message answer
+func (k *TSIGKey) digest(prevMAC, unsigned []byte, t TSIGData, timersOnly bool) []byte {
+	h := hmac.New(tsigAlgorithms[k.Algorithm], k.Secret)
+
+	if len(prevMAC) > 0 {
+		_ = binary.Write(h, binary.BigEndian, uint16(len(prevMAC)))
+		h.Write(prevMAC)
+	}
+	h.Write(unsigned)
+
+	var vars []byte
+	if !timersOnly {
+		vars = BuildName(vars, normName(k.Name))
+		vars = binary.BigEndian.AppendUint16(vars, ClassANY)
+		vars = binary.BigEndian.AppendUint32(vars, 0)
+		vars = BuildName(vars, k.Algorithm)
+	}
+	vars = binary.BigEndian.AppendUint16(vars, uint16(t.TimeSigned>>32))
+	vars = binary.BigEndian.AppendUint32(vars, uint32(t.TimeSigned))
+	vars = binary.BigEndian.AppendUint16(vars, t.Fudge)
+	if !timersOnly {
+		vars = binary.BigEndian.AppendUint16(vars, t.Error)
+		vars = binary.BigEndian.AppendUint16(vars, uint16(len(t.Other)))
+		vars = append(vars, t.Other...)
+	}
+	h.Write(vars)
+
+	return h.Sum(nil)
+}
+
+// appendTSIG adds the TSIG record to the additional section of msg
+func appendTSIG(msg []byte, name string, t TSIGData) []byte {
+	out := append([]byte(nil), msg...)
+	out, _ = BuildAnswer(out, nil, DNSAnswer{Name: name, Type: TypeTSIG, Class: ClassANY, RData: RData{Kind: TypeTSIG, TSIG: t}}, map[string]int{})
+	binary.BigEndian.PutUint16(out[10:12], binary.BigEndian.Uint16(out[10:12])+1)
+	return out
+}
+
+func (k *TSIGKey) sign(msg, prevMAC []byte, t TSIGData, timersOnly bool) ([]byte, []byte) {
+	t.Algorithm = k.Algorithm
+	t.Fudge = tsigFudge
+	t.OrigID = binary.BigEndian.Uint16(msg[0:2])
+	if t.TimeSigned == 0 {
+		t.TimeSigned = uint64(time.Now().Unix())
+	}
+	t.MAC = k.digest(prevMAC, msg, t, timersOnly)
+	return appendTSIG(msg, k.Name, t), t.MAC
+}
+
+// Sign appends a TSIG record to msg and returns the signed message and its MAC.
+// prevMAC is nil for requests and the request's MAC for a response.
+func (k *TSIGKey) Sign(msg, prevMAC []byte) ([]byte, []byte) {
+	return k.sign(msg, prevMAC, TSIGData{}, false)
+}
+
+// Verify checks the TSIG of msg against the keys. A nil result means the message
+// is unsigned; err is only set when the message is malformed.
+func (kr Keyring) Verify(msg, prevMAC []byte) (*TSIGResult, error) {
+	unsigned, rr, ok, err := splitTSIG(msg)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	t := rr.RData.TSIG
+	res := &TSIGResult{Name: normName(rr.Name), Alg: normName(t.Algorithm), MAC: t.MAC}
+
+	k := kr.Get(rr.Name)
+	if k == nil || k.Algorithm != res.Alg {
+		res.Error = TSIGBadKey
+		return res, nil
+	}
+	res.Key = k
+
+	if !hmac.Equal(k.digest(prevMAC, unsigned, t, false), t.MAC) {
+		res.Error = TSIGBadSig
+		return res, nil
+	}
+	if !tsigTimeOK(t) {
+		res.Error = TSIGBadTime
+	}
+	return res, nil
+}
+
+func tsigTimeOK(t TSIGData) bool {
+	now := uint64(time.Now().Unix())
+	skew := max(now, t.TimeSigned) - min(now, t.TimeSigned)
+	return skew <= uint64(t.Fudge)
+}
+
+// Reply signs resp, the answer to the request res was checked from. Failed
+// checks are reported with an unsigned TSIG carrying the error, except BADTIME
+// which is signed and tells the client our clock (RFC 8945 section 5.2.3).
+func (res *TSIGResult) Reply(resp []byte) []byte {
+	if res == nil || len(resp) < DNSHeaderSize {
+		return resp
+	}
+
+	switch res.Error {
+	case 0:
+		signed, _ := res.Key.Sign(resp, res.MAC)
+		return signed
+
+	case TSIGBadTime:
+		now := uint64(time.Now().Unix())
+		other := binary.BigEndian.AppendUint16(nil, uint16(now>>32))
+		other = binary.BigEndian.AppendUint32(other, uint32(now))
+		signed, _ := res.Key.sign(resp, res.MAC, TSIGData{TimeSigned: now, Error: TSIGBadTime, Other: other}, false)
+		return signed
+
+	default:
+		return appendTSIG(resp, res.Name, TSIGData{
+			Algorithm:  res.Alg,
+			TimeSigned: uint64(time.Now().Unix()),
+			Fudge:      tsigFudge,
+			OrigID:     binary.BigEndian.Uint16(resp[0:2]),
+			Error:      res.Error,
+		})
+	}
+}
+
+// Allowed reports whether the message was signed correctly with one of keys
+func (res *TSIGResult) Allowed(keys []string) bool {
+	if res == nil || res.Error != 0 {
+		return false
+	}
+	for _, k := range keys {
+		if normName(k) == res.Key.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// TSIGStream signs or verifies the messages of one multi-message answer such as
+// a zone transfer (RFC 8945 section 5.3.1). The first message covers the request
+// MAC, later ones the previous MAC, any unsigned messages in between and the timers.
+type TSIGStream struct {
+	key      *TSIGKey
+	mac      []byte
+	first    bool
+	pending  []byte // unsigned messages since the last signed one
+	unsigned int
+}
+
+func NewTSIGStream(key *TSIGKey, requestMAC []byte) *TSIGStream {
+	return &TSIGStream{key: key, mac: requestMAC, first: true}
+}
+
+// Sign signs the next message of the answer
+func (st *TSIGStream) Sign(msg []byte) []byte {
+	signed, mac := st.key.sign(msg, st.mac, TSIGData{}, !st.first)
+	st.mac, st.first = mac, false
+	return signed
+}
+
+// Verify checks the next message. Unsigned messages are accepted in between,
+// the first one and the last one (see Done) must be signed.
+func (st *TSIGStream) Verify(msg []byte) error {
+	unsigned, rr, ok, err := splitTSIG(msg)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		st.unsigned++
+		if st.first || st.unsigned > maxUnsignedXfr {
+			return fmt.Errorf("tsig: unsigned message in signed answer")
+		}
+		st.pending = append(st.pending, msg...)
+		return nil
+	}
+
+	t := rr.RData.TSIG
+	if normName(rr.Name) != st.key.Name || normName(t.Algorithm) != st.key.Algorithm {
+		return fmt.Errorf("tsig: answer signed with key %s", rr.Name)
+	}
+	if t.Error != 0 {
+		return fmt.Errorf("tsig: peer reported error %d", t.Error)
+	}
+
+	body := append(st.pending, unsigned...)
+	if !hmac.Equal(st.key.digest(st.mac, body, t, !st.first), t.MAC) {
+		return fmt.Errorf("tsig: bad signature")
+	}
+	if !tsigTimeOK(t) {
+		return fmt.Errorf("tsig: signature time outside the fudge window")
+	}
+
+	st.mac, st.first = t.MAC, false
+	st.pending, st.unsigned = nil, 0
+	return nil
+}
+
+// Done reports whether the last verified message was signed
+func (st *TSIGStream) Done() bool {
+	return !st.first && st.unsigned == 0
+}
@@ -0,0 +1,98 @@
+package dns
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Record types
+const (
+	TypeA       = 1
+	TypeNS      = 2
+	TypeCNAME   = 5
+	TypeSOA     = 6
+	TypePTR     = 12
+	TypeMX      = 15
+	TypeTXT     = 16
+	TypeAAAA    = 28
+	TypeSRV     = 33
+	TypeOPT     = 41
+	TypeDS      = 43
+	TypeRRSIG   = 46
+	TypeNSEC    = 47
+	TypeDNSKEY  = 48
+	TypeNSEC3   = 50
+	TypeCDS     = 59
+	TypeCDNSKEY = 60
+	TypeSVCB    = 64
+	TypeHTTPS   = 65
+	TypeNXNAME  = 128
+	TypeTSIG    = 250
+	TypeIXFR    = 251
+	TypeAXFR    = 252
+	TypeANY     = 255
+	TypeCAA     = 257
+)
+
+const (
+	ClassIN   = 1
+	ClassNONE = 254
+	ClassANY  = 255
+)
+
+// Opcodes
+const (
+	OpcodeQuery  = 0
+	OpcodeNotify = 4
+	OpcodeUpdate = 5
+)
+
+// Response codes
+const (
+	RCodeSuccess  = 0
+	RCodeFormErr  = 1
+	RCodeServFail = 2
+	RCodeNXDomain = 3
+	RCodeNotImp   = 4
+	RCodeRefused  = 5
+	RCodeYXDomain = 6
+	RCodeYXRRSet  = 7
+	RCodeNXRRSet  = 8
+	RCodeNotAuth  = 9
+	RCodeNotZone  = 10
+)
+
+var typeNames = map[uint16]string{
+	TypeA: "A", TypeNS: "NS", TypeCNAME: "CNAME", TypeSOA: "SOA", TypePTR: "PTR",
+	TypeMX: "MX", TypeTXT: "TXT", TypeAAAA: "AAAA", TypeSRV: "SRV", TypeOPT: "OPT",
+	TypeDS: "DS", TypeRRSIG: "RRSIG", TypeNSEC: "NSEC", TypeDNSKEY: "DNSKEY", TypeNSEC3: "NSEC3",
+	TypeCDS: "CDS", TypeCDNSKEY: "CDNSKEY", TypeSVCB: "SVCB", TypeHTTPS: "HTTPS", TypeNXNAME: "NXNAME",
+	TypeTSIG: "TSIG", TypeIXFR: "IXFR", TypeAXFR: "AXFR", TypeANY: "ANY", TypeCAA: "CAA",
+}
+
+// TypeName returns the mnemonic for t, TYPEnnn (RFC 3597) when unknown
+func TypeName(t uint16) string {
+	if n, ok := typeNames[t]; ok {
+		return n
+	}
+	return "TYPE" + strconv.Itoa(int(t))
+}
+
+// TypeByName is the inverse of TypeName
+func TypeByName(name string) (uint16, error) {
+	name = strings.ToUpper(name)
+	for t, n := range typeNames {
+		if n == name {
+			return t, nil
+		}
+	}
+
+	if num, ok := strings.CutPrefix(name, "TYPE"); ok {
+		t, err := strconv.ParseUint(num, 10, 16)
+		if err == nil {
+			return uint16(t), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown type %q", name)
+}
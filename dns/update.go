@@ -0,0 +1,343 @@
+package dns
+
+import (
+	"net/netip"
+
+	"github.com/rs/zerolog/log"
+)
+
+// updateSet is a mutable copy of a zone's data, owner -> type -> RRset
+type updateSet map[string]map[uint16][]DNSAnswer
+
+func (z *Zone) updateSet() updateSet {
+	set := make(updateSet)
+	for name, n := range z.nodes {
+		for t, rrs := range n.rrsets {
+			if set[name] == nil {
+				set[name] = make(map[uint16][]DNSAnswer)
+			}
+			set[name][t] = append([]DNSAnswer(nil), rrs...)
+		}
+	}
+	return set
+}
+
+func (set updateSet) records() []DNSAnswer {
+	var out []DNSAnswer
+	for _, sets := range set {
+		for _, rrs := range sets {
+			out = append(out, rrs...)
+		}
+	}
+	return out
+}
+
+// rrset returns the records of one type at name, nil when there are none
+func (z *Zone) rrset(name string, t uint16) []DNSAnswer {
+	if n, ok := z.nodes[name]; ok {
+		return n.rrsets[t]
+	}
+	return nil
+}
+
+// inUse reports whether name owns any records, empty non-terminals do not count
+func (z *Zone) inUse(name string) bool {
+	n, ok := z.nodes[name]
+	return ok && len(n.rrsets) > 0
+}
+
+// UpdateAllowed checks the zone's dynamic update ACL
+func (z *Zone) UpdateAllowed(client netip.Addr) bool {
+	client = client.Unmap()
+	for _, p := range z.AllowUpdate {
+		if p.Contains(client) {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleUpdate processes an RFC 2136 UPDATE message and answers with its outcome.
+// sig is the checked TSIG of the message, nil when unsigned.
+func (s *Server) HandleUpdate(q DNSQuestionPacket, msg []byte, client netip.Addr, sig *TSIGResult) []byte {
+	rcode := s.update(q, msg, client, sig)
+
+	resp := NewResponse(q, rcode, nil)
+	resp.Header.RA = false
+	wire, _ := BuildAnswerPacket(resp)
+	return wire
+}
+
+func (s *Server) update(q DNSQuestionPacket, msg []byte, client netip.Addr, sig *TSIGResult) uint8 {
+	pkt, err := ParseAnswerPacket(msg, len(msg))
+	if err != nil || len(pkt.Questions) != 1 || q.Question.Type != TypeSOA {
+		return RCodeFormErr
+	}
+
+	// one update at a time so concurrent clients don't overwrite each other
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+
+	z := s.zones.Get(q.Question.Name)
+	if z == nil {
+		return RCodeNotAuth
+	}
+	if !z.UpdateAllowed(client) && !sig.Allowed(z.UpdateKeys) {
+		log.Warn().Str("zone", z.Origin).Str("client", client.String()).Msg("update refused by ACL")
+		return RCodeRefused
+	}
+
+	if rcode := z.checkPrerequisites(pkt.Answers); rcode != RCodeSuccess {
+		return rcode
+	}
+	if rcode := z.prescanUpdate(pkt.Authority); rcode != RCodeSuccess {
+		return rcode
+	}
+
+	set := z.updateSet()
+	changed := false
+	for _, rr := range pkt.Authority {
+		if z.applyUpdate(set, rr) {
+			changed = true
+		}
+	}
+	if !changed {
+		return RCodeSuccess
+	}
+
+	// the serial must move forward for secondaries to notice (RFC 2136 section 3.6)
+	oldSerial := z.SOA().RData.SOA.Serial
+	soa := set[z.Origin][TypeSOA][0]
+	if !SerialLess(oldSerial, soa.RData.SOA.Serial) {
+		soa.RData.SOA.Serial = oldSerial + 1
+		set[z.Origin][TypeSOA][0] = soa
+	}
+
+	nz, err := NewZone(z.Origin, set.records())
+	if err != nil {
+		log.Error().Str("zone", z.Origin).Msg("update produced an invalid zone " + err.Error())
+		return RCodeServFail
+	}
+	nz.AllowTransfer, nz.AllowUpdate, nz.File = z.AllowTransfer, z.AllowUpdate, z.File
+	nz.TransferKeys, nz.UpdateKeys, nz.Signer = z.TransferKeys, z.UpdateKeys, z.Signer
+
+	if nz.File != "" {
+		if err := SaveZoneFile(nz.File, nz); err != nil {
+			log.Error().Str("zone", z.Origin).Msg("failed to save updated zone " + err.Error())
+			return RCodeServFail
+		}
+	}
+
+	s.zones.Replace(nz)
+	s.stats.DynamicUpdates.Add(1)
+	log.Info().Str("zone", z.Origin).Str("client", client.String()).
+		Uint32("serial", soa.RData.SOA.Serial).Int("changes", len(pkt.Authority)).Msg("dynamic update")
+	return RCodeSuccess
+}
+
+// checkPrerequisites evaluates the prerequisite section (RFC 2136 section 3.2)
+func (z *Zone) checkPrerequisites(prereqs []DNSAnswer) uint8 {
+	// value-dependent RRsets are compared as a whole once collected
+	type setKey struct {
+		name  string
+		rtype uint16
+	}
+	want := make(map[setKey][]DNSAnswer)
+
+	for _, rr := range prereqs {
+		name := normName(rr.Name)
+		if rr.TTL != 0 {
+			return RCodeFormErr
+		}
+		if !IsSubdomain(name, z.Origin) {
+			return RCodeNotZone
+		}
+
+		switch rr.Class {
+		case ClassANY:
+			if rr.RDLength != 0 {
+				return RCodeFormErr
+			}
+			if rr.Type == TypeANY {
+				if !z.inUse(name) {
+					return RCodeNXDomain
+				}
+			} else if len(z.rrset(name, rr.Type)) == 0 {
+				return RCodeNXRRSet
+			}
+
+		case ClassNONE:
+			if rr.RDLength != 0 {
+				return RCodeFormErr
+			}
+			if rr.Type == TypeANY {
+				if z.inUse(name) {
+					return RCodeYXDomain
+				}
+			} else if len(z.rrset(name, rr.Type)) > 0 {
+				return RCodeYXRRSet
+			}
+
+		case ClassIN:
+			k := setKey{name, rr.Type}
+			want[k] = append(want[k], rr)
+
+		default:
+			return RCodeFormErr
+		}
+	}
+
+	for k, rrs := range want {
+		have := z.rrset(k.name, k.rtype)
+		if !sameRRset(have, rrs) {
+			return RCodeNXRRSet
+		}
+	}
+	return RCodeSuccess
+}
+
+// sameRRset compares two RRsets by RDATA, ignoring TTLs and duplicates
+func sameRRset(a, b []DNSAnswer) bool {
+	contains := func(set []DNSAnswer, rr DNSAnswer) bool {
+		for _, have := range set {
+			if sameRData(have, rr) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, rr := range a {
+		if !contains(b, rr) {
+			return false
+		}
+	}
+	for _, rr := range b {
+		if !contains(a, rr) {
+			return false
+		}
+	}
+	return true
+}
+
+// prescanUpdate rejects malformed update records before anything is applied
+// (RFC 2136 section 3.4.1), an update is all or nothing
+func (z *Zone) prescanUpdate(updates []DNSAnswer) uint8 {
+	for _, rr := range updates {
+		if !IsSubdomain(normName(rr.Name), z.Origin) {
+			return RCodeNotZone
+		}
+
+		meta := rr.Type == TypeAXFR || rr.Type == TypeIXFR
+		switch rr.Class {
+		case ClassIN:
+			if meta || rr.Type == TypeANY {
+				return RCodeFormErr
+			}
+		case ClassANY:
+			if rr.TTL != 0 || rr.RDLength != 0 || meta {
+				return RCodeFormErr
+			}
+		case ClassNONE:
+			if rr.TTL != 0 || meta || rr.Type == TypeANY {
+				return RCodeFormErr
+			}
+		default:
+			return RCodeFormErr
+		}
+	}
+	return RCodeSuccess
+}
+
+// applyUpdate performs one update record on set (RFC 2136 section 3.4.2) and
+// reports whether anything changed. The apex SOA and NS RRset can't be removed.
+func (z *Zone) applyUpdate(set updateSet, rr DNSAnswer) bool {
+	name := normName(rr.Name)
+	rr.Name = name
+	apex := name == z.Origin
+	sets := set[name]
+
+	switch rr.Class {
+	case ClassIN:
+		if sets == nil {
+			sets = make(map[uint16][]DNSAnswer)
+			set[name] = sets
+		}
+
+		if rr.Type == TypeSOA {
+			if !apex || !SerialLess(sets[TypeSOA][0].RData.SOA.Serial, rr.RData.SOA.Serial) {
+				return false
+			}
+			sets[TypeSOA] = []DNSAnswer{rr}
+			return true
+		}
+
+		// a CNAME can't share its owner with other data
+		hasCNAME := len(sets[TypeCNAME]) > 0
+		if rr.Type == TypeCNAME && len(sets) > 0 && !hasCNAME {
+			return false
+		}
+		if rr.Type != TypeCNAME && hasCNAME {
+			return false
+		}
+		if rr.Type == TypeCNAME {
+			sets[TypeCNAME] = []DNSAnswer{rr}
+			return true
+		}
+
+		for i, have := range sets[rr.Type] {
+			if sameRData(have, rr) {
+				if have.TTL == rr.TTL {
+					return false
+				}
+				sets[rr.Type][i] = rr
+				return true
+			}
+		}
+		sets[rr.Type] = append(sets[rr.Type], rr)
+		return true
+
+	case ClassANY:
+		if len(sets) == 0 {
+			return false
+		}
+		if rr.Type != TypeANY {
+			if apex && (rr.Type == TypeSOA || rr.Type == TypeNS) || len(sets[rr.Type]) == 0 {
+				return false
+			}
+			delete(sets, rr.Type)
+			return true
+		}
+
+		changed := false
+		for t := range sets {
+			if apex && (t == TypeSOA || t == TypeNS) {
+				continue
+			}
+			delete(sets, t)
+			changed = true
+		}
+		return changed
+
+	case ClassNONE:
+		if rr.Type == TypeSOA {
+			return false
+		}
+		rrs := sets[rr.Type]
+		for i, have := range rrs {
+			if !sameRData(have, rr) {
+				continue
+			}
+			if apex && rr.Type == TypeNS && len(rrs) == 1 {
+				return false
+			}
+			rrs = append(rrs[:i:i], rrs[i+1:]...)
+			if len(rrs) == 0 {
+				delete(sets, rr.Type)
+			} else {
+				sets[rr.Type] = rrs
+			}
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,544 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"nyasaki/dns-server/config"
+)
+
+const (
+	// queries in flight on one DoT connection before another one is opened
+	dotMaxInFlight = 64
+	dotMaxConns    = 4
+	// pooled connections nobody used for this long are closed
+	upstreamIdleTimeout = 30 * time.Second
+	// bootstrap answers are kept at least this long
+	bootstrapMinTTL = time.Minute
+)
+
+// Upstream carries a query to one configured server and returns the reply,
+// which keeps the query's ID
+type Upstream interface {
+	Exchange(msg []byte, timeout time.Duration) ([]byte, error)
+	String() string
+}
+
+// UpstreamOptions are shared by all upstreams of a server
+type UpstreamOptions struct {
+	// plain DNS servers that resolve upstream host names, the system
+	// resolver when empty
+	Bootstrap []string
+	// roots trusted for encrypted upstreams, the system pool when nil
+	RootCAs *x509.CertPool
+	// anonymizing relays (stamps or ip:port) DNSCrypt queries go through
+	Relays []string
+}
+
+// UpstreamOptionsFor reads the upstream settings of cfg
+func UpstreamOptionsFor(cfg *config.Config) (UpstreamOptions, error) {
+	opts := UpstreamOptions{Bootstrap: cfg.Bootstrap, Relays: cfg.Relays}
+	if cfg.UpstreamCA != "" {
+		pem, err := os.ReadFile(cfg.UpstreamCA)
+		if err != nil {
+			return opts, err
+		}
+		if opts.RootCAs, err = x509.SystemCertPool(); err != nil {
+			opts.RootCAs = x509.NewCertPool()
+		}
+		if !opts.RootCAs.AppendCertsFromPEM(pem) {
+			return opts, fmt.Errorf("%s: no certificates found", cfg.UpstreamCA)
+		}
+	}
+	return opts, nil
+}
+
+// NewUpstream parses spec: "host:port" or "udp://host[:53]" for plain DNS,
+// "tls://host[:853]" for DNS-over-TLS, "quic://host[:853]" for DNS-over-QUIC,
+// "https://host[:443]/path" for DNS-over-HTTPS and "sdns://" stamps of
+// plain or DNSCrypt servers. The host name of an encrypted upstream is what its
+// certificate is checked against.
+func NewUpstream(spec string, opts UpstreamOptions) (Upstream, error) {
+	scheme, rest, ok := strings.Cut(spec, "://")
+	if !ok {
+		scheme, rest = "udp", spec
+	}
+	boot := newBootstrap(opts.Bootstrap)
+
+	switch scheme {
+	case "udp":
+		return &plainUpstream{addr: withPort(rest, "53")}, nil
+	case "tls":
+		addr := withPort(rest, "853")
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %v", spec, err)
+		}
+		return &tlsUpstream{
+			addr: addr,
+			dial: boot.dial,
+			tlsConfig: &tls.Config{
+				ServerName:         host,
+				RootCAs:            opts.RootCAs,
+				NextProtos:         []string{"dot"},
+				MinVersion:         tls.VersionTLS12,
+				ClientSessionCache: tls.NewLRUClientSessionCache(dotMaxConns),
+			},
+		}, nil
+	case "quic":
+		addr := withPort(rest, "853")
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %v", spec, err)
+		}
+		return &quicUpstream{
+			addr: addr,
+			boot: boot,
+			tlsConfig: &tls.Config{
+				ServerName:         host,
+				RootCAs:            opts.RootCAs,
+				NextProtos:         []string{"doq"},
+				MinVersion:         tls.VersionTLS13,
+				ClientSessionCache: tls.NewLRUClientSessionCache(1),
+			},
+		}, nil
+	case "sdns":
+		st, err := ParseStamp(spec)
+		if err != nil {
+			return nil, err
+		}
+		if st.Proto == StampPlain {
+			return &plainUpstream{addr: st.Addr}, nil
+		}
+		return newDNSCryptUpstream(st, opts.Relays)
+	case "https":
+		u, err := url.Parse(spec)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("upstream %s: bad url", spec)
+		}
+		return &httpsUpstream{url: spec, client: &http.Client{Transport: &http.Transport{
+			DialContext:         boot.dial,
+			TLSClientConfig:     &tls.Config{RootCAs: opts.RootCAs, MinVersion: tls.VersionTLS12},
+			ForceAttemptHTTP2:   true,
+			MaxIdleConnsPerHost: dotMaxConns,
+			IdleConnTimeout:     upstreamIdleTimeout,
+		}}}, nil
+	}
+	return nil, fmt.Errorf("upstream %s: unknown scheme %q", spec, scheme)
+}
+
+func withPort(hostport, port string) string {
+	if _, _, err := net.SplitHostPort(hostport); err == nil {
+		return hostport
+	}
+	return net.JoinHostPort(strings.Trim(hostport, "[]"), port)
+}
+
+// plainUpstream is classic DNS. The UDP listener keeps its own sockets for
+// it, Exchange is the TCP path of the stream transports.
+type plainUpstream struct {
+	addr string
+}
+
+func (u *plainUpstream) Exchange(msg []byte, timeout time.Duration) ([]byte, error) {
+	return exchangeTCP(u.addr, msg, timeout)
+}
+
+func (u *plainUpstream) String() string { return u.addr }
+
+// tlsUpstream pipelines queries over a few long-lived DoT connections
+// (RFC 7766 section 6.2.1.1), replies are matched by ID
+type tlsUpstream struct {
+	addr      string
+	dial      func(ctx context.Context, network, addr string) (net.Conn, error)
+	tlsConfig *tls.Config
+
+	dialMu sync.Mutex
+	mu     sync.Mutex
+	conns  []*dotConn
+}
+
+type dotConn struct {
+	conn net.Conn
+	wmu  sync.Mutex
+
+	mu      sync.Mutex
+	waiting map[uint16]chan []byte
+	closed  bool
+}
+
+func (u *tlsUpstream) String() string { return "tls://" + u.addr }
+
+func (u *tlsUpstream) Exchange(msg []byte, timeout time.Duration) ([]byte, error) {
+	if len(msg) < DNSHeaderSize {
+		return nil, errors.New("short query")
+	}
+	deadline := time.Now().Add(timeout)
+
+	// a pooled connection the server already closed fails on write, one
+	// retry on a fresh connection covers that
+	var err error
+	for try := 0; try < 2; try++ {
+		var dc *dotConn
+		if dc, err = u.pick(deadline); err != nil {
+			return nil, err
+		}
+		var reply []byte
+		if reply, err = dc.exchange(msg, deadline); err == nil {
+			return reply, nil
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+	}
+	return nil, fmt.Errorf("%s: %v", u, err)
+}
+
+// pick returns the least busy open connection, dialing another one when all
+// of them are full
+func (u *tlsUpstream) pick(deadline time.Time) (*dotConn, error) {
+	if dc := u.pooled(); dc != nil {
+		return dc, nil
+	}
+	u.dialMu.Lock()
+	defer u.dialMu.Unlock()
+	// another query may have dialed while we waited
+	if dc := u.pooled(); dc != nil {
+		return dc, nil
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	raw, err := u.dial(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(raw, u.tlsConfig)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		raw.Close()
+		return nil, err
+	}
+
+	dc := &dotConn{conn: conn, waiting: make(map[uint16]chan []byte)}
+	u.mu.Lock()
+	u.conns = append(u.conns, dc)
+	u.mu.Unlock()
+	go u.read(dc)
+	return dc, nil
+}
+
+// read hands replies to their waiting queries until the connection breaks
+// or sits idle, then drops it from the pool
+func (u *tlsUpstream) read(dc *dotConn) {
+	for {
+		_ = dc.conn.SetReadDeadline(time.Now().Add(upstreamIdleTimeout))
+		reply, err := ReadTCPMessage(dc.conn)
+		if err != nil {
+			break
+		}
+		if len(reply) < DNSHeaderSize {
+			continue
+		}
+		id := binary.BigEndian.Uint16(reply[:2])
+		dc.mu.Lock()
+		ch := dc.waiting[id]
+		delete(dc.waiting, id)
+		dc.mu.Unlock()
+		if ch != nil {
+			ch <- reply
+		}
+	}
+
+	dc.mu.Lock()
+	dc.closed = true
+	for id, ch := range dc.waiting {
+		close(ch)
+		delete(dc.waiting, id)
+	}
+	dc.mu.Unlock()
+	dc.conn.Close()
+
+	u.mu.Lock()
+	for i, c := range u.conns {
+		if c == dc {
+			u.conns = append(u.conns[:i], u.conns[i+1:]...)
+			break
+		}
+	}
+	u.mu.Unlock()
+}
+
+func (u *tlsUpstream) pooled() *dotConn {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var best *dotConn
+	bestLoad := 0
+	for _, dc := range u.conns {
+		if load, ok := dc.load(); ok && (best == nil || load < bestLoad) {
+			best, bestLoad = dc, load
+		}
+	}
+	if best != nil && (bestLoad < dotMaxInFlight || len(u.conns) >= dotMaxConns) {
+		return best
+	}
+	return nil
+}
+
+func (dc *dotConn) load() (int, bool) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	return len(dc.waiting), !dc.closed
+}
+
+// exchange sends msg under an ID unique on this connection and gives the
+// reply back with the caller's ID
+func (dc *dotConn) exchange(msg []byte, deadline time.Time) ([]byte, error) {
+	ch := make(chan []byte, 1)
+	dc.mu.Lock()
+	if dc.closed {
+		dc.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	id := uint16(rand.Uint32())
+	for dc.waiting[id] != nil {
+		id++
+	}
+	dc.waiting[id] = ch
+	dc.mu.Unlock()
+
+	query := append([]byte(nil), msg...)
+	binary.BigEndian.PutUint16(query[:2], id)
+	dc.wmu.Lock()
+	_ = dc.conn.SetWriteDeadline(deadline)
+	err := WriteTCPMessage(dc.conn, query)
+	dc.wmu.Unlock()
+	if err != nil {
+		dc.conn.Close()
+		return nil, err
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case reply, ok := <-ch:
+		if !ok {
+			return nil, net.ErrClosed
+		}
+		copy(reply[:2], msg[:2])
+		return reply, nil
+	case <-timer.C:
+		dc.mu.Lock()
+		delete(dc.waiting, id)
+		dc.mu.Unlock()
+		return nil, errors.New("timeout")
+	}
+}
+
+// httpsUpstream posts queries to a DoH endpoint (RFC 8484), the HTTP client
+// keeps the connections and multiplexes them over HTTP/2
+type httpsUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func (u *httpsUpstream) String() string { return u.url }
+
+func (u *httpsUpstream) Exchange(msg []byte, timeout time.Duration) ([]byte, error) {
+	if len(msg) < DNSHeaderSize {
+		return nil, errors.New("short query")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// ID 0 keeps the request cacheable on the way (RFC 8484 section 4.1)
+	query := append([]byte(nil), msg...)
+	query[0], query[1] = 0, 0
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", u.url, resp.Status)
+	}
+	if ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); ct != dohContentType {
+		return nil, fmt.Errorf("%s: answered %q", u.url, ct)
+	}
+	reply, err := io.ReadAll(io.LimitReader(resp.Body, dohMaxMessage))
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) < DNSHeaderSize {
+		return nil, fmt.Errorf("%s: short reply", u.url)
+	}
+	copy(reply[:2], msg[:2])
+	return reply, nil
+}
+
+// bootstrap finds the addresses of upstream host names without asking the
+// upstreams themselves
+type bootstrap struct {
+	servers []string
+
+	mu    sync.Mutex
+	addrs map[string]bootEntry
+}
+
+type bootEntry struct {
+	addrs   []netip.Addr
+	expires time.Time
+}
+
+func newBootstrap(servers []string) *bootstrap {
+	return &bootstrap{servers: servers, addrs: make(map[string]bootEntry)}
+}
+
+// dial connects to addr, trying each address its host resolves to
+func (b *bootstrap) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	addrs, err := b.resolve(addr)
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	for _, a := range addrs {
+		var c net.Conn
+		if c, err = d.DialContext(ctx, network, a); err == nil {
+			return c, nil
+		}
+	}
+	return nil, err
+}
+
+// resolve turns host:port into the addresses to try. Without bootstrap
+// servers the host is left to the system resolver.
+func (b *bootstrap) resolve(addr string) ([]string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := netip.ParseAddr(host); err == nil || len(b.servers) == 0 {
+		return []string{addr}, nil
+	}
+
+	ips, err := b.lookup(host)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, len(ips))
+	for i, ip := range ips {
+		out[i] = net.JoinHostPort(ip.String(), port)
+	}
+	return out, nil
+}
+
+func (b *bootstrap) lookup(host string) ([]netip.Addr, error) {
+	name := normName(host)
+	b.mu.Lock()
+	e, ok := b.addrs[name]
+	b.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.addrs, nil
+	}
+
+	var err error
+	for _, qtype := range []uint16{TypeA, TypeAAAA} {
+		for _, server := range b.servers {
+			var ttl time.Duration
+			if e.addrs, ttl, err = b.ask(server, name, qtype); err == nil && len(e.addrs) > 0 {
+				e.expires = time.Now().Add(max(ttl, bootstrapMinTTL))
+				b.mu.Lock()
+				b.addrs[name] = e
+				b.mu.Unlock()
+				return e.addrs, nil
+			}
+		}
+	}
+	if err == nil {
+		err = errors.New("no addresses")
+	}
+	return nil, fmt.Errorf("bootstrap %s: %v", host, err)
+}
+
+func (b *bootstrap) ask(server, name string, qtype uint16) ([]netip.Addr, time.Duration, error) {
+	query := BuildQuery(DNSQuestion{Name: name, Type: qtype, Class: ClassIN})
+	binary.BigEndian.PutUint16(query[0:2], uint16(rand.Uint32()))
+	reply, err := exchangeUDP(server, query, tcpUpstreamTimeout)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := ParseAnswerPacket(reply, len(reply))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var addrs []netip.Addr
+	var ttl uint32
+	for _, rr := range resp.Answers {
+		var ip netip.Addr
+		switch rr.Type {
+		case TypeA:
+			ip = netip.AddrFrom4(rr.RData.A)
+		case TypeAAAA:
+			ip = netip.AddrFrom16(rr.RData.AAAA)
+		default:
+			continue
+		}
+		if len(addrs) == 0 || rr.TTL < ttl {
+			ttl = rr.TTL
+		}
+		addrs = append(addrs, ip)
+	}
+	return addrs, time.Duration(ttl) * time.Second, nil
+}
+
+// newTransports sets up every upstream the config names, keyed by spec, the
+// default upstream is under "" as well
+func newTransports(cfg *config.Config, router *Router, policy *Policy) (map[string]Upstream, error) {
+	opts, err := UpstreamOptionsFor(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	specs := append([]string{cfg.Upstream}, router.Upstreams()...)
+	for _, g := range policy.Groups() {
+		specs = append(specs, g.Upstream)
+	}
+	out := make(map[string]Upstream)
+	for _, spec := range specs {
+		if spec == "" || out[spec] != nil {
+			continue
+		}
+		up, err := NewUpstream(spec, opts)
+		if err != nil {
+			return nil, err
+		}
+		out[spec] = up
+	}
+	if up := out[cfg.Upstream]; up != nil {
+		out[""] = up
+	}
+	return out, nil
+}
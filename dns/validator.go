@@ -0,0 +1,789 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"nyasaki/dns-server/config"
+)
+
+// ValidationState is the DNSSEC status of an answer (RFC 4035 section 4.3)
+type ValidationState uint8
+
+const (
+	Indeterminate ValidationState = iota // not validated
+	Insecure                             // provably unsigned
+	Secure
+	Bogus
+)
+
+func (st ValidationState) String() string {
+	switch st {
+	case Insecure:
+		return "insecure"
+	case Secure:
+		return "secure"
+	case Bogus:
+		return "bogus"
+	}
+	return "indeterminate"
+}
+
+// rootAnchors are the DS records of the IANA root KSKs, KSK-2017 and KSK-2024
+var rootAnchors = []string{
+	"20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	"38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+const (
+	// zones hashing NSEC3 more often than this count as unsigned (RFC 9276 section 3.2)
+	maxNSEC3Iterations = 150
+	// how long answers that failed validation are cached (RFC 4035 section 4.7)
+	bogusTTL = time.Minute
+	// how long keys and zone cuts learned while validating are kept at most
+	maxTrustTTL = 24 * time.Hour
+)
+
+// Fetcher looks a question up, DNSSEC records included, for the validator
+type Fetcher func(q DNSQuestion) (DNSAnswerPacket, error)
+
+// zoneTrust is what the chain of trust established at a name
+type zoneTrust struct {
+	zone    string       // closest enclosing zone
+	keys    []DNSKEYData // its validated zone keys, nil when the zone is unsigned
+	cut     bool         // the name is a zone cut, other entries only save lookups
+	expires time.Time
+}
+
+// Validator checks answers against the chain of trust from the root trust
+// anchors down (RFC 4035 section 5). Keys and zone cuts it learns are cached
+// for their TTL.
+type Validator struct {
+	anchors []DSData
+	fetch   Fetcher
+
+	mu    sync.Mutex
+	trust map[string]zoneTrust
+
+	// validated NSEC/NSEC3 ranges, nil unless aggressive use is on
+	denials *denialCache
+}
+
+func NewValidator(cfg config.DNSSECConfig, fetch Fetcher) (*Validator, error) {
+	anchors := cfg.TrustAnchors
+	if len(anchors) == 0 {
+		anchors = rootAnchors
+	}
+
+	v := &Validator{fetch: fetch, trust: make(map[string]zoneTrust)}
+	if cfg.AggressiveNSEC {
+		v.denials = newDenialCache()
+	}
+	for _, a := range anchors {
+		ds, err := ParseDS(a)
+		if err != nil {
+			return nil, fmt.Errorf("dnssec: trust anchor: %v", err)
+		}
+		v.anchors = append(v.anchors, ds)
+	}
+	return v, nil
+}
+
+// ParseDS reads DS RDATA in presentation format: key tag, algorithm, digest type, hex digest
+func ParseDS(s string) (DSData, error) {
+	f := strings.Fields(s)
+	if len(f) < 4 {
+		return DSData{}, fmt.Errorf("DS %q: need key tag, algorithm, digest type and digest", s)
+	}
+	tag, err1 := strconv.ParseUint(f[0], 10, 16)
+	alg, err2 := strconv.ParseUint(f[1], 10, 8)
+	dt, err3 := strconv.ParseUint(f[2], 10, 8)
+	digest, err4 := hex.DecodeString(strings.Join(f[3:], ""))
+	if err := errors.Join(err1, err2, err3, err4); err != nil {
+		return DSData{}, fmt.Errorf("DS %q: %v", s, err)
+	}
+	return DSData{KeyTag: uint16(tag), Algorithm: uint8(alg), DigestType: uint8(dt), Digest: digest}, nil
+}
+
+// rrset is one owner's records of one type with the signatures covering them
+type rrset struct {
+	owner string
+	rtype uint16
+	rrs   []DNSAnswer
+	sigs  []RRSIGData
+}
+
+func rrsets(section []DNSAnswer) []*rrset {
+	var out []*rrset
+	find := func(owner string, t uint16) *rrset {
+		for _, set := range out {
+			if set.owner == owner && set.rtype == t {
+				return set
+			}
+		}
+		return nil
+	}
+
+	for _, rr := range section {
+		if rr.Type == TypeRRSIG || rr.Type == TypeOPT || rr.Type == TypeTSIG {
+			continue
+		}
+		owner := normName(rr.Name)
+		set := find(owner, rr.Type)
+		if set == nil {
+			set = &rrset{owner: owner, rtype: rr.Type}
+			out = append(out, set)
+		}
+		set.rrs = append(set.rrs, rr)
+	}
+	for _, rr := range section {
+		if rr.Type != TypeRRSIG {
+			continue
+		}
+		if set := find(normName(rr.Name), rr.RData.RRSIG.TypeCovered); set != nil {
+			set.sigs = append(set.sigs, rr.RData.RRSIG)
+		}
+	}
+	return out
+}
+
+func (set *rrset) ttl() time.Duration {
+	ttl := set.rrs[0].TTL
+	for _, rr := range set.rrs {
+		ttl = min(ttl, rr.TTL)
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// Validate works out the security status of resp, the reply to its question.
+// Bogus comes with the reason.
+func (v *Validator) Validate(resp DNSAnswerPacket) (ValidationState, error) {
+	if len(resp.Questions) != 1 {
+		return Indeterminate, nil
+	}
+	q := resp.Questions[0]
+
+	// every RRset of the answer stands on its own, a CNAME chain may cross zones
+	type expansion struct {
+		owner  string
+		labels int
+	}
+	var expanded []expansion
+	state := Secure
+	for _, set := range rrsets(resp.Answers) {
+		st, labels, err := v.validateSet(set)
+		if err != nil {
+			return Bogus, err
+		}
+		if st == Insecure {
+			state = Insecure
+		}
+		if st == Secure && labels < labelCount(set.owner) {
+			expanded = append(expanded, expansion{set.owner, labels})
+		}
+	}
+
+	name, answered := chainEnd(resp.Answers, normName(q.Name), q.Type)
+	negative := !answered || resp.Header.RCode == RCodeNXDomain
+	if state == Insecure || !negative && len(expanded) == 0 {
+		return state, nil
+	}
+
+	// the rest needs proof from the authority section
+	zone, proofs, state, err := v.denial(resp.Authority, name)
+	if state != Secure {
+		return state, err
+	}
+
+	for _, w := range expanded {
+		if !provesNoCloser(proofs, w.owner, w.labels, zone) {
+			return Bogus, fmt.Errorf("%s: wildcard answer without proof the name doesn't exist", fqdn(w.owner))
+		}
+	}
+	switch {
+	case !negative:
+	case resp.Header.RCode == RCodeNXDomain:
+		if !provesNXDomain(proofs, name, zone) {
+			return Bogus, fmt.Errorf("%s: NXDOMAIN without proof", fqdn(name))
+		}
+	default:
+		if !provesNoData(proofs, name, q.Type, zone) {
+			return Bogus, fmt.Errorf("%s %s: NODATA without proof", fqdn(name), TypeName(q.Type))
+		}
+	}
+	v.remember(zone, resp.Authority, proofs)
+	return Secure, nil
+}
+
+// remember keeps the proofs of a secure answer for aggressive negative caching,
+// along with the zone's SOA when that verifies too
+func (v *Validator) remember(zone string, authority []DNSAnswer, proofs []*rrset) {
+	if v.denials == nil || len(proofs) == 0 {
+		return
+	}
+	t, err := v.trustFor(zone)
+	if err != nil || t.zone != zone || t.keys == nil {
+		return
+	}
+	for _, set := range rrsets(authority) {
+		if set.rtype == TypeSOA && set.owner == zone {
+			if _, err := v.verify(set, t); err == nil {
+				v.denials.add(zone, set, proofs)
+			}
+			return
+		}
+	}
+}
+
+// Synthesize answers q from the NSEC/NSEC3 records of earlier secure answers
+// when they prove the name or type doesn't exist (RFC 8198)
+func (v *Validator) Synthesize(q DNSQuestionPacket) (DNSAnswerPacket, bool) {
+	if v.denials == nil {
+		return DNSAnswerPacket{}, false
+	}
+	return v.denials.synthesize(q)
+}
+
+// validateSet checks one RRset and returns the labels value of the signature
+// that verified it
+func (v *Validator) validateSet(set *rrset) (ValidationState, int, error) {
+	if len(set.sigs) == 0 {
+		t, err := v.trustFor(set.owner)
+		if err != nil {
+			return Bogus, 0, err
+		}
+		if t.keys == nil {
+			return Insecure, 0, nil
+		}
+		return Bogus, 0, fmt.Errorf("%s %s: missing signature", fqdn(set.owner), TypeName(set.rtype))
+	}
+
+	signer := normName(set.sigs[0].SignerName)
+	if !IsSubdomain(set.owner, signer) {
+		return Bogus, 0, fmt.Errorf("%s %s: signed by outsider %s", fqdn(set.owner), TypeName(set.rtype), fqdn(signer))
+	}
+	t, err := v.trustFor(signer)
+	if err != nil {
+		return Bogus, 0, err
+	}
+	if t.keys == nil {
+		return Insecure, 0, nil
+	}
+	if t.zone != signer {
+		return Bogus, 0, fmt.Errorf("%s %s: signer %s is not a zone", fqdn(set.owner), TypeName(set.rtype), fqdn(signer))
+	}
+
+	labels, err := v.verify(set, t)
+	if err != nil {
+		return Bogus, 0, err
+	}
+	return Secure, labels, nil
+}
+
+// verify checks set against the keys of t's zone, one good signature is enough
+func (v *Validator) verify(set *rrset, t zoneTrust) (int, error) {
+	err := fmt.Errorf("%s %s: no signature by %s", fqdn(set.owner), TypeName(set.rtype), fqdn(t.zone))
+	now := time.Now()
+	for _, sig := range set.sigs {
+		switch {
+		case normName(sig.SignerName) != t.zone:
+			continue
+		case int(sig.Labels) > labelCount(set.owner):
+			err = fmt.Errorf("%s %s: RRSIG has more labels than its owner", fqdn(set.owner), TypeName(set.rtype))
+			continue
+		case !sigTimeOK(sig, now):
+			err = fmt.Errorf("%s %s: signature expired or not yet valid", fqdn(set.owner), TypeName(set.rtype))
+			continue
+		}
+
+		for _, k := range t.keys {
+			if k.Algorithm != sig.Algorithm || KeyTag(k) != sig.KeyTag {
+				continue
+			}
+			if verr := VerifyRRSIG(sig, k, set.rrs); verr != nil {
+				err = fmt.Errorf("%s %s: %v", fqdn(set.owner), TypeName(set.rtype), verr)
+				continue
+			}
+			return int(sig.Labels), nil
+		}
+	}
+	return 0, err
+}
+
+// denial finds the zone that signed a negative or wildcard answer for name and
+// returns its NSEC/NSEC3 records that verify. Unsigned denials are only
+// acceptable from unsigned zones.
+func (v *Validator) denial(section []DNSAnswer, name string) (string, []*rrset, ValidationState, error) {
+	sets := rrsets(section)
+
+	signer := ""
+	for _, set := range sets {
+		switch set.rtype {
+		case TypeSOA, TypeNSEC, TypeNSEC3:
+			if len(set.sigs) > 0 && signer == "" {
+				signer = normName(set.sigs[0].SignerName)
+			}
+		}
+	}
+
+	if signer == "" || !IsSubdomain(name, signer) {
+		t, err := v.trustFor(name)
+		if err != nil {
+			return "", nil, Bogus, err
+		}
+		if t.keys == nil {
+			return t.zone, nil, Insecure, nil
+		}
+		return "", nil, Bogus, fmt.Errorf("%s: unsigned denial from signed zone %s", fqdn(name), fqdn(t.zone))
+	}
+
+	t, err := v.trustFor(signer)
+	if err != nil {
+		return "", nil, Bogus, err
+	}
+	if t.keys == nil {
+		return signer, nil, Insecure, nil
+	}
+	if t.zone != signer {
+		return "", nil, Bogus, fmt.Errorf("%s: denial signer %s is not a zone", fqdn(name), fqdn(signer))
+	}
+
+	proofs := v.verifiedProofs(sets, t)
+	for _, p := range proofs {
+		if p.rtype == TypeNSEC3 && p.rrs[0].RData.NSEC3.Iterations > maxNSEC3Iterations {
+			return signer, nil, Insecure, nil
+		}
+	}
+	return signer, proofs, Secure, nil
+}
+
+// verifiedProofs returns the NSEC and NSEC3 RRsets signed by t's zone
+func (v *Validator) verifiedProofs(sets []*rrset, t zoneTrust) []*rrset {
+	var out []*rrset
+	for _, set := range sets {
+		if set.rtype != TypeNSEC && set.rtype != TypeNSEC3 {
+			continue
+		}
+		if _, err := v.verify(set, t); err == nil {
+			out = append(out, set)
+		}
+	}
+	return out
+}
+
+// chainEnd follows the CNAMEs in answers from name and reports where they end
+// and whether that name has data of qtype
+func chainEnd(answers []DNSAnswer, name string, qtype uint16) (string, bool) {
+	for hops := 0; hops <= maxCNAMEHops; hops++ {
+		next := ""
+		for _, rr := range answers {
+			if normName(rr.Name) != name {
+				continue
+			}
+			if rr.Type == qtype || qtype == TypeANY {
+				return name, true
+			}
+			if rr.Type == TypeCNAME {
+				next = normName(rr.RData.Name)
+			}
+		}
+		if next == "" {
+			return name, false
+		}
+		name = next
+	}
+	return name, false
+}
+
+// trustFor walks the chain of trust from the root down to name and returns the
+// closest enclosing zone, with its keys when it is signed
+func (v *Validator) trustFor(name string) (zoneTrust, error) {
+	t, err := v.rootTrust()
+	if err != nil {
+		return t, err
+	}
+
+	labels := splitLabels(normName(name))
+	for i := len(labels) - 1; i >= 0 && t.keys != nil; i-- {
+		ct, err := v.child(strings.Join(labels[i:], "."), t)
+		if err != nil {
+			return ct, err
+		}
+		if ct.cut {
+			t = ct
+		}
+	}
+	return t, nil
+}
+
+func (v *Validator) cached(name string) (zoneTrust, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	t, ok := v.trust[name]
+	if ok && time.Now().After(t.expires) {
+		delete(v.trust, name)
+		return zoneTrust{}, false
+	}
+	return t, ok
+}
+
+func (v *Validator) store(name string, t zoneTrust, ttl time.Duration) zoneTrust {
+	t.expires = time.Now().Add(min(ttl, maxTrustTTL))
+	v.mu.Lock()
+	v.trust[name] = t
+	v.mu.Unlock()
+	return t
+}
+
+func (v *Validator) rootTrust() (zoneTrust, error) {
+	if t, ok := v.cached(""); ok {
+		return t, nil
+	}
+	keys, ttl, err := v.zoneKeys("", v.anchors)
+	if err != nil {
+		return zoneTrust{}, err
+	}
+	return v.store("", zoneTrust{keys: keys, cut: true}, ttl), nil
+}
+
+// child finds out whether c, just below the part of the tree parent covers, is
+// a zone cut and whether that zone is signed. The parent zone has to sign the
+// DS records or prove there are none.
+func (v *Validator) child(c string, parent zoneTrust) (zoneTrust, error) {
+	if t, ok := v.cached(c); ok {
+		return t, nil
+	}
+
+	resp, err := v.fetch(DNSQuestion{Name: c, Type: TypeDS, Class: ClassIN})
+	if err != nil {
+		return zoneTrust{}, fmt.Errorf("DS %s: %v", fqdn(c), err)
+	}
+
+	notCut := zoneTrust{zone: parent.zone, keys: parent.keys}
+	for _, set := range rrsets(resp.Answers) {
+		if set.owner != c {
+			continue
+		}
+		switch set.rtype {
+		case TypeCNAME:
+			// an alias never starts a zone
+			if _, err := v.verify(set, parent); err != nil {
+				return zoneTrust{}, err
+			}
+			return v.store(c, notCut, set.ttl()), nil
+
+		case TypeDS:
+			if _, err := v.verify(set, parent); err != nil {
+				return zoneTrust{}, err
+			}
+			var ds []DSData
+			for _, rr := range set.rrs {
+				d := rr.RData.DS
+				if _, ok := digestHash(d.DigestType); ok && SupportedAlgorithm(d.Algorithm) {
+					ds = append(ds, d)
+				}
+			}
+			if len(ds) == 0 {
+				// nothing we can check, as good as unsigned (RFC 4035 section 5.2)
+				return v.store(c, zoneTrust{zone: c, cut: true}, set.ttl()), nil
+			}
+			keys, ttl, err := v.zoneKeys(c, ds)
+			if err != nil {
+				return zoneTrust{}, err
+			}
+			return v.store(c, zoneTrust{zone: c, keys: keys, cut: true}, min(ttl, set.ttl())), nil
+		}
+	}
+
+	// no DS, the parent has to prove there is none
+	proofs := v.verifiedProofs(rrsets(resp.Authority), parent)
+	switch dsAbsence(proofs, c, parent.zone) {
+	case noCut:
+		return v.store(c, notCut, proofTTL(proofs)), nil
+	case insecureCut:
+		return v.store(c, zoneTrust{zone: c, cut: true}, proofTTL(proofs)), nil
+	}
+	return zoneTrust{}, fmt.Errorf("DS %s: no proof it doesn't exist", fqdn(c))
+}
+
+func proofTTL(proofs []*rrset) time.Duration {
+	ttl := maxTrustTTL
+	for _, p := range proofs {
+		ttl = min(ttl, p.ttl())
+	}
+	return ttl
+}
+
+// zoneKeys fetches and checks zone's DNSKEY RRset: it has to be signed by a key
+// one of the DS records (or trust anchors) vouches for
+func (v *Validator) zoneKeys(zone string, ds []DSData) ([]DNSKEYData, time.Duration, error) {
+	resp, err := v.fetch(DNSQuestion{Name: zone, Type: TypeDNSKEY, Class: ClassIN})
+	if err != nil {
+		return nil, 0, fmt.Errorf("DNSKEY %s: %v", fqdn(zone), err)
+	}
+
+	var set *rrset
+	for _, s := range rrsets(resp.Answers) {
+		if s.owner == zone && s.rtype == TypeDNSKEY {
+			set = s
+		}
+	}
+	if set == nil {
+		return nil, 0, fmt.Errorf("%s has a DS but no DNSKEY", fqdn(zone))
+	}
+
+	var keys []DNSKEYData
+	for _, rr := range set.rrs {
+		k := rr.RData.DNSKEY
+		if k.Protocol == 3 && k.Flags&DNSKEYZone != 0 && k.Flags&DNSKEYRevoke == 0 {
+			keys = append(keys, k)
+		}
+	}
+
+	for _, k := range keys {
+		if !matchesDS(zone, k, ds) {
+			continue
+		}
+		if _, err := v.verify(set, zoneTrust{zone: zone, keys: []DNSKEYData{k}}); err == nil {
+			return keys, set.ttl(), nil
+		}
+	}
+	return nil, 0, fmt.Errorf("no DNSKEY of %s matching its DS signs the key set", fqdn(zone))
+}
+
+func matchesDS(zone string, k DNSKEYData, ds []DSData) bool {
+	tag := KeyTag(k)
+	for _, d := range ds {
+		if d.KeyTag != tag || d.Algorithm != k.Algorithm {
+			continue
+		}
+		if digest, err := DSDigest(zone, k, d.DigestType); err == nil && bytes.Equal(digest, d.Digest) {
+			return true
+		}
+	}
+	return false
+}
+
+// cutProof is what the parent proved about a missing DS
+type cutProof int
+
+const (
+	noProof     cutProof = iota
+	noCut                // the name is no delegation
+	insecureCut          // a delegation to an unsigned zone
+)
+
+func dsAbsence(proofs []*rrset, c, zone string) cutProof {
+	fromTypes := func(types []uint16) cutProof {
+		switch {
+		case HasType(types, TypeDS) || HasType(types, TypeSOA):
+			// claims a DS we didn't get, or comes from the child side
+			return noProof
+		case HasType(types, TypeNS):
+			return insecureCut
+		}
+		return noCut
+	}
+
+	if n, ok := nsecFind(proofs, c, zone, false); ok {
+		return fromTypes(n.Types)
+	}
+	if _, ok := nsecFind(proofs, c, zone, true); ok {
+		// an empty non-terminal or no such name, either way no delegation
+		return noCut
+	}
+
+	if n, ok := nsec3Find(proofs, c, zone, false); ok {
+		return fromTypes(n.Types)
+	}
+	if n, ok := nsec3Find(proofs, c, zone, true); ok {
+		// opt-out spans may hide unsigned delegations (RFC 5155 section 6)
+		if n.Flags&NSEC3OptOut != 0 {
+			return insecureCut
+		}
+		return noCut
+	}
+	return noProof
+}
+
+// nsecFind returns the NSEC owned by name, or with cover set the one proving
+// name doesn't exist
+func nsecFind(proofs []*rrset, name, zone string, cover bool) (NSECData, bool) {
+	for _, p := range proofs {
+		if p.rtype != TypeNSEC {
+			continue
+		}
+		n := p.rrs[0].RData.NSEC
+		if !cover && p.owner == name {
+			return n, true
+		}
+		if cover && nsecCovers(p.owner, normName(n.NextName), name, zone) {
+			return n, true
+		}
+	}
+	return NSECData{}, false
+}
+
+// nsec3Find is nsecFind for the hashed owner names of NSEC3
+func nsec3Find(proofs []*rrset, name, zone string, cover bool) (NSEC3Data, bool) {
+	for _, p := range proofs {
+		if p.rtype != TypeNSEC3 {
+			continue
+		}
+		label, pzone, _ := strings.Cut(p.owner, ".")
+		if pzone != zone || !IsSubdomain(name, zone) {
+			continue
+		}
+		n := p.rrs[0].RData.NSEC3
+		h := NSEC3Hash(name, n.Salt, n.Iterations)
+		if !cover && label == h {
+			return n, true
+		}
+		if cover && hashCovers(label, strings.ToLower(nsec3Encoding.EncodeToString(n.NextHashed)), h) {
+			return n, true
+		}
+	}
+	return NSEC3Data{}, false
+}
+
+// closestEncloser runs the NSEC3 closest encloser proof (RFC 5155 section
+// 8.3): an ancestor that exists and the name just below it that doesn't
+func closestEncloser(proofs []*rrset, name, zone string) (ce string, nc NSEC3Data, ok bool) {
+	for cur := name; cur != zone && cur != ""; {
+		_, parent, _ := strings.Cut(cur, ".")
+		if _, found := nsec3Find(proofs, parent, zone, false); found {
+			nc, ok = nsec3Find(proofs, cur, zone, true)
+			return parent, nc, ok
+		}
+		cur = parent
+	}
+	return "", nc, false
+}
+
+// commonAncestor is the longest name both a and b sit below
+func commonAncestor(a, b string) string {
+	la, lb := splitLabels(a), splitLabels(b)
+	i := 0
+	for i < len(la) && i < len(lb) && la[len(la)-1-i] == lb[len(lb)-1-i] {
+		i++
+	}
+	return strings.Join(la[len(la)-i:], ".")
+}
+
+// nsecEncloser is the closest encloser of name as seen from the NSEC covering it
+func nsecEncloser(proofs []*rrset, name, zone string) (string, bool) {
+	for _, p := range proofs {
+		if p.rtype != TypeNSEC {
+			continue
+		}
+		next := normName(p.rrs[0].RData.NSEC.NextName)
+		if nsecCovers(p.owner, next, name, zone) {
+			ce := commonAncestor(name, p.owner)
+			if other := commonAncestor(name, next); len(other) > len(ce) {
+				ce = other
+			}
+			return ce, true
+		}
+	}
+	return "", false
+}
+
+func wildcardOf(ce string) string {
+	if ce == "" {
+		return "*"
+	}
+	return "*." + ce
+}
+
+// provesNXDomain checks that name and the wildcard that could have matched it are both absent
+func provesNXDomain(proofs []*rrset, name, zone string) bool {
+	if ce, ok := nsecEncloser(proofs, name, zone); ok {
+		_, covered := nsecFind(proofs, wildcardOf(ce), zone, true)
+		return covered
+	}
+	if ce, _, ok := closestEncloser(proofs, name, zone); ok {
+		_, covered := nsec3Find(proofs, wildcardOf(ce), zone, true)
+		return covered
+	}
+	return false
+}
+
+// provesNoData checks that name exists without qtype, directly or through a wildcard
+func provesNoData(proofs []*rrset, name string, qtype uint16, zone string) bool {
+	lacks := func(types []uint16) bool {
+		return !HasType(types, qtype) && !HasType(types, TypeCNAME)
+	}
+
+	if n, ok := nsecFind(proofs, name, zone, false); ok {
+		return lacks(n.Types)
+	}
+	for _, p := range proofs {
+		// empty non-terminal: the next owner sits below name
+		if p.rtype == TypeNSEC && nsecCovers(p.owner, normName(p.rrs[0].RData.NSEC.NextName), name, zone) &&
+			IsSubdomain(normName(p.rrs[0].RData.NSEC.NextName), name) {
+			return true
+		}
+	}
+	if ce, ok := nsecEncloser(proofs, name, zone); ok {
+		n, ok := nsecFind(proofs, wildcardOf(ce), zone, false)
+		return ok && lacks(n.Types)
+	}
+
+	if n, ok := nsec3Find(proofs, name, zone, false); ok {
+		return lacks(n.Types)
+	}
+	if ce, nc, ok := closestEncloser(proofs, name, zone); ok {
+		// an unsigned delegation in an opt-out span has no DS (RFC 5155 section 8.6)
+		if qtype == TypeDS && nc.Flags&NSEC3OptOut != 0 {
+			return true
+		}
+		n, ok := nsec3Find(proofs, wildcardOf(ce), zone, false)
+		return ok && lacks(n.Types)
+	}
+	return false
+}
+
+// provesNoCloser checks that a wildcard expansion was legitimate: the name
+// below the wildcard's parent that leads to owner doesn't exist (RFC 4035 section 5.3.4)
+func provesNoCloser(proofs []*rrset, owner string, labels int, zone string) bool {
+	if _, ok := nsecFind(proofs, owner, zone, true); ok {
+		return true
+	}
+	parts := splitLabels(owner)
+	next := strings.Join(parts[len(parts)-labels-1:], ".")
+	_, ok := nsec3Find(proofs, next, zone, true)
+	return ok
+}
+
+// UpstreamFetcher asks up, for validating forwarded answers
+func UpstreamFetcher(up Upstream) Fetcher {
+	return func(q DNSQuestion) (DNSAnswerPacket, error) {
+		if up == nil {
+			return DNSAnswerPacket{}, fmt.Errorf("no upstream to fetch %s from", q.Name)
+		}
+		query := WithDO(BuildQuery(q))
+		binary.BigEndian.PutUint16(query[0:2], uint16(rand.Uint32()))
+
+		reply, err := up.Exchange(query, tcpUpstreamTimeout)
+		if err != nil {
+			return DNSAnswerPacket{}, err
+		}
+		resp, err := ParseAnswerPacket(reply, len(reply))
+		if err != nil {
+			return resp, err
+		}
+		if resp.Header.RCode != RCodeSuccess && resp.Header.RCode != RCodeNXDomain {
+			return resp, fmt.Errorf("%s answered rcode %d", up, resp.Header.RCode)
+		}
+		return resp, nil
+	}
+}
@@ -0,0 +1,222 @@
+package dns
+
+import (
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// xfrMessageLimit keeps transfer messages well below the 64k TCP frame
+const xfrMessageLimit = 16 * 1024
+
+// SerialLess compares SOA serials with RFC 1982 sequence space arithmetic
+func SerialLess(a, b uint32) bool {
+	return a != b && b-a < 1<<31
+}
+
+// PackTransfer splits records into as few messages as fit in limit bytes each.
+// Only the first message repeats the question (RFC 5936 section 2.2).
+func PackTransfer(q DNSQuestionPacket, records []DNSAnswer, limit int) ([][]byte, error) {
+	hdr := DNSHeader{ID: q.Header.ID, QR: true, AA: true, Opcode: q.Header.Opcode}
+
+	var msgs [][]byte
+	var pkt []byte
+	var names map[string]int
+	count := 0
+
+	start := func(first bool) {
+		pkt = make([]byte, DNSHeaderSize, limit)
+		names = make(map[string]int)
+		count = 0
+		if first {
+			pkt, _ = BuildQuestion(pkt, q.Question, names)
+		}
+	}
+	finish := func(first bool) {
+		h := hdr
+		h.ANCount = uint16(count)
+		if first {
+			h.QDCount = 1
+		}
+		copy(pkt[:DNSHeaderSize], BuildHeader(h))
+		msgs = append(msgs, pkt)
+	}
+
+	start(true)
+	for _, rr := range records {
+		mark := len(pkt)
+		next, err := BuildAnswer(pkt, nil, rr, names)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %v", rr.Name, TypeName(rr.Type), err)
+		}
+
+		if len(next) > limit && count > 0 {
+			// drop compression targets that lived in the rolled back bytes
+			for n, off := range names {
+				if off >= mark {
+					delete(names, n)
+				}
+			}
+			pkt = next[:mark]
+			finish(len(msgs) == 0)
+			start(false)
+
+			if next, err = BuildAnswer(pkt, nil, rr, names); err != nil {
+				return nil, err
+			}
+		}
+
+		pkt = next
+		count++
+	}
+	finish(len(msgs) == 0)
+
+	return msgs, nil
+}
+
+// AXFRRecords is the full zone bracketed by its SOA (RFC 5936 section 2.2)
+func (z *Zone) AXFRRecords() []DNSAnswer {
+	return append(z.Records(), z.SOA())
+}
+
+// IXFRRecords returns the incremental answer for a client at serial (RFC 1995
+// section 4). ok is false when the journal no longer reaches back that far.
+func (z *Zone) IXFRRecords(serial uint32) (records []DNSAnswer, ok bool) {
+	soa := z.SOA()
+
+	// client is current (or ahead), the lone SOA says so
+	if !SerialLess(serial, soa.RData.SOA.Serial) {
+		return []DNSAnswer{soa}, true
+	}
+
+	deltas, ok := z.DeltasSince(serial)
+	if !ok {
+		return nil, false
+	}
+
+	records = []DNSAnswer{soa}
+	for _, d := range deltas {
+		records = append(records, d.OldSOA)
+		records = append(records, d.Removed...)
+		records = append(records, d.NewSOA)
+		records = append(records, d.Added...)
+	}
+	return append(records, soa), true
+}
+
+// TransferAllowed checks the zone's transfer ACL and keys
+func (z *Zone) TransferAllowed(client netip.Addr, sig *TSIGResult) bool {
+	if sig.Allowed(z.TransferKeys) {
+		return true
+	}
+
+	client = client.Unmap()
+	for _, p := range z.AllowTransfer {
+		if p.Contains(client) {
+			return true
+		}
+	}
+	return false
+}
+
+// Transfer answers an AXFR or IXFR request on a stream connection. Signed
+// requests get every message of the answer signed.
+func (s *Server) Transfer(w io.Writer, q DNSQuestionPacket, msg []byte, client netip.Addr) error {
+	sig, err := s.keys.Verify(msg, nil)
+	refuse := func(rcode uint8) error {
+		resp, err := BuildResponse(q, rcode, nil)
+		if err != nil {
+			return err
+		}
+		return WriteTCPMessage(w, sig.Reply(resp))
+	}
+
+	if err != nil {
+		return refuse(RCodeFormErr)
+	}
+	if sig != nil && sig.Error != 0 {
+		log.Warn().Str("key", sig.Name).Str("client", client.String()).Uint16("error", sig.Error).Msg("tsig check failed")
+		return refuse(RCodeNotAuth)
+	}
+
+	z := s.zones.Get(q.Question.Name)
+	if z == nil {
+		return refuse(RCodeNotAuth)
+	}
+	if !z.TransferAllowed(client, sig) {
+		log.Warn().Str("zone", z.Origin).Str("client", client.String()).Msg("transfer refused by ACL")
+		return refuse(RCodeRefused)
+	}
+
+	records := z.AXFRRecords()
+	kind := "AXFR"
+	if q.Question.Type == TypeIXFR {
+		serial, err := ixfrClientSerial(msg)
+		if err != nil {
+			return refuse(RCodeFormErr)
+		}
+
+		// without the history we fall back to a full zone (RFC 1995 section 4)
+		if incr, ok := z.IXFRRecords(serial); ok {
+			records, kind = incr, "IXFR"
+		}
+	}
+
+	msgs, err := PackTransfer(q, records, xfrMessageLimit)
+	if err != nil {
+		return err
+	}
+
+	var stream *TSIGStream
+	if sig != nil {
+		stream = NewTSIGStream(sig.Key, sig.MAC)
+	}
+	for _, m := range msgs {
+		if stream != nil {
+			m = stream.Sign(m)
+		}
+		if err := WriteTCPMessage(w, m); err != nil {
+			return err
+		}
+	}
+
+	s.stats.ZoneTransfers.Add(1)
+	log.Info().Str("zone", z.Origin).Str("client", client.String()).Str("kind", kind).
+		Int("records", len(records)).Int("messages", len(msgs)).Msg("zone transfer")
+	return nil
+}
+
+// TransferOverUDP answers an IXFR that came in over UDP with the current SOA,
+// telling the client to retry over TCP when it is behind. AXFR gets nil.
+func (s *Server) TransferOverUDP(q DNSQuestionPacket, client netip.Addr, sig *TSIGResult) []byte {
+	if q.Question.Type != TypeIXFR {
+		return nil
+	}
+
+	z := s.zones.Get(q.Question.Name)
+	if z == nil || !z.TransferAllowed(client, sig) {
+		return nil
+	}
+
+	resp := NewResponse(q, RCodeSuccess, []DNSAnswer{z.SOA()})
+	resp.Header.AA = true
+	wire, _ := BuildAnswerPacket(resp)
+	return wire
+}
+
+// ixfrClientSerial digs the client's SOA out of the IXFR query's authority section
+func ixfrClientSerial(msg []byte) (uint32, error) {
+	pkt, err := ParseAnswerPacket(msg, len(msg))
+	if err != nil {
+		return 0, err
+	}
+	for _, rr := range pkt.Authority {
+		if rr.Type == TypeSOA && strings.EqualFold(normName(rr.Name), normName(pkt.Questions[0].Name)) {
+			return rr.RData.SOA.Serial, nil
+		}
+	}
+	return 0, fmt.Errorf("IXFR without SOA in authority section")
+}
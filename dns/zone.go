@@ -0,0 +1,450 @@
+package dns
+
+import (
+	"bytes"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"nyasaki/dns-server/config"
+
+	"github.com/rs/zerolog/log"
+)
+
+// zoneNode holds the RRsets owned by one name, empty for empty non-terminals
+type zoneNode struct {
+	rrsets map[uint16][]DNSAnswer
+}
+
+// Zone is an in-memory authoritative zone. Names are stored lower-cased without
+// the trailing dot and every ancestor up to the apex has a node, so existence
+// checks and closest encloser lookups are map hits.
+type Zone struct {
+	Origin string
+	nodes  map[string]*zoneNode
+
+	// Clients allowed to transfer the zone
+	AllowTransfer []netip.Prefix
+	// Clients allowed to send dynamic updates, and where to save the result
+	AllowUpdate []netip.Prefix
+	File        string
+	// TSIG keys allowed to transfer or update regardless of the client address
+	TransferKeys []string
+	UpdateKeys   []string
+	// Changes between serials, oldest first, for IXFR
+	journal []ZoneDelta
+	// Signs answers for DO clients, nil for an unsigned zone
+	Signer *Signer
+}
+
+// NewZone checks the records form a valid zone: one SOA at the apex, nothing
+// outside the origin and no data next to a CNAME
+func NewZone(origin string, records []DNSAnswer) (*Zone, error) {
+	z := &Zone{Origin: normName(origin), nodes: make(map[string]*zoneNode)}
+	z.nodes[z.Origin] = &zoneNode{rrsets: make(map[uint16][]DNSAnswer)}
+
+	for _, rr := range records {
+		if err := z.add(rr); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(z.nodes[z.Origin].rrsets[TypeSOA]) != 1 {
+		return nil, fmt.Errorf("zone %s: need exactly one SOA at the apex", z.Origin)
+	}
+	if len(z.nodes[z.Origin].rrsets[TypeNS]) == 0 {
+		return nil, fmt.Errorf("zone %s: no NS records at the apex", z.Origin)
+	}
+
+	for name, n := range z.nodes {
+		if len(n.rrsets[TypeCNAME]) > 0 && len(n.rrsets) > 1 {
+			return nil, fmt.Errorf("zone %s: %s has a CNAME and other data", z.Origin, name)
+		}
+		if len(n.rrsets[TypeCNAME]) > 1 {
+			return nil, fmt.Errorf("zone %s: %s has more than one CNAME", z.Origin, name)
+		}
+	}
+
+	return z, nil
+}
+
+// LoadZoneFile parses a master file and builds the zone from it
+func LoadZoneFile(origin, path string) (*Zone, error) {
+	records, err := ParseZoneFile(path, origin)
+	if err != nil {
+		return nil, err
+	}
+	return NewZone(origin, records)
+}
+
+func (z *Zone) add(rr DNSAnswer) error {
+	name := normName(rr.Name)
+	if !IsSubdomain(name, z.Origin) {
+		return fmt.Errorf("zone %s: %s is out of zone", z.Origin, name)
+	}
+	rr.Name = name
+
+	n := z.node(name)
+	for _, have := range n.rrsets[rr.Type] {
+		if sameRData(have, rr) {
+			return nil
+		}
+	}
+	n.rrsets[rr.Type] = append(n.rrsets[rr.Type], rr)
+	return nil
+}
+
+// node returns the node for name, creating it and any missing ancestors
+func (z *Zone) node(name string) *zoneNode {
+	if n, ok := z.nodes[name]; ok {
+		return n
+	}
+
+	n := &zoneNode{rrsets: make(map[uint16][]DNSAnswer)}
+	z.nodes[name] = n
+
+	if name != z.Origin {
+		_, parent, _ := strings.Cut(name, ".")
+		z.node(parent)
+	}
+	return n
+}
+
+// sameRData compares the fields ParseRdata fills for the record's type
+func sameRData(a, b DNSAnswer) bool {
+	x, y := a.RData, b.RData
+	if a.Type == b.Type && a.Type == TypeDS {
+		return x.DS.KeyTag == y.DS.KeyTag && x.DS.Algorithm == y.DS.Algorithm &&
+			x.DS.DigestType == y.DS.DigestType && string(x.DS.Digest) == string(y.DS.Digest)
+	}
+	if a.Type != b.Type || x.A != y.A || x.AAAA != y.AAAA || !strings.EqualFold(x.Name, y.Name) ||
+		x.MX != y.MX || x.SRV != y.SRV || x.SOA != y.SOA || string(x.Opaque) != string(y.Opaque) ||
+		len(x.TXT) != len(y.TXT) {
+		return false
+	}
+	for i := range x.TXT {
+		if string(x.TXT[i]) != string(y.TXT[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// SOA returns the apex SOA record
+func (z *Zone) SOA() DNSAnswer {
+	return z.nodes[z.Origin].rrsets[TypeSOA][0]
+}
+
+// negativeSOA is the SOA for the authority section of negative answers, its TTL
+// capped by the minimum field (RFC 2308 section 3)
+func (z *Zone) negativeSOA() DNSAnswer {
+	soa := z.SOA()
+	soa.TTL = min(soa.TTL, soa.RData.SOA.Minimum)
+	return soa
+}
+
+// Records returns every record of the zone, SOA first
+func (z *Zone) Records() []DNSAnswer {
+	out := []DNSAnswer{z.SOA()}
+	for _, n := range z.nodes {
+		for t, rrs := range n.rrsets {
+			if t != TypeSOA {
+				out = append(out, rrs...)
+			}
+		}
+	}
+	return out
+}
+
+// findCut returns the NS RRset of a delegation at or above name, nil when name is
+// served by this zone. A DS query at the cut itself belongs to the parent side.
+func (z *Zone) findCut(name string, qtype uint16) []DNSAnswer {
+	labels := strings.Split(name, ".")
+	depth := len(labels) - strings.Count(z.Origin, ".") - 1
+	if z.Origin == "" {
+		depth = len(labels)
+	}
+
+	// walk from just below the apex down towards name
+	for i := depth - 1; i >= 0; i-- {
+		cut := strings.Join(labels[i:], ".")
+		n, ok := z.nodes[cut]
+		if !ok {
+			return nil
+		}
+		if ns := n.rrsets[TypeNS]; len(ns) > 0 {
+			if i == 0 && qtype == TypeDS {
+				return nil
+			}
+			return ns
+		}
+	}
+	return nil
+}
+
+// closestEncloser returns the deepest existing ancestor of a name missing from the zone
+func (z *Zone) closestEncloser(name string) string {
+	for name != z.Origin {
+		_, parent, _ := strings.Cut(name, ".")
+		if _, ok := z.nodes[parent]; ok {
+			return parent
+		}
+		name = parent
+	}
+	return z.Origin
+}
+
+func withOwner(rrs []DNSAnswer, owner string) []DNSAnswer {
+	out := make([]DNSAnswer, len(rrs))
+	for i, rr := range rrs {
+		rr.Name = owner
+		out[i] = rr
+	}
+	return out
+}
+
+// addressesFor returns in-zone A/AAAA records for target, used for glue and additional data
+func (z *Zone) addressesFor(target string) []DNSAnswer {
+	n, ok := z.nodes[normName(target)]
+	if !ok {
+		return nil
+	}
+	return append(append([]DNSAnswer(nil), n.rrsets[TypeA]...), n.rrsets[TypeAAAA]...)
+}
+
+// additionalFor collects addresses of names NS, MX and SRV records point at
+func (z *Zone) additionalFor(rrs []DNSAnswer) []DNSAnswer {
+	var out []DNSAnswer
+	for _, rr := range rrs {
+		switch rr.Type {
+		case TypeNS:
+			out = append(out, z.addressesFor(rr.RData.Name)...)
+		case TypeMX:
+			out = append(out, z.addressesFor(rr.RData.MX.Host)...)
+		case TypeSRV:
+			out = append(out, z.addressesFor(rr.RData.SRV.Target)...)
+		}
+	}
+	return out
+}
+
+// Answer resolves q against the zone (RFC 1034 section 4.3.2): referrals at
+// delegations, CNAME chasing inside the zone, wildcard synthesis (RFC 4592) and
+// NXDOMAIN/NODATA with the SOA in the authority section.
+func (z *Zone) Answer(q DNSQuestionPacket) DNSAnswerPacket {
+	resp := NewResponse(q, RCodeSuccess, nil)
+	resp.Header.AA = true
+
+	name := normName(q.Question.Name)
+	qtype := q.Question.Type
+
+	for hops := 0; hops < 8; hops++ {
+		if ns := z.findCut(name, qtype); ns != nil {
+			// only the first name decides whether we are authoritative
+			if hops == 0 {
+				resp.Header.AA = false
+			}
+			resp.Authority = append(resp.Authority, ns...)
+			resp.Additional = append(resp.Additional, z.additionalFor(ns)...)
+			return resp
+		}
+
+		owner := name
+		n, ok := z.nodes[name]
+		if !ok {
+			wild, found := z.nodes["*."+z.closestEncloser(name)]
+			if !found {
+				resp.Header.RCode = RCodeNXDomain
+				resp.Authority = []DNSAnswer{z.negativeSOA()}
+				return resp
+			}
+			n = wild
+		}
+
+		var rrs []DNSAnswer
+		if qtype == TypeANY {
+			for _, set := range n.rrsets {
+				rrs = append(rrs, set...)
+			}
+		} else {
+			rrs = n.rrsets[qtype]
+		}
+		if owner == z.Origin && z.Signer != nil {
+			rrs = append(append([]DNSAnswer(nil), rrs...), z.Signer.apexRecords(z.Origin, z.SOA().TTL, qtype)...)
+		}
+
+		if len(rrs) > 0 {
+			rrs = withOwner(rrs, owner)
+			resp.Answers = append(resp.Answers, rrs...)
+			resp.Additional = append(resp.Additional, z.additionalFor(rrs)...)
+			return resp
+		}
+
+		cname := n.rrsets[TypeCNAME]
+		if len(cname) == 0 || qtype == TypeCNAME {
+			// the name exists but has no data of this type
+			resp.Authority = []DNSAnswer{z.negativeSOA()}
+			return resp
+		}
+
+		resp.Answers = append(resp.Answers, withOwner(cname, owner)...)
+		target := normName(cname[0].RData.Name)
+		if !IsSubdomain(target, z.Origin) {
+			// the client's resolver continues from here
+			return resp
+		}
+		name = target
+	}
+
+	return resp
+}
+
+// LoadZones reads every configured zone file
+func LoadZones(cfgs []config.ZoneConfig) (*Zones, error) {
+	zs := NewZones()
+	for _, zc := range cfgs {
+		z, err := LoadConfiguredZone(zc)
+		if err != nil {
+			return nil, err
+		}
+		zs.Put(z)
+	}
+	return zs, nil
+}
+
+// LoadConfiguredZone reads one zone file and applies its ACLs
+func LoadConfiguredZone(zc config.ZoneConfig) (*Zone, error) {
+	z, err := LoadZoneFile(zc.Origin, zc.File)
+	if err != nil {
+		return nil, fmt.Errorf("zone %s: %v", zc.Origin, err)
+	}
+
+	z.File = zc.File
+	z.TransferKeys, z.UpdateKeys = zc.TransferKeys, zc.UpdateKeys
+
+	if zc.Signing.KeyFile != "" {
+		if z.Signer, err = LoadSigner(zc.Signing); err != nil {
+			return nil, fmt.Errorf("zone %s: %v", zc.Origin, err)
+		}
+		ds, _ := NewDS(z.Origin, z.Signer.DNSKEY(), DigestSHA256)
+		log.Info().Str("zone", z.Origin).Str("ds", FormatRData(DNSAnswer{Type: TypeDS, RData: RData{DS: ds}})).Msg("zone signed")
+	}
+
+	for _, c := range zc.AllowTransfer {
+		p, err := netip.ParsePrefix(c)
+		if err != nil {
+			return nil, fmt.Errorf("zone %s: allow_transfer: %v", zc.Origin, err)
+		}
+		z.AllowTransfer = append(z.AllowTransfer, p.Masked())
+	}
+	for _, c := range zc.AllowUpdate {
+		p, err := netip.ParsePrefix(c)
+		if err != nil {
+			return nil, fmt.Errorf("zone %s: allow_update: %v", zc.Origin, err)
+		}
+		z.AllowUpdate = append(z.AllowUpdate, p.Masked())
+	}
+	return z, nil
+}
+
+// Zones is the set of zones we are authoritative for
+type Zones struct {
+	mu       sync.RWMutex
+	byOrigin map[string]*Zone
+}
+
+func NewZones() *Zones {
+	return &Zones{byOrigin: make(map[string]*Zone)}
+}
+
+// Put adds or replaces a zone
+func (zs *Zones) Put(z *Zone) {
+	zs.mu.Lock()
+	zs.byOrigin[z.Origin] = z
+	zs.mu.Unlock()
+}
+
+// Replace swaps in a new version of a zone. When the serial moved forward the
+// difference is appended to the journal so secondaries can IXFR it.
+func (zs *Zones) Replace(z *Zone) {
+	zs.mu.Lock()
+	defer zs.mu.Unlock()
+
+	old := zs.byOrigin[z.Origin]
+	if old != nil {
+		oldSerial, newSerial := old.SOA().RData.SOA.Serial, z.SOA().RData.SOA.Serial
+		switch {
+		case SerialLess(oldSerial, newSerial):
+			z.journal = append(append([]ZoneDelta(nil), old.journal...), Diff(old, z))
+			if len(z.journal) > maxJournal {
+				z.journal = z.journal[len(z.journal)-maxJournal:]
+			}
+		case oldSerial == newSerial:
+			// same version, keep the history
+			z.journal = old.journal
+		}
+	}
+	zs.byOrigin[z.Origin] = z
+}
+
+// Remove stops serving a zone
+func (zs *Zones) Remove(origin string) {
+	zs.mu.Lock()
+	delete(zs.byOrigin, normName(origin))
+	zs.mu.Unlock()
+}
+
+// Get returns the zone with exactly this origin
+func (zs *Zones) Get(origin string) *Zone {
+	zs.mu.RLock()
+	defer zs.mu.RUnlock()
+	return zs.byOrigin[normName(origin)]
+}
+
+// Contains tells whether any zone holds name, given dotted and lower-cased
+// like normName makes it, without allocating
+func (zs *Zones) Contains(name []byte) bool {
+	zs.mu.RLock()
+	defer zs.mu.RUnlock()
+
+	if len(zs.byOrigin) == 0 {
+		return false
+	}
+
+	for {
+		if _, ok := zs.byOrigin[string(name)]; ok {
+			return true
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if i := bytes.IndexByte(name, '.'); i >= 0 {
+			name = name[i+1:]
+		} else {
+			name = name[:0]
+		}
+	}
+}
+
+// Find returns the most specific zone containing name
+func (zs *Zones) Find(name string) *Zone {
+	name = normName(name)
+
+	zs.mu.RLock()
+	defer zs.mu.RUnlock()
+
+	if len(zs.byOrigin) == 0 {
+		return nil
+	}
+
+	for {
+		if z, ok := zs.byOrigin[name]; ok {
+			return z
+		}
+		if name == "" {
+			return nil
+		}
+		_, name, _ = strings.Cut(name, ".")
+	}
+}
@@ -0,0 +1,512 @@
+package dns
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// zoneToken is one field of a master file line, quoted strings keep their spaces
+type zoneToken struct {
+	text   string
+	quoted bool
+}
+
+// zoneLine is one logical entry, parentheses already folded into a single line
+type zoneLine struct {
+	num   int  // line number the entry starts on
+	blank bool // starts with whitespace, i.e. reuses the previous owner
+	toks  []zoneToken
+}
+
+// lexZone splits a master file into logical lines (RFC 1035 section 5.1)
+func lexZone(data string) ([]zoneLine, error) {
+	var lines []zoneLine
+	var cur zoneLine
+	var tok strings.Builder
+	inTok, quoted, parens := false, false, 0
+	lineNum := 1
+	atStart := true
+
+	flush := func() {
+		if inTok {
+			cur.toks = append(cur.toks, zoneToken{text: tok.String(), quoted: quoted})
+			tok.Reset()
+			inTok, quoted = false, false
+		}
+	}
+	endLine := func() {
+		flush()
+		if len(cur.toks) > 0 {
+			lines = append(lines, cur)
+		}
+		cur = zoneLine{}
+		atStart = true
+	}
+
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+
+		if quoted {
+			switch c {
+			case '"':
+				cur.toks = append(cur.toks, zoneToken{text: tok.String(), quoted: true})
+				tok.Reset()
+				inTok, quoted = false, false
+			case '\\':
+				if i+1 < len(data) {
+					tok.WriteByte(c)
+					tok.WriteByte(data[i+1])
+					i++
+				}
+			case '\n':
+				return nil, fmt.Errorf("line %d: unterminated string", lineNum)
+			default:
+				tok.WriteByte(c)
+			}
+			continue
+		}
+
+		if atStart && c != '\n' {
+			cur.num = lineNum
+			cur.blank = c == ' ' || c == '\t'
+			atStart = false
+		}
+
+		switch c {
+		case ';':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+			i--
+		case '"':
+			flush()
+			inTok, quoted = true, true
+		case '(':
+			flush()
+			parens++
+		case ')':
+			flush()
+			if parens == 0 {
+				return nil, fmt.Errorf("line %d: unbalanced ')'", lineNum)
+			}
+			parens--
+		case ' ', '\t', '\r':
+			flush()
+		case '\n':
+			lineNum++
+			if parens > 0 {
+				flush()
+				continue
+			}
+			endLine()
+		case '\\':
+			tok.WriteByte(c)
+			if i+1 < len(data) {
+				tok.WriteByte(data[i+1])
+				i++
+			}
+			inTok = true
+		default:
+			tok.WriteByte(c)
+			inTok = true
+		}
+	}
+
+	if quoted {
+		return nil, fmt.Errorf("line %d: unterminated string", lineNum)
+	}
+	if parens > 0 {
+		return nil, fmt.Errorf("line %d: unbalanced '('", lineNum)
+	}
+	endLine()
+	return lines, nil
+}
+
+// zoneParser keeps the state that carries from one entry to the next
+type zoneParser struct {
+	origin    string
+	ttl       uint32
+	hasTTL    bool
+	lastOwner string
+	dir       string
+	depth     int
+}
+
+// ParseZoneFile reads an RFC 1035 master file, origin is the initial $ORIGIN
+func ParseZoneFile(path, origin string) ([]DNSAnswer, error) {
+	p := &zoneParser{origin: normName(origin), dir: filepath.Dir(path)}
+	return p.parseFile(path)
+}
+
+// ParseZone reads master file data from r. $INCLUDE paths are relative to dir.
+func ParseZone(r io.Reader, origin, dir string) ([]DNSAnswer, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	p := &zoneParser{origin: normName(origin), dir: dir}
+	return p.parse(string(data), "<zone>")
+}
+
+func (p *zoneParser) parseFile(path string) ([]DNSAnswer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return p.parse(string(data), path)
+}
+
+func (p *zoneParser) parse(data, src string) ([]DNSAnswer, error) {
+	lines, err := lexZone(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", src, err)
+	}
+
+	var out []DNSAnswer
+	for _, l := range lines {
+		rrs, err := p.entry(l)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", src, l.num, err)
+		}
+		out = append(out, rrs...)
+	}
+	return out, nil
+}
+
+// absName resolves a presentation name against the current origin
+func (p *zoneParser) absName(name string) string {
+	if name == "@" {
+		return p.origin
+	}
+	if strings.HasSuffix(name, ".") && !strings.HasSuffix(name, "\\.") {
+		return normName(name)
+	}
+	if p.origin == "" {
+		return normName(name)
+	}
+	return normName(name + "." + p.origin)
+}
+
+func (p *zoneParser) entry(l zoneLine) ([]DNSAnswer, error) {
+	toks := l.toks
+
+	switch strings.ToUpper(toks[0].text) {
+	case "$ORIGIN":
+		if len(toks) != 2 {
+			return nil, fmt.Errorf("$ORIGIN needs one argument")
+		}
+		p.origin = p.absName(toks[1].text)
+		return nil, nil
+
+	case "$TTL":
+		if len(toks) != 2 {
+			return nil, fmt.Errorf("$TTL needs one argument")
+		}
+		ttl, err := parseTTL(toks[1].text)
+		if err != nil {
+			return nil, err
+		}
+		p.ttl, p.hasTTL = ttl, true
+		return nil, nil
+
+	case "$INCLUDE":
+		if len(toks) < 2 || len(toks) > 3 {
+			return nil, fmt.Errorf("$INCLUDE needs a file and an optional origin")
+		}
+		if p.depth >= 8 {
+			return nil, fmt.Errorf("$INCLUDE nested too deep")
+		}
+
+		path := toks[1].text
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(p.dir, path)
+		}
+
+		// the included file gets its own origin, ours is restored afterwards
+		sub := *p
+		sub.depth++
+		if len(toks) == 3 {
+			sub.origin = p.absName(toks[2].text)
+		}
+		rrs, err := sub.parseFile(path)
+		if err != nil {
+			return nil, err
+		}
+		p.ttl, p.hasTTL, p.lastOwner = sub.ttl, sub.hasTTL, sub.lastOwner
+		return rrs, nil
+	}
+
+	owner := p.lastOwner
+	if !l.blank {
+		owner = p.absName(toks[0].text)
+		toks = toks[1:]
+	}
+	if owner == "" && p.lastOwner == "" && l.blank {
+		return nil, fmt.Errorf("record without owner")
+	}
+	p.lastOwner = owner
+
+	// [ttl] [class] type or [class] [ttl] type
+	ttl, hasTTL := p.ttl, p.hasTTL
+	var rtype uint16
+	for {
+		if len(toks) == 0 {
+			return nil, fmt.Errorf("missing record type")
+		}
+		t := toks[0].text
+
+		if t[0] >= '0' && t[0] <= '9' {
+			v, err := parseTTL(t)
+			if err != nil {
+				return nil, err
+			}
+			ttl, hasTTL = v, true
+			toks = toks[1:]
+			continue
+		}
+
+		switch strings.ToUpper(t) {
+		case "IN":
+			toks = toks[1:]
+			continue
+		case "CH", "HS", "CS":
+			return nil, fmt.Errorf("class %s not supported", t)
+		}
+
+		typ, err := TypeByName(t)
+		if err != nil {
+			return nil, err
+		}
+		rtype = typ
+		toks = toks[1:]
+		break
+	}
+
+	rd, err := p.rdata(rtype, toks)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %v", owner, TypeName(rtype), err)
+	}
+
+	// RFC 1035 falls back to the SOA minimum, RFC 2308 made $TTL the norm
+	if rtype == TypeSOA && !hasTTL {
+		ttl, hasTTL = rd.SOA.Minimum, true
+	}
+	if !hasTTL {
+		return nil, fmt.Errorf("no TTL and no $TTL default")
+	}
+	if !p.hasTTL {
+		// the last explicit TTL becomes the default, as BIND does
+		p.ttl, p.hasTTL = ttl, true
+	}
+
+	return []DNSAnswer{{Name: owner, Type: rtype, Class: ClassIN, TTL: ttl, RData: rd}}, nil
+}
+
+// parseTTL accepts plain seconds and BIND style units (1h30m, 2d, 1w)
+func parseTTL(s string) (uint32, error) {
+	if v, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(v), nil
+	}
+
+	var total, cur uint64
+	seen := false
+	for _, c := range strings.ToLower(s) {
+		if c >= '0' && c <= '9' {
+			cur = cur*10 + uint64(c-'0')
+			seen = true
+			continue
+		}
+
+		mult := map[rune]uint64{'s': 1, 'm': 60, 'h': 3600, 'd': 86400, 'w': 604800}[c]
+		if mult == 0 || !seen {
+			return 0, fmt.Errorf("bad TTL %q", s)
+		}
+		total += cur * mult
+		cur, seen = 0, false
+	}
+	if seen || total > 1<<31-1 {
+		return 0, fmt.Errorf("bad TTL %q", s)
+	}
+	return uint32(total), nil
+}
+
+func (p *zoneParser) rdata(rtype uint16, toks []zoneToken) (RData, error) {
+	rd := RData{Kind: rtype}
+
+	// RFC 3597 generic encoding works for every type
+	if len(toks) > 0 && toks[0].text == "\\#" && !toks[0].quoted {
+		return parseGenericRdata(rtype, toks[1:])
+	}
+
+	want := func(n int) error {
+		if len(toks) != n {
+			return fmt.Errorf("want %d fields, got %d", n, len(toks))
+		}
+		return nil
+	}
+	num16 := func(s string) (uint16, error) {
+		v, err := strconv.ParseUint(s, 10, 16)
+		return uint16(v), err
+	}
+
+	switch rtype {
+	case TypeA, TypeAAAA:
+		if err := want(1); err != nil {
+			return rd, err
+		}
+		ip, err := netip.ParseAddr(toks[0].text)
+		if err != nil {
+			return rd, err
+		}
+		if rtype == TypeA {
+			if !ip.Is4() {
+				return rd, fmt.Errorf("not an IPv4 address")
+			}
+			rd.A = ip.As4()
+		} else {
+			if !ip.Is6() || ip.Is4In6() {
+				return rd, fmt.Errorf("not an IPv6 address")
+			}
+			rd.AAAA = ip.As16()
+		}
+
+	case TypeNS, TypeCNAME, TypePTR:
+		if err := want(1); err != nil {
+			return rd, err
+		}
+		rd.Name = p.absName(toks[0].text)
+
+	case TypeMX:
+		if err := want(2); err != nil {
+			return rd, err
+		}
+		pref, err := num16(toks[0].text)
+		if err != nil {
+			return rd, err
+		}
+		rd.MX = MXData{Pref: pref, Host: p.absName(toks[1].text)}
+
+	case TypeSRV:
+		if err := want(4); err != nil {
+			return rd, err
+		}
+		var vals [3]uint16
+		for i := range vals {
+			v, err := num16(toks[i].text)
+			if err != nil {
+				return rd, err
+			}
+			vals[i] = v
+		}
+		rd.SRV = SRVData{Pri: vals[0], Wt: vals[1], Port: vals[2], Target: p.absName(toks[3].text)}
+
+	case TypeSOA:
+		if err := want(7); err != nil {
+			return rd, err
+		}
+		var vals [5]uint32
+		for i := range vals {
+			v, err := parseTTL(toks[2+i].text)
+			if err != nil {
+				return rd, err
+			}
+			vals[i] = v
+		}
+		rd.SOA = SOAData{
+			MName: p.absName(toks[0].text), RName: p.absName(toks[1].text),
+			Serial: vals[0], Refresh: vals[1], Retry: vals[2], Expire: vals[3], Minimum: vals[4],
+		}
+
+	case TypeTXT:
+		if len(toks) == 0 {
+			return rd, fmt.Errorf("empty TXT")
+		}
+		for _, t := range toks {
+			b, err := unescapeText(t.text)
+			if err != nil {
+				return rd, err
+			}
+			if len(b) > 255 {
+				return rd, fmt.Errorf("TXT string longer than 255 bytes")
+			}
+			rd.TXT = append(rd.TXT, b)
+		}
+
+	case TypeDS:
+		texts := make([]string, len(toks))
+		for i, t := range toks {
+			texts[i] = t.text
+		}
+		ds, err := ParseDS(strings.Join(texts, " "))
+		if err != nil {
+			return rd, err
+		}
+		rd.DS = ds
+
+	default:
+		return rd, fmt.Errorf("type %s needs the generic \\# form", TypeName(rtype))
+	}
+
+	return rd, nil
+}
+
+// parseGenericRdata handles `\# <len> <hex...>`
+func parseGenericRdata(rtype uint16, toks []zoneToken) (RData, error) {
+	if len(toks) == 0 {
+		return RData{}, fmt.Errorf("generic rdata needs a length")
+	}
+	n, err := strconv.Atoi(toks[0].text)
+	if err != nil {
+		return RData{}, err
+	}
+
+	var sb strings.Builder
+	for _, t := range toks[1:] {
+		sb.WriteString(t.text)
+	}
+	raw, err := hex.DecodeString(sb.String())
+	if err != nil {
+		return RData{}, err
+	}
+	if len(raw) != n {
+		return RData{}, fmt.Errorf("generic rdata length %d, got %d bytes", n, len(raw))
+	}
+
+	rd, err := ParseRdata(raw, 0, uint16(n), rtype)
+	rd.Kind = rtype
+	return rd, err
+}
+
+// unescapeText resolves \X and \DDD escapes of a character-string
+func unescapeText(s string) ([]byte, error) {
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			out = append(out, s[i])
+			continue
+		}
+		if i+1 >= len(s) {
+			return nil, fmt.Errorf("dangling escape")
+		}
+		if i+3 < len(s) && isDigit(s[i+1]) && isDigit(s[i+2]) && isDigit(s[i+3]) {
+			v, _ := strconv.Atoi(s[i+1 : i+4])
+			if v > 255 {
+				return nil, fmt.Errorf("bad escape \\%s", s[i+1:i+4])
+			}
+			out = append(out, byte(v))
+			i += 3
+			continue
+		}
+		out = append(out, s[i+1])
+		i++
+	}
+	return out, nil
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
@@ -0,0 +1,129 @@
+package dns
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// fqdn renders a stored name in absolute master file form
+func fqdn(name string) string {
+	if name == "" {
+		return "."
+	}
+	return name + "."
+}
+
+// escapeText quotes a character-string so unescapeText reads it back unchanged
+func escapeText(b []byte) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, c := range b {
+		switch {
+		case c == '"' || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c < 0x20 || c > 0x7e:
+			fmt.Fprintf(&sb, "\\%03d", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// FormatRData renders rr's RDATA in presentation format, RFC 3597 `\#` for
+// types the master file parser has no syntax for
+func FormatRData(rr DNSAnswer) string {
+	rd := rr.RData
+	switch rr.Type {
+	case TypeA:
+		return netip.AddrFrom4(rd.A).String()
+	case TypeAAAA:
+		return netip.AddrFrom16(rd.AAAA).String()
+	case TypeNS, TypeCNAME, TypePTR:
+		return fqdn(normName(rd.Name))
+	case TypeMX:
+		return strconv.Itoa(int(rd.MX.Pref)) + " " + fqdn(normName(rd.MX.Host))
+	case TypeSRV:
+		return fmt.Sprintf("%d %d %d %s", rd.SRV.Pri, rd.SRV.Wt, rd.SRV.Port, fqdn(normName(rd.SRV.Target)))
+	case TypeSOA:
+		s := rd.SOA
+		return fmt.Sprintf("%s %s %d %d %d %d %d", fqdn(normName(s.MName)), fqdn(normName(s.RName)),
+			s.Serial, s.Refresh, s.Retry, s.Expire, s.Minimum)
+	case TypeTXT:
+		parts := make([]string, len(rd.TXT))
+		for i, t := range rd.TXT {
+			parts[i] = escapeText(t)
+		}
+		return strings.Join(parts, " ")
+	case TypeDS:
+		return fmt.Sprintf("%d %d %d %X", rd.DS.KeyTag, rd.DS.Algorithm, rd.DS.DigestType, rd.DS.Digest)
+	}
+
+	raw, _ := BuildRdata(nil, rd, rr.Type, nil)
+	if len(raw) == 0 {
+		return "\\# 0"
+	}
+	return fmt.Sprintf("\\# %d %s", len(raw), hex.EncodeToString(raw))
+}
+
+// FormatRecord renders one master file line
+func FormatRecord(rr DNSAnswer) string {
+	return fmt.Sprintf("%s\t%d\tIN\t%s\t%s", fqdn(normName(rr.Name)), rr.TTL, TypeName(rr.Type), FormatRData(rr))
+}
+
+// WriteZone writes z as a master file with absolute names, SOA first and the
+// rest sorted by owner so successive saves diff cleanly
+func WriteZone(w io.Writer, z *Zone) error {
+	records := z.Records()
+	rest := records[1:]
+	sort.SliceStable(rest, func(i, j int) bool {
+		if rest[i].Name != rest[j].Name {
+			return rest[i].Name < rest[j].Name
+		}
+		if rest[i].Type != rest[j].Type {
+			return rest[i].Type < rest[j].Type
+		}
+		return FormatRData(rest[i]) < FormatRData(rest[j])
+	})
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "$ORIGIN %s\n", fqdn(z.Origin))
+	for _, rr := range records {
+		fmt.Fprintln(bw, FormatRecord(rr))
+	}
+	return bw.Flush()
+}
+
+// SaveZoneFile replaces path with the current contents of z. The file is written
+// next to the old one and renamed into place so a crash never leaves half a zone.
+func SaveZoneFile(path string, z *Zone) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	// keep the permissions of the file we replace
+	if fi, err := os.Stat(path); err == nil {
+		_ = tmp.Chmod(fi.Mode().Perm())
+	}
+
+	if err := WriteZone(tmp, z); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
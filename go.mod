@@ -2,12 +2,18 @@ module nyasaki/dns-server
 
 go 1.24.0
 
+require (
+	github.com/dgraph-io/ristretto/v2 v2.3.0
+	github.com/quic-go/quic-go v0.59.1
+	github.com/rs/zerolog v1.34.0
+	golang.org/x/crypto v0.41.0
+	golang.org/x/net v0.43.0
+	golang.org/x/sys v0.37.0
+)
+
 require (
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
-	github.com/dgraph-io/ristretto/v2 v2.3.0 // indirect
 	github.com/dustin/go-humanize v1.0.1 // indirect
 	github.com/mattn/go-colorable v0.1.14 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
-	github.com/rs/zerolog v1.34.0 // indirect
-	golang.org/x/sys v0.37.0 // indirect
 )
@@ -2,8 +2,13 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"nyasaki/dns-server/config"
 	"nyasaki/dns-server/dns"
 	"nyasaki/dns-server/metrics"
 
@@ -12,21 +17,40 @@ import (
 )
 
 func main() {
+	configPath := flag.String("config", "", "path to a JSON config file")
+	flag.Parse()
+
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 	stats := &metrics.Stats{}
 
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load config")
+	}
+
 	go func() {
         http.HandleFunc("/stats", func(w http.ResponseWriter, _ *http.Request) {
-            json.NewEncoder(w).Encode(map[string]uint64{
-                "cache_hits":   stats.CacheHits.Load(),
-                "cache_misses": stats.CacheMisses.Load(),
-                "up_ok":        stats.UpstreamOK.Load(),
-                "up_err":       stats.UpstreamErr.Load(),
-            })
+            json.NewEncoder(w).Encode(stats.Snapshot())
         })
         _ = http.ListenAndServe(":8081", nil)
     }()
 
+	srv, err := dns.NewServer(cfg, stats)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to set up server")
+	}
+
+	// SIGHUP re-reads the zone files
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := srv.ReloadZones(); err != nil {
+				log.Error().Err(err).Msg("zone reload failed")
+			}
+		}
+	}()
+
 	log.Info().Msg("Starting DNS")
-	dns.StartServer(stats)
+	srv.Run()
 }
@@ -8,6 +8,19 @@ type Stats struct {
     CacheMisses  atomic.Uint64
     UpstreamOK   atomic.Uint64
     UpstreamErr  atomic.Uint64
+
+    RebindStripped atomic.Uint64
+    Blocked        atomic.Uint64
+
+    SafeSearchRewrites atomic.Uint64
+    LocalAnswers       atomic.Uint64
+    AuthAnswers        atomic.Uint64
+    ZoneTransfers      atomic.Uint64
+    DynamicUpdates     atomic.Uint64
+    DNSSECSecure       atomic.Uint64
+    DNSSECBogus        atomic.Uint64
+    DNSSECSynthesized  atomic.Uint64
+    Overloaded         atomic.Uint64
 }
 
 func (s *Stats) Snapshot() map[string]uint64 {
@@ -16,5 +29,18 @@ func (s *Stats) Snapshot() map[string]uint64 {
         "cache_misses": s.CacheMisses.Load(),
         "up_ok":        s.UpstreamOK.Load(),
         "up_err":       s.UpstreamErr.Load(),
+
+        "rebind_stripped": s.RebindStripped.Load(),
+        "blocked":         s.Blocked.Load(),
+
+        "safe_search_rewrites": s.SafeSearchRewrites.Load(),
+        "local_answers":        s.LocalAnswers.Load(),
+        "auth_answers":         s.AuthAnswers.Load(),
+        "zone_transfers":       s.ZoneTransfers.Load(),
+        "dynamic_updates":      s.DynamicUpdates.Load(),
+        "dnssec_secure":        s.DNSSECSecure.Load(),
+        "dnssec_bogus":         s.DNSSECBogus.Load(),
+        "dnssec_synthesized":   s.DNSSECSynthesized.Load(),
+        "overloaded":           s.Overloaded.Load(),
     }
 }
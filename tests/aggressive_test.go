@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"nyasaki/dns-server/config"
+	dns "nyasaki/dns-server/dns"
+	"nyasaki/dns-server/metrics"
+)
+
+func newAggressiveValidator(t *testing.T, w *signedWorld) *dns.Validator {
+	t.Helper()
+	v, err := dns.NewValidator(config.DNSSECConfig{TrustAnchors: []string{w.anchor}, AggressiveNSEC: true}, w.fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func validateAsked(t *testing.T, v *dns.Validator, w *signedWorld, name string, qtype uint16) {
+	t.Helper()
+	resp, _ := w.fetch(dns.DNSQuestion{Name: name, Type: qtype, Class: dns.ClassIN})
+	if state, err := v.Validate(resp); state != dns.Secure {
+		t.Fatalf("%s %s: %v (%v)", name, dns.TypeName(qtype), state, err)
+	}
+}
+
+func synthesize(v *dns.Validator, name string, qtype uint16) (dns.DNSAnswerPacket, bool) {
+	return v.Synthesize(dns.DNSQuestionPacket{Question: dns.DNSQuestion{Name: name, Type: qtype, Class: dns.ClassIN}})
+}
+
+func TestAggressiveNSEC(t *testing.T) {
+	for _, nsec3 := range []bool{false, true} {
+		w := newSignedWorld(t, nsec3)
+		v := newAggressiveValidator(t, w)
+
+		if _, ok := synthesize(v, "nope.secure.test", dns.TypeA); ok {
+			t.Fatalf("nsec3=%v: synthesized without any proofs", nsec3)
+		}
+
+		validateAsked(t, v, w, "nope.secure.test", dns.TypeA)
+		validateAsked(t, v, w, "www.secure.test", dns.TypeAAAA)
+
+		cases := []struct {
+			name  string
+			qtype uint16
+			rcode uint8
+		}{
+			{"nope.secure.test", dns.TypeAAAA, dns.RCodeNXDomain},
+			{"deeper.nope.secure.test", dns.TypeA, dns.RCodeNXDomain},
+			{"www.secure.test", dns.TypeTXT, dns.RCodeSuccess},
+		}
+		if !nsec3 {
+			// the gap from bad to *.wild holds more names than the one asked for
+			cases = append(cases, struct {
+				name  string
+				qtype uint16
+				rcode uint8
+			}{"other.secure.test", dns.TypeMX, dns.RCodeNXDomain})
+		}
+
+		for _, c := range cases {
+			resp, ok := synthesize(v, c.name, c.qtype)
+			if !ok || resp.Header.RCode != c.rcode || !resp.Header.AD || len(resp.Answers) != 0 {
+				t.Errorf("nsec3=%v %s %s: ok=%v %+v", nsec3, c.name, dns.TypeName(c.qtype), ok, resp.Header)
+				continue
+			}
+			// what we hand out has to hold up to another validator
+			if state, err := newTestValidator(t, w).Validate(resp); state != dns.Secure {
+				t.Errorf("nsec3=%v %s: synthesized answer is %v (%v)", nsec3, c.name, state, err)
+			}
+		}
+
+		// www exists with A, the proof for AAAA says nothing about that
+		if _, ok := synthesize(v, "www.secure.test", dns.TypeA); ok {
+			t.Errorf("nsec3=%v: synthesized NODATA for a type the NSEC lists", nsec3)
+		}
+	}
+}
+
+func TestAggressiveNSECStopsAtCuts(t *testing.T) {
+	w := newSignedWorld(t, false)
+	v := newAggressiveValidator(t, w)
+
+	// the parent proves plain.test has no DS, nothing more
+	validateAsked(t, v, w, "plain.test", dns.TypeDS)
+
+	if _, ok := synthesize(v, "plain.test", dns.TypeDS); !ok {
+		t.Fatalf("DS denial at the cut not reused")
+	}
+	for _, name := range []string{"plain.test", "www.plain.test"} {
+		if resp, ok := synthesize(v, name, dns.TypeA); ok {
+			t.Fatalf("%s A synthesized from the parent's NSEC: %+v", name, resp.Authority)
+		}
+	}
+}
+
+func TestAggressiveNSECSavesUpstreamQueries(t *testing.T) {
+	w := newSignedWorld(t, false)
+	cfg := config.Default()
+	cfg.Upstream = serveWorldTCP(t, w)
+	cfg.DNSSEC.Validate = true
+	cfg.DNSSEC.TrustAnchors = []string{w.anchor}
+	stats := &metrics.Stats{}
+	srv, err := dns.NewServer(cfg, stats)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	ask := func(name string) dns.DNSAnswerPacket {
+		t.Helper()
+		q := dns.DNSQuestionPacket{Header: dns.DNSHeader{ID: 7, RD: true}, Question: dns.DNSQuestion{Name: name, Type: dns.TypeA, Class: dns.ClassIN}}
+		resp := srv.Resolve(q, dns.BuildQuery(q.Question), netip.MustParseAddr("10.0.0.7"))
+		pkt, err := dns.ParseAnswerPacket(resp, len(resp))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		return pkt
+	}
+
+	if pkt := ask("nope.secure.test"); pkt.Header.RCode != dns.RCodeNXDomain || !pkt.Header.AD {
+		t.Fatalf("first NXDOMAIN: %+v", pkt.Header)
+	}
+	before := w.queries.Load()
+
+	for _, name := range []string{"random1.secure.test", "random2.secure.test", "q.random3.secure.test"} {
+		pkt := ask(name)
+		if pkt.Header.RCode != dns.RCodeNXDomain || !pkt.Header.AD || pkt.Header.ID != 7 {
+			t.Fatalf("%s: %+v", name, pkt.Header)
+		}
+		for _, rr := range pkt.Authority {
+			if rr.Type == dns.TypeNSEC || rr.Type == dns.TypeRRSIG {
+				t.Fatalf("%s: DNSSEC records for a client without DO", name)
+			}
+		}
+	}
+	if after := w.queries.Load(); after != before {
+		t.Fatalf("upstream asked %d more times", after-before)
+	}
+	if stats.DNSSECSynthesized.Load() != 3 {
+		t.Fatalf("synthesized %d answers, want 3", stats.DNSSECSynthesized.Load())
+	}
+}
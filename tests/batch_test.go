@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"nyasaki/dns-server/config"
+	dns "nyasaki/dns-server/dns"
+)
+
+// startFakeUpstream is a plain UDP upstream answering qN.test with 192.0.2.N
+// and big.test with 40 addresses, more than 512 bytes
+func startFakeUpstream(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			q, err := dns.ParseQuestionPacket(buf[:n], n)
+			if err != nil {
+				continue
+			}
+			var last byte
+			fmt.Sscanf(q.Question.Name, "q%d.test", &last)
+			answers := []dns.DNSAnswer{{
+				Name: q.Question.Name, Type: dns.TypeA, Class: dns.ClassIN, TTL: 60, RData: dns.RData{A: [4]byte{192, 0, 2, last}},
+			}}
+			if q.Question.Name == "big.test" {
+				answers = answers[:0]
+				for i := 1; i <= 40; i++ {
+					answers = append(answers, dns.DNSAnswer{Name: q.Question.Name, Type: dns.TypeA, Class: dns.ClassIN, TTL: 60, RData: dns.RData{A: [4]byte{192, 0, 2, byte(i)}}})
+				}
+			}
+			resp, _ := dns.BuildResponse(q, dns.RCodeSuccess, answers)
+			_, _ = pc.WriteTo(resp, from)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+// freePort finds a port the server can bind for UDP and TCP
+func freePort(t *testing.T) string {
+	t.Helper()
+	for i := 0; i < 20; i++ {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := pc.LocalAddr().String()
+		// the same TCP port may be taken by someone else's connection
+		ln, err := net.Listen("tcp", addr)
+		pc.Close()
+		if err == nil {
+			ln.Close()
+			return addr
+		}
+	}
+	t.Fatal("no port free for both UDP and TCP")
+	return ""
+}
+
+// waitForListener asks for printer.lan, an override, until the server answers
+func waitForListener(t *testing.T, c net.Conn) {
+	t.Helper()
+	for i := 0; ; i++ {
+		_ = c.SetDeadline(time.Now().Add(100 * time.Millisecond))
+		_, _ = c.Write(dns.BuildQuery(dns.DNSQuestion{Name: "printer.lan", Type: dns.TypeA, Class: dns.ClassIN}))
+		if _, err := c.Read(make([]byte, 512)); err == nil {
+			return
+		}
+		if i == 20 {
+			t.Fatal("server did not come up")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// sendBurst sends all queries before reading a single answer, so they pile
+// up in the socket and are read and answered in batches
+func sendBurst(c net.Conn, queries [][]byte) (map[uint16]dns.DNSAnswerPacket, error) {
+	_ = c.SetDeadline(time.Now().Add(2 * time.Second))
+	for _, q := range queries {
+		if _, err := c.Write(q); err != nil {
+			return nil, err
+		}
+	}
+	got := make(map[uint16]dns.DNSAnswerPacket)
+	buf := make([]byte, 4096)
+	for len(got) < len(queries) {
+		n, err := c.Read(buf)
+		if err != nil {
+			return got, err
+		}
+		pkt, err := dns.ParseAnswerPacket(buf[:n], n)
+		if err != nil {
+			return got, err
+		}
+		got[pkt.Header.ID] = pkt
+	}
+	return got, nil
+}
+
+func TestUDPBatchesThroughUpstream(t *testing.T) {
+	upstream := startFakeUpstream(t)
+	addr := freePort(t)
+	srv, _ := newLocalServer(t, t.TempDir(), func(cfg *config.Config) {
+		cfg.Listen = []string{addr}
+		cfg.Workers = 1
+		cfg.Upstream = upstream
+	})
+	go srv.Run()
+
+	c, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	waitForListener(t, c)
+
+	// forwarded and local answers mixed in one burst
+	var queries [][]byte
+	for i := 1; i <= 100; i++ {
+		name := fmt.Sprintf("q%d.test", i)
+		if i%10 == 0 {
+			name = "printer.lan"
+		}
+		q := dns.BuildQuery(dns.DNSQuestion{Name: name, Type: dns.TypeA, Class: dns.ClassIN})
+		binary.BigEndian.PutUint16(q[:2], uint16(1000+i))
+		queries = append(queries, q)
+	}
+	got, err := sendBurst(c, queries)
+	if err != nil {
+		t.Fatalf("%d of %d answers: %v", len(got), len(queries), err)
+	}
+	for i := 1; i <= 100; i++ {
+		want := [4]byte{192, 0, 2, byte(i)}
+		if i%10 == 0 {
+			want = [4]byte{192, 168, 1, 200}
+		}
+		pkt := got[uint16(1000+i)]
+		if len(pkt.Answers) != 1 || pkt.Answers[0].RData.A != want {
+			t.Errorf("query %d: %+v, want %v", i, pkt.Answers, want)
+		}
+	}
+}
+
+func TestUDPTruncatesCachedAnswers(t *testing.T) {
+	upstream := startFakeUpstream(t)
+	addr := freePort(t)
+	srv, stats := newLocalServer(t, t.TempDir(), func(cfg *config.Config) {
+		cfg.Listen = []string{addr}
+		cfg.Workers = 1
+		cfg.Upstream = upstream
+	})
+	go srv.Run()
+
+	c, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	waitForListener(t, c)
+
+	// an EDNS client takes all 40 addresses and leaves them in the cache
+	q := dns.WithDO(dns.BuildQuery(dns.DNSQuestion{Name: "big.test", Type: dns.TypeA, Class: dns.ClassIN}))
+	binary.BigEndian.PutUint16(q[:2], 1)
+	got, err := sendBurst(c, [][]byte{q})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkt := got[1]; pkt.Header.TC || len(pkt.Answers) != 40 {
+		t.Fatalf("EDNS client: TC %v, %d answers", pkt.Header.TC, len(pkt.Answers))
+	}
+
+	// a plain client gets the cached answer cut down to 512 bytes
+	q = dns.BuildQuery(dns.DNSQuestion{Name: "big.test", Type: dns.TypeA, Class: dns.ClassIN})
+	binary.BigEndian.PutUint16(q[:2], 2)
+	if got, err = sendBurst(c, [][]byte{q}); err != nil {
+		t.Fatal(err)
+	}
+	if pkt := got[2]; !pkt.Header.TC || len(pkt.Answers) != 0 || len(pkt.Questions) != 1 || stats.CacheHits.Load() != 1 {
+		t.Fatalf("plain client: TC %v, %d answers, %d cache hits", pkt.Header.TC, len(pkt.Answers), stats.CacheHits.Load())
+	}
+}
+
+// BenchmarkUDPBurst keeps 16 queries in flight per client, enough for the
+// listener to fill its batches
+func BenchmarkUDPBurst(b *testing.B) {
+	const burst = 16
+	queries := make([][]byte, burst)
+	for i := range queries {
+		queries[i] = dns.BuildQuery(dns.DNSQuestion{Name: "printer.lan", Type: dns.TypeA, Class: dns.ClassIN})
+		binary.BigEndian.PutUint16(queries[i][:2], uint16(i))
+	}
+	addr := startWorkers(b, 1)
+	b.SetParallelism(4)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		c, err := net.Dial("udp", addr)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		defer c.Close()
+		for pb.Next() {
+			if _, err := sendBurst(c, queries); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+	b.ReportMetric(float64(b.N*burst)/b.Elapsed().Seconds(), "qps")
+}
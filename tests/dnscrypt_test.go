@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dns "nyasaki/dns-server/dns"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+var (
+	resolverMagic = []byte{0x72, 0x36, 0x66, 0x6e, 0x76, 0x57, 0x6a, 0x38}
+	anonPrefix    = []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00}
+)
+
+// fakeDNSCrypt is a DNSCrypt v2 resolver answering qN.test with 192.0.2.N
+type fakeDNSCrypt struct {
+	stamp   dns.Stamp
+	pk, sk  *[32]byte
+	magic   [8]byte
+	packets atomic.Int32
+	certs   atomic.Int32
+	// certificate requests left unanswered before it starts answering them
+	dropCerts atomic.Int32
+
+	mu         sync.Mutex
+	clientKeys map[[32]byte]bool
+}
+
+func startFakeDNSCrypt(t *testing.T) *fakeDNSCrypt {
+	t.Helper()
+	providerPub, providerKey, _ := ed25519.GenerateKey(rand.Reader)
+	f := &fakeDNSCrypt{clientKeys: make(map[[32]byte]bool)}
+	f.pk, f.sk, _ = box.GenerateKey(rand.Reader)
+	copy(f.magic[:], "testmagc")
+
+	cert := []byte("DNSC\x00\x01\x00\x00")
+	cert = append(cert, make([]byte, 64)...)
+	cert = append(cert, f.pk[:]...)
+	cert = append(cert, f.magic[:]...)
+	cert = binary.BigEndian.AppendUint32(cert, 1)
+	cert = binary.BigEndian.AppendUint32(cert, uint32(time.Now().Add(-time.Hour).Unix()))
+	cert = binary.BigEndian.AppendUint32(cert, uint32(time.Now().Add(time.Hour).Unix()))
+	copy(cert[8:72], ed25519.Sign(providerKey, cert[72:]))
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	f.stamp = dns.Stamp{Proto: dns.StampDNSCrypt, Addr: pc.LocalAddr().String(), PublicKey: providerPub, ProviderName: "2.dnscrypt-cert.test"}
+
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			f.packets.Add(1)
+			if out := f.answer(buf[:n], cert); out != nil {
+				_, _ = pc.WriteTo(out, from)
+			}
+		}
+	}()
+	return f
+}
+
+func (f *fakeDNSCrypt) answer(pkt, cert []byte) []byte {
+	if !bytes.HasPrefix(pkt, f.magic[:]) {
+		// certificate requests come in plain DNS
+		q, err := dns.ParseQuestionPacket(pkt, len(pkt))
+		if err != nil || q.Question.Type != dns.TypeTXT {
+			return nil
+		}
+		if f.dropCerts.Add(-1) >= 0 {
+			return nil
+		}
+		f.certs.Add(1)
+		out, _ := dns.BuildResponse(q, dns.RCodeSuccess, []dns.DNSAnswer{{
+			Name: q.Question.Name, Type: dns.TypeTXT, Class: dns.ClassIN, TTL: 60, RData: dns.RData{TXT: [][]byte{cert}},
+		}})
+		return out
+	}
+
+	var clientPK [32]byte
+	var nonce [24]byte
+	copy(clientPK[:], pkt[8:40])
+	copy(nonce[:12], pkt[40:52])
+	padded, ok := box.Open(nil, pkt[52:], &nonce, &clientPK, f.sk)
+	if !ok {
+		return nil
+	}
+	f.mu.Lock()
+	f.clientKeys[clientPK] = true
+	f.mu.Unlock()
+
+	end := bytes.LastIndexByte(padded, 0x80)
+	q, err := dns.ParseQuestionPacket(padded[:end], end)
+	if err != nil {
+		return nil
+	}
+	var last byte
+	fmt.Sscanf(q.Question.Name, "q%d.test", &last)
+	resp, _ := dns.BuildResponse(q, dns.RCodeSuccess, []dns.DNSAnswer{{
+		Name: q.Question.Name, Type: dns.TypeA, Class: dns.ClassIN, TTL: 60, RData: dns.RData{A: [4]byte{192, 0, 2, last}},
+	}})
+	resp = append(resp, 0x80)
+	resp = append(resp, make([]byte, 63-(len(resp)-1)%64)...)
+
+	_, _ = rand.Read(nonce[12:])
+	out := append(append([]byte(nil), resolverMagic...), nonce[:]...)
+	return box.Seal(out, resp, &nonce, &clientPK, f.sk)
+}
+
+// startRelay passes anonymized DNSCrypt packets on to the server they name
+func startRelay(t *testing.T) (string, *atomic.Int32) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	var relayed atomic.Int32
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < len(anonPrefix)+18 || !bytes.HasPrefix(buf[:n], anonPrefix) {
+				continue
+			}
+			ip := netip.AddrFrom16([16]byte(buf[10:26])).Unmap()
+			target := netip.AddrPortFrom(ip, binary.BigEndian.Uint16(buf[26:28]))
+			payload := append([]byte(nil), buf[28:n]...)
+			relayed.Add(1)
+			go func() {
+				c, err := net.Dial("udp", target.String())
+				if err != nil {
+					return
+				}
+				defer c.Close()
+				_ = c.SetDeadline(time.Now().Add(time.Second))
+				_, _ = c.Write(payload)
+				reply := make([]byte, 4096)
+				if n, err := c.Read(reply); err == nil {
+					_, _ = pc.WriteTo(reply[:n], from)
+				}
+			}()
+		}
+	}()
+	return pc.LocalAddr().String(), &relayed
+}
+
+func TestStamps(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	for _, st := range []dns.Stamp{
+		{Proto: dns.StampDNSCrypt, Props: 1, Addr: "192.0.2.1:8443", PublicKey: pub, ProviderName: "2.dnscrypt-cert.example.com"},
+		{Proto: dns.StampDNSCrypt, Addr: "[2001:db8::1]:443", PublicKey: pub, ProviderName: "2.dnscrypt-cert.example.com"},
+		{Proto: dns.StampRelay, Addr: "192.0.2.9:443"},
+		{Proto: dns.StampPlain, Props: 7, Addr: "192.0.2.53:53"},
+	} {
+		got, err := dns.ParseStamp(st.String())
+		if err != nil {
+			t.Fatalf("%s: %v", st, err)
+		}
+		if got.Proto != st.Proto || got.Props != st.Props || got.Addr != st.Addr || !bytes.Equal(got.PublicKey, st.PublicKey) || got.ProviderName != st.ProviderName {
+			t.Fatalf("round trip: %+v, want %+v", got, st)
+		}
+	}
+
+	// ports default per protocol
+	short := dns.Stamp{Proto: dns.StampDNSCrypt, Addr: "192.0.2.1", PublicKey: pub, ProviderName: "2.dnscrypt-cert.example.com"}
+	if got, _ := dns.ParseStamp(short.String()); got.Addr != "192.0.2.1:443" {
+		t.Fatalf("default port: %s", got.Addr)
+	}
+	plain := dns.Stamp{Proto: dns.StampPlain, Addr: "192.0.2.53"}
+	if up, err := dns.NewUpstream(plain.String(), dns.UpstreamOptions{}); err != nil || up.String() != "192.0.2.53:53" {
+		t.Fatalf("plain stamp: %v (%v)", up, err)
+	}
+
+	for _, bad := range []string{"sdns://", "sdns://AQ", "sdns://Ag", "dnscrypt://x", (dns.Stamp{Proto: dns.StampDNSCrypt, Addr: "1.2.3.4", PublicKey: pub[:5]}).String()} {
+		if _, err := dns.ParseStamp(bad); err == nil {
+			t.Errorf("%q parsed", bad)
+		}
+	}
+}
+
+func TestDNSCryptUpstream(t *testing.T) {
+	f := startFakeDNSCrypt(t)
+	up, err := dns.NewUpstream(f.stamp.String(), dns.UpstreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		pkt, err := exchangeName(up, fmt.Sprintf("q%d.test", i), uint16(100+i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pkt.Header.ID != uint16(100+i) || len(pkt.Answers) != 1 || pkt.Answers[0].RData.A != [4]byte{192, 0, 2, byte(i)} {
+			t.Fatalf("q%d: id %d, %+v", i, pkt.Header.ID, pkt.Answers)
+		}
+	}
+	if n := f.certs.Load(); n != 1 {
+		t.Fatalf("certificate fetched %d times", n)
+	}
+	// every query under a key of its own, nothing links them
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.clientKeys) != 3 {
+		t.Fatalf("%d client keys for 3 queries", len(f.clientKeys))
+	}
+}
+
+func TestDNSCryptThroughRelay(t *testing.T) {
+	f := startFakeDNSCrypt(t)
+	relay, relayed := startRelay(t)
+	relayStamp := dns.Stamp{Proto: dns.StampRelay, Addr: relay}
+
+	up, err := dns.NewUpstream(f.stamp.String(), dns.UpstreamOptions{Relays: []string{relayStamp.String()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt, err := exchangeName(up, "q7.test", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkt.Answers) != 1 || pkt.Answers[0].RData.A != [4]byte{192, 0, 2, 7} {
+		t.Fatalf("answer: %+v", pkt.Answers)
+	}
+	// certificate and query both went through the relay
+	if got, want := relayed.Load(), f.packets.Load(); got != 2 || want != 2 {
+		t.Fatalf("relayed %d of %d packets", got, want)
+	}
+}
+
+func TestDNSCryptSlowCertificateFetch(t *testing.T) {
+	f := startFakeDNSCrypt(t)
+	f.dropCerts.Store(1)
+	up, err := dns.NewUpstream(f.stamp.String(), dns.UpstreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first fetch goes unanswered until its query gives up
+	first := make(chan error, 1)
+	go func() {
+		_, err := up.Exchange(dns.BuildQuery(dns.DNSQuestion{Name: "q1.test", Type: dns.TypeA, Class: dns.ClassIN}), time.Second)
+		first <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// a second query doesn't wait behind it
+	reply, err := up.Exchange(dns.BuildQuery(dns.DNSQuestion{Name: "q2.test", Type: dns.TypeA, Class: dns.ClassIN}), 300*time.Millisecond)
+	if err != nil {
+		t.Fatalf("second query held up by the first fetch: %v", err)
+	}
+	if pkt, err := dns.ParseAnswerPacket(reply, len(reply)); err != nil || len(pkt.Answers) != 1 || pkt.Answers[0].RData.A != [4]byte{192, 0, 2, 2} {
+		t.Fatalf("answer: %+v (%v)", pkt.Answers, err)
+	}
+	if err := <-first; err == nil {
+		t.Fatalf("unanswered certificate request went through")
+	}
+}
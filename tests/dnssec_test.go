@@ -0,0 +1,678 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"nyasaki/dns-server/config"
+	dns "nyasaki/dns-server/dns"
+	"nyasaki/dns-server/metrics"
+)
+
+type setKey struct {
+	owner string
+	rtype uint16
+}
+
+// signedZone is an in-memory zone signed with one ECDSA P-256 key, or not at all
+type signedZone struct {
+	origin string
+	key    *ecdsa.PrivateKey
+	dnskey dns.DNSKEYData
+	nsec3  bool
+	sets   map[setKey][]dns.DNSAnswer
+	sigs   map[setKey]dns.DNSAnswer
+	chain  []dns.DNSAnswer // NSEC or NSEC3 records
+}
+
+func newSignedZone(t *testing.T, origin string, signed bool) *signedZone {
+	t.Helper()
+	z := &signedZone{origin: origin, sets: make(map[setKey][]dns.DNSAnswer), sigs: make(map[setKey]dns.DNSAnswer)}
+	z.add(origin, dns.TypeSOA, dns.RData{SOA: dns.SOAData{MName: "ns." + origin, RName: "admin." + origin, Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, Minimum: 300}})
+	z.add(origin, dns.TypeNS, dns.RData{Name: "ns." + origin})
+
+	if signed {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		z.key = key
+		pub := append(key.X.FillBytes(make([]byte, 32)), key.Y.FillBytes(make([]byte, 32))...)
+		z.dnskey = dns.DNSKEYData{Flags: dns.DNSKEYZone | dns.DNSKEYSEP, Protocol: 3, Algorithm: dns.AlgECDSAP256SHA256, PublicKey: pub}
+		z.add(origin, dns.TypeDNSKEY, dns.RData{DNSKEY: z.dnskey})
+	}
+	return z
+}
+
+func (z *signedZone) add(owner string, rtype uint16, rd dns.RData) {
+	k := setKey{owner, rtype}
+	z.sets[k] = append(z.sets[k], dns.DNSAnswer{Name: owner, Type: rtype, Class: dns.ClassIN, TTL: 300, RData: rd})
+}
+
+func (z *signedZone) delegate(child *signedZone) {
+	z.add(child.origin, dns.TypeNS, dns.RData{Name: "ns." + child.origin})
+	if child.key != nil {
+		ds, _ := dns.NewDS(child.origin, child.dnskey, dns.DigestSHA256)
+		z.add(child.origin, dns.TypeDS, dns.RData{DS: ds})
+	}
+}
+
+func labelsOf(name string) int {
+	if name == "" {
+		return 0
+	}
+	n := strings.Count(name, ".") + 1
+	if strings.HasPrefix(name, "*.") {
+		n--
+	}
+	return n
+}
+
+func (z *signedZone) sign(t *testing.T, rrs []dns.DNSAnswer) dns.DNSAnswer {
+	now := time.Now()
+	sig := dns.RRSIGData{
+		TypeCovered: rrs[0].Type, Algorithm: dns.AlgECDSAP256SHA256, Labels: uint8(labelsOf(rrs[0].Name)),
+		OrigTTL: rrs[0].TTL, Expiration: uint32(now.Add(time.Hour).Unix()), Inception: uint32(now.Add(-time.Hour).Unix()),
+		KeyTag: dns.KeyTag(z.dnskey), SignerName: z.origin,
+	}
+	digest := sha256.Sum256(dns.SignedData(sig, rrs))
+	r, s, err := ecdsa.Sign(rand.Reader, z.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig.Signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return dns.DNSAnswer{Name: rrs[0].Name, Type: dns.TypeRRSIG, Class: dns.ClassIN, TTL: rrs[0].TTL, RData: dns.RData{RRSIG: sig}}
+}
+
+// delegated reports names at or below a cut, which the zone doesn't sign
+func (z *signedZone) delegated(name string) bool {
+	for k := range z.sets {
+		if k.rtype == dns.TypeNS && k.owner != z.origin && dns.IsSubdomain(name, k.owner) {
+			return true
+		}
+	}
+	return false
+}
+
+func (z *signedZone) exists(name string) bool {
+	for k := range z.sets {
+		if dns.IsSubdomain(k.owner, name) {
+			return true
+		}
+	}
+	return false
+}
+
+var hexEncoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// finish builds the denial chain and signs every authoritative RRset
+func (z *signedZone) finish(t *testing.T) {
+	if z.key == nil {
+		return
+	}
+
+	owners := map[string][]uint16{}
+	for k := range z.sets {
+		owners[k.owner] = append(owners[k.owner], k.rtype)
+		// NSEC3 also hashes empty non-terminals
+		for n := k.owner; z.nsec3 && n != z.origin; {
+			_, n, _ = strings.Cut(n, ".")
+			owners[n] = append(owners[n], 0)
+		}
+	}
+	typesAt := func(owner string, extra uint16) []uint16 {
+		var types []uint16
+		for _, ty := range owners[owner] {
+			if ty != 0 {
+				types = append(types, ty)
+			}
+		}
+		if len(types) > 0 && !(z.delegated(owner) && len(z.sets[setKey{owner, dns.TypeDS}]) == 0) {
+			types = append(types, dns.TypeRRSIG)
+		}
+		types = append(types, extra)
+		sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+		return types
+	}
+
+	if z.nsec3 {
+		hashed := map[string]string{}
+		var hashes []string
+		for owner := range owners {
+			h := dns.NSEC3Hash(owner, nil, 0)
+			hashed[h] = owner
+			hashes = append(hashes, h)
+		}
+		sort.Strings(hashes)
+		for i, h := range hashes {
+			next, _ := hexEncoding.DecodeString(strings.ToUpper(hashes[(i+1)%len(hashes)]))
+			types := typesAt(hashed[h], 0)
+			rd := dns.RData{NSEC3: dns.NSEC3Data{HashAlg: 1, NextHashed: next, Types: types[1:]}}
+			z.add(h+"."+z.origin, dns.TypeNSEC3, rd)
+		}
+	} else {
+		var names []string
+		for owner := range owners {
+			names = append(names, owner)
+		}
+		sort.Slice(names, func(i, j int) bool { return dns.CanonicalCompare(names[i], names[j]) < 0 })
+		for i, owner := range names {
+			rd := dns.RData{NSEC: dns.NSECData{NextName: names[(i+1)%len(names)], Types: typesAt(owner, dns.TypeNSEC)}}
+			z.add(owner, dns.TypeNSEC, rd)
+		}
+	}
+
+	for k, rrs := range z.sets {
+		if k.rtype == dns.TypeNSEC || k.rtype == dns.TypeNSEC3 {
+			z.chain = append(z.chain, rrs...)
+		}
+		if k.owner != z.origin && k.rtype == dns.TypeNS {
+			continue
+		}
+		z.sigs[k] = z.sign(t, rrs)
+	}
+}
+
+func (z *signedZone) signed(rrs []dns.DNSAnswer) []dns.DNSAnswer {
+	out := append([]dns.DNSAnswer(nil), rrs...)
+	if sig, ok := z.sigs[setKey{rrs[0].Name, rrs[0].Type}]; ok {
+		out = append(out, sig)
+	}
+	return out
+}
+
+// proofs returns every chain record matching or covering name, its ancestors
+// in the zone or their wildcards, more than a real server sends but never too little
+func (z *signedZone) proofs(name string) []dns.DNSAnswer {
+	var want []string
+	for n := name; ; {
+		want = append(want, n, "*."+n)
+		if n == z.origin {
+			break
+		}
+		_, n, _ = strings.Cut(n, ".")
+	}
+
+	var out []dns.DNSAnswer
+	for _, rr := range z.chain {
+		for _, w := range want {
+			var hit bool
+			if rr.Type == dns.TypeNSEC {
+				next := rr.RData.NSEC.NextName
+				c1, c2 := dns.CanonicalCompare(rr.Name, w), dns.CanonicalCompare(w, next)
+				wraps := dns.CanonicalCompare(rr.Name, next) >= 0
+				hit = c1 == 0 || (!wraps && c1 < 0 && c2 < 0) || (wraps && (c1 < 0 || c2 < 0))
+			} else {
+				label, _, _ := strings.Cut(rr.Name, ".")
+				next := strings.ToLower(hexEncoding.EncodeToString(rr.RData.NSEC3.NextHashed))
+				h := dns.NSEC3Hash(w, nil, 0)
+				hit = label == h || (label < next && label < h && h < next) || (label >= next && (label < h || h < next))
+			}
+			if hit {
+				out = append(out, z.signed([]dns.DNSAnswer{rr})...)
+				break
+			}
+		}
+	}
+	return out
+}
+
+func (z *signedZone) answer(name string, qtype uint16) dns.DNSAnswerPacket {
+	resp := dns.DNSAnswerPacket{
+		Header:    dns.DNSHeader{QR: true, RD: true, RA: true},
+		Questions: []dns.DNSQuestion{{Name: name, Type: qtype, Class: dns.ClassIN}},
+	}
+	if rrs := z.sets[setKey{name, qtype}]; len(rrs) > 0 {
+		resp.Answers = z.signed(rrs)
+		return resp
+	}
+	if rrs := z.sets[setKey{name, dns.TypeCNAME}]; len(rrs) > 0 {
+		resp.Answers = z.signed(rrs)
+		return resp
+	}
+
+	if !z.exists(name) {
+		_, parent, _ := strings.Cut(name, ".")
+		for ; !z.exists(parent); _, parent, _ = strings.Cut(parent, ".") {
+		}
+		if rrs := z.sets[setKey{"*." + parent, qtype}]; len(rrs) > 0 {
+			for _, rr := range z.signed(rrs) {
+				rr.Name = name
+				resp.Answers = append(resp.Answers, rr)
+			}
+			resp.Authority = z.proofs(name)
+			return resp
+		}
+		if !z.exists("*." + parent) {
+			resp.Header.RCode = dns.RCodeNXDomain
+		}
+	}
+	resp.Authority = append(z.signed(z.sets[setKey{z.origin, dns.TypeSOA}]), z.proofs(name)...)
+	return resp
+}
+
+// signedWorld answers like a recursive resolver in front of a few signed zones:
+// the root, test, secure.test (signed), plain.test (unsigned delegation)
+type signedWorld struct {
+	zones   []*signedZone
+	anchor  string
+	queries atomic.Int32
+}
+
+func newSignedWorld(t *testing.T, nsec3 bool) *signedWorld {
+	root := newSignedZone(t, "", true)
+	tld := newSignedZone(t, "test", true)
+	secure := newSignedZone(t, "secure.test", true)
+	secure.nsec3 = nsec3
+	plain := newSignedZone(t, "plain.test", false)
+
+	root.delegate(tld)
+	tld.delegate(secure)
+	tld.delegate(plain)
+	secure.add("www.secure.test", dns.TypeA, dns.RData{A: [4]byte{192, 0, 2, 1}})
+	secure.add("www.secure.test", dns.TypeHTTPS, dns.RData{Opaque: []byte("\x00\x01\x00\x00\x01\x00\x03\x02h2")})
+	secure.add("alias.secure.test", dns.TypeCNAME, dns.RData{Name: "www.secure.test"})
+	secure.add("*.wild.secure.test", dns.TypeA, dns.RData{A: [4]byte{192, 0, 2, 7}})
+	secure.add("bad.secure.test", dns.TypeA, dns.RData{A: [4]byte{192, 0, 2, 66}})
+	plain.add("www.plain.test", dns.TypeA, dns.RData{A: [4]byte{192, 0, 2, 2}})
+	// 40 addresses, more than a plain UDP client takes
+	for i := 1; i <= 40; i++ {
+		secure.add("many.secure.test", dns.TypeA, dns.RData{A: [4]byte{192, 0, 2, byte(i)}})
+	}
+
+	w := &signedWorld{zones: []*signedZone{root, tld, secure, plain}}
+	for _, z := range w.zones {
+		z.finish(t)
+	}
+
+	// changed after signing, so its signature no longer matches
+	secure.sets[setKey{"bad.secure.test", dns.TypeA}][0].RData.A = [4]byte{192, 0, 2, 99}
+
+	w.anchor = rootAnchor(root)
+	return w
+}
+
+// rootAnchor is the trust anchor line for a test root
+func rootAnchor(root *signedZone) string {
+	ds, _ := dns.NewDS("", root.dnskey, dns.DigestSHA256)
+	return dns.FormatRData(dns.DNSAnswer{Type: dns.TypeDS, RData: dns.RData{DS: ds}})
+}
+
+func (w *signedWorld) zoneFor(name string, qtype uint16) *signedZone {
+	var best *signedZone
+	for _, z := range w.zones {
+		if !dns.IsSubdomain(name, z.origin) || qtype == dns.TypeDS && name == z.origin && name != "" {
+			continue
+		}
+		if best == nil || len(z.origin) > len(best.origin) {
+			best = z
+		}
+	}
+	return best
+}
+
+// fetch answers q, following CNAMEs across zones
+func (w *signedWorld) fetch(q dns.DNSQuestion) (dns.DNSAnswerPacket, error) {
+	w.queries.Add(1)
+	name := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+	resp := w.zoneFor(name, q.Type).answer(name, q.Type)
+	for len(resp.Answers) > 0 && resp.Answers[0].Type == dns.TypeCNAME && q.Type != dns.TypeCNAME {
+		next := w.fetchOne(resp.Answers[0].RData.Name, q.Type)
+		resp.Answers = append(resp.Answers, next.Answers...)
+		resp.Authority, resp.Header.RCode = next.Authority, next.Header.RCode
+		if len(next.Answers) == 0 || next.Answers[0].Type != dns.TypeCNAME {
+			break
+		}
+	}
+	resp.Questions = []dns.DNSQuestion{q}
+	return resp, nil
+}
+
+func (w *signedWorld) fetchOne(name string, qtype uint16) dns.DNSAnswerPacket {
+	return w.zoneFor(name, qtype).answer(name, qtype)
+}
+
+func newTestValidator(t *testing.T, w *signedWorld) *dns.Validator {
+	t.Helper()
+	v, err := dns.NewValidator(config.DNSSECConfig{TrustAnchors: []string{w.anchor}}, w.fetch)
+	if err != nil {
+		t.Fatalf("NewValidator: %v", err)
+	}
+	return v
+}
+
+func TestNSEC3Hash(t *testing.T) {
+	// RFC 5155 appendix A
+	salt := []byte{0xaa, 0xbb, 0xcc, 0xdd}
+	for name, want := range map[string]string{
+		"example":   "0p9mhaveqvm6t7vbl5lop2u3t2rp3tom",
+		"a.example": "35mthgpgcu1qg68fab165klnsnk3dpvl",
+	} {
+		if got := dns.NSEC3Hash(name, salt, 12); got != want {
+			t.Errorf("NSEC3Hash(%s) = %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestDNSSECRecordsRoundTrip(t *testing.T) {
+	w := newSignedWorld(t, true)
+	resp, _ := w.fetch(dns.DNSQuestion{Name: "nope.secure.test", Type: dns.TypeA, Class: dns.ClassIN})
+	resp.Answers = append(resp.Answers, dns.DNSAnswer{Name: "secure.test", Type: dns.TypeNSEC, Class: dns.ClassIN, TTL: 60,
+		RData: dns.RData{NSEC: dns.NSECData{NextName: "www.secure.test", Types: []uint16{dns.TypeA, dns.TypeNS, 257, 1234}}}})
+
+	wire, err := dns.BuildAnswerPacket(resp)
+	if err != nil {
+		t.Fatalf("BuildAnswerPacket: %v", err)
+	}
+	back, err := dns.ParseAnswerPacket(wire, len(wire))
+	if err != nil {
+		t.Fatalf("ParseAnswerPacket: %v", err)
+	}
+	nsec := back.Answers[0].RData.NSEC
+	if nsec.NextName != "www.secure.test" || fmt.Sprint(nsec.Types) != "[1 2 257 1234]" {
+		t.Fatalf("NSEC = %+v", nsec)
+	}
+	if len(back.Authority) != len(resp.Authority) {
+		t.Fatalf("authority has %d records, want %d", len(back.Authority), len(resp.Authority))
+	}
+	for i, rr := range back.Authority {
+		if rr.Type == dns.TypeRRSIG && string(rr.RData.RRSIG.Signature) != string(resp.Authority[i].RData.RRSIG.Signature) {
+			t.Fatalf("RRSIG %d changed in transit", i)
+		}
+		if rr.Type == dns.TypeNSEC3 && fmt.Sprint(rr.RData.NSEC3) != fmt.Sprint(resp.Authority[i].RData.NSEC3) {
+			t.Fatalf("NSEC3 %d = %+v, want %+v", i, rr.RData.NSEC3, resp.Authority[i].RData.NSEC3)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, nsec3 := range []bool{false, true} {
+		w := newSignedWorld(t, nsec3)
+		v := newTestValidator(t, w)
+
+		cases := []struct {
+			name  string
+			qtype uint16
+			want  dns.ValidationState
+		}{
+			{"www.secure.test", dns.TypeA, dns.Secure},
+			{"alias.secure.test", dns.TypeA, dns.Secure},
+			{"www.secure.test", dns.TypeHTTPS, dns.Secure},
+			{"www.secure.test", dns.TypeAAAA, dns.Secure},   // NODATA
+			{"nope.secure.test", dns.TypeA, dns.Secure},     // NXDOMAIN
+			{"a.b.wild.secure.test", dns.TypeA, dns.Secure}, // wildcard
+			{"x.wild.secure.test", dns.TypeTXT, dns.Secure}, // wildcard NODATA
+			{"secure.test", dns.TypeDNSKEY, dns.Secure},
+			{"www.plain.test", dns.TypeA, dns.Insecure}, // unsigned delegation
+			{"nope.plain.test", dns.TypeA, dns.Insecure},
+			{"bad.secure.test", dns.TypeA, dns.Bogus},
+		}
+		for _, c := range cases {
+			resp, _ := w.fetch(dns.DNSQuestion{Name: c.name, Type: c.qtype, Class: dns.ClassIN})
+			got, err := v.Validate(resp)
+			if got != c.want {
+				t.Errorf("nsec3=%v %s %s: %v (%v), want %v", nsec3, c.name, dns.TypeName(c.qtype), got, err, c.want)
+			}
+		}
+	}
+}
+
+func TestValidateMissingProofs(t *testing.T) {
+	for _, nsec3 := range []bool{false, true} {
+		w := newSignedWorld(t, nsec3)
+		v := newTestValidator(t, w)
+
+		for _, name := range []string{"nope.secure.test", "a.wild.secure.test"} {
+			resp, _ := w.fetch(dns.DNSQuestion{Name: name, Type: dns.TypeA, Class: dns.ClassIN})
+			var soaOnly []dns.DNSAnswer
+			for _, rr := range resp.Authority {
+				if rr.Type == dns.TypeSOA || rr.Type == dns.TypeRRSIG && rr.RData.RRSIG.TypeCovered == dns.TypeSOA {
+					soaOnly = append(soaOnly, rr)
+				}
+			}
+			resp.Authority = soaOnly
+			if got, _ := v.Validate(resp); got != dns.Bogus {
+				t.Errorf("nsec3=%v %s without proof: %v", nsec3, name, got)
+			}
+		}
+
+		// stripping the signatures off a signed answer doesn't make it insecure
+		resp, _ := w.fetch(dns.DNSQuestion{Name: "www.secure.test", Type: dns.TypeA, Class: dns.ClassIN})
+		resp.Answers = resp.Answers[:1]
+		if got, _ := v.Validate(resp); got != dns.Bogus {
+			t.Errorf("unsigned answer from a signed zone: %v", got)
+		}
+	}
+}
+
+func TestValidateWrongAnchor(t *testing.T) {
+	w := newSignedWorld(t, false)
+	other := newSignedWorld(t, false)
+	v, err := dns.NewValidator(config.DNSSECConfig{TrustAnchors: []string{other.anchor}}, w.fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, _ := w.fetch(dns.DNSQuestion{Name: "www.secure.test", Type: dns.TypeA, Class: dns.ClassIN})
+	if got, _ := v.Validate(resp); got != dns.Bogus {
+		t.Fatalf("answer under an untrusted root: %v", got)
+	}
+}
+
+// serveWorldTCP answers like an upstream resolver from w
+func serveWorldTCP(t *testing.T, w *signedWorld) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				for {
+					msg, err := dns.ReadTCPMessage(c)
+					if err != nil {
+						return
+					}
+					q, err := dns.ParseQuestionPacket(msg, len(msg))
+					if err != nil {
+						return
+					}
+					resp, _ := w.fetch(q.Question)
+					resp.Header.ID = q.Header.ID
+					wire, _ := dns.BuildAnswerPacket(resp)
+					if err := dns.WriteTCPMessage(c, wire); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// serveWorldUDP answers queries for w over UDP on addr as well, the
+// validator still fetches keys over TCP
+func serveWorldUDP(t *testing.T, w *signedWorld, addr string) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			q, err := dns.ParseQuestionPacket(buf[:n], n)
+			if err != nil {
+				continue
+			}
+			resp, _ := w.fetch(q.Question)
+			resp.Header.ID = q.Header.ID
+			wire, _ := dns.BuildAnswerPacket(resp)
+			_, _ = pc.WriteTo(wire, from)
+		}
+	}()
+}
+
+func TestServerValidates(t *testing.T) {
+	w := newSignedWorld(t, false)
+	cfg := config.Default()
+	cfg.Upstream = serveWorldTCP(t, w)
+	cfg.DNSSEC = config.DNSSECConfig{Validate: true, TrustAnchors: []string{w.anchor}}
+	stats := &metrics.Stats{}
+	srv, err := dns.NewServer(cfg, stats)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	ask := func(name string, do, cd bool) dns.DNSAnswerPacket {
+		t.Helper()
+		q := dns.DNSQuestionPacket{Header: dns.DNSHeader{ID: 9, RD: true, CD: cd}, Question: dns.DNSQuestion{Name: name, Type: dns.TypeA, Class: dns.ClassIN}}
+		msg := dns.BuildQuery(q.Question)
+		binary.BigEndian.PutUint16(msg, 9)
+		if do {
+			msg = dns.WithDO(msg)
+		}
+		resp := srv.Resolve(q, msg, netip.MustParseAddr("10.0.0.9"))
+		pkt, err := dns.ParseAnswerPacket(resp, len(resp))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		return pkt
+	}
+	hasSig := func(pkt dns.DNSAnswerPacket) bool {
+		for _, rr := range pkt.Answers {
+			if rr.Type == dns.TypeRRSIG {
+				return true
+			}
+		}
+		return false
+	}
+
+	pkt := ask("www.secure.test", true, false)
+	if !pkt.Header.AD || !hasSig(pkt) || pkt.Header.RCode != dns.RCodeSuccess {
+		t.Fatalf("secure answer for a DO client: AD=%v sig=%v rcode=%d", pkt.Header.AD, hasSig(pkt), pkt.Header.RCode)
+	}
+	if pkt := ask("www.secure.test", false, false); !pkt.Header.AD || hasSig(pkt) || len(pkt.Answers) != 1 {
+		t.Fatalf("secure answer without DO: AD=%v answers=%+v", pkt.Header.AD, pkt.Answers)
+	}
+	if pkt := ask("www.plain.test", false, false); pkt.Header.AD || len(pkt.Answers) != 1 {
+		t.Fatalf("insecure answer: AD=%v answers=%d", pkt.Header.AD, len(pkt.Answers))
+	}
+
+	// bogus data is refused, also from the cache, unless checking is disabled
+	for i := 0; i < 2; i++ {
+		if pkt := ask("bad.secure.test", false, false); pkt.Header.RCode != dns.RCodeServFail || len(pkt.Answers) != 0 {
+			t.Fatalf("bogus answer #%d: rcode %d, %d answers", i, pkt.Header.RCode, len(pkt.Answers))
+		}
+		time.Sleep(50 * time.Millisecond) // ristretto applies sets asynchronously
+	}
+	if pkt := ask("bad.secure.test", false, true); pkt.Header.RCode != dns.RCodeSuccess || pkt.Header.AD || len(pkt.Answers) != 1 {
+		t.Fatalf("bogus answer with CD: rcode %d AD=%v", pkt.Header.RCode, pkt.Header.AD)
+	}
+	if stats.DNSSECBogus.Load() != 1 || stats.CacheHits.Load() != 2 {
+		t.Fatalf("bogus validations %d, cache hits %d", stats.DNSSECBogus.Load(), stats.CacheHits.Load())
+	}
+}
+
+func TestServerValidatesHTTPS(t *testing.T) {
+	w := newSignedWorld(t, false)
+	cfg := config.Default()
+	cfg.Upstream = serveWorldTCP(t, w)
+	cfg.DNSSEC = config.DNSSECConfig{Validate: true, TrustAnchors: []string{w.anchor}}
+	stats := &metrics.Stats{}
+	srv, err := dns.NewServer(cfg, stats)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	client := netip.MustParseAddr("10.0.0.9")
+	q := dns.DNSQuestionPacket{Header: dns.DNSHeader{ID: 9, RD: true}, Question: dns.DNSQuestion{Name: "www.secure.test", Type: dns.TypeHTTPS, Class: dns.ClassIN}}
+	msg := dns.BuildQuery(q.Question)
+	binary.BigEndian.PutUint16(msg, 9)
+
+	// browsers ask for HTTPS records all the time, they are checked and cached like the rest
+	for i := 0; i < 2; i++ {
+		resp := srv.Resolve(q, msg, client)
+		pkt, err := dns.ParseAnswerPacket(resp, len(resp))
+		if err != nil || !pkt.Header.AD || len(pkt.Answers) != 1 || pkt.Answers[0].Type != dns.TypeHTTPS {
+			t.Fatalf("#%d: %+v (%v)", i, pkt, err)
+		}
+		time.Sleep(50 * time.Millisecond) // ristretto applies sets asynchronously
+	}
+	if stats.DNSSECSecure.Load() != 1 || stats.CacheHits.Load() != 1 {
+		t.Fatalf("secure validations %d, cache hits %d", stats.DNSSECSecure.Load(), stats.CacheHits.Load())
+	}
+
+	// a reply the validator can't read is not passed on unchecked
+	msg = dns.BuildQuery(dns.DNSQuestion{Name: "bad.secure.test", Type: dns.TypeA, Class: dns.ClassIN})
+	q, _ = dns.ParseQuestionPacket(msg, len(msg))
+	_, fwd := srv.HandleQuery(q, msg, client)
+	if fwd == nil || !fwd.Validate {
+		t.Fatalf("forward %+v", fwd)
+	}
+	raw, _ := dns.BuildResponse(q, dns.RCodeSuccess, []dns.DNSAnswer{
+		{Name: "bad.secure.test", Type: dns.TypeA, Class: dns.ClassIN, TTL: 60, RData: dns.RData{A: [4]byte{192, 0, 2, 99}}},
+	})
+	out := srv.FinishUpstream(raw[:len(raw)-2], fwd)
+	if pkt, err := dns.ParseAnswerPacket(out, len(out)); err != nil || pkt.Header.RCode != dns.RCodeServFail || len(pkt.Answers) != 0 {
+		t.Fatalf("unreadable reply: %+v (%v)", pkt, err)
+	}
+}
+
+func TestServerValidatesOverUDP(t *testing.T) {
+	w := newSignedWorld(t, false)
+	upstream := serveWorldTCP(t, w)
+	serveWorldUDP(t, w, upstream)
+
+	addr := freePort(t)
+	srv, stats := newLocalServer(t, t.TempDir(), func(cfg *config.Config) {
+		cfg.Listen = []string{addr}
+		cfg.Workers = 1
+		cfg.Upstream = upstream
+		cfg.DNSSEC = config.DNSSECConfig{Validate: true, TrustAnchors: []string{w.anchor}}
+	})
+	go srv.Run()
+
+	c, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	waitForListener(t, c)
+
+	// the upstream is asked with DO and a 1232 byte buffer, the plain
+	// client still only takes 512 bytes of the checked answer
+	q := dns.BuildQuery(dns.DNSQuestion{Name: "many.secure.test", Type: dns.TypeA, Class: dns.ClassIN})
+	binary.BigEndian.PutUint16(q[:2], 1)
+	got, err := sendBurst(c, [][]byte{q})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkt := got[1]; !pkt.Header.TC || len(pkt.Answers) != 0 || stats.DNSSECSecure.Load() != 1 {
+		t.Fatalf("TC %v, %d answers, %d secure", pkt.Header.TC, len(pkt.Answers), stats.DNSSECSecure.Load())
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"nyasaki/dns-server/config"
+	dns "nyasaki/dns-server/dns"
+)
+
+func dohQuery(name string) []byte {
+	return dns.BuildQuery(dns.DNSQuestion{Name: name, Type: dns.TypeA, Class: dns.ClassIN})
+}
+
+func dohAnswer(t *testing.T, rec *httptest.ResponseRecorder) dns.DNSAnswerPacket {
+	t.Helper()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/dns-message" {
+		t.Fatalf("content type %q", ct)
+	}
+	body := rec.Body.Bytes()
+	pkt, err := dns.ParseAnswerPacket(body, len(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkt
+}
+
+func TestDoHGetAndPost(t *testing.T) {
+	srv, _ := newLocalServer(t, t.TempDir(), func(cfg *config.Config) { cfg.Overrides.TTL = 120 })
+	h := srv.DoHHandler()
+
+	get := httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(dohQuery("printer.lan")), nil)
+	post := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(dohQuery("printer.lan")))
+	post.Header.Set("Content-Type", "application/dns-message")
+
+	for _, req := range []*http.Request{get, post} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		pkt := dohAnswer(t, rec)
+		if len(pkt.Answers) != 1 || pkt.Answers[0].RData.A != [4]byte{192, 168, 1, 200} {
+			t.Fatalf("%s: %+v", req.Method, pkt.Answers)
+		}
+		if cc := rec.Header().Get("Cache-Control"); cc != "max-age=120" {
+			t.Fatalf("%s: Cache-Control %q", req.Method, cc)
+		}
+	}
+}
+
+func TestDoHRejectsBadRequests(t *testing.T) {
+	srv, _ := newLocalServer(t, t.TempDir(), nil)
+	h := srv.DoHHandler()
+
+	wrongType := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(dohQuery("printer.lan")))
+	wrongType.Header.Set("Content-Type", "text/plain")
+
+	for _, tc := range []struct {
+		req  *http.Request
+		code int
+	}{
+		{httptest.NewRequest(http.MethodGet, "/dns-query", nil), http.StatusBadRequest},
+		{httptest.NewRequest(http.MethodGet, "/dns-query?dns=***", nil), http.StatusBadRequest},
+		{httptest.NewRequest(http.MethodGet, "/dns-query?dns=AAAA", nil), http.StatusBadRequest},
+		{httptest.NewRequest(http.MethodPut, "/dns-query", nil), http.StatusMethodNotAllowed},
+		{wrongType, http.StatusUnsupportedMediaType},
+		{httptest.NewRequest(http.MethodGet, "/other", nil), http.StatusNotFound},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, tc.req)
+		if rec.Code != tc.code {
+			t.Errorf("%s %s: status %d, want %d", tc.req.Method, tc.req.URL, rec.Code, tc.code)
+		}
+	}
+}
+
+func TestDoHOverHTTP2(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath, pool := writeTestCert(t, dir, 1)
+	srv, _ := newLocalServer(t, dir, func(cfg *config.Config) {
+		cfg.DoH.CertFile, cfg.DoH.KeyFile = certPath, keyPath
+	})
+	ln, err := srv.ListenDoH("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenDoH: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go srv.ServeDoH(ln)
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: pool, ServerName: "localhost"},
+		ForceAttemptHTTP2: true,
+	}}
+	resp, err := client.Post("https://"+ln.Addr().String()+"/dns-query", "application/dns-message", bytes.NewReader(dohQuery("printer.lan")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("served over %s, want HTTP/2", resp.Proto)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	pkt, err := dns.ParseAnswerPacket(body, len(body))
+	if err != nil || len(pkt.Answers) != 1 {
+		t.Fatalf("answer: %+v (%v)", pkt.Answers, err)
+	}
+}
+
+func TestDoHForwardedFor(t *testing.T) {
+	srv, _ := newLocalServer(t, t.TempDir(), func(cfg *config.Config) {
+		cfg.Upstream = "127.0.0.1:1" // refuses, unblocked names fail fast
+		cfg.DoH.TrustedProxies = []string{"127.0.0.0/8"}
+		cfg.Blocklists = map[string]config.BlocklistConfig{"ads": {Domains: []string{"ads.test"}}}
+		cfg.Groups = []config.GroupConfig{{Name: "kids", CIDRs: []string{"10.9.0.0/16"}, Blocklists: []string{"ads"}}}
+	})
+	h := srv.DoHHandler()
+
+	for _, tc := range []struct {
+		peer, xff string
+		blocked   bool
+	}{
+		{"127.0.0.1:4000", "10.9.0.5", true},
+		{"127.0.0.1:4000", "10.9.0.5, 127.0.0.2", true},  // chain of our own proxies
+		{"127.0.0.1:4000", "10.9.0.5, 192.0.2.7", false}, // spoofed by the client
+		{"192.0.2.9:4000", "10.9.0.5", false},            // not a proxy we trust
+		{"10.9.0.7:4000", "", true},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(dohQuery("ads.test")), nil)
+		req.RemoteAddr = tc.peer
+		if tc.xff != "" {
+			req.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		pkt := dohAnswer(t, rec)
+		if got := pkt.Header.RCode == dns.RCodeNXDomain; got != tc.blocked {
+			t.Errorf("%s via %s: rcode %d, blocked want %v", tc.xff, tc.peer, pkt.Header.RCode, tc.blocked)
+		}
+	}
+}
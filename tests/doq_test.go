@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"nyasaki/dns-server/config"
+	dns "nyasaki/dns-server/dns"
+
+	"github.com/quic-go/quic-go"
+)
+
+func startDoQ(t *testing.T) (string, *x509.CertPool) {
+	t.Helper()
+	dir := t.TempDir()
+	certPath, keyPath, pool := writeTestCert(t, dir, 1)
+	srv, _ := newLocalServer(t, dir, func(cfg *config.Config) {
+		cfg.DoQ.CertFile, cfg.DoQ.KeyFile = certPath, keyPath
+	})
+
+	ln, err := srv.ListenDoQ("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenDoQ: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go srv.ServeDoQ(ln)
+	return ln.Addr().String(), pool
+}
+
+func dialDoQ(t *testing.T, addr string, pool *x509.CertPool) *quic.Conn {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, addr, &tls.Config{RootCAs: pool, ServerName: "localhost", NextProtos: []string{"doq"}}, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.CloseWithError(0, "") })
+	return conn
+}
+
+// queryDoQ sends one query on a stream of its own, as RFC 9250 asks
+func queryDoQ(conn *quic.Conn, name string, id uint16) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	st, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	_ = st.SetDeadline(time.Now().Add(2 * time.Second))
+
+	msg := dns.BuildQuery(dns.DNSQuestion{Name: name, Type: dns.TypeA, Class: dns.ClassIN})
+	binary.BigEndian.PutUint16(msg[:2], id)
+	if err := dns.WriteTCPMessage(st, msg); err != nil {
+		return nil, err
+	}
+	st.Close()
+	return dns.ReadTCPMessage(st)
+}
+
+func TestDoQAnswers(t *testing.T) {
+	addr, pool := startDoQ(t)
+	conn := dialDoQ(t, addr, pool)
+
+	// concurrent queries, each on its own stream of one connection
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reply, err := queryDoQ(conn, "printer.lan", 0)
+			if err != nil {
+				t.Errorf("query: %v", err)
+				return
+			}
+			pkt, err := dns.ParseAnswerPacket(reply, len(reply))
+			if err != nil || pkt.Header.ID != 0 || len(pkt.Answers) != 1 || pkt.Answers[0].RData.A != [4]byte{192, 168, 1, 200} {
+				t.Errorf("answer: id %d, %+v (%v)", pkt.Header.ID, pkt.Answers, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestDoQRejectsMessageID(t *testing.T) {
+	addr, pool := startDoQ(t)
+	conn := dialDoQ(t, addr, pool)
+
+	_, err := queryDoQ(conn, "printer.lan", 7)
+	var appErr *quic.ApplicationError
+	if !errors.As(err, &appErr) || appErr.ErrorCode != 0x2 {
+		t.Fatalf("query with ID 7: %v, want DOQ_PROTOCOL_ERROR", err)
+	}
+}
+
+func TestQUICUpstream(t *testing.T) {
+	addr, pool := startDoQ(t)
+	boot, asked := startBootstrap(t)
+	_, port, _ := net.SplitHostPort(addr)
+
+	up, err := dns.NewUpstream("quic://localhost:"+port, dns.UpstreamOptions{Bootstrap: []string{boot}, RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		pkt, err := exchangeName(up, "printer.lan", 0x4242)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pkt.Header.ID != 0x4242 || len(pkt.Answers) != 1 || pkt.Answers[0].RData.A != [4]byte{192, 168, 1, 200} {
+			t.Fatalf("id %#x, %+v", pkt.Header.ID, pkt.Answers)
+		}
+	}
+	// the connection is kept, the name resolved once
+	if n := asked.Load(); n != 1 {
+		t.Fatalf("bootstrap asked %d times", n)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"nyasaki/dns-server/config"
+	dns "nyasaki/dns-server/dns"
+	"nyasaki/dns-server/metrics"
+)
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and localhost
+// to dir, named after serial, and returns the file paths and a pool trusting it
+func writeTestCert(t *testing.T, dir string, serial int64) (string, string, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "dns test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return certPath, keyPath, pool
+}
+
+// newLocalServer answers printer.lan from an override, nothing goes upstream
+func newLocalServer(t testing.TB, dir string, edit func(*config.Config)) (*dns.Server, *metrics.Stats) {
+	t.Helper()
+	hosts := filepath.Join(dir, "hosts.json")
+	if err := os.WriteFile(hosts, []byte(`{"printer.lan": "192.168.1.200"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Default()
+	cfg.Overrides.JSONFiles = []string{hosts}
+	if edit != nil {
+		edit(cfg)
+	}
+	stats := &metrics.Stats{}
+	srv, err := dns.NewServer(cfg, stats)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	return srv, stats
+}
+
+func startDoT(t *testing.T) (string, string, string, *x509.CertPool) {
+	t.Helper()
+	dir := t.TempDir()
+	certPath, keyPath, pool := writeTestCert(t, dir, 1)
+	srv, _ := newLocalServer(t, dir, func(cfg *config.Config) {
+		cfg.DoT.CertFile, cfg.DoT.KeyFile = certPath, keyPath
+	})
+
+	ln, err := srv.ListenDoT("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenDoT: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go srv.ServeTCP(ln)
+	return ln.Addr().String(), certPath, keyPath, pool
+}
+
+func queryDoT(t *testing.T, conn *tls.Conn, name string) dns.DNSAnswerPacket {
+	t.Helper()
+	if err := dns.WriteTCPMessage(conn, dns.BuildQuery(dns.DNSQuestion{Name: name, Type: dns.TypeA, Class: dns.ClassIN})); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := dns.ReadTCPMessage(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt, err := dns.ParseAnswerPacket(reply, len(reply))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkt
+}
+
+func TestDoTAnswers(t *testing.T) {
+	addr, _, _, pool := startDoT(t)
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool, ServerName: "localhost", NextProtos: []string{"dot"}})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if p := conn.ConnectionState().NegotiatedProtocol; p != "dot" {
+		t.Fatalf("ALPN %q, want dot", p)
+	}
+
+	// several queries share one connection
+	for i := 0; i < 3; i++ {
+		pkt := queryDoT(t, conn, "printer.lan")
+		if len(pkt.Answers) != 1 || pkt.Answers[0].RData.A != [4]byte{192, 168, 1, 200} {
+			t.Fatalf("query %d: %+v", i, pkt.Answers)
+		}
+	}
+}
+
+func TestDoTSessionResumption(t *testing.T) {
+	addr, _, _, pool := startDoT(t)
+	conf := &tls.Config{RootCAs: pool, ServerName: "localhost", ClientSessionCache: tls.NewLRUClientSessionCache(4)}
+
+	for i, want := range []bool{false, true} {
+		conn, err := tls.Dial("tcp", addr, conf)
+		if err != nil {
+			t.Fatalf("dial %d: %v", i, err)
+		}
+		// TLS 1.3 tickets arrive after the handshake, one exchange picks them up
+		queryDoT(t, conn, "printer.lan")
+		if got := conn.ConnectionState().DidResume; got != want {
+			t.Fatalf("connection %d resumed=%v, want %v", i, got, want)
+		}
+		conn.Close()
+	}
+}
+
+func TestDoTCertificateReload(t *testing.T) {
+	addr, certPath, keyPath, _ := startDoT(t)
+
+	serial := func() int64 {
+		t.Helper()
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+	if got := serial(); got != 1 {
+		t.Fatalf("serial %d, want 1", got)
+	}
+
+	// a renewal replaces both files, make sure the change is visible even on coarse clocks
+	renewed := t.TempDir()
+	newCert, newKey, _ := writeTestCert(t, renewed, 2)
+	for _, f := range [][2]string{{newCert, certPath}, {newKey, keyPath}} {
+		if err := os.Rename(f[0], f[1]); err != nil {
+			t.Fatal(err)
+		}
+		later := time.Now().Add(time.Minute)
+		if err := os.Chtimes(f[1], later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the files are looked at every couple of seconds, not on every handshake
+	for i := 0; serial() != 2; i++ {
+		if i == 50 {
+			t.Fatalf("renewal not picked up")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// a broken file keeps the last good certificate
+	if err := os.WriteFile(certPath, []byte("garbage"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2100 * time.Millisecond)
+	if got := serial(); got != 2 {
+		t.Fatalf("serial %d after a broken renewal, want 2", got)
+	}
+}
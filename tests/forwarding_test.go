@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"nyasaki/dns-server/config"
+	dns "nyasaki/dns-server/dns"
+	"nyasaki/dns-server/metrics"
+)
+
+var corpRoutes = []config.ForwardConfig{
+	{Domains: []string{"corp.lan", "10.in-addr.arpa"}, Upstreams: []string{"10.0.0.53:53", "10.0.0.54:53"}, Timeout: "2s"},
+	{Domains: []string{"vpn.corp.lan."}, Upstreams: []string{"172.16.0.53:53"}},
+}
+
+func TestRouterMatch(t *testing.T) {
+	r, err := dns.NewRouter(corpRoutes)
+	if err != nil {
+		t.Fatalf("NewRouter: %v", err)
+	}
+
+	cases := []struct {
+		name, suffix string
+	}{
+		{"corp.lan", "corp.lan"},
+		{"Files.CORP.lan.", "corp.lan"},
+		{"host.vpn.corp.lan", "vpn.corp.lan"},
+		{"4.3.2.10.in-addr.arpa", "10.in-addr.arpa"},
+		{"notcorp.lan", ""},
+		{"example.com", ""},
+	}
+	for _, c := range cases {
+		rt := r.Match(c.name)
+		got := ""
+		if rt != nil {
+			got = rt.Suffix
+		}
+		if got != c.suffix {
+			t.Errorf("Match(%q) = %q, want %q", c.name, got, c.suffix)
+		}
+	}
+
+	rt := r.Match("corp.lan")
+	if rt.Timeout != 2*time.Second {
+		t.Fatalf("timeout = %v", rt.Timeout)
+	}
+	if a, b, c := rt.Pick(), rt.Pick(), rt.Pick(); a == b || a != c {
+		t.Fatalf("upstreams not rotated: %s %s %s", a, b, c)
+	}
+}
+
+func TestConditionalForward(t *testing.T) {
+	cfg := config.Default()
+	cfg.Forwarders = corpRoutes
+	cfg.Groups = []config.GroupConfig{{Name: "guest", CIDRs: []string{"192.168.50.0/24"}, Upstream: "1.1.1.1:53"}}
+	srv, err := dns.NewServer(cfg, &metrics.Stats{})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	forward := func(name, from string) *dns.Forward {
+		q := dns.DNSQuestionPacket{Header: dns.DNSHeader{ID: 3}, Question: dns.DNSQuestion{Name: name, Type: dns.TypeA, Class: dns.ClassIN}}
+		resp, fwd := srv.HandleQuery(q, dns.BuildQuery(q.Question), netip.MustParseAddr(from))
+		if resp != nil || fwd == nil {
+			t.Fatalf("%s was not forwarded", name)
+		}
+		return fwd
+	}
+
+	if fwd := forward("vpn.corp.lan", "10.0.0.9"); fwd.Upstream != "172.16.0.53:53" {
+		t.Fatalf("vpn.corp.lan went to %q", fwd.Upstream)
+	}
+	if fwd := forward("www.corp.lan", "192.168.50.7"); fwd.Upstream != "10.0.0.53:53" && fwd.Upstream != "10.0.0.54:53" || fwd.Timeout != 2*time.Second {
+		t.Fatalf("route should beat the group upstream: %q %v", fwd.Upstream, fwd.Timeout)
+	}
+	if fwd := forward("example.com", "192.168.50.7"); fwd.Upstream != "1.1.1.1:53" {
+		t.Fatalf("unrouted name for guest went to %q", fwd.Upstream)
+	}
+	if fwd := forward("example.com", "10.0.0.9"); fwd.Upstream != "" {
+		t.Fatalf("unrouted name went to %q, want the default", fwd.Upstream)
+	}
+}
+
+func TestConditionalForwardResolve(t *testing.T) {
+	// the xfr.lan primary stands in for an internal DNS server
+	_, addr, _ := startPrimary(t)
+
+	cfg := config.Default()
+	cfg.Upstream = "127.0.0.1:1" // nothing listens here
+	cfg.Forwarders = []config.ForwardConfig{{Domains: []string{"xfr.lan"}, Upstreams: []string{addr}}}
+	srv, err := dns.NewServer(cfg, &metrics.Stats{})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	q := dns.DNSQuestionPacket{Header: dns.DNSHeader{ID: 77}, Question: dns.DNSQuestion{Name: "ns1.xfr.lan", Type: dns.TypeA, Class: dns.ClassIN}}
+	resp := srv.Resolve(q, dns.BuildQuery(q.Question), netip.MustParseAddr("10.0.0.9"))
+	pkt, err := dns.ParseAnswerPacket(resp, len(resp))
+	if err != nil {
+		t.Fatalf("ParseAnswerPacket: %v", err)
+	}
+	if pkt.Header.ID != 77 || len(pkt.Answers) != 1 || pkt.Answers[0].RData.A != [4]byte{10, 0, 0, 1} {
+		t.Fatalf("routed answer wrong: %+v", pkt)
+	}
+}
+
+func TestConditionalForwardFailover(t *testing.T) {
+	_, addr, _ := startPrimary(t)
+
+	cfg := config.Default()
+	cfg.Upstream = "127.0.0.1:1"
+	// nothing listens on the first, every query has to get to the second;
+	// xfr.lan hands out 10.0.0.1, the route may resolve privately
+	cfg.Forwarders = []config.ForwardConfig{{Domains: []string{"xfr.lan"}, Upstreams: []string{"127.0.0.1:1", addr}, AllowPrivate: true}}
+	cfg.Rebind.Enabled = true
+	srv, err := dns.NewServer(cfg, &metrics.Stats{})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		q := dns.DNSQuestionPacket{Header: dns.DNSHeader{ID: 77}, Question: dns.DNSQuestion{Name: "ns1.xfr.lan", Type: dns.TypeA, Class: dns.ClassIN}}
+		resp := srv.Resolve(q, dns.BuildQuery(q.Question), netip.MustParseAddr("10.0.0.9"))
+		pkt, err := dns.ParseAnswerPacket(resp, len(resp))
+		if err != nil {
+			t.Fatalf("ParseAnswerPacket: %v", err)
+		}
+		if len(pkt.Answers) != 1 || pkt.Answers[0].RData.A != [4]byte{10, 0, 0, 1} {
+			t.Fatalf("query %d: rcode %d, %+v", i, pkt.Header.RCode, pkt.Answers)
+		}
+	}
+}
+
+func TestConditionalForwardRebind(t *testing.T) {
+	_, addr, _ := startPrimary(t)
+
+	// without allow_private a route is checked like any other upstream
+	cfg := config.Default()
+	cfg.Forwarders = []config.ForwardConfig{{Domains: []string{"xfr.lan"}, Upstreams: []string{addr}}}
+	cfg.Rebind.Enabled = true
+	srv, err := dns.NewServer(cfg, &metrics.Stats{})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	q := dns.DNSQuestionPacket{Header: dns.DNSHeader{ID: 77}, Question: dns.DNSQuestion{Name: "ns1.xfr.lan", Type: dns.TypeA, Class: dns.ClassIN}}
+	resp := srv.Resolve(q, dns.BuildQuery(q.Question), netip.MustParseAddr("10.0.0.9"))
+	if pkt, err := dns.ParseAnswerPacket(resp, len(resp)); err != nil || len(pkt.Answers) != 0 {
+		t.Fatalf("private answer passed: %+v (%v)", pkt.Answers, err)
+	}
+}
+
+func TestConditionalForwardTimeout(t *testing.T) {
+	// accepts connections and never answers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	cfg := config.Default()
+	cfg.Forwarders = []config.ForwardConfig{{Domains: []string{"slow.lan"}, Upstreams: []string{ln.Addr().String()}, Timeout: "200ms"}}
+	srv, err := dns.NewServer(cfg, &metrics.Stats{})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	q := dns.DNSQuestionPacket{Header: dns.DNSHeader{ID: 77}, Question: dns.DNSQuestion{Name: "www.slow.lan", Type: dns.TypeA, Class: dns.ClassIN}}
+	start := time.Now()
+	resp := srv.Resolve(q, dns.BuildQuery(q.Question), netip.MustParseAddr("10.0.0.9"))
+	if took := time.Since(start); took > time.Second {
+		t.Fatalf("gave up after %v, the route allows 200ms", took)
+	}
+	if pkt, err := dns.ParseAnswerPacket(resp, len(resp)); err != nil || pkt.Header.RCode != dns.RCodeServFail {
+		t.Fatalf("%+v (%v)", pkt.Header, err)
+	}
+}
+
+func TestConditionalForwardFailoverUDP(t *testing.T) {
+	// a silent upstream, queries sent to it time out
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	upstream := startFakeUpstream(t)
+
+	addr := freePort(t)
+	srv, _ := newLocalServer(t, t.TempDir(), func(cfg *config.Config) {
+		cfg.Listen = []string{addr}
+		cfg.Workers = 1
+		cfg.Forwarders = []config.ForwardConfig{{Domains: []string{"test"}, Upstreams: []string{silent.LocalAddr().String(), upstream}, Timeout: "100ms"}}
+	})
+	go srv.Run()
+
+	c, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	waitForListener(t, c)
+
+	// the route rotates, one of the two starts on the silent upstream
+	var queries [][]byte
+	for i := 1; i <= 2; i++ {
+		q := dns.BuildQuery(dns.DNSQuestion{Name: fmt.Sprintf("q%d.test", i), Type: dns.TypeA, Class: dns.ClassIN})
+		binary.BigEndian.PutUint16(q[:2], uint16(i))
+		queries = append(queries, q)
+	}
+	got, err := sendBurst(c, queries)
+	if err != nil {
+		t.Fatalf("%d of 2 answers: %v", len(got), err)
+	}
+	for i := 1; i <= 2; i++ {
+		if pkt := got[uint16(i)]; len(pkt.Answers) != 1 || pkt.Answers[0].RData.A != [4]byte{192, 0, 2, byte(i)} {
+			t.Fatalf("query %d: %+v", i, pkt.Answers)
+		}
+	}
+}
@@ -33,6 +33,18 @@ func TestParseName(t *testing.T) {
 			wantName: "www.google.com",
 			wantNext: 18,
 		},
+		{
+			name:    "pointer to itself",
+			msg:     []byte{0, 1, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0xC0, 12, 0, 1, 0, 1},
+			offset:  12,
+			wantErr: true,
+		},
+		{
+			name:    "longer than 255 octets",
+			msg:     []byte(strings.Repeat("\x3f"+strings.Repeat("a", 63), 4) + "\x00"),
+			offset:  0,
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
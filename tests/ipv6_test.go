@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"nyasaki/dns-server/config"
+	dns "nyasaki/dns-server/dns"
+)
+
+// queryUDP asks the server at addr for name over plain UDP
+func queryUDP(t *testing.T, addr, name string) dns.DNSAnswerPacket {
+	t.Helper()
+	c, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.Write(dns.BuildQuery(dns.DNSQuestion{Name: name, Type: dns.TypeA, Class: dns.ClassIN})); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4096)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatalf("%s via %s: %v", name, addr, err)
+	}
+	pkt, err := dns.ParseAnswerPacket(buf[:n], n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkt
+}
+
+func TestDualStackListener(t *testing.T) {
+	srv, _ := newLocalServer(t, t.TempDir(), func(cfg *config.Config) {
+		cfg.Upstream = "127.0.0.1:1"
+		cfg.Blocklists = map[string]config.BlocklistConfig{
+			"v4": {Domains: []string{"four.test"}},
+			"v6": {Domains: []string{"six.test"}},
+		}
+		cfg.Groups = []config.GroupConfig{
+			{Name: "v4", CIDRs: []string{"127.0.0.0/8"}, Blocklists: []string{"v4"}},
+			{Name: "v6", CIDRs: []string{"::1/128"}, Blocklists: []string{"v6"}},
+		}
+	})
+
+	// [::] takes IPv4 clients as well, they arrive as ::ffff:127.0.0.1
+	conn, err := dns.SetupConnection("[::]:0")
+	if err != nil {
+		t.Skipf("no IPv6: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go srv.ServeUDP(conn)
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	v4 := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	v6 := net.JoinHostPort("::1", strconv.Itoa(port))
+	if c, err := net.Dial("udp", v6); err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	} else {
+		c.Close()
+	}
+
+	for _, tc := range []struct {
+		addr, name string
+		blocked    bool
+	}{
+		{v4, "four.test", true},
+		{v4, "six.test", false},
+		{v6, "six.test", true},
+		{v6, "four.test", false},
+	} {
+		pkt := queryUDP(t, tc.addr, tc.name)
+		if got := pkt.Header.RCode == dns.RCodeNXDomain; got != tc.blocked {
+			t.Errorf("%s via %s: rcode %d, blocked want %v", tc.name, tc.addr, pkt.Header.RCode, tc.blocked)
+		}
+	}
+	for _, addr := range []string{v4, v6} {
+		if pkt := queryUDP(t, addr, "printer.lan"); len(pkt.Answers) != 1 || pkt.Answers[0].RData.A != [4]byte{192, 168, 1, 200} {
+			t.Errorf("printer.lan via %s: %+v", addr, pkt.Answers)
+		}
+	}
+}
+
+func TestListenValidation(t *testing.T) {
+	for listen, ok := range map[string]bool{
+		":53":            true,
+		"[::1]:5353":     true,
+		"0.0.0.0:53":     true,
+		"::1":            false,
+		"127.0.0.1":      false,
+		"[fe80::1%lo]:0": true,
+	} {
+		cfg := config.Default()
+		cfg.Listen = []string{listen}
+		if err := cfg.Validate(); (err == nil) != ok {
+			t.Errorf("%q: %v, want ok %v", listen, err, ok)
+		}
+	}
+	cfg := config.Default()
+	cfg.Listen = nil
+	if cfg.Validate() == nil {
+		t.Error("no listen addresses accepted")
+	}
+}
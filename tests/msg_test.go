@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"nyasaki/dns-server/config"
+	dns "nyasaki/dns-server/dns"
+)
+
+// sampleResponse answers www.example.com with a CNAME and an A record, the
+// owner names compressed against the question, and an OPT record
+func sampleResponse(t testing.TB, qname string) []byte {
+	t.Helper()
+	q := dns.DNSQuestionPacket{Header: dns.DNSHeader{ID: 0x1234, RD: true}, Question: dns.DNSQuestion{Name: qname, Type: dns.TypeA, Class: dns.ClassIN}}
+	resp, err := dns.BuildResponse(q, dns.RCodeSuccess, []dns.DNSAnswer{
+		{Name: qname, Type: dns.TypeCNAME, Class: dns.ClassIN, TTL: 300, RData: dns.RData{Name: "edge.example.net"}},
+		{Name: "edge.example.net", Type: dns.TypeA, Class: dns.ClassIN, TTL: 60, RData: dns.RData{A: [4]byte{192, 0, 2, 1}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dns.WithDO(resp)
+}
+
+func TestMsgView(t *testing.T) {
+	b := sampleResponse(t, "WwW.Example.COM")
+	m, err := dns.ParseMsg(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ID() != 0x1234 || m.QType() != dns.TypeA || m.QClass() != dns.ClassIN || m.Count(dns.SectionAnswer) != 2 {
+		t.Fatalf("header/question: id %#x type %d class %d answers %d", m.ID(), m.QType(), m.QClass(), m.Count(dns.SectionAnswer))
+	}
+	if name, _ := m.AppendQName(nil); string(name) != "www.example.com" {
+		t.Fatalf("qname %q", name)
+	}
+
+	answers := m.Records(dns.SectionAnswer)
+	var got []dns.RRView
+	for rr, ok := answers.Next(); ok; rr, ok = answers.Next() {
+		got = append(got, rr)
+	}
+	if answers.Err() != nil || len(got) != 2 {
+		t.Fatalf("answers: %d (%v)", len(got), answers.Err())
+	}
+	if got[0].Type != dns.TypeCNAME || got[1].Type != dns.TypeA || got[1].TTL != 60 || string(got[1].RData) != "\xc0\x00\x02\x01" {
+		t.Fatalf("records: %+v", got)
+	}
+	if name, err := got[1].Name(); err != nil || name != "edge.example.net" {
+		t.Fatalf("owner %q (%v)", name, err)
+	}
+	// the CNAME's owner is a pointer to the question, still the same name
+	if !dns.NameEqual(b, m.QNameOffset(), b, got[0].NameOffset()) || dns.NameEqual(b, m.QNameOffset(), b, got[1].NameOffset()) {
+		t.Fatal("NameEqual on compressed owners")
+	}
+
+	// the additional section is found without the caller walking the others
+	m2, _ := dns.ParseMsg(b)
+	extra := m2.Records(dns.SectionAdditional)
+	if opt, ok := extra.Next(); !ok || opt.Type != dns.TypeOPT {
+		t.Fatalf("additional: %+v (%v)", opt, extra.Err())
+	}
+
+	// truncated records end the walk with an error
+	m3, err := dns.ParseMsg(b[:len(b)-20])
+	if err != nil {
+		t.Fatal(err)
+	}
+	cut := m3.Records(dns.SectionAdditional)
+	if _, ok := cut.Next(); ok || cut.Err() == nil {
+		t.Fatal("truncated message walked")
+	}
+}
+
+func TestNameEqual(t *testing.T) {
+	wire := func(labels ...string) []byte {
+		var b []byte
+		for _, l := range labels {
+			b = append(append(b, byte(len(l))), l...)
+		}
+		return append(b, 0)
+	}
+	for _, tc := range []struct {
+		a, b []byte
+		want bool
+	}{
+		{wire("example", "com"), wire("EXAMPLE", "Com"), true},
+		{wire("example", "com"), wire("example", "org"), false},
+		{wire("example", "com"), wire("example"), false},
+		{wire("a-b"), wire("A-B"), true},
+		{wire(""), wire(""), true},
+		{wire("x"), []byte{0xc0, 0x00}, false}, // pointer to itself
+	} {
+		if got := dns.NameEqual(tc.a, 0, tc.b, 0); got != tc.want {
+			t.Errorf("%q vs %q: %v", tc.a, tc.b, got)
+		}
+	}
+}
+
+func TestSameQuestion(t *testing.T) {
+	query := dns.BuildQuery(dns.DNSQuestion{Name: "www.example.com", Type: dns.TypeA, Class: dns.ClassIN})
+	if !dns.SameQuestion(sampleResponse(t, "WWW.example.com"), query) {
+		t.Fatal("0x20 cased reply rejected")
+	}
+	for _, other := range [][]byte{
+		sampleResponse(t, "evil.example.com"),
+		dns.BuildQuery(dns.DNSQuestion{Name: "www.example.com", Type: dns.TypeAAAA, Class: dns.ClassIN}),
+		query[:12],
+	} {
+		if dns.SameQuestion(other, query) {
+			t.Errorf("%x taken as the answer", other)
+		}
+	}
+}
+
+func TestUpstreamReplyMustMatchQuestion(t *testing.T) {
+	// the upstream first answers every query for another name under the same
+	// ID, the way an off-path spoofer that guessed it would
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			q, err := dns.ParseQuestionPacket(buf[:n], n)
+			if err != nil {
+				continue
+			}
+			spoof := q
+			spoof.Question.Name = "evil.test"
+			fake, _ := dns.BuildResponse(spoof, dns.RCodeSuccess, []dns.DNSAnswer{{
+				Name: "evil.test", Type: dns.TypeA, Class: dns.ClassIN, TTL: 60, RData: dns.RData{A: [4]byte{203, 0, 113, 66}},
+			}})
+			real, _ := dns.BuildResponse(q, dns.RCodeSuccess, []dns.DNSAnswer{{
+				Name: q.Question.Name, Type: dns.TypeA, Class: dns.ClassIN, TTL: 60, RData: dns.RData{A: [4]byte{192, 0, 2, 1}},
+			}})
+			_, _ = pc.WriteTo(fake, from)
+			_, _ = pc.WriteTo(real, from)
+		}
+	}()
+
+	addr := freePort(t)
+	srv, _ := newLocalServer(t, t.TempDir(), func(cfg *config.Config) {
+		cfg.Listen = []string{addr}
+		cfg.Workers = 1
+		cfg.Upstream = pc.LocalAddr().String()
+	})
+	go srv.Run()
+
+	c, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	waitForListener(t, c)
+
+	got, err := sendBurst(c, [][]byte{dns.BuildQuery(dns.DNSQuestion{Name: "www.example.com", Type: dns.TypeA, Class: dns.ClassIN})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pkt := range got {
+		if len(pkt.Answers) != 1 || pkt.Answers[0].Name != "www.example.com" || pkt.Answers[0].RData.A != [4]byte{192, 0, 2, 1} {
+			t.Fatalf("spoofed reply accepted: %+v", pkt.Answers)
+		}
+	}
+}
+
+func TestCacheKeyFromWire(t *testing.T) {
+	for _, name := range []string{"www.example.com", "MiXeD.CaSe.Test", "", "xn--bcher-kva.example"} {
+		msg := dns.BuildQuery(dns.DNSQuestion{Name: name, Type: dns.TypeMX, Class: dns.ClassIN})
+		q, err := dns.ParseQuestionPacket(msg, len(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, _ := dns.ParseMsg(msg)
+		key, err := m.AppendCacheKey(nil)
+		if err != nil || string(key) != dns.CacheKeyFromQuestion(q) {
+			t.Errorf("%q: wire key %q, parsed key %q (%v)", name, key, dns.CacheKeyFromQuestion(q), err)
+		}
+	}
+}
+
+// cachedServer blocks ads.test for everyone and has answered it once, so the
+// block sits in the cache
+func cachedServer(t testing.TB) (*dns.Server, []byte) {
+	t.Helper()
+	srv, _ := newLocalServer(t, t.TempDir(), func(cfg *config.Config) {
+		cfg.Blocklists = map[string]config.BlocklistConfig{"ads": {Domains: []string{"ads.test"}}}
+		cfg.Groups = []config.GroupConfig{{Name: "everyone", Blocklists: []string{"ads"}}}
+	})
+	msg := dns.BuildQuery(dns.DNSQuestion{Name: "ads.test", Type: dns.TypeA, Class: dns.ClassIN})
+	q, _ := dns.ParseQuestionPacket(msg, len(msg))
+	client := netip.MustParseAddr("192.0.2.7")
+	srv.HandleQuery(q, msg, client)
+
+	// the cache takes its writes asynchronously
+	dst := make([]byte, 0, 4096)
+	for i := 0; i < 100; i++ {
+		if _, ok := srv.CachedResponse(dst, msg, client); ok {
+			return srv, msg
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("answer never cached")
+	return nil, nil
+}
+
+func TestCachedResponse(t *testing.T) {
+	srv, msg := cachedServer(t)
+	client := netip.MustParseAddr("192.0.2.7")
+	dst := make([]byte, 0, 4096)
+
+	binary.BigEndian.PutUint16(msg[:2], 0xbeef)
+	resp, ok := srv.CachedResponse(dst, msg, client)
+	if !ok {
+		t.Fatal("cache miss")
+	}
+	pkt, err := dns.ParseAnswerPacket(resp, len(resp))
+	if err != nil || pkt.Header.ID != 0xbeef || pkt.Header.RCode != dns.RCodeNXDomain {
+		t.Fatalf("answer: %+v (%v)", pkt.Header, err)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { srv.CachedResponse(dst, msg, client) }); allocs != 0 {
+		t.Fatalf("%v allocations per cache hit", allocs)
+	}
+
+	// overrides, responses and other opcodes take the full pipeline
+	local := dns.BuildQuery(dns.DNSQuestion{Name: "printer.lan", Type: dns.TypeA, Class: dns.ClassIN})
+	notify := append([]byte(nil), msg...)
+	notify[2] |= dns.OpcodeNotify << 3
+	for name, pkt := range map[string][]byte{"override": local, "response": sampleResponse(t, "ads.test"), "notify": notify, "short": msg[:5]} {
+		if _, ok := srv.CachedResponse(dst, pkt, client); ok {
+			t.Errorf("%s answered from the cache", name)
+		}
+	}
+}
+
+func BenchmarkCachedResponse(b *testing.B) {
+	srv, msg := cachedServer(b)
+	client := netip.MustParseAddr("192.0.2.7")
+	dst := make([]byte, 0, 4096)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, ok := srv.CachedResponse(dst, msg, client); !ok {
+			b.Fatal("cache miss")
+		}
+	}
+}
+
+func BenchmarkParseMsg(b *testing.B) {
+	resp := sampleResponse(b, "www.example.com")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		m, _ := dns.ParseMsg(resp)
+		answers := m.Records(dns.SectionAnswer)
+		for _, ok := answers.Next(); ok; _, ok = answers.Next() {
+		}
+	}
+}
+
+func BenchmarkParseAnswerPacket(b *testing.B) {
+	resp := sampleResponse(b, "www.example.com")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _ = dns.ParseAnswerPacket(resp, len(resp))
+	}
+}
+
+func BenchmarkCacheKey(b *testing.B) {
+	msg := dns.BuildQuery(dns.DNSQuestion{Name: "www.Example.com", Type: dns.TypeA, Class: dns.ClassIN})
+	b.Run("wire", func(b *testing.B) {
+		key := make([]byte, 0, 256)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			m, _ := dns.ParseMsg(msg)
+			key, _ = m.AppendCacheKey(key[:0])
+		}
+	})
+	b.Run("parsed", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			q, _ := dns.ParseQuestionPacket(msg, len(msg))
+			_ = dns.CacheKeyFromQuestion(q)
+		}
+	})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"nyasaki/dns-server/config"
+	dns "nyasaki/dns-server/dns"
+	"nyasaki/dns-server/metrics"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func loadTestOverrides(t *testing.T) *dns.Overrides {
+	t.Helper()
+	hosts := writeFile(t, "hosts", "127.0.0.1 localhost\n192.168.1.200 printer.lan printer # office\nfd00::200 printer.lan\n")
+	jsonFile := writeFile(t, "hosts.json", `{
+		"my.local.dev": "192.168.1.50",
+		"nas.lan": ["192.168.1.10", "192.168.1.11"],
+		"www.lan": {"cname": "nas.lan"},
+		"docs.lan": {"cname": "docs.example.org"},
+		"mail.lan": {"a": ["192.168.1.25"], "txt": ["v=spf1 mx -all"]}
+	}`)
+
+	o, err := dns.LoadOverrides(config.OverridesConfig{JSONFiles: []string{jsonFile}, HostsFiles: []string{hosts}, TTL: 60})
+	if err != nil {
+		t.Fatalf("LoadOverrides: %v", err)
+	}
+	return o
+}
+
+func TestOverridesLookup(t *testing.T) {
+	o := loadTestOverrides(t)
+
+	answers, fwd, ok := o.Lookup(dns.DNSQuestion{Name: "Printer.LAN", Type: 1, Class: 1})
+	if !ok || fwd != "" || len(answers) != 1 || answers[0].RData.A != [4]byte{192, 168, 1, 200} {
+		t.Fatalf("printer A: ok=%v fwd=%q answers=%+v", ok, fwd, answers)
+	}
+
+	answers, _, _ = o.Lookup(dns.DNSQuestion{Name: "printer.lan", Type: 28, Class: 1})
+	if len(answers) != 1 || answers[0].RData.AAAA != netip.MustParseAddr("fd00::200").As16() {
+		t.Fatalf("printer AAAA: %+v", answers)
+	}
+
+	answers, _, ok = o.Lookup(dns.DNSQuestion{Name: "nas.lan", Type: 15, Class: 1})
+	if !ok || len(answers) != 0 {
+		t.Fatalf("MX for overridden name should be NODATA, got ok=%v %+v", ok, answers)
+	}
+
+	if _, _, ok = o.Lookup(dns.DNSQuestion{Name: "example.com", Type: 1, Class: 1}); ok {
+		t.Fatalf("unrelated name should not be overridden")
+	}
+
+	answers, _, _ = o.Lookup(dns.DNSQuestion{Name: "mail.lan", Type: 16, Class: 1})
+	if len(answers) != 1 || string(answers[0].RData.TXT[0]) != "v=spf1 mx -all" {
+		t.Fatalf("mail TXT: %+v", answers)
+	}
+
+	// the records are class IN, CHAOS and friends are someone else's
+	if _, _, ok = o.Lookup(dns.DNSQuestion{Name: "printer.lan", Type: 16, Class: 3}); ok {
+		t.Fatalf("CH query answered from the overrides")
+	}
+}
+
+func TestOverridesCNAMEClash(t *testing.T) {
+	hosts := writeFile(t, "hosts", "192.168.1.10 www.lan\n")
+	jsonFile := writeFile(t, "hosts.json", `{"www.lan": {"cname": "nas.lan"}}`)
+
+	if _, err := dns.LoadOverrides(config.OverridesConfig{JSONFiles: []string{jsonFile}, HostsFiles: []string{hosts}, TTL: 60}); err == nil {
+		t.Fatalf("CNAME next to an address from another file was accepted")
+	}
+}
+
+func TestOverridesPTR(t *testing.T) {
+	o := loadTestOverrides(t)
+
+	tests := map[string]string{
+		"200.1.168.192.in-addr.arpa":                      "printer.lan",
+		"10.1.168.192.in-addr.arpa":                       "nas.lan",
+		dns.ReverseName(netip.MustParseAddr("fd00::200")): "printer.lan",
+	}
+	for name, want := range tests {
+		answers, _, ok := o.Lookup(dns.DNSQuestion{Name: name, Type: 12, Class: 1})
+		if !ok || len(answers) == 0 || answers[0].RData.Name != want {
+			t.Errorf("PTR %s: ok=%v answers=%+v, want %s", name, ok, answers, want)
+		}
+	}
+
+	if got := dns.ReverseName(netip.MustParseAddr("2001:db8::1")); got != "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa" {
+		t.Fatalf("ReverseName v6 = %s", got)
+	}
+}
+
+func TestOverridesCNAME(t *testing.T) {
+	o := loadTestOverrides(t)
+
+	answers, fwd, ok := o.Lookup(dns.DNSQuestion{Name: "www.lan", Type: 1, Class: 1})
+	if !ok || fwd != "" || len(answers) != 3 || answers[0].Type != 5 {
+		t.Fatalf("local CNAME chase: ok=%v fwd=%q answers=%+v", ok, fwd, answers)
+	}
+
+	answers, fwd, _ = o.Lookup(dns.DNSQuestion{Name: "docs.lan", Type: 1, Class: 1})
+	if fwd != "docs.example.org" || len(answers) != 1 {
+		t.Fatalf("external CNAME should be forwarded: fwd=%q answers=%+v", fwd, answers)
+	}
+
+	resp := dns.NewResponse(dns.DNSQuestionPacket{Question: dns.DNSQuestion{Name: "www.lan", Type: 1, Class: 1}}, 0, nil)
+	resp.Answers, _, _ = o.Lookup(resp.Questions[0])
+	resp.Header.AA = true
+	wire, err := dns.BuildAnswerPacket(resp)
+	if err != nil {
+		t.Fatalf("BuildAnswerPacket: %v", err)
+	}
+	hdr, _ := dns.ParseHeader(wire)
+	if !hdr.AA || hdr.ANCount != 3 {
+		t.Fatalf("override answer not authoritative or incomplete: %+v", hdr)
+	}
+}
+
+func TestOverridesNoDataSOA(t *testing.T) {
+	o := loadTestOverrides(t)
+
+	cases := []struct {
+		name  string
+		qtype uint16
+		owner string // of the SOA, "" when the answer has data
+	}{
+		{"printer.lan", 1, ""},
+		{"nas.lan", 15, "nas.lan"},
+		// the gap is at the end of the chain
+		{"www.lan", 28, "nas.lan"},
+		{"www.lan", 5, ""},
+	}
+	for _, c := range cases {
+		q := dns.DNSQuestion{Name: c.name, Type: c.qtype, Class: 1}
+		answers, _, _ := o.Lookup(q)
+		auth := o.Authority(q, answers)
+		if c.owner == "" {
+			if len(auth) != 0 {
+				t.Errorf("%s/%d has data, got authority %+v", c.name, c.qtype, auth)
+			}
+			continue
+		}
+		if len(auth) != 1 || auth[0].Type != dns.TypeSOA || auth[0].Name != c.owner || auth[0].TTL != 60 || auth[0].RData.SOA.Minimum != 60 {
+			t.Errorf("%s/%d: authority %+v, want the SOA of %s with minimum 60", c.name, c.qtype, auth, c.owner)
+		}
+	}
+
+	// and it makes it onto the wire
+	cfg := config.Default()
+	cfg.Overrides = config.OverridesConfig{JSONFiles: []string{writeFile(t, "hosts.json", `{"nas.lan": "192.168.1.10"}`)}, TTL: 60}
+	srv, err := dns.NewServer(cfg, &metrics.Stats{})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	q := dns.DNSQuestionPacket{Header: dns.DNSHeader{ID: 5}, Question: dns.DNSQuestion{Name: "nas.lan", Type: 15, Class: 1}}
+	resp := srv.Resolve(q, dns.BuildQuery(q.Question), netip.MustParseAddr("192.168.1.2"))
+	pkt, err := dns.ParseAnswerPacket(resp, len(resp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pkt.Header.AA || pkt.Header.RCode != 0 || len(pkt.Answers) != 0 || len(pkt.Authority) != 1 || pkt.Authority[0].RData.SOA.Minimum != 60 {
+		t.Fatalf("NODATA: %+v, authority %+v", pkt.Header, pkt.Authority)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"nyasaki/dns-server/config"
+	dns "nyasaki/dns-server/dns"
+)
+
+func TestBlocklistMatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	content := "# ads\nads.example.com\n0.0.0.0 tracker.net # hosts style\n*.social.example\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	bl := dns.NewBlocklist(nil)
+	if err := bl.LoadFile(path); err != nil {
+		t.Fatalf("LoadFile: %v", err)
+	}
+
+	tests := map[string]bool{
+		"ads.example.com":      true,
+		"x.ADS.example.com.":   true,
+		"cdn.tracker.net":      true,
+		"feed.social.example":  true,
+		"social.example":       true,
+		"example.com":          false,
+		"badads.example.com":   false,
+		"tracker.net.evil.org": false,
+	}
+	for name, want := range tests {
+		if got := bl.Match(name); got != want {
+			t.Errorf("Match(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestPolicyGroupFor(t *testing.T) {
+	cfg := config.Default()
+	cfg.Blocklists = map[string]config.BlocklistConfig{
+		"social": {Domains: []string{"social.example"}},
+	}
+	cfg.Groups = []config.GroupConfig{
+		{Name: "lan", CIDRs: []string{"192.168.0.0/16"}},
+		{Name: "kids", CIDRs: []string{"192.168.10.0/24", "fd00:10::/64"}, Blocklists: []string{"social"}, SafeSearch: true},
+		{Name: "guest", CIDRs: []string{"10.99.0.0/16"}, Upstream: "1.1.1.1:53"},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	p, err := dns.NewPolicy(cfg)
+	if err != nil {
+		t.Fatalf("NewPolicy: %v", err)
+	}
+
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"192.168.1.5", "lan"},
+		{"192.168.10.5", "kids"},
+		{"::ffff:192.168.10.5", "kids"},
+		{"fd00:10::42", "kids"},
+		{"10.99.3.3", "guest"},
+		{"8.8.8.8", ""},
+	}
+	for _, tt := range tests {
+		if got := p.GroupFor(netip.MustParseAddr(tt.addr)).Name; got != tt.want {
+			t.Errorf("GroupFor(%s) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+
+	kids := p.GroupFor(netip.MustParseAddr("192.168.10.5"))
+	if !kids.Blocked("m.social.example") || !kids.SafeSearch {
+		t.Fatalf("kids group lost its rules")
+	}
+	if p.GroupFor(netip.MustParseAddr("192.168.1.5")).Blocked("m.social.example") {
+		t.Fatalf("lan group should not use the kids blocklist")
+	}
+
+	q := dns.DNSQuestionPacket{Question: dns.DNSQuestion{Name: "Example.com", Type: 1, Class: 1}}
+	if key := p.GroupFor(netip.MustParseAddr("10.99.3.3")).CacheKey(q); key != "guest|example.com|1|1" {
+		t.Fatalf("guest cache key %q is not isolated", key)
+	}
+}
+
+func TestConfigRejectsUnknownBlocklist(t *testing.T) {
+	cfg := config.Default()
+	cfg.Groups = []config.GroupConfig{{Name: "kids", Blocklists: []string{"missing"}}}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for unknown blocklist")
+	}
+}
+
+func TestNewPolicyRejectsBadGroups(t *testing.T) {
+	// NewServer doesn't run Validate, NewPolicy checks on its own
+	cases := map[string][]config.GroupConfig{
+		"unknown blocklist": {{Name: "kids", Blocklists: []string{"missing"}}},
+		"unknown rule list": {{Name: "kids", Rules: []config.RuleConfig{{Blocklist: "missing"}}}},
+		"unknown schedule":  {{Name: "kids", Rules: []config.RuleConfig{{Blocklist: "social", Schedule: "missing"}}}},
+		"two defaults":      {{Name: "a"}, {Name: "b"}},
+	}
+	for name, groups := range cases {
+		cfg := config.Default()
+		cfg.Blocklists = map[string]config.BlocklistConfig{"social": {Domains: []string{"social.example"}}}
+		cfg.Groups = groups
+		if _, err := dns.NewPolicy(cfg); err == nil {
+			t.Errorf("%s: NewPolicy accepted %+v", name, groups)
+		}
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("%s: Validate accepted %+v", name, groups)
+		}
+	}
+}
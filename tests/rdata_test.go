@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+
+	dns "nyasaki/dns-server/dns"
+)
+
+func TestBuildRdataRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		typ   uint16
+		rdata dns.RData
+	}{
+		{"A", 1, dns.RData{A: [4]byte{192, 0, 2, 1}}},
+		{"AAAA", 28, dns.RData{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}}},
+		{"NS", 2, dns.RData{Name: "ns1.example.com"}},
+		{"CNAME", 5, dns.RData{Name: "edge.example.net"}},
+		{"PTR", 12, dns.RData{Name: "printer.lan"}},
+		{"SOA", 6, dns.RData{SOA: dns.SOAData{MName: "ns1.example.com", RName: "hostmaster.example.com", Serial: 2024010101, Refresh: 7200, Retry: 3600, Expire: 1209600, Minimum: 300}}},
+		{"MX", 15, dns.RData{MX: dns.MXData{Pref: 1000, Host: "mail.example.com"}}},
+		{"MX null", 15, dns.RData{MX: dns.MXData{Pref: 0, Host: ""}}},
+		{"TXT", 16, dns.RData{TXT: [][]byte{[]byte("v=spf1 -all"), bytes.Repeat([]byte("x"), 255), nil}}},
+		{"SRV", 33, dns.RData{SRV: dns.SRVData{Pri: 10, Wt: 60, Port: 5060, Target: "sip.example.com"}}},
+		{"DS", 43, dns.RData{DS: dns.DSData{KeyTag: 20326, Algorithm: 8, DigestType: 2, Digest: bytes.Repeat([]byte{0xab}, 32)}}},
+		{"CDS", 59, dns.RData{DS: dns.DSData{KeyTag: 1, Algorithm: 13, DigestType: 2, Digest: []byte{1, 2, 3}}}},
+		{"DNSKEY", 48, dns.RData{DNSKEY: dns.DNSKEYData{Flags: 257, Protocol: 3, Algorithm: 15, PublicKey: bytes.Repeat([]byte{7}, 32)}}},
+		{"CDNSKEY", 60, dns.RData{DNSKEY: dns.DNSKEYData{Flags: 256, Protocol: 3, Algorithm: 13, PublicKey: []byte{1}}}},
+		{"RRSIG", 46, dns.RData{RRSIG: dns.RRSIGData{TypeCovered: 1, Algorithm: 13, Labels: 3, OrigTTL: 300, Expiration: 1700003600, Inception: 1700000000, KeyTag: 4242, SignerName: "example.com", Signature: bytes.Repeat([]byte{9}, 64)}}},
+		{"NSEC", 47, dns.RData{NSEC: dns.NSECData{NextName: "b.example.com", Types: []uint16{1, 46, 47, 1234}}}},
+		{"NSEC3", 50, dns.RData{NSEC3: dns.NSEC3Data{HashAlg: 1, Flags: 1, Iterations: 0, NextHashed: bytes.Repeat([]byte{0x5a}, 20), Types: []uint16{1, 28}}}},
+		{"TSIG", 250, dns.RData{TSIG: dns.TSIGData{Algorithm: "hmac-sha256", TimeSigned: 1<<40 + 5, Fudge: 300, MAC: bytes.Repeat([]byte{3}, 32), OrigID: 77, Error: 0}}},
+		{"HTTPS", 65, dns.RData{Opaque: []byte("\x00\x01\x00\x00\x01\x00\x03\x02h2")}},
+		{"CAA", 257, dns.RData{Opaque: []byte("\x00\x05issueca.test")}},
+		{"opaque", 99, dns.RData{Opaque: []byte{1, 2, 3, 4, 5}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// TSIG is the one record of class ANY that carries RDATA
+			class := uint16(1)
+			if tc.typ == 250 {
+				class = 255
+			}
+			rr := dns.DNSAnswer{Name: "www.example.com", Type: tc.typ, Class: class, TTL: 3600, RDLength: 1, RData: tc.rdata}
+
+			pkt, err := dns.BuildAnswer(make([]byte, 12), nil, rr, make(map[string]int))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, end, err := dns.ParseAnswer(pkt, 12)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// RDLENGTH comes from the encoded bytes, not the stale field;
+			// the RDATA starts after the 17 byte owner and the fixed fields
+			if end != len(pkt) || int(got.RDLength) != len(pkt)-12-17-10 {
+				t.Fatalf("RDLENGTH %d, record ends at %d of %d", got.RDLength, end, len(pkt))
+			}
+			// Kind is bookkeeping, the wire carries the type in the record header
+			got.RData.Kind = tc.rdata.Kind
+			if !reflect.DeepEqual(got.RData, tc.rdata) {
+				t.Fatalf("round trip:\n got %+v\nwant %+v", got.RData, tc.rdata)
+			}
+		})
+	}
+}
+
+func TestBuildRdataWire(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		typ   uint16
+		rdata dns.RData
+		want  []byte
+	}{
+		{"SOA keeps every 32-bit field", 6, dns.RData{SOA: dns.SOAData{MName: "a", RName: "b", Serial: 0x01020304, Refresh: 0x05060708, Retry: 0x090a0b0c, Expire: 0x0d0e0f10, Minimum: 0x11121314}},
+			[]byte{1, 'a', 0, 1, 'b', 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}},
+		{"MX preference is 16 bits", 15, dns.RData{MX: dns.MXData{Pref: 0x0102, Host: "m"}},
+			[]byte{1, 2, 1, 'm', 0}},
+		{"SRV fields are 16 bits", 33, dns.RData{SRV: dns.SRVData{Pri: 0x0102, Wt: 0x0304, Port: 0x0506, Target: "t"}},
+			[]byte{1, 2, 3, 4, 5, 6, 1, 't', 0}},
+	} {
+		got, err := dns.BuildRdata(nil, tc.rdata, tc.typ, make(map[string]int))
+		if err != nil || !bytes.Equal(got, tc.want) {
+			t.Errorf("%s: %v (%v), want %v", tc.name, got, err, tc.want)
+		}
+	}
+}
+
+func TestBuildRdataCompression(t *testing.T) {
+	names := map[string]int{"example.com": 12}
+	pkt := make([]byte, 12)
+	pkt = dns.BuildName(pkt, "example.com")
+
+	// MX is an RFC 1035 type, its host may point back
+	mx, err := dns.BuildRdata(nil, dns.RData{MX: dns.MXData{Pref: 10, Host: "mail.example.com"}}, 15, names)
+	if err != nil || !bytes.Equal(mx, []byte{0, 10, 4, 'm', 'a', 'i', 'l', 0xc0, 12}) {
+		t.Fatalf("MX: %v (%v)", mx, err)
+	}
+	// SRV targets never are (RFC 2782)
+	srv, err := dns.BuildRdata(nil, dns.RData{SRV: dns.SRVData{Target: "sip.example.com"}}, 33, names)
+	if err != nil || bytes.Contains(srv, []byte{0xc0}) || !bytes.HasSuffix(srv, []byte("\x07example\x03com\x00")) {
+		t.Fatalf("SRV: %v (%v)", srv, err)
+	}
+}
+
+func TestBuildRdataRejects(t *testing.T) {
+	long := strings.Repeat("a", 64)
+	for name, tc := range map[string]struct {
+		typ   uint16
+		rdata dns.RData
+	}{
+		"long label":   {5, dns.RData{Name: long + ".example.com"}},
+		"empty label":  {2, dns.RData{Name: "ns1..example.com"}},
+		"long name":    {12, dns.RData{Name: strings.Repeat("abcdefg.", 40) + "com"}},
+		"long MX host": {15, dns.RData{MX: dns.MXData{Host: long}}},
+		"long SOA":     {6, dns.RData{SOA: dns.SOAData{MName: "ns", RName: long}}},
+		"TXT over 255": {16, dns.RData{TXT: [][]byte{bytes.Repeat([]byte("x"), 256)}}},
+		"NSEC3 hash":   {50, dns.RData{NSEC3: dns.NSEC3Data{HashAlg: 1}}},
+		"RRSIG signer": {46, dns.RData{RRSIG: dns.RRSIGData{SignerName: long + ".example"}}},
+	} {
+		if got, err := dns.BuildRdata(nil, tc.rdata, tc.typ, make(map[string]int)); err == nil {
+			t.Errorf("%s: encoded as %v", name, got)
+		}
+	}
+
+	// the record is rolled back, nothing half written stays in the packet
+	rr := dns.DNSAnswer{Name: "x.example", Type: 5, Class: 1, TTL: 1, RData: dns.RData{Name: long}}
+	pkt, err := dns.BuildAnswer(make([]byte, 12), nil, rr, make(map[string]int))
+	if err == nil || len(pkt) != 12 {
+		t.Fatalf("BuildAnswer: %d bytes (%v)", len(pkt), err)
+	}
+}
+
+func TestBuildAnswerRDLength(t *testing.T) {
+	// synthesized records carry no RDLength, the encoder fills it in
+	rr := dns.DNSAnswer{Name: "_sip._udp.example.com", Type: 33, Class: 1, TTL: 60,
+		RData: dns.RData{SRV: dns.SRVData{Pri: 1, Wt: 2, Port: 5060, Target: "sip.example.com"}}}
+	pkt, err := dns.BuildAnswer(make([]byte, 12), nil, rr, make(map[string]int))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nameEnd := 12 + len("_sip._udp.example.com") + 2
+	rdlen := binary.BigEndian.Uint16(pkt[nameEnd+8:])
+	if int(rdlen) != len(pkt)-nameEnd-10 || rdlen != 6+17 {
+		t.Fatalf("RDLENGTH %d, %d bytes follow", rdlen, len(pkt)-nameEnd-10)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"nyasaki/dns-server/config"
+	dns "nyasaki/dns-server/dns"
+)
+
+func TestIsPrivateAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.11", true},
+		{"127.0.0.1", true},
+		{"169.254.10.10", true},
+		{"0.0.0.0", true},
+		{"::1", true},
+		{"fe80::1", true},
+		{"fd00::53", true},
+		{"::ffff:192.168.0.1", true},
+		{"9.9.9.9", false},
+		{"2620:fe::fe", false},
+	}
+
+	for _, tt := range tests {
+		if got := dns.IsPrivateAddr(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("IsPrivateAddr(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func rebindPacket() dns.DNSAnswerPacket {
+	return dns.DNSAnswerPacket{
+		Header: dns.DNSHeader{ID: 1, QR: true, QDCount: 1, ANCount: 3},
+		Answers: []dns.DNSAnswer{
+			{Name: "evil.example", Type: 1, Class: 1, TTL: 60, RDLength: 4, RData: dns.RData{A: [4]byte{192, 168, 1, 1}}},
+			{Name: "evil.example", Type: 1, Class: 1, TTL: 60, RDLength: 4, RData: dns.RData{A: [4]byte{93, 184, 216, 34}}},
+			{Name: "evil.example", Type: 16, Class: 1, TTL: 60, RDLength: 3, RData: dns.RData{TXT: [][]byte{[]byte("hi")}}},
+		},
+	}
+}
+
+func TestRebindGuardStrip(t *testing.T) {
+	g := dns.NewRebindGuard(config.RebindConfig{Enabled: true, Mode: "strip", AllowDomains: []string{"corp.lan"}})
+
+	a := rebindPacket()
+	if n := g.Filter(&a); n != 1 {
+		t.Fatalf("stripped %d, want 1", n)
+	}
+	if len(a.Answers) != 2 || a.Answers[0].RData.A != [4]byte{93, 184, 216, 34} {
+		t.Fatalf("unexpected answers left: %+v", a.Answers)
+	}
+	if a.Header.RCode != 0 {
+		t.Fatalf("strip mode changed rcode to %d", a.Header.RCode)
+	}
+
+	// glue for a private address is just as much of a rebinding vector
+	a = dns.DNSAnswerPacket{
+		Header:  dns.DNSHeader{ID: 1, QR: true, QDCount: 1},
+		Answers: []dns.DNSAnswer{{Name: "evil.example", Type: dns.TypeNS, Class: 1, TTL: 60, RData: dns.RData{Name: "ns.evil.example"}}},
+		Additional: []dns.DNSAnswer{
+			{Name: "ns.evil.example", Type: dns.TypeA, Class: 1, TTL: 60, RData: dns.RData{A: [4]byte{10, 0, 0, 1}}},
+			{Name: "ns.evil.example", Type: dns.TypeA, Class: 1, TTL: 60, RData: dns.RData{A: [4]byte{93, 184, 216, 34}}},
+		},
+	}
+	if n := g.Filter(&a); n != 1 || len(a.Answers) != 1 || len(a.Additional) != 1 || a.Additional[0].RData.A != [4]byte{93, 184, 216, 34} {
+		t.Fatalf("stripped %d, additional left: %+v", n, a.Additional)
+	}
+
+	if !g.Allowed("nas.corp.lan") || g.Allowed("corp.lan.evil.example") {
+		t.Fatalf("allow list matched wrong names")
+	}
+}
+
+func TestRebindGuardRefuse(t *testing.T) {
+	g := dns.NewRebindGuard(config.RebindConfig{Enabled: true, Mode: "refuse"})
+
+	a := rebindPacket()
+	g.Filter(&a)
+	if a.Header.RCode != dns.RCodeRefused || len(a.Answers) != 0 {
+		t.Fatalf("expected empty REFUSED answer, got rcode %d with %d answers", a.Header.RCode, len(a.Answers))
+	}
+
+	if dns.NewRebindGuard(config.RebindConfig{}) != nil {
+		t.Fatalf("disabled config should not build a guard")
+	}
+}
+
+func TestRebindFailsClosed(t *testing.T) {
+	srv, _ := newLocalServer(t, t.TempDir(), func(cfg *config.Config) {
+		cfg.Rebind = config.RebindConfig{Enabled: true, Mode: "strip", AllowDomains: []string{"corp.lan"}}
+	})
+	ask := func(name string) (dns.DNSQuestionPacket, *dns.Forward) {
+		msg := dns.BuildQuery(dns.DNSQuestion{Name: name, Type: dns.TypeA, Class: dns.ClassIN})
+		q, _ := dns.ParseQuestionPacket(msg, len(msg))
+		_, fwd := srv.HandleQuery(q, msg, netip.MustParseAddr("192.0.2.7"))
+		if fwd == nil {
+			t.Fatalf("%s was not forwarded", name)
+		}
+		return q, fwd
+	}
+	finish := func(raw []byte, fwd *dns.Forward) (dns.DNSAnswerPacket, error) {
+		out := srv.FinishUpstream(raw, fwd)
+		return dns.ParseAnswerPacket(out, len(out))
+	}
+	reply := func(q dns.DNSQuestionPacket) []byte {
+		raw, err := dns.BuildResponse(q, dns.RCodeSuccess, []dns.DNSAnswer{
+			{Name: q.Question.Name, Type: dns.TypeA, Class: dns.ClassIN, TTL: 60, RData: dns.RData{A: [4]byte{192, 168, 1, 1}}},
+			{Name: q.Question.Name, Type: dns.TypeCAA, Class: dns.ClassIN, TTL: 60, RData: dns.RData{Opaque: []byte("\x00\x05issueca.test")}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+
+	// a CAA next to the private address doesn't get it past the filter
+	q, fwd := ask("evil.example")
+	out, err := finish(reply(q), fwd)
+	if err != nil || len(out.Answers) != 1 || out.Answers[0].Type != dns.TypeCAA {
+		t.Fatalf("answers %+v (%v)", out.Answers, err)
+	}
+
+	// nor does a reply we can't read, it becomes SERVFAIL
+	raw := reply(q)
+	out, err = finish(raw[:len(raw)-3], fwd)
+	if err != nil || out.Header.RCode != dns.RCodeServFail || out.Header.ID != q.Header.ID || len(out.Answers) != 0 {
+		t.Fatalf("truncated reply: %+v (%v)", out, err)
+	}
+
+	// allowed names aren't looked at
+	q, fwd = ask("nas.corp.lan")
+	raw = reply(q)
+	if got := srv.FinishUpstream(raw[:len(raw)-3], fwd); len(got) != len(raw)-3 {
+		t.Fatalf("allowed name rewritten to %d bytes", len(got))
+	}
+}
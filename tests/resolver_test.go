@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"nyasaki/dns-server/config"
+	dns "nyasaki/dns-server/dns"
+	"nyasaki/dns-server/metrics"
+)
+
+// a small hierarchy: root on 127.0.0.1, lan on .2, corp.lan and lame.lan on .3,
+// dev.corp.lan (delegated without glue) on .4
+var fakeHierarchy = map[string]map[string]string{
+	"127.0.0.1": {".": `
+@                    SOA a.root-servers.test. admin.root. 1 3600 600 86400 60
+@                    NS  a.root-servers.test.
+a.root-servers.test. A   127.0.0.1
+lan.                 NS  ns.lan.
+ns.lan.              A   127.0.0.2
+`},
+	"127.0.0.2": {"lan": `
+@        SOA ns admin 1 3600 600 86400 60
+@        NS  ns
+ns       A   127.0.0.2
+corp     NS  ns1.corp
+ns1.corp A   127.0.0.3
+lame     NS  ns.lame
+lame     NS  ns2.lame
+ns.lame  A   127.0.0.1
+ns2.lame A   127.0.0.3
+`},
+	"127.0.0.3": {
+		"corp.lan": `
+@       SOA ns1 admin 1 3600 600 86400 60
+@       NS  ns1
+ns1     A   127.0.0.3
+www     CNAME web
+web     A   10.0.0.80
+ext     CNAME www.lame.lan.
+dev     NS  dns.lame.lan.
+big     TXT "01 the quick brown fox jumps over the lazy dog"
+big     TXT "02 the quick brown fox jumps over the lazy dog"
+big     TXT "03 the quick brown fox jumps over the lazy dog"
+big     TXT "04 the quick brown fox jumps over the lazy dog"
+big     TXT "05 the quick brown fox jumps over the lazy dog"
+big     TXT "06 the quick brown fox jumps over the lazy dog"
+big     TXT "07 the quick brown fox jumps over the lazy dog"
+big     TXT "08 the quick brown fox jumps over the lazy dog"
+big     TXT "09 the quick brown fox jumps over the lazy dog"
+big     TXT "10 the quick brown fox jumps over the lazy dog"
+big     TXT "11 the quick brown fox jumps over the lazy dog"
+big     TXT "12 the quick brown fox jumps over the lazy dog"
+`,
+		"lame.lan": `
+@       SOA ns2 admin 1 3600 600 86400 60
+@       NS  ns.lame.lan.
+@       NS  ns2
+ns2     A   127.0.0.3
+www     A   10.0.0.99
+dns     A   127.0.0.4
+`},
+	"127.0.0.4": {"dev.corp.lan": `
+@       SOA dns.lame.lan. admin 1 3600 600 86400 60
+@       NS  dns.lame.lan.
+box     A   10.2.0.1
+`},
+}
+
+// hierarchyQueries counts the queries the fake servers answered
+var hierarchyQueries atomic.Int64
+
+// startHierarchy serves every fake zone over UDP on one shared port
+func startHierarchy(t *testing.T) int {
+	t.Helper()
+	first, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := first.LocalAddr().(*net.UDPAddr).Port
+
+	for ip, zones := range fakeHierarchy {
+		dir := t.TempDir()
+		cfg := config.Default()
+		for origin, body := range zones {
+			path := filepath.Join(dir, origin+"zone")
+			if err := os.WriteFile(path, []byte("$TTL 300\n"+body), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			cfg.Zones = append(cfg.Zones, config.ZoneConfig{Origin: origin, File: path})
+		}
+		srv, err := dns.NewServer(cfg, &metrics.Stats{})
+		if err != nil {
+			t.Fatalf("%s: NewServer: %v", ip, err)
+		}
+
+		conn := first
+		if ip != "127.0.0.1" {
+			if conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(ip), Port: port}); err != nil {
+				t.Skipf("cannot bind %s: %v", ip, err)
+			}
+		}
+		t.Cleanup(func() { conn.Close() })
+		go serveAuthUDP(srv, conn)
+	}
+	return port
+}
+
+func serveAuthUDP(srv *dns.Server, conn *net.UDPConn) {
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		pkt := append([]byte(nil), buf[:n]...)
+		q, err := dns.ParseQuestionPacket(pkt, n)
+		if err != nil {
+			continue
+		}
+		hierarchyQueries.Add(1)
+		if resp, _ := srv.HandleQuery(q, pkt, addr.AddrPort().Addr()); resp != nil {
+			_, _ = conn.WriteToUDP(resp, addr)
+		}
+	}
+}
+
+func newTestResolver(t *testing.T, port, maxQueries int) *dns.Resolver {
+	t.Helper()
+	r, err := dns.NewResolver(config.ResolverConfig{RootHints: []string{"127.0.0.1"}, Port: port, MaxQueries: maxQueries, Timeout: "500ms"})
+	if err != nil {
+		t.Fatalf("NewResolver: %v", err)
+	}
+	return r
+}
+
+func TestIterativeResolve(t *testing.T) {
+	port := startHierarchy(t)
+	r := newTestResolver(t, port, 50)
+
+	cases := []struct {
+		name  string
+		rcode uint8
+		last  [4]byte
+		count int
+	}{
+		{"web.corp.lan", dns.RCodeSuccess, [4]byte{10, 0, 0, 80}, 1},
+		{"www.corp.lan", dns.RCodeSuccess, [4]byte{10, 0, 0, 80}, 2},
+		// chain into another zone behind a lame first nameserver
+		{"ext.corp.lan", dns.RCodeSuccess, [4]byte{10, 0, 0, 99}, 2},
+		// delegation without glue, the nameserver name is resolved first
+		{"box.dev.corp.lan", dns.RCodeSuccess, [4]byte{10, 2, 0, 1}, 1},
+		{"missing.corp.lan", dns.RCodeNXDomain, [4]byte{}, 0},
+	}
+	for _, c := range cases {
+		res, err := r.Resolve(dns.DNSQuestion{Name: c.name, Type: dns.TypeA, Class: dns.ClassIN})
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if res.RCode != c.rcode || len(res.Answers) != c.count {
+			t.Fatalf("%s: rcode %d with %d answers, want %d with %d", c.name, res.RCode, len(res.Answers), c.rcode, c.count)
+		}
+		if c.count > 0 && res.Answers[c.count-1].RData.A != c.last {
+			t.Fatalf("%s: got %v", c.name, res.Answers[c.count-1].RData.A)
+		}
+		if c.rcode == dns.RCodeNXDomain && (len(res.Authority) != 1 || res.Authority[0].Type != dns.TypeSOA) {
+			t.Fatalf("%s: negative answer without SOA", c.name)
+		}
+	}
+}
+
+func TestIterativeQueryLimit(t *testing.T) {
+	port := startHierarchy(t)
+
+	// root, lan and corp.lan take three queries
+	if _, err := newTestResolver(t, port, 2).Resolve(dns.DNSQuestion{Name: "web.corp.lan", Type: dns.TypeA, Class: dns.ClassIN}); err == nil {
+		t.Fatalf("resolution finished within a budget that is too small")
+	}
+	if _, err := newTestResolver(t, port, 3).Resolve(dns.DNSQuestion{Name: "web.corp.lan", Type: dns.TypeA, Class: dns.ClassIN}); err != nil {
+		t.Fatalf("three queries should do: %v", err)
+	}
+}
+
+func TestIterativeDelegationCache(t *testing.T) {
+	port := startHierarchy(t)
+	r := newTestResolver(t, port, 50)
+
+	before := hierarchyQueries.Load()
+	if _, err := r.Resolve(dns.DNSQuestion{Name: "web.corp.lan", Type: dns.TypeA, Class: dns.ClassIN}); err != nil {
+		t.Fatal(err)
+	}
+	if n := hierarchyQueries.Load() - before; n != 3 {
+		t.Fatalf("cold lookup took %d queries, want 3", n)
+	}
+
+	// the corp.lan servers are cached, one query is enough now
+	before = hierarchyQueries.Load()
+	if _, err := r.Resolve(dns.DNSQuestion{Name: "www.corp.lan", Type: dns.TypeA, Class: dns.ClassIN}); err != nil {
+		t.Fatal(err)
+	}
+	if n := hierarchyQueries.Load() - before; n != 1 {
+		t.Fatalf("warm lookup took %d queries, want 1", n)
+	}
+}
+
+func TestServerRecursiveMode(t *testing.T) {
+	port := startHierarchy(t)
+
+	cfg := config.Default()
+	cfg.Resolver = config.ResolverConfig{Recursive: true, RootHints: []string{"127.0.0.1"}, Port: port, MaxQueries: 50, Timeout: "500ms"}
+	srv, err := dns.NewServer(cfg, &metrics.Stats{})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	q := dns.DNSQuestionPacket{Header: dns.DNSHeader{ID: 321, RD: true}, Question: dns.DNSQuestion{Name: "www.corp.lan", Type: dns.TypeA, Class: dns.ClassIN}}
+	resp := srv.Resolve(q, dns.BuildQuery(q.Question), netip.MustParseAddr("10.0.0.9"))
+	pkt, err := dns.ParseAnswerPacket(resp, len(resp))
+	if err != nil {
+		t.Fatalf("ParseAnswerPacket: %v", err)
+	}
+	if pkt.Header.ID != 321 || !pkt.Header.RA || len(pkt.Answers) != 2 || pkt.Answers[1].RData.A != [4]byte{10, 0, 0, 80} {
+		t.Fatalf("recursive answer wrong: %+v", pkt)
+	}
+}
+
+func TestServerRecursiveOverUDP(t *testing.T) {
+	port := startHierarchy(t)
+	addr := freePort(t)
+	srv, _ := newLocalServer(t, t.TempDir(), func(cfg *config.Config) {
+		cfg.Listen = []string{addr}
+		cfg.Workers = 1
+		cfg.Resolver = config.ResolverConfig{Recursive: true, RootHints: []string{"127.0.0.1"}, Port: port, MaxQueries: 50, Timeout: "500ms"}
+	})
+	go srv.Run()
+
+	c, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	waitForListener(t, c)
+
+	// twelve TXT records don't fit in 512 bytes, the client is told to use TCP
+	got, err := sendBurst(c, [][]byte{dns.BuildQuery(dns.DNSQuestion{Name: "big.corp.lan", Type: dns.TypeTXT, Class: dns.ClassIN})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pkt := range got {
+		if !pkt.Header.TC || len(pkt.Answers) != 0 || len(pkt.Questions) != 1 || pkt.Questions[0].Name != "big.corp.lan" {
+			t.Fatalf("oversized answer not truncated: %+v, %d answers", pkt.Header, len(pkt.Answers))
+		}
+	}
+
+	// a client with a larger buffer gets all of it
+	q := dns.WithDO(dns.BuildQuery(dns.DNSQuestion{Name: "big.corp.lan", Type: dns.TypeTXT, Class: dns.ClassIN}))
+	if got, err = sendBurst(c, [][]byte{q}); err != nil {
+		t.Fatal(err)
+	}
+	for _, pkt := range got {
+		if pkt.Header.TC || len(pkt.Answers) != 12 {
+			t.Fatalf("EDNS client got %d answers, TC %v", len(pkt.Answers), pkt.Header.TC)
+		}
+	}
+}
+
+func TestServerRecursiveInflightLimit(t *testing.T) {
+	// a root server that never answers keeps the first query busy
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	addr := freePort(t)
+	srv, stats := newLocalServer(t, t.TempDir(), func(cfg *config.Config) {
+		cfg.Listen = []string{addr}
+		cfg.Workers = 1
+		cfg.Inflight = 1
+		cfg.Resolver = config.ResolverConfig{Recursive: true, RootHints: []string{"127.0.0.1"}, Port: silent.LocalAddr().(*net.UDPAddr).Port, MaxQueries: 50, Timeout: "500ms"}
+	})
+	go srv.Run()
+
+	c, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	waitForListener(t, c)
+
+	var queries [][]byte
+	for i, name := range []string{"one.test", "two.test"} {
+		q := dns.BuildQuery(dns.DNSQuestion{Name: name, Type: dns.TypeA, Class: dns.ClassIN})
+		binary.BigEndian.PutUint16(q[:2], uint16(i+1))
+		queries = append(queries, q)
+	}
+	got, err := sendBurst(c, queries)
+	if err != nil {
+		t.Fatalf("%d of 2 answers: %v", len(got), err)
+	}
+	// the second query finds the only slot taken and fails at once
+	if got[2].Header.RCode != dns.RCodeServFail || stats.Overloaded.Load() != 1 {
+		t.Fatalf("second query: rcode %d, %d overloaded", got[2].Header.RCode, stats.Overloaded.Load())
+	}
+}
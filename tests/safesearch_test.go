@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+
+	dns "nyasaki/dns-server/dns"
+)
+
+func TestSafeSearchTarget(t *testing.T) {
+	tests := map[string]string{
+		"www.google.com":             "forcesafesearch.google.com",
+		"google.co.uk.":              "forcesafesearch.google.com",
+		"WWW.Google.DE":              "forcesafesearch.google.com",
+		"www.bing.com":               "strict.bing.com",
+		"duckduckgo.com":             "safe.duckduckgo.com",
+		"m.youtube.com":              "restrict.youtube.com",
+		"mail.google.com":            "",
+		"google.example.com":         "",
+		"forcesafesearch.google.com": "",
+	}
+
+	for name, want := range tests {
+		got, ok := dns.SafeSearchTarget(name)
+		if ok != (want != "") || got != want {
+			t.Errorf("SafeSearchTarget(%q) = %q, %v; want %q", name, got, ok, want)
+		}
+	}
+}
+
+func TestWithAliasBuildsValidPacket(t *testing.T) {
+	upstream := dns.DNSAnswerPacket{
+		Header:    dns.DNSHeader{ID: 0x2222, QR: true, RD: true, RA: true, QDCount: 1, ANCount: 1},
+		Questions: []dns.DNSQuestion{{Name: "forcesafesearch.google.com", Type: 1, Class: 1}},
+		Answers: []dns.DNSAnswer{
+			{Name: "forcesafesearch.google.com", Type: 1, Class: 1, TTL: 3600, RDLength: 4, RData: dns.RData{A: [4]byte{216, 239, 38, 120}}},
+		},
+	}
+
+	alias := dns.SafeSearchCNAME(dns.DNSQuestion{Name: "www.google.com", Type: 1, Class: 1}, "forcesafesearch.google.com")
+	aliased := dns.WithAlias(upstream, "www.google.com", []dns.DNSAnswer{alias})
+	wire, err := dns.BuildAnswerPacket(aliased)
+	if err != nil {
+		t.Fatalf("BuildAnswerPacket: %v", err)
+	}
+
+	got, err := dns.ParseAnswerPacket(wire, len(wire))
+	if err != nil {
+		t.Fatalf("ParseAnswerPacket: %v", err)
+	}
+	if got.Questions[0].Name != "www.google.com" {
+		t.Fatalf("question not restored: %q", got.Questions[0].Name)
+	}
+	if len(got.Answers) != 2 {
+		t.Fatalf("got %d answers, want CNAME + A", len(got.Answers))
+	}
+	if got.Answers[0].Type != 5 || got.Answers[0].RData.Name != "forcesafesearch.google.com" {
+		t.Fatalf("first answer is not the alias: %+v", got.Answers[0])
+	}
+	if got.Answers[1].Name != "forcesafesearch.google.com" || got.Answers[1].RData.A != [4]byte{216, 239, 38, 120} {
+		t.Fatalf("address record mangled: %+v", got.Answers[1])
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"nyasaki/dns-server/config"
+	dns "nyasaki/dns-server/dns"
+)
+
+func TestScheduleActive(t *testing.T) {
+	s, err := dns.NewSchedule("school", config.ScheduleConfig{
+		Timezone: "Europe/Vienna",
+		Windows: []config.WindowConfig{
+			{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "08:00", End: "15:30"},
+			{Days: []string{"fri"}, Start: "22:00", End: "06:00"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewSchedule: %v", err)
+	}
+
+	vie, _ := time.LoadLocation("Europe/Vienna")
+	at := func(day, hour, minute int) time.Time {
+		// 2026-10-19 is a Monday
+		return time.Date(2026, 10, 19+day, hour, minute, 0, 0, vie)
+	}
+
+	tests := []struct {
+		name string
+		t    time.Time
+		want bool
+	}{
+		{"monday before school", at(0, 7, 59), false},
+		{"monday in school", at(0, 8, 0), true},
+		{"monday end is exclusive", at(0, 15, 30), false},
+		{"friday night", at(4, 23, 0), true},
+		{"saturday early tail", at(5, 5, 59), true},
+		{"saturday after tail", at(5, 6, 0), false},
+		{"sunday", at(6, 12, 0), false},
+		{"same instant in UTC", at(0, 9, 0).UTC(), true},
+	}
+	for _, tt := range tests {
+		if got := s.Active(tt.t); got != tt.want {
+			t.Errorf("%s: Active = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if next := s.NextTransition(at(0, 12, 0)); !next.Equal(at(0, 15, 30)) {
+		t.Errorf("NextTransition mid-window = %v, want 15:30", next)
+	}
+	if next := s.NextTransition(at(4, 16, 0)); !next.Equal(at(4, 22, 0)) {
+		t.Errorf("NextTransition friday afternoon = %v, want 22:00", next)
+	}
+	if next := s.NextTransition(at(5, 12, 0)); !next.Equal(at(7, 8, 0)) {
+		t.Errorf("NextTransition saturday = %v, want monday 08:00", next)
+	}
+}
+
+func TestGroupDecideWithSchedule(t *testing.T) {
+	cfg := config.Default()
+	cfg.Blocklists = map[string]config.BlocklistConfig{
+		"games":   {Domains: []string{"games.example"}},
+		"malware": {Domains: []string{"bad.example"}},
+	}
+	cfg.Schedules = map[string]config.ScheduleConfig{
+		"homework": {Timezone: "UTC", Windows: []config.WindowConfig{{Start: "16:00", End: "18:00"}}},
+	}
+	cfg.Groups = []config.GroupConfig{{
+		Name:       "kids",
+		CIDRs:      []string{"192.168.10.0/24"},
+		Blocklists: []string{"malware"},
+		Rules:      []config.RuleConfig{{Blocklist: "games", Schedule: "homework"}},
+	}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	p, err := dns.NewPolicy(cfg)
+	if err != nil {
+		t.Fatalf("NewPolicy: %v", err)
+	}
+	kids := p.Groups()[1]
+
+	noon := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	blocked, until := kids.Decide("play.games.example", noon)
+	if blocked || !until.Equal(noon.Add(4*time.Hour)) {
+		t.Fatalf("noon: blocked=%v until=%v, want allowed until 16:00", blocked, until)
+	}
+
+	blocked, until = kids.Decide("play.games.example", noon.Add(5*time.Hour))
+	if !blocked || !until.Equal(noon.Add(6*time.Hour)) {
+		t.Fatalf("17:00: blocked=%v until=%v, want blocked until 18:00", blocked, until)
+	}
+
+	blocked, until = kids.Decide("bad.example", noon)
+	if !blocked || !until.IsZero() {
+		t.Fatalf("unscheduled rule should block with no expiry, got %v %v", blocked, until)
+	}
+
+	if _, until = kids.Decide("example.org", noon); !until.IsZero() {
+		t.Fatalf("unrelated name should not be capped, got %v", until)
+	}
+}
+
+func TestScheduleDays(t *testing.T) {
+	for day, want := range map[string]time.Weekday{"mon": time.Monday, "Wednesday": time.Wednesday, "SAT": time.Saturday, "sunday": time.Sunday} {
+		if got, ok := config.ParseWeekday(day); !ok || got != want {
+			t.Errorf("%q: %v %v, want %v", day, got, ok, want)
+		}
+	}
+
+	// only whole names and exact abbreviations count
+	for _, day := range []string{"monkey", "wedge", "tues", "su", "", "frid"} {
+		if _, ok := config.ParseWeekday(day); ok {
+			t.Errorf("%q taken for a day", day)
+		}
+
+		cfg := config.Default()
+		cfg.Schedules = map[string]config.ScheduleConfig{
+			"bad": {Windows: []config.WindowConfig{{Days: []string{day}, Start: "08:00", End: "09:00"}}},
+		}
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("%q passed Validate", day)
+		}
+		if _, err := dns.NewSchedule("bad", cfg.Schedules["bad"]); err == nil {
+			t.Errorf("%q passed NewSchedule", day)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"nyasaki/dns-server/config"
+	dns "nyasaki/dns-server/dns"
+	"nyasaki/dns-server/metrics"
+)
+
+// startPrimary serves the xfr.lan fixture over TCP on a loopback port
+func startPrimary(t *testing.T) (*dns.Server, string, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "xfr.lan.zone")
+	if err := os.WriteFile(path, []byte(xfrZoneV1), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Default()
+	cfg.Zones = []config.ZoneConfig{{Origin: "xfr.lan", File: path, AllowTransfer: []string{"127.0.0.0/8"}}}
+	srv, err := dns.NewServer(cfg, &metrics.Stats{})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go srv.ServeTCP(ln)
+
+	return srv, ln.Addr().String(), path
+}
+
+// bumpPrimary rewrites the zone file with serial 2 and reloads it
+func bumpPrimary(t *testing.T, srv *dns.Server, path string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(xfrZoneV2), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.ReloadZones(); err != nil {
+		t.Fatalf("ReloadZones: %v", err)
+	}
+}
+
+func hasOwner(z *dns.Zone, name string) bool {
+	for _, rr := range z.Records() {
+		if rr.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTransferInAXFR(t *testing.T) {
+	_, addr, _ := startPrimary(t)
+
+	z, err := dns.TransferIn(addr, "xfr.lan", nil, nil)
+	if err != nil {
+		t.Fatalf("TransferIn: %v", err)
+	}
+	if z.SOA().RData.SOA.Serial != 1 {
+		t.Fatalf("serial = %d, want 1", z.SOA().RData.SOA.Serial)
+	}
+	if !hasOwner(z, "old.xfr.lan") || !hasOwner(z, "keep.xfr.lan") {
+		t.Fatalf("transferred zone is missing records: %v", z.Records())
+	}
+}
+
+func TestTransferInIXFR(t *testing.T) {
+	srv, addr, path := startPrimary(t)
+
+	v1, err := dns.TransferIn(addr, "xfr.lan", nil, nil)
+	if err != nil {
+		t.Fatalf("TransferIn: %v", err)
+	}
+
+	// nothing changed, the lone SOA keeps our copy
+	same, err := dns.TransferIn(addr, "xfr.lan", v1, nil)
+	if err != nil || same != v1 {
+		t.Fatalf("up to date IXFR returned %v, %v", same, err)
+	}
+
+	bumpPrimary(t, srv, path)
+
+	v2, err := dns.TransferIn(addr, "xfr.lan", v1, nil)
+	if err != nil {
+		t.Fatalf("IXFR: %v", err)
+	}
+	if v2.SOA().RData.SOA.Serial != 2 {
+		t.Fatalf("serial = %d, want 2", v2.SOA().RData.SOA.Serial)
+	}
+	if hasOwner(v2, "old.xfr.lan") || !hasOwner(v2, "new.xfr.lan") || !hasOwner(v2, "keep.xfr.lan") {
+		t.Fatalf("deltas not applied: %v", v2.Records())
+	}
+}
+
+// startStalePrimary serves xfr.lan at serial 8, its IXFR deltas start at
+// serial 7 whatever the client has, AXFR hands out full.xfr.lan
+func startStalePrimary(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	soa := func(serial uint32) dns.DNSAnswer {
+		return dns.DNSAnswer{Name: "xfr.lan", Type: dns.TypeSOA, Class: dns.ClassIN, TTL: 300, RData: dns.RData{SOA: dns.SOAData{
+			MName: "ns1.xfr.lan", RName: "admin.xfr.lan", Serial: serial, Refresh: 3600, Retry: 600, Expire: 86400, Minimum: 60}}}
+	}
+	a := func(name string) dns.DNSAnswer {
+		return dns.DNSAnswer{Name: name, Type: dns.TypeA, Class: dns.ClassIN, TTL: 300, RData: dns.RData{A: [4]byte{10, 0, 0, 9}}}
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			msg, err := dns.ReadTCPMessage(c)
+			if err == nil {
+				q, _ := dns.ParseQuestionPacket(msg, len(msg))
+				resp := dns.NewResponse(q, dns.RCodeSuccess, []dns.DNSAnswer{
+					soa(8), {Name: "xfr.lan", Type: dns.TypeNS, Class: dns.ClassIN, TTL: 300, RData: dns.RData{Name: "ns1.xfr.lan"}}, a("ns1.xfr.lan"), a("full.xfr.lan"), soa(8),
+				})
+				if q.Question.Type == dns.TypeIXFR {
+					resp.Answers = []dns.DNSAnswer{soa(8), soa(7), soa(8), a("delta.xfr.lan"), soa(8)}
+				}
+				wire, _ := dns.BuildAnswerPacket(resp)
+				_ = dns.WriteTCPMessage(c, wire)
+			}
+			c.Close()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestTransferInIXFRFromOtherSerial(t *testing.T) {
+	_, addr, _ := startPrimary(t)
+	v1, err := dns.TransferIn(addr, "xfr.lan", nil, nil)
+	if err != nil {
+		t.Fatalf("TransferIn: %v", err)
+	}
+
+	// deltas from 7 don't apply to our serial 1, the whole zone is fetched
+	z, err := dns.TransferIn(startStalePrimary(t), "xfr.lan", v1, nil)
+	if err != nil {
+		t.Fatalf("TransferIn: %v", err)
+	}
+	if z.SOA().RData.SOA.Serial != 8 || !hasOwner(z, "full.xfr.lan") || hasOwner(z, "delta.xfr.lan") || hasOwner(z, "old.xfr.lan") {
+		t.Fatalf("serial %d, records %v", z.SOA().RData.SOA.Serial, z.Records())
+	}
+}
+
+func TestSecondaryRefresh(t *testing.T) {
+	srv, addr, path := startPrimary(t)
+
+	zones := dns.NewZones()
+	sec, err := dns.NewSecondary(config.SecondaryConfig{Origin: "xfr.lan.", Primary: addr}, zones, nil)
+	if err != nil {
+		t.Fatalf("NewSecondary: %v", err)
+	}
+
+	if err := sec.Refresh(); err != nil {
+		t.Fatalf("initial refresh: %v", err)
+	}
+	if z := zones.Get("xfr.lan"); z == nil || z.SOA().RData.SOA.Serial != 1 {
+		t.Fatalf("zone not loaded after first refresh")
+	}
+
+	bumpPrimary(t, srv, path)
+	if err := sec.Refresh(); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	if z := zones.Get("xfr.lan"); z.SOA().RData.SOA.Serial != 2 || !hasOwner(z, "new.xfr.lan") {
+		t.Fatalf("zone not updated after refresh")
+	}
+
+	// the primary's address is the default NOTIFY ACL
+	if !sec.NotifyAllowed(netip.MustParseAddr("127.0.0.1"), nil) || sec.NotifyAllowed(netip.MustParseAddr("10.1.1.1"), nil) {
+		t.Fatalf("unexpected default NOTIFY ACL %v", sec.AllowNotify)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	cfg := config.Default()
+	cfg.Secondaries = []config.SecondaryConfig{{Origin: "xfr.lan", Primary: "127.0.0.1:5300"}}
+	srv, err := dns.NewServer(cfg, &metrics.Stats{})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	notify := func(name, from string) dns.DNSAnswerPacket {
+		q := dns.DNSQuestionPacket{
+			Header:   dns.DNSHeader{ID: 7, Opcode: dns.OpcodeNotify},
+			Question: dns.DNSQuestion{Name: name, Type: dns.TypeSOA, Class: dns.ClassIN},
+		}
+		resp, fwd := srv.HandleQuery(q, nil, netip.MustParseAddr(from))
+		if fwd != nil || resp == nil {
+			t.Fatalf("NOTIFY was not answered locally")
+		}
+		pkt, err := dns.ParseAnswerPacket(resp, len(resp))
+		if err != nil {
+			t.Fatalf("ParseAnswerPacket: %v", err)
+		}
+		if pkt.Header.Opcode != dns.OpcodeNotify || !pkt.Header.QR || pkt.Header.ID != 7 {
+			t.Fatalf("bad NOTIFY response header %+v", pkt.Header)
+		}
+		return pkt
+	}
+
+	if pkt := notify("xfr.lan", "127.0.0.1"); pkt.Header.RCode != dns.RCodeSuccess || !pkt.Header.AA {
+		t.Fatalf("NOTIFY from primary: rcode %d aa %v", pkt.Header.RCode, pkt.Header.AA)
+	}
+	if pkt := notify("xfr.lan", "192.0.2.1"); pkt.Header.RCode != dns.RCodeRefused {
+		t.Fatalf("NOTIFY from stranger: rcode %d, want REFUSED", pkt.Header.RCode)
+	}
+	if pkt := notify("other.lan", "127.0.0.1"); pkt.Header.RCode != dns.RCodeNotAuth {
+		t.Fatalf("NOTIFY for unknown zone: rcode %d, want NOTAUTH", pkt.Header.RCode)
+	}
+}
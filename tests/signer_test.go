@@ -0,0 +1,203 @@
+package main
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"nyasaki/dns-server/config"
+	dns "nyasaki/dns-server/dns"
+	"nyasaki/dns-server/metrics"
+)
+
+const signedCorpZone = `$ORIGIN corp.
+$TTL 300
+@        IN SOA ns1 hostmaster 1 3600 600 86400 60
+         IN NS  ns1
+ns1      A     192.0.2.53
+www      A     192.0.2.10
+x.ent    TXT   "below an empty non-terminal"
+*.wild   A     192.0.2.20
+alias    CNAME missing
+sub      NS    ns.sub
+ns.sub   A     192.0.2.54
+safe     NS    ns.safe
+safe     DS    12345 13 2 4C3A5F0BC1E5C6D0A38F1E6E1B3B69D2F3A6E0C2B5E8C6C7C3B5B7A0E3D1C2B4
+ns.safe  A     192.0.2.55
+`
+
+// signedCorp serves corp. from a signing server below a signed test root
+type signedCorp struct {
+	t     *testing.T
+	srv   *dns.Server
+	root  *signedZone
+	key   string
+	trust string
+}
+
+func newSignedCorp(t *testing.T, algorithm, denial string) *signedCorp {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "corp.zone")
+	if err := os.WriteFile(path, []byte(signedCorpZone), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Default()
+	cfg.Zones = []config.ZoneConfig{{
+		Origin: "corp", File: path,
+		Signing: config.SigningConfig{KeyFile: filepath.Join(dir, "corp.key"), Algorithm: algorithm, Denial: denial},
+	}}
+	srv, err := dns.NewServer(cfg, &metrics.Stats{})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	c := &signedCorp{t: t, srv: srv, key: cfg.Zones[0].Signing.KeyFile}
+
+	// the root delegates corp. with the DS the zone publishes as CDS
+	cds := c.ask("corp", dns.TypeCDS, true)
+	if len(cds.Answers) == 0 {
+		t.Fatalf("no CDS at the apex: %+v", cds)
+	}
+	c.root = newSignedZone(t, "", true)
+	c.root.add("corp", dns.TypeNS, dns.RData{Name: "ns1.corp"})
+	c.root.add("corp", dns.TypeDS, cds.Answers[0].RData)
+	c.root.finish(t)
+	c.trust = rootAnchor(c.root)
+	return c
+}
+
+func (c *signedCorp) ask(name string, qtype uint16, do bool) dns.DNSAnswerPacket {
+	c.t.Helper()
+	q := dns.DNSQuestionPacket{Header: dns.DNSHeader{RD: true}, Question: dns.DNSQuestion{Name: name, Type: qtype, Class: dns.ClassIN}}
+	msg := dns.BuildQuery(q.Question)
+	if do {
+		msg = dns.WithDO(msg)
+	}
+	resp := c.srv.Resolve(q, msg, netip.MustParseAddr("192.0.2.200"))
+	pkt, err := dns.ParseAnswerPacket(resp, len(resp))
+	if err != nil {
+		c.t.Fatalf("%s %s: %v", name, dns.TypeName(qtype), err)
+	}
+	return pkt
+}
+
+func (c *signedCorp) fetch(q dns.DNSQuestion) (dns.DNSAnswerPacket, error) {
+	name := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+	if !dns.IsSubdomain(name, "corp") || name == "corp" && q.Type == dns.TypeDS {
+		return c.root.answer(name, q.Type), nil
+	}
+	return c.ask(name, q.Type, true), nil
+}
+
+func findType(rrs []dns.DNSAnswer, t uint16) (dns.DNSAnswer, bool) {
+	for _, rr := range rrs {
+		if rr.Type == t {
+			return rr, true
+		}
+	}
+	return dns.DNSAnswer{}, false
+}
+
+func TestOnlineSigning(t *testing.T) {
+	for _, mode := range []struct{ algorithm, denial string }{
+		{"ecdsap256sha256", "black_lies"},
+		{"ecdsap256sha256", "minimal"},
+		{"ed25519", "black_lies"},
+	} {
+		c := newSignedCorp(t, mode.algorithm, mode.denial)
+		v, err := dns.NewValidator(config.DNSSECConfig{TrustAnchors: []string{c.trust}}, c.fetch)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, q := range []struct {
+			name  string
+			qtype uint16
+		}{
+			{"www.corp", dns.TypeA},
+			{"corp", dns.TypeDNSKEY},
+			{"www.corp", dns.TypeAAAA},      // NODATA
+			{"ent.corp", dns.TypeA},         // empty non-terminal
+			{"nope.corp", dns.TypeA},        // NXDOMAIN
+			{"a.b.nope.corp", dns.TypeA},    // NXDOMAIN below a missing name
+			{"host.wild.corp", dns.TypeA},   // wildcard
+			{"host.wild.corp", dns.TypeTXT}, // wildcard NODATA
+			{"alias.corp", dns.TypeA},       // CNAME to a missing name
+			{"sub.corp", dns.TypeDS},        // insecure delegation
+			{"safe.corp", dns.TypeDS},       // secure delegation
+		} {
+			resp := c.ask(q.name, q.qtype, true)
+			if state, err := v.Validate(resp); state != dns.Secure {
+				t.Errorf("%s/%s %s %s: %v (%v)", mode.algorithm, mode.denial, q.name, dns.TypeName(q.qtype), state, err)
+			}
+		}
+
+		resp := c.ask("nope.corp", dns.TypeA, true)
+		if want := map[string]uint8{"black_lies": dns.RCodeSuccess, "minimal": dns.RCodeNXDomain}[mode.denial]; resp.Header.RCode != want {
+			t.Errorf("%s: NXDOMAIN answered with rcode %d", mode.denial, resp.Header.RCode)
+		}
+	}
+}
+
+func TestOnlineSigningReferrals(t *testing.T) {
+	c := newSignedCorp(t, "", "")
+
+	resp := c.ask("www.sub.corp", dns.TypeA, true)
+	nsec, ok := findType(resp.Authority, dns.TypeNSEC)
+	if !ok || nsec.Name != "sub.corp" || !dns.HasType(nsec.RData.NSEC.Types, dns.TypeNS) || dns.HasType(nsec.RData.NSEC.Types, dns.TypeDS) {
+		t.Fatalf("insecure referral needs an NSEC proving no DS: %+v", resp.Authority)
+	}
+	if sig, ok := findType(resp.Authority, dns.TypeRRSIG); !ok || sig.RData.RRSIG.TypeCovered != dns.TypeNSEC {
+		t.Fatalf("NSEC at the cut is not signed: %+v", resp.Authority)
+	}
+	if _, ok := findType(resp.Additional, dns.TypeRRSIG); ok {
+		t.Fatalf("glue must not be signed: %+v", resp.Additional)
+	}
+
+	resp = c.ask("www.safe.corp", dns.TypeA, true)
+	if _, ok := findType(resp.Authority, dns.TypeDS); !ok {
+		t.Fatalf("secure referral without DS: %+v", resp.Authority)
+	}
+	for _, rr := range resp.Authority {
+		if rr.Type == dns.TypeRRSIG && rr.RData.RRSIG.TypeCovered == dns.TypeNS {
+			t.Fatalf("delegation NS records must not be signed")
+		}
+	}
+}
+
+func TestOnlineSigningOnlyForDO(t *testing.T) {
+	c := newSignedCorp(t, "", "")
+
+	resp := c.ask("www.corp", dns.TypeA, false)
+	if len(resp.Answers) != 1 || len(resp.Additional) != 0 {
+		t.Fatalf("plain query got DNSSEC records: %+v %+v", resp.Answers, resp.Additional)
+	}
+	resp = c.ask("nope.corp", dns.TypeA, false)
+	if resp.Header.RCode != dns.RCodeNXDomain || len(resp.Authority) != 1 {
+		t.Fatalf("plain NXDOMAIN changed: rcode %d, %+v", resp.Header.RCode, resp.Authority)
+	}
+
+	// the DNSKEY is published either way
+	if resp := c.ask("corp", dns.TypeDNSKEY, false); len(resp.Answers) != 1 {
+		t.Fatalf("DNSKEY query: %+v", resp.Answers)
+	}
+}
+
+func TestSigningKeyIsKept(t *testing.T) {
+	c := newSignedCorp(t, "ed25519", "")
+	first := c.ask("corp", dns.TypeDNSKEY, false).Answers[0].RData.DNSKEY
+
+	if _, err := os.Stat(c.key); err != nil {
+		t.Fatalf("key file not written: %v", err)
+	}
+	signer, err := dns.LoadSigner(config.SigningConfig{KeyFile: c.key})
+	if err != nil {
+		t.Fatalf("LoadSigner: %v", err)
+	}
+	if again := signer.DNSKEY(); string(again.PublicKey) != string(first.PublicKey) || again.Algorithm != dns.AlgED25519 {
+		t.Fatalf("reloaded key differs: %+v vs %+v", again, first)
+	}
+}
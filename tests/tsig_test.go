@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"nyasaki/dns-server/config"
+	dns "nyasaki/dns-server/dns"
+	"nyasaki/dns-server/metrics"
+)
+
+var xfrKey = config.TSIGKeyConfig{Name: "xfr-key.", Algorithm: "hmac-sha256", Secret: "c2VjcmV0LXNoYXJlZC1ieS1wcmltYXJ5LWFuZC1zZWNvbmRhcnk="}
+
+func mustKey(t *testing.T, kc config.TSIGKeyConfig) *dns.TSIGKey {
+	t.Helper()
+	k, err := dns.NewTSIGKey(kc)
+	if err != nil {
+		t.Fatalf("NewTSIGKey: %v", err)
+	}
+	return k
+}
+
+func TestTSIGSignVerify(t *testing.T) {
+	key := mustKey(t, xfrKey)
+	keys := dns.Keyring{key.Name: key}
+
+	query := dns.BuildQuery(dns.DNSQuestion{Name: "xfr.lan", Type: dns.TypeSOA, Class: dns.ClassIN})
+	signed, mac := key.Sign(query, nil)
+
+	res, err := keys.Verify(signed, nil)
+	if err != nil || res == nil || res.Error != 0 || res.Key != key {
+		t.Fatalf("Verify = %+v, %v", res, err)
+	}
+
+	// the response is bound to the request MAC
+	resp := res.Reply(query)
+	if err := dns.NewTSIGStream(key, mac).Verify(resp); err != nil {
+		t.Fatalf("response: %v", err)
+	}
+	if err := dns.NewTSIGStream(key, []byte("other request")).Verify(resp); err == nil {
+		t.Fatalf("response verified against the wrong request MAC")
+	}
+
+	tampered := append([]byte(nil), signed...)
+	tampered[2] ^= 0x01 // flip RD
+	if res, _ := keys.Verify(tampered, nil); res == nil || res.Error != dns.TSIGBadSig {
+		t.Fatalf("tampered message: %+v", res)
+	}
+
+	if res, _ := (dns.Keyring{}).Verify(signed, nil); res == nil || res.Error != dns.TSIGBadKey {
+		t.Fatalf("unknown key: %+v", res)
+	}
+
+	if res, err := keys.Verify(query, nil); res != nil || err != nil {
+		t.Fatalf("unsigned message: %+v, %v", res, err)
+	}
+}
+
+func TestTSIGSignedQueryNotForwarded(t *testing.T) {
+	cfg := config.Default()
+	cfg.TSIGKeys = []config.TSIGKeyConfig{xfrKey}
+	srv, err := dns.NewServer(cfg, &metrics.Stats{})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	key := mustKey(t, xfrKey)
+
+	// example.com isn't ours, the signed query is refused with a signed answer
+	signed, mac := key.Sign(dns.BuildQuery(dns.DNSQuestion{Name: "example.com", Type: dns.TypeA, Class: dns.ClassIN}), nil)
+	q, _ := dns.ParseQuestionPacket(signed, len(signed))
+	resp, fwd := srv.HandleQuery(q, signed, netip.MustParseAddr("192.0.2.9"))
+	if fwd != nil {
+		t.Fatalf("signed query forwarded: %+v", fwd)
+	}
+	if pkt, err := dns.ParseAnswerPacket(resp, len(resp)); err != nil || pkt.Header.RCode != dns.RCodeRefused {
+		t.Fatalf("%+v (%v)", pkt.Header, err)
+	}
+	if err := dns.NewTSIGStream(key, mac).Verify(resp); err != nil {
+		t.Fatalf("refusal not signed: %v", err)
+	}
+}
+
+// startSignedPrimary serves a zone big enough for a multi-message AXFR that only
+// the TSIG key may transfer
+func startSignedPrimary(t *testing.T) string {
+	t.Helper()
+	var sb strings.Builder
+	sb.WriteString(xfrZoneV1)
+	for i := 0; i < 1500; i++ {
+		fmt.Fprintf(&sb, "host%d A 10.1.%d.%d\n", i, i/250, i%250)
+	}
+	path := filepath.Join(t.TempDir(), "xfr.lan.zone")
+	if err := os.WriteFile(path, []byte(sb.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Default()
+	cfg.TSIGKeys = []config.TSIGKeyConfig{xfrKey}
+	cfg.Zones = []config.ZoneConfig{{Origin: "xfr.lan", File: path, TransferKeys: []string{"xfr-key"}}}
+	srv, err := dns.NewServer(cfg, &metrics.Stats{})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go srv.ServeTCP(ln)
+	return ln.Addr().String()
+}
+
+func TestTSIGSignedTransfer(t *testing.T) {
+	addr := startSignedPrimary(t)
+
+	z, err := dns.TransferIn(addr, "xfr.lan", nil, mustKey(t, xfrKey))
+	if err != nil {
+		t.Fatalf("signed AXFR: %v", err)
+	}
+	if !hasOwner(z, "host1499.xfr.lan") {
+		t.Fatalf("transfer incomplete")
+	}
+
+	serial, err := dns.QuerySOA(addr, "xfr.lan", mustKey(t, xfrKey))
+	if err != nil || serial != 1 {
+		t.Fatalf("signed SOA query = %d, %v", serial, err)
+	}
+
+	if _, err := dns.TransferIn(addr, "xfr.lan", nil, nil); err == nil {
+		t.Fatalf("unsigned transfer was allowed")
+	}
+
+	wrong := xfrKey
+	wrong.Secret = "d3Jvbmctc2VjcmV0"
+	if _, err := dns.TransferIn(addr, "xfr.lan", nil, mustKey(t, wrong)); err == nil {
+		t.Fatalf("transfer with the wrong secret was allowed")
+	}
+}
+
+func TestTSIGSignedUpdate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dyn.lan.zone")
+	if err := os.WriteFile(path, []byte(dynZone), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Default()
+	cfg.TSIGKeys = []config.TSIGKeyConfig{xfrKey}
+	cfg.Zones = []config.ZoneConfig{{Origin: "dyn.lan", File: path, UpdateKeys: []string{"xfr-key."}}}
+	srv, err := dns.NewServer(cfg, &metrics.Stats{})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	key := mustKey(t, xfrKey)
+
+	msg, _ := dns.BuildAnswerPacket(dns.DNSAnswerPacket{
+		Header:    dns.DNSHeader{ID: 5, Opcode: dns.OpcodeUpdate},
+		Questions: []dns.DNSQuestion{{Name: "dyn.lan", Type: dns.TypeSOA, Class: dns.ClassIN}},
+		Authority: []dns.DNSAnswer{aRecord("dhcp1.dyn.lan", dns.ClassIN, 60, "10.0.0.77")},
+	})
+	signed, mac := key.Sign(msg, nil)
+
+	send := func(m []byte) []byte {
+		q, _ := dns.ParseQuestionPacket(m, len(m))
+		resp, _ := srv.HandleQuery(q, m, netip.MustParseAddr("192.0.2.9"))
+		return resp
+	}
+	rcode := func(resp []byte) uint8 {
+		pkt, err := dns.ParseAnswerPacket(resp, len(resp))
+		if err != nil {
+			t.Fatalf("ParseAnswerPacket: %v", err)
+		}
+		return pkt.Header.RCode
+	}
+
+	if rc := rcode(send(msg)); rc != dns.RCodeRefused {
+		t.Fatalf("unsigned update from outside the ACL: rcode %d", rc)
+	}
+
+	resp := send(signed)
+	if rc := rcode(resp); rc != dns.RCodeSuccess {
+		t.Fatalf("signed update: rcode %d", rc)
+	}
+	if err := dns.NewTSIGStream(key, mac).Verify(resp); err != nil {
+		t.Fatalf("update response not signed: %v", err)
+	}
+
+	// a broken signature is NOTAUTH
+	bad := append([]byte(nil), signed...)
+	bad[len(bad)-10] ^= 0xff
+	if rc := rcode(send(bad)); rc != dns.RCodeNotAuth {
+		t.Fatalf("bad signature: rcode %d, want NOTAUTH", rc)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"nyasaki/dns-server/config"
+	dns "nyasaki/dns-server/dns"
+	"nyasaki/dns-server/metrics"
+)
+
+const dynZone = `$ORIGIN dyn.lan.
+$TTL 300
+@      SOA ns1 admin 10 3600 600 86400 60
+       NS  ns1
+ns1    A   10.0.0.1
+printer A  10.0.0.20
+`
+
+func newUpdateServer(t *testing.T) (*dns.Server, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "dyn.lan.zone")
+	if err := os.WriteFile(path, []byte(dynZone), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Default()
+	cfg.Zones = []config.ZoneConfig{{Origin: "dyn.lan", File: path, AllowUpdate: []string{"10.0.0.0/8"}}}
+	srv, err := dns.NewServer(cfg, &metrics.Stats{})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	return srv, path
+}
+
+func aRecord(name string, class uint16, ttl uint32, ip string) dns.DNSAnswer {
+	return dns.DNSAnswer{Name: name, Type: dns.TypeA, Class: class, TTL: ttl, RData: dns.RData{A: netip.MustParseAddr(ip).As4()}}
+}
+
+// sendUpdate builds an UPDATE for dyn.lan and returns the response rcode
+func sendUpdate(t *testing.T, srv *dns.Server, from string, prereqs, updates []dns.DNSAnswer) uint8 {
+	t.Helper()
+	msg, err := dns.BuildAnswerPacket(dns.DNSAnswerPacket{
+		Header:    dns.DNSHeader{ID: 99, Opcode: dns.OpcodeUpdate},
+		Questions: []dns.DNSQuestion{{Name: "dyn.lan", Type: dns.TypeSOA, Class: dns.ClassIN}},
+		Answers:   prereqs,
+		Authority: updates,
+	})
+	if err != nil {
+		t.Fatalf("BuildAnswerPacket: %v", err)
+	}
+	q, err := dns.ParseQuestionPacket(msg, len(msg))
+	if err != nil {
+		t.Fatalf("ParseQuestionPacket: %v", err)
+	}
+
+	resp, fwd := srv.HandleQuery(q, msg, netip.MustParseAddr(from))
+	if fwd != nil || resp == nil {
+		t.Fatalf("UPDATE was not answered locally")
+	}
+	pkt, err := dns.ParseAnswerPacket(resp, len(resp))
+	if err != nil {
+		t.Fatalf("ParseAnswerPacket: %v", err)
+	}
+	if pkt.Header.Opcode != dns.OpcodeUpdate || pkt.Header.ID != 99 {
+		t.Fatalf("bad UPDATE response header %+v", pkt.Header)
+	}
+	return pkt.Header.RCode
+}
+
+func lookup(t *testing.T, srv *dns.Server, name string, qtype uint16) dns.DNSAnswerPacket {
+	t.Helper()
+	q := dns.DNSQuestionPacket{Header: dns.DNSHeader{ID: 1}, Question: dns.DNSQuestion{Name: name, Type: qtype, Class: dns.ClassIN}}
+	resp, _ := srv.HandleQuery(q, dns.BuildQuery(q.Question), netip.MustParseAddr("10.0.0.5"))
+	pkt, err := dns.ParseAnswerPacket(resp, len(resp))
+	if err != nil {
+		t.Fatalf("ParseAnswerPacket: %v", err)
+	}
+	return pkt
+}
+
+func TestUpdateAddAndPersist(t *testing.T) {
+	srv, path := newUpdateServer(t)
+
+	// add laptop only if the name is not taken yet
+	notInUse := dns.DNSAnswer{Name: "laptop.dyn.lan", Type: dns.TypeANY, Class: dns.ClassNONE}
+	add := aRecord("laptop.dyn.lan", dns.ClassIN, 120, "10.0.0.42")
+	if rc := sendUpdate(t, srv, "10.0.0.5", []dns.DNSAnswer{notInUse}, []dns.DNSAnswer{add}); rc != dns.RCodeSuccess {
+		t.Fatalf("add: rcode %d", rc)
+	}
+
+	ans := lookup(t, srv, "laptop.dyn.lan", dns.TypeA)
+	if len(ans.Answers) != 1 || ans.Answers[0].RData.A != [4]byte{10, 0, 0, 42} || ans.Answers[0].TTL != 120 {
+		t.Fatalf("added record not served: %+v", ans.Answers)
+	}
+	if soa := lookup(t, srv, "dyn.lan", dns.TypeSOA); soa.Answers[0].RData.SOA.Serial != 11 {
+		t.Fatalf("serial = %d, want 11", soa.Answers[0].RData.SOA.Serial)
+	}
+
+	// the saved file loads back to the same zone
+	z, err := dns.LoadZoneFile("dyn.lan", path)
+	if err != nil {
+		t.Fatalf("reloading saved zone: %v", err)
+	}
+	if z.SOA().RData.SOA.Serial != 11 || !hasOwner(z, "laptop.dyn.lan") || !hasOwner(z, "printer.dyn.lan") {
+		t.Fatalf("saved zone is incomplete: %v", z.Records())
+	}
+
+	// the same prerequisite now fails and nothing changes
+	again := aRecord("laptop.dyn.lan", dns.ClassIN, 120, "10.0.0.43")
+	if rc := sendUpdate(t, srv, "10.0.0.5", []dns.DNSAnswer{notInUse}, []dns.DNSAnswer{again}); rc != dns.RCodeYXDomain {
+		t.Fatalf("taken name: rcode %d, want YXDOMAIN", rc)
+	}
+	if ans := lookup(t, srv, "laptop.dyn.lan", dns.TypeA); len(ans.Answers) != 1 {
+		t.Fatalf("failed prerequisite still applied: %+v", ans.Answers)
+	}
+}
+
+func TestUpdateDelete(t *testing.T) {
+	srv, _ := newUpdateServer(t)
+
+	// exact RRset prerequisite, then delete the single record
+	is := aRecord("printer.dyn.lan", dns.ClassIN, 0, "10.0.0.20")
+	del := aRecord("printer.dyn.lan", dns.ClassNONE, 0, "10.0.0.20")
+	if rc := sendUpdate(t, srv, "10.0.0.5", []dns.DNSAnswer{is}, []dns.DNSAnswer{del}); rc != dns.RCodeSuccess {
+		t.Fatalf("delete: rcode %d", rc)
+	}
+	if ans := lookup(t, srv, "printer.dyn.lan", dns.TypeA); ans.Header.RCode != dns.RCodeNXDomain {
+		t.Fatalf("deleted name still resolves: %+v", ans)
+	}
+
+	// deleting the apex NS RRset is ignored
+	delNS := dns.DNSAnswer{Name: "dyn.lan", Type: dns.TypeNS, Class: dns.ClassANY}
+	if rc := sendUpdate(t, srv, "10.0.0.5", nil, []dns.DNSAnswer{delNS}); rc != dns.RCodeSuccess {
+		t.Fatalf("apex NS delete: rcode %d", rc)
+	}
+	if ans := lookup(t, srv, "dyn.lan", dns.TypeNS); len(ans.Answers) != 1 {
+		t.Fatalf("apex NS was removed: %+v", ans.Answers)
+	}
+
+	// an RRset prerequisite on a missing set
+	exists := dns.DNSAnswer{Name: "printer.dyn.lan", Type: dns.TypeA, Class: dns.ClassANY}
+	if rc := sendUpdate(t, srv, "10.0.0.5", []dns.DNSAnswer{exists}, nil); rc != dns.RCodeNXRRSet {
+		t.Fatalf("missing RRset: rcode %d, want NXRRSET", rc)
+	}
+}
+
+func TestUpdateRejected(t *testing.T) {
+	srv, _ := newUpdateServer(t)
+	add := aRecord("evil.dyn.lan", dns.ClassIN, 60, "10.6.6.6")
+
+	if rc := sendUpdate(t, srv, "192.0.2.1", nil, []dns.DNSAnswer{add}); rc != dns.RCodeRefused {
+		t.Fatalf("outside ACL: rcode %d, want REFUSED", rc)
+	}
+
+	outside := aRecord("evil.example.org", dns.ClassIN, 60, "10.6.6.6")
+	if rc := sendUpdate(t, srv, "10.0.0.5", nil, []dns.DNSAnswer{add, outside}); rc != dns.RCodeNotZone {
+		t.Fatalf("out of zone: rcode %d, want NOTZONE", rc)
+	}
+	if ans := lookup(t, srv, "evil.dyn.lan", dns.TypeA); ans.Header.RCode != dns.RCodeNXDomain {
+		t.Fatalf("rejected update was partially applied")
+	}
+}
+
+func TestWriteZoneRoundTrip(t *testing.T) {
+	z := loadCorpZone(t)
+
+	var buf bytes.Buffer
+	if err := dns.WriteZone(&buf, z); err != nil {
+		t.Fatalf("WriteZone: %v", err)
+	}
+	records, err := dns.ParseZone(strings.NewReader(buf.String()), "corp.lan", "")
+	if err != nil {
+		t.Fatalf("parsing written zone: %v\n%s", err, buf.String())
+	}
+	back, err := dns.NewZone("corp.lan", records)
+	if err != nil {
+		t.Fatalf("NewZone: %v", err)
+	}
+
+	lines := func(z *dns.Zone) map[string]bool {
+		out := map[string]bool{}
+		for _, rr := range z.Records() {
+			out[dns.FormatRecord(rr)] = true
+		}
+		return out
+	}
+	want, got := lines(z), lines(back)
+	if len(want) != len(got) {
+		t.Fatalf("record count %d, want %d", len(got), len(want))
+	}
+	for l := range want {
+		if !got[l] {
+			t.Fatalf("lost %q in round trip", l)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"nyasaki/dns-server/config"
+	dns "nyasaki/dns-server/dns"
+	"nyasaki/dns-server/metrics"
+)
+
+// fakeDoT answers qN.test with 192.0.2.N, replies leave in random order;
+// big.test gets 40 addresses and slow.test waits a second
+type fakeDoT struct {
+	addr  string
+	conns atomic.Int32
+
+	mu    sync.Mutex
+	names []string // SNI of every connection
+}
+
+func startFakeDoT(t *testing.T, certPath, keyPath string) *fakeDoT {
+	t.Helper()
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	f := &fakeDoT{addr: ln.Addr().String()}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			f.conns.Add(1)
+			go f.serve(c.(*tls.Conn))
+		}
+	}()
+	return f
+}
+
+func (f *fakeDoT) serve(c *tls.Conn) {
+	defer c.Close()
+	if err := c.Handshake(); err != nil {
+		return
+	}
+	f.mu.Lock()
+	f.names = append(f.names, c.ConnectionState().ServerName)
+	f.mu.Unlock()
+
+	var wmu sync.Mutex
+	for {
+		msg, err := dns.ReadTCPMessage(c)
+		if err != nil {
+			return
+		}
+		go func() {
+			q, err := dns.ParseQuestionPacket(msg, len(msg))
+			if err != nil {
+				return
+			}
+			var n byte
+			fmt.Sscanf(q.Question.Name, "q%d.test", &n)
+			answers := []dns.DNSAnswer{{
+				Name: q.Question.Name, Type: dns.TypeA, Class: dns.ClassIN, TTL: 60, RData: dns.RData{A: [4]byte{192, 0, 2, n}},
+			}}
+			switch q.Question.Name {
+			case "big.test":
+				for i := byte(1); i < 40; i++ {
+					answers = append(answers, dns.DNSAnswer{Name: q.Question.Name, Type: dns.TypeA, Class: dns.ClassIN, TTL: 60, RData: dns.RData{A: [4]byte{192, 0, 2, i}}})
+				}
+			case "slow.test":
+				time.Sleep(time.Second)
+			}
+			resp, _ := dns.BuildResponse(q, dns.RCodeSuccess, answers)
+			time.Sleep(time.Duration(rand.IntN(3)) * time.Millisecond)
+			wmu.Lock()
+			defer wmu.Unlock()
+			_ = dns.WriteTCPMessage(c, resp)
+		}()
+	}
+}
+
+// startBootstrap resolves every name to 127.0.0.1 over UDP and counts the questions
+func startBootstrap(t *testing.T) (string, *atomic.Int32) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	var asked atomic.Int32
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			q, err := dns.ParseQuestionPacket(buf[:n], n)
+			if err != nil {
+				continue
+			}
+			asked.Add(1)
+			var answers []dns.DNSAnswer
+			if q.Question.Type == dns.TypeA {
+				answers = append(answers, dns.DNSAnswer{Name: q.Question.Name, Type: dns.TypeA, Class: dns.ClassIN, TTL: 300, RData: dns.RData{A: [4]byte{127, 0, 0, 1}}})
+			}
+			resp, _ := dns.BuildResponse(q, dns.RCodeSuccess, answers)
+			_, _ = pc.WriteTo(resp, from)
+		}
+	}()
+	return pc.LocalAddr().String(), &asked
+}
+
+func exchangeName(up dns.Upstream, name string, id uint16) (dns.DNSAnswerPacket, error) {
+	msg := dns.BuildQuery(dns.DNSQuestion{Name: name, Type: dns.TypeA, Class: dns.ClassIN})
+	binary.BigEndian.PutUint16(msg[:2], id)
+	reply, err := up.Exchange(msg, 2*time.Second)
+	if err != nil {
+		return dns.DNSAnswerPacket{}, err
+	}
+	return dns.ParseAnswerPacket(reply, len(reply))
+}
+
+func TestNewUpstream(t *testing.T) {
+	for spec, want := range map[string]string{
+		"9.9.9.9:53":                       "9.9.9.9:53",
+		"udp://9.9.9.9":                    "9.9.9.9:53",
+		"udp://[2620:fe::fe]":              "[2620:fe::fe]:53",
+		"tls://dns.quad9.net":              "tls://dns.quad9.net:853",
+		"tls://1.1.1.1:8853":               "tls://1.1.1.1:8853",
+		"quic://dns.adguard-dns.com":       "quic://dns.adguard-dns.com:853",
+		"https://dns.quad9.net/dns-query":  "https://dns.quad9.net/dns-query",
+		"https://127.0.0.1:8443/dns-query": "https://127.0.0.1:8443/dns-query",
+	} {
+		up, err := dns.NewUpstream(spec, dns.UpstreamOptions{})
+		if err != nil {
+			t.Errorf("%s: %v", spec, err)
+			continue
+		}
+		if up.String() != want {
+			t.Errorf("%s: got %s, want %s", spec, up, want)
+		}
+	}
+	for _, spec := range []string{"ftp://dns.example", "https:///dns-query"} {
+		if _, err := dns.NewUpstream(spec, dns.UpstreamOptions{}); err == nil {
+			t.Errorf("%s: accepted", spec)
+		}
+	}
+}
+
+func TestTLSUpstreamPipelines(t *testing.T) {
+	certPath, keyPath, pool := writeTestCert(t, t.TempDir(), 1)
+	f := startFakeDoT(t, certPath, keyPath)
+	boot, asked := startBootstrap(t)
+	_, port, _ := net.SplitHostPort(f.addr)
+
+	up, err := dns.NewUpstream("tls://localhost:"+port, dns.UpstreamOptions{Bootstrap: []string{boot}, RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// every client picks the same ID, the upstream has to tell them apart
+			pkt, err := exchangeName(up, fmt.Sprintf("q%d.test", i), 7)
+			if err != nil {
+				t.Errorf("q%d: %v", i, err)
+				return
+			}
+			if pkt.Header.ID != 7 || len(pkt.Answers) != 1 || pkt.Answers[0].RData.A != [4]byte{192, 0, 2, byte(i)} {
+				t.Errorf("q%d: id %d, %+v", i, pkt.Header.ID, pkt.Answers)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := f.conns.Load(); n != 1 {
+		t.Errorf("%d connections, want all queries on one", n)
+	}
+	if n := asked.Load(); n != 1 {
+		t.Errorf("bootstrap asked %d times, want once", n)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.names) != 1 || f.names[0] != "localhost" {
+		t.Errorf("SNI %v, want localhost", f.names)
+	}
+}
+
+func TestTLSUpstreamChecksServerName(t *testing.T) {
+	certPath, keyPath, pool := writeTestCert(t, t.TempDir(), 1)
+	f := startFakeDoT(t, certPath, keyPath)
+	boot, _ := startBootstrap(t)
+	_, port, _ := net.SplitHostPort(f.addr)
+
+	for spec, opts := range map[string]dns.UpstreamOptions{
+		"tls://elsewhere.test:" + port: {Bootstrap: []string{boot}, RootCAs: pool}, // certificate is for another name
+		"tls://localhost:" + port:      {Bootstrap: []string{boot}},                // not signed by a trusted root
+	} {
+		up, err := dns.NewUpstream(spec, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := exchangeName(up, "q1.test", 1); err == nil {
+			t.Errorf("%s: exchange succeeded", spec)
+		}
+	}
+}
+
+func TestHTTPSUpstream(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath, pool := writeTestCert(t, dir, 1)
+	srv, _ := newLocalServer(t, dir, func(cfg *config.Config) {
+		cfg.DoH.CertFile, cfg.DoH.KeyFile = certPath, keyPath
+	})
+	ln, err := srv.ListenDoH("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go srv.ServeDoH(ln)
+	boot, _ := startBootstrap(t)
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	up, err := dns.NewUpstream("https://localhost:"+port+"/dns-query", dns.UpstreamOptions{Bootstrap: []string{boot}, RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		pkt, err := exchangeName(up, "printer.lan", 0x1234)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pkt.Header.ID != 0x1234 || len(pkt.Answers) != 1 || pkt.Answers[0].RData.A != [4]byte{192, 168, 1, 200} {
+			t.Fatalf("id %#x, %+v", pkt.Header.ID, pkt.Answers)
+		}
+	}
+}
+
+func TestServerForwardsOverTLS(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath, _ := writeTestCert(t, dir, 1)
+	f := startFakeDoT(t, certPath, keyPath)
+	boot, _ := startBootstrap(t)
+	_, port, _ := net.SplitHostPort(f.addr)
+
+	cfg := config.Default()
+	cfg.Upstream = "tls://localhost:" + port
+	cfg.Bootstrap = []string{boot}
+	cfg.UpstreamCA = certPath
+	srv, err := dns.NewServer(cfg, &metrics.Stats{})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	q := dns.DNSQuestionPacket{Header: dns.DNSHeader{ID: 99, RD: true}, Question: dns.DNSQuestion{Name: "q42.test", Type: dns.TypeA, Class: dns.ClassIN}}
+	msg := dns.BuildQuery(q.Question)
+	binary.BigEndian.PutUint16(msg[:2], 99)
+	resp := srv.Resolve(q, msg, netip.MustParseAddr("192.0.2.200"))
+	pkt, err := dns.ParseAnswerPacket(resp, len(resp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkt.Header.ID != 99 || len(pkt.Answers) != 1 || pkt.Answers[0].RData.A != [4]byte{192, 0, 2, 42} {
+		t.Fatalf("id %d, %+v", pkt.Header.ID, pkt.Answers)
+	}
+}
+
+func TestServerForwardsOverTLSToUDPClients(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath, _ := writeTestCert(t, dir, 1)
+	f := startFakeDoT(t, certPath, keyPath)
+	boot, _ := startBootstrap(t)
+	_, port, _ := net.SplitHostPort(f.addr)
+
+	addr := freePort(t)
+	srv, stats := newLocalServer(t, dir, func(cfg *config.Config) {
+		cfg.Listen = []string{addr}
+		cfg.Workers = 1
+		cfg.Inflight = 1
+		cfg.Upstream = "tls://localhost:" + port
+		cfg.Bootstrap = []string{boot}
+		cfg.UpstreamCA = certPath
+	})
+	go srv.Run()
+
+	c, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	waitForListener(t, c)
+
+	// 40 addresses don't fit in 512 bytes, the client is told to use TCP
+	got, err := sendBurst(c, [][]byte{dns.BuildQuery(dns.DNSQuestion{Name: "big.test", Type: dns.TypeA, Class: dns.ClassIN})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pkt := range got {
+		if !pkt.Header.TC || len(pkt.Answers) != 0 || len(pkt.Questions) != 1 {
+			t.Fatalf("oversized answer not truncated: %+v, %d answers", pkt.Header, len(pkt.Answers))
+		}
+	}
+
+	// slow.test holds the only slot, the query behind it fails at once
+	var queries [][]byte
+	for i, name := range []string{"slow.test", "q7.test"} {
+		q := dns.BuildQuery(dns.DNSQuestion{Name: name, Type: dns.TypeA, Class: dns.ClassIN})
+		binary.BigEndian.PutUint16(q[:2], uint16(i+1))
+		queries = append(queries, q)
+	}
+	if got, err = sendBurst(c, queries); err != nil {
+		t.Fatalf("%d of 2 answers: %v", len(got), err)
+	}
+	if got[1].Header.RCode != dns.RCodeSuccess || got[2].Header.RCode != dns.RCodeServFail || stats.Overloaded.Load() != 1 {
+		t.Fatalf("rcodes %d and %d, %d overloaded", got[1].Header.RCode, got[2].Header.RCode, stats.Overloaded.Load())
+	}
+}
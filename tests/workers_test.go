@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	dns "nyasaki/dns-server/dns"
+)
+
+// startWorkers serves a local server on n SO_REUSEPORT sockets of one port
+func startWorkers(b *testing.B, n int) string {
+	b.Helper()
+	srv, _ := newLocalServer(b, b.TempDir(), nil)
+	conns, err := dns.ListenUDPWorkers("127.0.0.1:0", n)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, c := range conns {
+		b.Cleanup(func() { c.Close() })
+		go srv.ServeUDP(c)
+	}
+	return conns[0].LocalAddr().String()
+}
+
+// BenchmarkUDPWorkers reports the queries per second answered from the
+// overrides as the number of worker sockets grows with the cores
+func BenchmarkUDPWorkers(b *testing.B) {
+	query := dns.BuildQuery(dns.DNSQuestion{Name: "printer.lan", Type: dns.TypeA, Class: dns.ClassIN})
+	for _, n := range []int{1, 2, 4, runtime.NumCPU()} {
+		b.Run(fmt.Sprintf("workers=%d", n), func(b *testing.B) {
+			addr := startWorkers(b, n)
+			b.SetParallelism(4)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				// every client on a port of its own, so the kernel spreads them
+				c, err := net.Dial("udp", addr)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				defer c.Close()
+				buf := make([]byte, 512)
+				for pb.Next() {
+					_ = c.SetDeadline(time.Now().Add(time.Second))
+					if _, err := c.Write(query); err != nil {
+						b.Error(err)
+						return
+					}
+					if _, err := c.Read(buf); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "qps")
+		})
+	}
+}
+
+func TestUDPWorkersSharePort(t *testing.T) {
+	conns, err := dns.ListenUDPWorkers("127.0.0.1:0", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS == "linux" && len(conns) != 4 {
+		t.Fatalf("%d sockets, want 4", len(conns))
+	}
+	srv, _ := newLocalServer(t, t.TempDir(), nil)
+	port := conns[0].LocalAddr().(*net.UDPAddr).Port
+	for _, c := range conns {
+		t.Cleanup(func() { c.Close() })
+		if p := c.LocalAddr().(*net.UDPAddr).Port; p != port {
+			t.Fatalf("worker on port %d, want %d", p, port)
+		}
+		go srv.ServeUDP(c)
+	}
+
+	// clients on different ports land on different workers, all get answers
+	for i := 0; i < 20; i++ {
+		if pkt := queryUDP(t, conns[0].LocalAddr().String(), "printer.lan"); len(pkt.Answers) != 1 || pkt.Answers[0].RData.A != [4]byte{192, 168, 1, 200} {
+			t.Fatalf("answer: %+v", pkt.Answers)
+		}
+	}
+}
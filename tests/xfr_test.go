@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"nyasaki/dns-server/config"
+	dns "nyasaki/dns-server/dns"
+	"nyasaki/dns-server/metrics"
+)
+
+const xfrZoneV1 = `$ORIGIN xfr.lan.
+$TTL 300
+@    SOA ns1 admin 1 3600 600 86400 60
+     NS  ns1
+ns1  A   10.0.0.1
+old  A   10.0.0.2
+keep TXT "same"
+`
+
+const xfrZoneV2 = `$ORIGIN xfr.lan.
+$TTL 300
+@    SOA ns1 admin 2 3600 600 86400 60
+     NS  ns1
+ns1  A   10.0.0.1
+new  A   10.0.0.3
+keep TXT "same"
+`
+
+func newXfrServer(t *testing.T) (*dns.Server, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "xfr.lan.zone")
+	if err := os.WriteFile(path, []byte(xfrZoneV1), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Default()
+	cfg.Zones = []config.ZoneConfig{{Origin: "xfr.lan", File: path, AllowTransfer: []string{"10.0.0.0/8"}}}
+	srv, err := dns.NewServer(cfg, &metrics.Stats{})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	return srv, path
+}
+
+func xfrQuery(qtype uint16, serial uint32) (dns.DNSQuestionPacket, []byte) {
+	q := dns.DNSQuestionPacket{Header: dns.DNSHeader{ID: 0x4242}, Question: dns.DNSQuestion{Name: "xfr.lan", Type: qtype, Class: 1}}
+	pkt := dns.DNSAnswerPacket{Header: q.Header, Questions: []dns.DNSQuestion{q.Question}}
+	if qtype == dns.TypeIXFR {
+		pkt.Authority = []dns.DNSAnswer{{Name: "xfr.lan", Type: dns.TypeSOA, Class: 1, RData: dns.RData{SOA: dns.SOAData{MName: "ns1.xfr.lan", RName: "admin.xfr.lan", Serial: serial}}}}
+	}
+	wire, _ := dns.BuildAnswerPacket(pkt)
+	return q, wire
+}
+
+// readTransfer collects every record of a transfer stream
+func readTransfer(t *testing.T, buf *bytes.Buffer) ([]dns.DNSAnswer, int) {
+	t.Helper()
+	var records []dns.DNSAnswer
+	msgs := 0
+	for buf.Len() > 0 {
+		msg, err := dns.ReadTCPMessage(buf)
+		if err != nil {
+			t.Fatalf("ReadTCPMessage: %v", err)
+		}
+		pkt, err := dns.ParseAnswerPacket(msg, len(msg))
+		if err != nil {
+			t.Fatalf("ParseAnswerPacket: %v", err)
+		}
+		if pkt.Header.RCode != 0 {
+			t.Fatalf("transfer failed with rcode %d", pkt.Header.RCode)
+		}
+		records = append(records, pkt.Answers...)
+		msgs++
+	}
+	return records, msgs
+}
+
+func TestAXFR(t *testing.T) {
+	srv, _ := newXfrServer(t)
+	q, msg := xfrQuery(dns.TypeAXFR, 0)
+
+	var buf bytes.Buffer
+	if err := srv.Transfer(&buf, q, msg, netip.MustParseAddr("10.1.2.3")); err != nil {
+		t.Fatalf("Transfer: %v", err)
+	}
+
+	records, _ := readTransfer(t, &buf)
+	if len(records) != 6 || records[0].Type != dns.TypeSOA || records[len(records)-1].Type != dns.TypeSOA {
+		t.Fatalf("AXFR must be SOA ... SOA with the 4 other records, got %d records", len(records))
+	}
+
+	buf.Reset()
+	if err := srv.Transfer(&buf, q, msg, netip.MustParseAddr("192.0.2.1")); err != nil {
+		t.Fatalf("Transfer: %v", err)
+	}
+	resp, _ := dns.ReadTCPMessage(&buf)
+	if hdr, _ := dns.ParseHeader(resp); hdr.RCode != dns.RCodeRefused || hdr.ANCount != 0 {
+		t.Fatalf("client outside ACL got rcode %d with %d records", hdr.RCode, hdr.ANCount)
+	}
+}
+
+func TestIXFRFromJournal(t *testing.T) {
+	srv, path := newXfrServer(t)
+	if err := os.WriteFile(path, []byte(xfrZoneV2), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.ReloadZones(); err != nil {
+		t.Fatalf("ReloadZones: %v", err)
+	}
+
+	q, msg := xfrQuery(dns.TypeIXFR, 1)
+	var buf bytes.Buffer
+	if err := srv.Transfer(&buf, q, msg, netip.MustParseAddr("10.1.2.3")); err != nil {
+		t.Fatalf("Transfer: %v", err)
+	}
+
+	records, _ := readTransfer(t, &buf)
+	var got []string
+	for _, rr := range records {
+		s := dns.TypeName(rr.Type) + " " + rr.Name
+		if rr.Type == dns.TypeSOA {
+			s = "SOA " + string(rune('0'+rr.RData.SOA.Serial))
+		}
+		got = append(got, s)
+	}
+	want := "SOA 2,SOA 1,A old.xfr.lan,SOA 2,A new.xfr.lan,SOA 2"
+	if strings.Join(got, ",") != want {
+		t.Fatalf("IXFR sequence\n got: %s\nwant: %s", strings.Join(got, ","), want)
+	}
+
+	// a current client only gets the SOA
+	q, msg = xfrQuery(dns.TypeIXFR, 2)
+	buf.Reset()
+	_ = srv.Transfer(&buf, q, msg, netip.MustParseAddr("10.1.2.3"))
+	if records, _ = readTransfer(t, &buf); len(records) != 1 {
+		t.Fatalf("up to date IXFR should be a single SOA, got %d records", len(records))
+	}
+
+	// unknown history falls back to the full zone
+	q, msg = xfrQuery(dns.TypeIXFR, 0)
+	buf.Reset()
+	_ = srv.Transfer(&buf, q, msg, netip.MustParseAddr("10.1.2.3"))
+	if records, _ = readTransfer(t, &buf); len(records) != 6 {
+		t.Fatalf("IXFR fallback should be AXFR shaped, got %d records", len(records))
+	}
+}
+
+func TestPackTransferSplits(t *testing.T) {
+	var records []dns.DNSAnswer
+	for i := 0; i < 200; i++ {
+		records = append(records, dns.DNSAnswer{Name: "host" + string(rune('a'+i%26)) + ".big.lan", Type: 16, Class: 1, TTL: 60,
+			RData: dns.RData{TXT: [][]byte{bytes.Repeat([]byte{'x'}, 100)}}})
+	}
+	q := dns.DNSQuestionPacket{Question: dns.DNSQuestion{Name: "big.lan", Type: dns.TypeAXFR, Class: 1}}
+
+	msgs, err := dns.PackTransfer(q, records, 4096)
+	if err != nil {
+		t.Fatalf("PackTransfer: %v", err)
+	}
+	if len(msgs) < 5 {
+		t.Fatalf("expected the transfer to be split, got %d messages", len(msgs))
+	}
+
+	total := 0
+	for i, m := range msgs {
+		if len(m) > 4096 {
+			t.Fatalf("message %d is %d bytes", i, len(m))
+		}
+		pkt, err := dns.ParseAnswerPacket(m, len(m))
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if (i == 0) != (len(pkt.Questions) == 1) {
+			t.Fatalf("message %d has %d questions", i, len(pkt.Questions))
+		}
+		total += len(pkt.Answers)
+	}
+	if total != len(records) {
+		t.Fatalf("got %d records back, want %d", total, len(records))
+	}
+}
+
+func TestServeStreamAnswersZoneQueries(t *testing.T) {
+	srv, _ := newXfrServer(t)
+	client, server := net.Pipe()
+	defer client.Close()
+	go srv.ServeStream(server)
+
+	query := dns.BuildQuery(dns.DNSQuestion{Name: "ns1.xfr.lan", Type: 1, Class: 1})
+	if err := dns.WriteTCPMessage(client, query); err != nil {
+		t.Fatalf("WriteTCPMessage: %v", err)
+	}
+	resp, err := dns.ReadTCPMessage(client)
+	if err != nil {
+		t.Fatalf("ReadTCPMessage: %v", err)
+	}
+
+	pkt, err := dns.ParseAnswerPacket(resp, len(resp))
+	if err != nil || !pkt.Header.AA || len(pkt.Answers) != 1 || pkt.Answers[0].RData.A != [4]byte{10, 0, 0, 1} {
+		t.Fatalf("TCP zone answer wrong: %v %+v", err, pkt)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	dns "nyasaki/dns-server/dns"
+)
+
+const corpZone = `$ORIGIN corp.lan.
+$TTL 1h
+@   IN SOA ns1 hostmaster.corp.lan. (
+        2026101901 ; serial
+        3600       ; refresh
+        600        ; retry
+        1209600    ; expire
+        300 )      ; minimum
+    IN NS  ns1
+    IN NS  ns2.corp.lan.
+    IN MX  10 mail
+ns1          A     10.0.0.53
+ns2   600 IN A     10.0.0.54
+mail         A     10.0.0.25
+             AAAA  fd00::25
+www          CNAME web
+web          A     10.0.0.80
+ext          CNAME docs.example.org.
+*.apps       A     10.0.0.90
+info         TXT   "hello world" "second \"part\""
+_ldap._tcp   SRV   0 100 389 dc1
+lab          NS    ns.lab
+ns.lab       A     10.9.0.53
+raw          TYPE99 \# 3 010203
+$INCLUDE hosts.inc
+`
+
+const corpInclude = `$ORIGIN dev.corp.lan.
+box1 A 10.1.0.1
+`
+
+func loadCorpZone(t *testing.T) *dns.Zone {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "hosts.inc"), []byte(corpInclude), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "corp.lan.zone")
+	if err := os.WriteFile(path, []byte(corpZone), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	z, err := dns.LoadZoneFile("corp.lan", path)
+	if err != nil {
+		t.Fatalf("LoadZoneFile: %v", err)
+	}
+	return z
+}
+
+func TestParseZoneFile(t *testing.T) {
+	z := loadCorpZone(t)
+
+	soa := z.SOA()
+	if soa.RData.SOA.MName != "ns1.corp.lan" || soa.RData.SOA.Serial != 2026101901 || soa.RData.SOA.Minimum != 300 || soa.TTL != 3600 {
+		t.Fatalf("SOA parsed wrong: %+v ttl=%d", soa.RData.SOA, soa.TTL)
+	}
+
+	byName := map[string][]dns.DNSAnswer{}
+	for _, rr := range z.Records() {
+		byName[rr.Name] = append(byName[rr.Name], rr)
+	}
+
+	if rrs := byName["ns2.corp.lan"]; len(rrs) != 1 || rrs[0].TTL != 600 {
+		t.Fatalf("explicit TTL lost: %+v", rrs)
+	}
+	if rrs := byName["mail.corp.lan"]; len(rrs) != 2 {
+		t.Fatalf("blank owner should continue mail: %+v", rrs)
+	}
+	if rrs := byName["box1.dev.corp.lan"]; len(rrs) != 1 || rrs[0].RData.A != [4]byte{10, 1, 0, 1} {
+		t.Fatalf("$INCLUDE with $ORIGIN failed: %+v", rrs)
+	}
+	if rrs := byName["info.corp.lan"]; len(rrs) != 1 || string(rrs[0].RData.TXT[1]) != `second "part"` {
+		t.Fatalf("TXT strings parsed wrong: %+v", rrs)
+	}
+	if rrs := byName["_ldap._tcp.corp.lan"]; len(rrs) != 1 || rrs[0].RData.SRV.Port != 389 || rrs[0].RData.SRV.Target != "dc1.corp.lan" {
+		t.Fatalf("SRV parsed wrong: %+v", rrs)
+	}
+	if rrs := byName["raw.corp.lan"]; len(rrs) != 1 || rrs[0].Type != 99 || string(rrs[0].RData.Opaque) != "\x01\x02\x03" {
+		t.Fatalf("generic rdata parsed wrong: %+v", rrs)
+	}
+}
+
+func TestParseZoneErrors(t *testing.T) {
+	bad := map[string]string{
+		"unbalanced":  "$ORIGIN x.\n@ SOA ns h ( 1 2 3 4 5\n",
+		"no ttl":      "$ORIGIN x.\nwww A 10.0.0.1\n",
+		"bad address": "$TTL 60\n$ORIGIN x.\nwww A 10.0.0.300\n",
+		"bad class":   "$TTL 60\n$ORIGIN x.\nwww CH A 10.0.0.1\n",
+	}
+	for name, data := range bad {
+		if _, err := dns.ParseZone(strings.NewReader(data), "x", ""); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func zoneQuery(z *dns.Zone, name string, qtype uint16) dns.DNSAnswerPacket {
+	q := dns.DNSQuestionPacket{Header: dns.DNSHeader{ID: 7, RD: true}, Question: dns.DNSQuestion{Name: name, Type: qtype, Class: 1}}
+	return z.Answer(q)
+}
+
+func TestZoneAnswer(t *testing.T) {
+	z := loadCorpZone(t)
+
+	resp := zoneQuery(z, "WEB.corp.lan", 1)
+	if !resp.Header.AA || resp.Header.RCode != 0 || len(resp.Answers) != 1 {
+		t.Fatalf("positive answer wrong: %+v", resp)
+	}
+
+	resp = zoneQuery(z, "corp.lan", 15)
+	if len(resp.Answers) != 1 || len(resp.Additional) != 2 {
+		t.Fatalf("MX should come with mail's addresses: %+v", resp)
+	}
+
+	resp = zoneQuery(z, "www.corp.lan", 1)
+	if len(resp.Answers) != 2 || resp.Answers[0].Type != 5 || resp.Answers[1].RData.A != [4]byte{10, 0, 0, 80} {
+		t.Fatalf("CNAME not chased: %+v", resp.Answers)
+	}
+
+	resp = zoneQuery(z, "ext.corp.lan", 1)
+	if len(resp.Answers) != 1 || resp.Answers[0].RData.Name != "docs.example.org" {
+		t.Fatalf("out of zone CNAME: %+v", resp.Answers)
+	}
+
+	resp = zoneQuery(z, "web.corp.lan", 28)
+	if resp.Header.RCode != 0 || len(resp.Answers) != 0 || len(resp.Authority) != 1 || resp.Authority[0].Type != 6 {
+		t.Fatalf("NODATA wrong: %+v", resp)
+	}
+	if resp.Authority[0].TTL != 300 {
+		t.Fatalf("negative SOA TTL %d, want minimum 300", resp.Authority[0].TTL)
+	}
+
+	resp = zoneQuery(z, "nope.corp.lan", 1)
+	if resp.Header.RCode != dns.RCodeNXDomain || len(resp.Authority) != 1 || resp.Authority[0].Type != 6 {
+		t.Fatalf("NXDOMAIN wrong: %+v", resp)
+	}
+
+	// dev.corp.lan only exists as a parent of box1
+	resp = zoneQuery(z, "dev.corp.lan", 1)
+	if resp.Header.RCode != 0 || len(resp.Authority) != 1 {
+		t.Fatalf("empty non-terminal should be NODATA: %+v", resp)
+	}
+}
+
+func TestZoneWildcardAndDelegation(t *testing.T) {
+	z := loadCorpZone(t)
+
+	resp := zoneQuery(z, "grafana.apps.corp.lan", 1)
+	if len(resp.Answers) != 1 || resp.Answers[0].Name != "grafana.apps.corp.lan" || resp.Answers[0].RData.A != [4]byte{10, 0, 0, 90} {
+		t.Fatalf("wildcard not expanded: %+v", resp.Answers)
+	}
+
+	resp = zoneQuery(z, "grafana.apps.corp.lan", 28)
+	if resp.Header.RCode != 0 || len(resp.Answers) != 0 {
+		t.Fatalf("wildcard NODATA wrong: %+v", resp)
+	}
+
+	resp = zoneQuery(z, "host.lab.corp.lan", 1)
+	if resp.Header.AA || len(resp.Answers) != 0 || len(resp.Authority) != 1 || resp.Authority[0].Type != 2 {
+		t.Fatalf("referral wrong: %+v", resp)
+	}
+	if len(resp.Additional) != 1 || resp.Additional[0].RData.A != [4]byte{10, 9, 0, 53} {
+		t.Fatalf("glue missing: %+v", resp.Additional)
+	}
+
+	// the whole referral has to survive the wire, SOA and glue included
+	wire, err := dns.BuildAnswerPacket(zoneQuery(z, "nope.corp.lan", 1))
+	if err != nil {
+		t.Fatalf("BuildAnswerPacket: %v", err)
+	}
+	back, err := dns.ParseAnswerPacket(wire, len(wire))
+	if err != nil || back.Header.NSCount != 1 || back.Authority[0].RData.SOA.Expire != 1209600 {
+		t.Fatalf("NXDOMAIN did not round trip: %v %+v", err, back.Authority)
+	}
+
+	wire, _ = dns.BuildAnswerPacket(resp)
+	back, err = dns.ParseAnswerPacket(wire, len(wire))
+	if err != nil || back.Header.NSCount != 1 || back.Header.ARCount != 1 {
+		t.Fatalf("referral did not round trip: %v %+v", err, back.Header)
+	}
+}
+
+func TestZonesFind(t *testing.T) {
+	zs := dns.NewZones()
+	zs.Put(loadCorpZone(t))
+
+	if z := zs.Find("a.b.corp.lan."); z == nil || z.Origin != "corp.lan" {
+		t.Fatalf("Find did not return corp.lan")
+	}
+	if zs.Find("corp.lan.example") != nil || zs.Find("lan") != nil {
+		t.Fatalf("Find matched outside the zone")
+	}
+}